@@ -2,7 +2,9 @@ package usermgr
 
 import (
 	"crypto/subtle"
+	"encoding/base32"
 	"io"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/scrypt"
@@ -24,6 +26,16 @@ type BackupCode struct {
 	Hash       []byte    `json:"hash,omitempty"`
 }
 
+// NewBackupCodeString returns a new random backup code, 16 lower case
+// base32 characters long.
+func NewBackupCodeString() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(randReader, buf); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(buf)), nil
+}
+
 func NewBackupCode(code string) BackupCode {
 	salt := make([]byte, saltBytes)
 	_, err := io.ReadFull(randReader, salt)
@@ -1,6 +1,8 @@
 package usermgr
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/hex"
 
 	. "gopkg.in/check.v1"
@@ -28,3 +30,17 @@ func (s *TestBackupCode) TestCanHashAndCompare(c *C) {
 	bc.Hash, _ = hex.DecodeString("4c06d54904fb520ea1e54c74edf02a6295d707a21fa65f287c3e028ce6e790ce64df39dad12af907bae4d32d260cadc8ba9c2e8cd1a3c2364299ed37b3868b0b")
 	c.Assert(bc.Matches("Wyja8OeSygqwT9v8"), Equals, false)
 }
+
+func (s *TestBackupCode) TestNewBackupCodeString(c *C) {
+	defer func() { randReader = rand.Reader }()
+
+	randReader = bytes.NewReader([]byte("0123456789"))
+	code, err := NewBackupCodeString()
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, "gaytemzugu3doobz")
+
+	// a short read of random data is an error rather than a weak code
+	randReader = bytes.NewReader([]byte("01234"))
+	_, err = NewBackupCodeString()
+	c.Assert(err, NotNil)
+}
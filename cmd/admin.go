@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/context"
+)
+
+var adminKeyFlag = cli.StringFlag{
+	Name:   "admin-key",
+	Value:  "",
+	Usage:  "The admin key",
+	EnvVar: "UM_ADMIN_KEY",
+}
+
+var adminKeyFileFlag = cli.StringFlag{
+	Name:   "admin-key-file",
+	Value:  "",
+	Usage:  "The path to a passphrase protected admin key (see: usermgr keygen --admin-key-file)",
+	EnvVar: "UM_ADMIN_KEY_FILE",
+}
+
+var passphraseFileFlag = cli.StringFlag{
+	Name:   "passphrase-file",
+	Value:  "",
+	Usage:  "The path to a file containing the passphrase for the admin key file. If not specified, you are prompted for it.",
+	EnvVar: "UM_PASSPHRASE_FILE",
+}
+
+var signerFlag = cli.StringSliceFlag{
+	Name:   "signer",
+	Usage:  "The public signing key of an administrator. Specify multiple times for multiple keys.",
+	EnvVar: "UM_SIGNERS",
+}
+
+var thresholdFlag = cli.IntFlag{
+	Name:   "threshold",
+	Usage:  "The number of administrators who must approve. If zero, all of them must.",
+	EnvVar: "UM_THRESHOLD",
+}
+
+var adminCommand = cli.Command{
+	Name:  "admin",
+	Usage: "Edit, approve and publish the account database without the web interface",
+	Subcommands: []cli.Command{
+		{
+			Name:   "show",
+			Usage:  "Print the contents of a signed account database or a proposal",
+			Action: WithError(AdminShowCommand),
+			Flags:  []cli.Flag{adminKeyFlag, adminKeyFileFlag, passphraseFileFlag},
+		},
+		{
+			Name:   "propose",
+			Usage:  "Sign the account database in JSON_FILE as a proposal that other administrators can approve",
+			Action: WithError(AdminProposeCommand),
+			Flags: []cli.Flag{
+				adminKeyFlag,
+				adminKeyFileFlag,
+				passphraseFileFlag,
+				cli.DurationFlag{
+					Name:   "lifetime",
+					Usage:  "How long hosts trust the data. If zero, the data never expire.",
+					EnvVar: "UM_LIFETIME",
+				},
+			},
+		},
+		{
+			Name:   "sign",
+			Usage:  "Approve a proposal",
+			Action: WithError(AdminSignCommand),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "signing-key",
+					Value:  "",
+					Usage:  "Your signing key (see: usermgr keygen signing)",
+					EnvVar: "UM_SIGNING_KEY",
+				},
+			},
+		},
+		{
+			Name:   "publish",
+			Usage:  "Publish a proposal once enough administrators have approved it",
+			Action: WithError(AdminPublishCommand),
+			Flags: []cli.Flag{
+				signerFlag,
+				thresholdFlag,
+				cli.StringFlag{
+					Name:   "store",
+					Value:  "",
+					Usage:  "The URL of the data storage service",
+					EnvVar: "UM_STORE",
+				},
+			},
+		},
+		adminAddUserCommand,
+		adminRemoveUserCommand,
+		adminAddGroupCommand,
+		adminRemoveGroupCommand,
+		adminAddKeyCommand,
+		adminRemoveKeyCommand,
+		adminSetCommand,
+		adminBackupCodeCommand,
+	},
+}
+
+// readPassphrase returns the passphrase from the file named by the
+// passphrase-file flag or, if there is none, prompts for it on the terminal.
+// If confirm is true the user must enter the passphrase twice.
+func readPassphrase(ctx *cli.Context, confirm bool) ([]byte, error) {
+	if path := ctx.String("passphrase-file"); path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(buf, "\r\n"), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot prompt for passphrase: standard input is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		confirmation, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, confirmation) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// keyFileReader reads passphrase protected admin keys, asking for the
+// passphrase at most once, so that the current, next and previous admin
+// keys can share it.
+type keyFileReader struct {
+	ctx        *cli.Context
+	passphrase []byte
+}
+
+// read returns the admin key in the file at path.
+func (r *keyFileReader) read(path string) (usermgr.AdminKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return usermgr.AdminKey{}, err
+	}
+	if r.passphrase == nil {
+		r.passphrase, err = readPassphrase(r.ctx, false)
+		if err != nil {
+			return usermgr.AdminKey{}, err
+		}
+	}
+	adminKey, err := usermgr.DecryptAdminKey(buf, r.passphrase)
+	if err != nil {
+		return usermgr.AdminKey{}, fmt.Errorf("cannot read %s: %s", path, err)
+	}
+	return *adminKey, nil
+}
+
+// adminKey returns the admin key specified on the command line, either
+// directly or as a passphrase protected file.
+func (r *keyFileReader) adminKey() (usermgr.AdminKey, error) {
+	if path := r.ctx.String("admin-key-file"); path != "" {
+		return r.read(path)
+	}
+
+	adminKey := usermgr.AdminKey{}
+	if err := adminKey.UnmarshalText([]byte(r.ctx.String("admin-key"))); err != nil {
+		return adminKey, fmt.Errorf("cannot parse key: %s", err)
+	}
+	return adminKey, nil
+}
+
+// adminKeyFromContext returns the admin key specified on the command line,
+// either directly or as a passphrase protected file.
+func adminKeyFromContext(ctx *cli.Context) (usermgr.AdminKey, error) {
+	return (&keyFileReader{ctx: ctx}).adminKey()
+}
+
+// AdminShowCommand implements the "admin show" subcommand which prints the
+// decrypted contents of an account database so that an administrator can
+// review a proposal before approving it.
+func AdminShowCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: usermgr admin show FILE")
+	}
+	adminKey, err := adminKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	usersData, err := usermgr.LoadUsersDataAsAdmin(buf, adminKey)
+	if err != nil {
+		return err
+	}
+
+	output, err := json.MarshalIndent(usersData, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.App.Writer, "%s\n", output)
+	return nil
+}
+
+// AdminProposeCommand implements the "admin propose" subcommand which signs
+// an account database as the version that follows the one it was derived
+// from. The result is not accepted by hosts that require approvals until
+// enough administrators have signed it with "admin sign".
+func AdminProposeCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: usermgr admin propose JSON_FILE PROPOSAL_FILE")
+	}
+	adminKey, err := adminKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	usersData := usermgr.UsersData{}
+	if err := json.Unmarshal(buf, &usersData); err != nil {
+		return fmt.Errorf("cannot parse %s: %s", ctx.Args()[0], err)
+	}
+
+	stampUsersData(&usersData, ctx.Duration("lifetime"))
+	signedData, err := usersData.SignedString(adminKey)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ctx.Args()[1], signedData, 0644)
+}
+
+// AdminSignCommand implements the "admin sign" subcommand which adds the
+// administrator's approval to a proposal.
+func AdminSignCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: usermgr admin sign PROPOSAL_FILE")
+	}
+	signingKey := usermgr.SigningKey{}
+	if err := signingKey.UnmarshalText([]byte(ctx.String("signing-key"))); err != nil {
+		return fmt.Errorf("cannot parse signing key: %s", err)
+	}
+	buf, err := ioutil.ReadFile(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	buf, err = usermgr.Approve(buf, signingKey)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ctx.Args()[0], buf, 0644); err != nil {
+		return err
+	}
+
+	approvers, err := usermgr.Approvers(buf)
+	if err != nil {
+		return err
+	}
+	for _, approver := range approvers {
+		fmt.Fprintf(ctx.App.Writer, "approved by: %s\n", approver)
+	}
+	return nil
+}
+
+// signaturePolicyFromContext returns the policy described by the signer and
+// threshold flags.
+func signaturePolicyFromContext(ctx *cli.Context) (usermgr.SignaturePolicy, error) {
+	policy := usermgr.SignaturePolicy{Threshold: ctx.Int("threshold")}
+	for _, signerStr := range ctx.StringSlice("signer") {
+		signer := usermgr.SigningPublicKey{}
+		if err := signer.UnmarshalText([]byte(signerStr)); err != nil {
+			return usermgr.SignaturePolicy{}, fmt.Errorf("cannot parse signer: %s", err)
+		}
+		policy.Keys = append(policy.Keys, signer)
+	}
+	return policy, nil
+}
+
+// AdminPublishCommand implements the "admin publish" subcommand which
+// checks that a proposal has been approved by enough administrators and
+// writes it to the storage service.
+func AdminPublishCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: usermgr admin publish PROPOSAL_FILE")
+	}
+	policy, err := signaturePolicyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if len(policy.Keys) == 0 {
+		return fmt.Errorf("at least one signer must be specified")
+	}
+
+	buf, err := ioutil.ReadFile(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+	if err := policy.Verify(buf); err != nil {
+		return err
+	}
+
+	storage, err := openStorage(ctx.String("store"))
+	if err != nil {
+		return err
+	}
+	_, err = storage.Put(context.Background(), buf, "")
+	return err
+}
@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
+	"github.com/crewjam/usermgr/web"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// adminEditFlags returns the flags common to the subcommands that edit the
+// account database, followed by extraFlags.
+func adminEditFlags(extraFlags ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		adminKeyFlag,
+		adminKeyFileFlag,
+		passphraseFileFlag,
+		cli.StringFlag{
+			Name:  "file, f",
+			Value: "",
+			Usage: "The path to the signed account database to edit",
+		},
+		cli.StringFlag{
+			Name:   "store",
+			Value:  "",
+			Usage:  "The URL of the data storage service holding the account database to edit",
+			EnvVar: "UM_STORE",
+		},
+		cli.DurationFlag{
+			Name:   "lifetime",
+			Usage:  "How long hosts trust the data. If zero, the data never expire.",
+			EnvVar: "UM_LIFETIME",
+		},
+	}, extraFlags...)
+}
+
+var adminAddUserCommand = cli.Command{
+	Name:   "add-user",
+	Usage:  "Add a user: add-user NAME",
+	Action: WithError(AdminAddUserCommand),
+	Flags: adminEditFlags(
+		cli.StringFlag{Name: "real-name", Usage: "The user's real name"},
+		cli.StringFlag{Name: "email", Usage: "The user's email address"},
+		cli.StringSliceFlag{Name: "group", Usage: "A group the user is a member of. Specify multiple times for multiple groups."},
+	),
+}
+
+var adminRemoveUserCommand = cli.Command{
+	Name:   "remove-user",
+	Usage:  "Remove a user: remove-user NAME",
+	Action: WithError(AdminRemoveUserCommand),
+	Flags:  adminEditFlags(),
+}
+
+var adminAddGroupCommand = cli.Command{
+	Name:   "add-group",
+	Usage:  "Add a user to a group: add-group USER GROUP",
+	Action: WithError(AdminAddGroupCommand),
+	Flags:  adminEditFlags(),
+}
+
+var adminRemoveGroupCommand = cli.Command{
+	Name:   "remove-group",
+	Usage:  "Remove a user from a group: remove-group USER GROUP",
+	Action: WithError(AdminRemoveGroupCommand),
+	Flags:  adminEditFlags(),
+}
+
+var adminAddKeyCommand = cli.Command{
+	Name:   "add-key",
+	Usage:  "Add an SSH public key for a user: add-key USER KEY",
+	Action: WithError(AdminAddKeyCommand),
+	Flags:  adminEditFlags(),
+}
+
+var adminRemoveKeyCommand = cli.Command{
+	Name:   "remove-key",
+	Usage:  "Remove an SSH public key from a user: remove-key USER KEY",
+	Action: WithError(AdminRemoveKeyCommand),
+	Flags:  adminEditFlags(),
+}
+
+var adminSetCommand = cli.Command{
+	Name:   "set",
+	Usage:  "Set an attribute of a user: set USER real_name|email|subject VALUE",
+	Action: WithError(AdminSetCommand),
+	Flags:  adminEditFlags(),
+}
+
+var adminBackupCodeCommand = cli.Command{
+	Name:   "backup-code",
+	Usage:  "Generate a backup code for a user and print it: backup-code USER",
+	Action: WithError(AdminBackupCodeCommand),
+	Flags:  adminEditFlags(),
+}
+
+// stampUsersData prepares usersData to be signed as the version that
+// follows the one it was loaded from.
+func stampUsersData(usersData *usermgr.UsersData, lifetime time.Duration) {
+	now := time.Now()
+	usersData.Serial++
+	usersData.IssueTime = &now
+	usersData.ExpireTime = nil
+	if lifetime != 0 {
+		expireTime := now.Add(lifetime)
+		usersData.ExpireTime = &expireTime
+	}
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers see
+// either the old or the new content. The file keeps its mode; a new file is
+// only readable by its owner.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"~")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// editUsersData loads the account database from the file or storage service
+// specified on the command line, applies f to it and writes it back signed
+// with the admin key. If the database does not exist, f is applied to an
+// empty one.
+//
+// This works without the web interface, which makes it the way to change
+// the database when the web interface is unavailable.
+func editUsersData(ctx *cli.Context, f func(usersData *usermgr.UsersData) error) error {
+	adminKey, err := adminKeyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var read func() ([]byte, error)
+	var write func(data []byte) error
+	switch {
+	case ctx.String("file") != "" && ctx.String("store") != "":
+		return fmt.Errorf("specify only one of --file or --store")
+	case ctx.String("file") != "":
+		path := ctx.String("file")
+		read = func() ([]byte, error) { return ioutil.ReadFile(path) }
+		write = func(data []byte) error { return writeFileAtomic(path, data) }
+	case ctx.String("store") != "":
+		storage, err := openStorage(ctx.String("store"))
+		if err != nil {
+			return err
+		}
+		if gitStorage, ok := storage.(*web.GitStorage); ok {
+			gitStorage.Render = func(data []byte) ([]byte, error) {
+				usersData, err := usermgr.LoadUsersDataAsAdmin(data, adminKey)
+				if err != nil {
+					return nil, err
+				}
+				return web.RedactedJSON(usersData)
+			}
+		}
+		storeCtx := context.Background()
+		if u, err := user.Current(); err == nil {
+			storeCtx = web.WithRemoteUserName(storeCtx, u.Username)
+		}
+		// the database is written only if nobody changed it since it was read
+		var etag string
+		read = func() ([]byte, error) {
+			data, currentEtag, err := storage.Get(storeCtx, "")
+			etag = currentEtag
+			return data, err
+		}
+		write = func(data []byte) error {
+			_, err := storage.Put(storeCtx, data, etag)
+			return err
+		}
+	default:
+		return fmt.Errorf("specify either --file or --store")
+	}
+
+	usersData := &usermgr.UsersData{}
+	buf, err := read()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		usersData, err = usermgr.LoadUsersDataAsAdmin(buf, adminKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := f(usersData); err != nil {
+		return err
+	}
+
+	stampUsersData(usersData, ctx.Duration("lifetime"))
+	signedData, err := usersData.SignedString(adminKey)
+	if err != nil {
+		return err
+	}
+	return write(signedData)
+}
+
+// editUser is like editUsersData, but applies f to the named user, which
+// must exist.
+func editUser(ctx *cli.Context, name string, f func(user *usermgr.User) error) error {
+	return editUsersData(ctx, func(usersData *usermgr.UsersData) error {
+		user := usersData.GetUserByName(name)
+		if user == nil {
+			return fmt.Errorf("%s: not found", name)
+		}
+		if err := f(user); err != nil {
+			return err
+		}
+		usersData.Set(*user)
+		return nil
+	})
+}
+
+func AdminAddUserCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: usermgr admin add-user NAME")
+	}
+	name := ctx.Args()[0]
+	return editUsersData(ctx, func(usersData *usermgr.UsersData) error {
+		if usersData.GetUserByName(name) != nil {
+			return fmt.Errorf("%s: already exists", name)
+		}
+		usersData.Set(usermgr.User{
+			Name:     name,
+			RealName: ctx.String("real-name"),
+			Email:    ctx.String("email"),
+			Groups:   ctx.StringSlice("group"),
+		})
+		return nil
+	})
+}
+
+func AdminRemoveUserCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: usermgr admin remove-user NAME")
+	}
+	name := ctx.Args()[0]
+	return editUsersData(ctx, func(usersData *usermgr.UsersData) error {
+		if usersData.GetUserByName(name) == nil {
+			return fmt.Errorf("%s: not found", name)
+		}
+		usersData.Delete(name)
+		return nil
+	})
+}
+
+func AdminAddGroupCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: usermgr admin add-group USER GROUP")
+	}
+	group := ctx.Args()[1]
+	return editUser(ctx, ctx.Args()[0], func(user *usermgr.User) error {
+		if !user.InGroup(group) {
+			user.Groups = append(user.Groups, group)
+		}
+		return nil
+	})
+}
+
+func AdminRemoveGroupCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: usermgr admin remove-group USER GROUP")
+	}
+	group := ctx.Args()[1]
+	return editUser(ctx, ctx.Args()[0], func(user *usermgr.User) error {
+		groups := []string{}
+		for _, g := range user.Groups {
+			if g != group {
+				groups = append(groups, g)
+			}
+		}
+		user.Groups = groups
+		return nil
+	})
+}
+
+// sameAuthorizedKey returns true if a and b are the same SSH public key,
+// ignoring the options and comment. Keys that cannot be parsed are compared
+// as text.
+func sameAuthorizedKey(a, b string) bool {
+	keyA, _, _, _, errA := ssh.ParseAuthorizedKey([]byte(a))
+	keyB, _, _, _, errB := ssh.ParseAuthorizedKey([]byte(b))
+	if errA != nil || errB != nil {
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	}
+	return bytes.Equal(keyA.Marshal(), keyB.Marshal())
+}
+
+func AdminAddKeyCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: usermgr admin add-key USER KEY")
+	}
+	key := strings.TrimSpace(ctx.Args()[1])
+	return editUser(ctx, ctx.Args()[0], func(user *usermgr.User) error {
+		for _, existingKey := range user.AuthorizedKeys {
+			if sameAuthorizedKey(existingKey, key) {
+				return nil
+			}
+		}
+		user.AuthorizedKeys = append(user.AuthorizedKeys, key)
+		return nil
+	})
+}
+
+func AdminRemoveKeyCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("usage: usermgr admin remove-key USER KEY")
+	}
+	key := ctx.Args()[1]
+	return editUser(ctx, ctx.Args()[0], func(user *usermgr.User) error {
+		keys := []string{}
+		for _, existingKey := range user.AuthorizedKeys {
+			if !sameAuthorizedKey(existingKey, key) {
+				keys = append(keys, existingKey)
+			}
+		}
+		if len(keys) == len(user.AuthorizedKeys) {
+			return fmt.Errorf("%s: key not found", user.Name)
+		}
+		user.AuthorizedKeys = keys
+		return nil
+	})
+}
+
+func AdminSetCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 3 {
+		return fmt.Errorf("usage: usermgr admin set USER real_name|email|subject VALUE")
+	}
+	attribute, value := ctx.Args()[1], ctx.Args()[2]
+	return editUser(ctx, ctx.Args()[0], func(user *usermgr.User) error {
+		switch attribute {
+		case "real_name":
+			user.RealName = value
+		case "email":
+			user.Email = value
+		case "subject":
+			user.Subject = value
+		default:
+			return fmt.Errorf("unknown attribute: %s", attribute)
+		}
+		return nil
+	})
+}
+
+// AdminBackupCodeCommand implements the "admin backup-code" subcommand
+// which adds a backup code to a user and prints it. This is the only chance
+// to see the code, as only its hash is stored.
+func AdminBackupCodeCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("usage: usermgr admin backup-code USER")
+	}
+
+	code, err := usermgr.NewBackupCodeString()
+	if err != nil {
+		return err
+	}
+
+	err = editUser(ctx, ctx.Args()[0], func(user *usermgr.User) error {
+		user.BackupCodes = append(user.BackupCodes, usermgr.NewBackupCode(code))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.App.Writer, "backup code: %s\n", code)
+	return nil
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestAdminEditCommand struct {
+	tempDir  string
+	Output   *bytes.Buffer
+	AdminKey usermgr.AdminKey
+}
+
+var _ = Suite(&TestAdminEditCommand{})
+
+func (s *TestAdminEditCommand) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+	s.AdminKey.UnmarshalText([]byte(testAdminKey))
+}
+
+func (s *TestAdminEditCommand) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestAdminEditCommand) admin(args ...string) error {
+	return Main(append([]string{"usermgr", "admin", args[0], "--admin-key", testAdminKey,
+		"--file", filepath.Join(s.tempDir, "users.pem")}, args[1:]...), s.Output)
+}
+
+func (s *TestAdminEditCommand) load(c *C) *usermgr.UsersData {
+	buf, err := ioutil.ReadFile(filepath.Join(s.tempDir, "users.pem"))
+	c.Assert(err, IsNil)
+	usersData, err := usermgr.LoadUsersData(buf, s.AdminKey.HostKey)
+	c.Assert(err, IsNil)
+	return usersData
+}
+
+func (s *TestAdminEditCommand) TestCanEdit(c *C) {
+	c.Assert(s.admin("add-user", "--real-name", "Alice Smith", "--group", "users", "alice"), IsNil)
+	c.Assert(s.admin("add-user", "bob"), IsNil)
+	c.Assert(s.admin("add-user", "bob"), ErrorMatches, "bob: already exists")
+
+	usersData := s.load(c)
+	c.Assert(usersData.Serial, Equals, uint64(2))
+	c.Assert(*usersData.GetUserByName("alice"), DeepEquals, usermgr.User{
+		Name: "alice", RealName: "Alice Smith", Groups: []string{"users"}})
+
+	c.Assert(s.admin("add-group", "alice", "wheel"), IsNil)
+	c.Assert(s.admin("add-group", "alice", "wheel"), IsNil)
+	c.Assert(s.admin("remove-group", "alice", "users"), IsNil)
+	c.Assert(s.admin("add-group", "carol", "wheel"), ErrorMatches, "carol: not found")
+	c.Assert(s.load(c).GetUserByName("alice").Groups, DeepEquals, []string{"wheel"})
+
+	laptopKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIH6kkwh1CqSUs9pu2zyICfTi2dpFOB0hjPdXCNZQcpVF"
+	desktopKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO4VcGDGQfFyCEbooEqnQSqzlcJa5tvjND4j243jpBd5"
+	securityKey := "sk-ssh-ed25519@openssh.com " +
+		"AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4fAAAABHNzaDo="
+	c.Assert(s.admin("add-key", "alice", laptopKey+" alice@laptop"), IsNil)
+	c.Assert(s.admin("add-key", "alice", desktopKey+" alice@desktop"), IsNil)
+	c.Assert(s.admin("add-key", "alice", `command="ssh-ed25519 x",no-pty `+laptopKey+" again"), IsNil)
+	c.Assert(s.admin("add-key", "alice", securityKey+" alice@yubikey"), IsNil)
+	c.Assert(s.admin("add-key", "alice", securityKey), IsNil)
+	c.Assert(len(s.load(c).GetUserByName("alice").AuthorizedKeys), Equals, 3)
+	c.Assert(s.admin("remove-key", "alice", "no-agent-forwarding "+laptopKey), IsNil)
+	c.Assert(s.admin("remove-key", "alice", laptopKey), ErrorMatches, "alice: key not found")
+	c.Assert(s.admin("remove-key", "alice", securityKey), IsNil)
+	c.Assert(s.load(c).GetUserByName("alice").AuthorizedKeys, DeepEquals,
+		[]string{desktopKey + " alice@desktop"})
+
+	c.Assert(s.admin("set", "alice", "email", "alice@example.com"), IsNil)
+	c.Assert(s.admin("set", "alice", "shell", "/bin/sh"), ErrorMatches, "unknown attribute: shell")
+	c.Assert(s.load(c).GetUserByName("alice").Email, Equals, "alice@example.com")
+	c.Assert(s.admin("set", "alice", "subject", "1234"), IsNil)
+	c.Assert(s.load(c).GetUserByName("alice").Subject, Equals, "1234")
+
+	s.Output.Reset()
+	c.Assert(s.admin("backup-code", "alice"), IsNil)
+	c.Assert(s.Output.String(), Matches, "backup code: [a-z2-7]{16}\n")
+	code := strings.TrimSpace(strings.TrimPrefix(s.Output.String(), "backup code: "))
+	c.Assert(s.load(c).GetUserByName("alice").BackupCodes[0].Matches(code), Equals, true)
+
+	c.Assert(s.admin("remove-user", "bob"), IsNil)
+	c.Assert(s.admin("remove-user", "bob"), ErrorMatches, "bob: not found")
+	c.Assert(len(s.load(c).Users), Equals, 1)
+}
+
+func (s *TestAdminEditCommand) TestFileKeepsMode(c *C) {
+	path := filepath.Join(s.tempDir, "users.pem")
+	c.Assert(s.admin("add-user", "alice"), IsNil)
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	c.Assert(os.Chmod(path, 0640), IsNil)
+	c.Assert(s.admin("add-user", "bob"), IsNil)
+	fi, err = os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0640))
+
+	// no temporary files are left behind
+	names, err := filepath.Glob(filepath.Join(s.tempDir, "*users.pem*"))
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{path})
+}
+
+func (s *TestAdminEditCommand) TestCanEditStore(c *C) {
+	err := Main([]string{"usermgr", "admin", "add-user", "--admin-key", testAdminKey,
+		"--store", "file://" + s.tempDir, "alice"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.load(c).GetUserByName("alice"), NotNil)
+}
+
+func (s *TestAdminEditCommand) TestRequiresDestination(c *C) {
+	err := Main([]string{"usermgr", "admin", "add-user", "--admin-key", testAdminKey,
+		"alice"}, s.Output)
+	c.Assert(err, ErrorMatches, "specify either --file or --store")
+
+	err = Main([]string{"usermgr", "admin", "add-user", "--admin-key", testAdminKey,
+		"--file", "users.pem", "--store", "file:///tmp", "alice"}, s.Output)
+	c.Assert(err, ErrorMatches, "specify only one of --file or --store")
+}
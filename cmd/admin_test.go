@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+const testAdminKey = "m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"
+
+type TestAdminCommand struct {
+	tempDir string
+	Output  *bytes.Buffer
+}
+
+var _ = Suite(&TestAdminCommand{})
+
+func (s *TestAdminCommand) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+}
+
+func (s *TestAdminCommand) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestAdminCommand) TestProposeSignPublish(c *C) {
+	alice := usermgr.GenerateSigningKey()
+	bob := usermgr.GenerateSigningKey()
+	jsonPath := filepath.Join(s.tempDir, "users.json")
+	proposalPath := filepath.Join(s.tempDir, "proposal.pem")
+	storeDir := filepath.Join(s.tempDir, "store")
+	os.Mkdir(storeDir, 0755)
+
+	ioutil.WriteFile(jsonPath, []byte(`{"users": [{"name": "alice"}], "serial": 4}`), 0644)
+	err := Main([]string{"usermgr", "admin", "propose", "--admin-key", testAdminKey,
+		jsonPath, proposalPath}, s.Output)
+	c.Assert(err, IsNil)
+
+	publishArgs := []string{"usermgr", "admin", "publish",
+		"--signer", alice.PublicKey.String(), "--signer", bob.PublicKey.String(),
+		"--store", "file://" + storeDir, proposalPath}
+	err = Main(publishArgs, s.Output)
+	c.Assert(err, ErrorMatches, "user data approved by 0 of 2 required administrators")
+
+	err = Main([]string{"usermgr", "admin", "sign", "--signing-key", alice.String(),
+		proposalPath}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, "approved by: "+alice.PublicKey.String()+"\n")
+
+	err = Main(publishArgs, s.Output)
+	c.Assert(err, ErrorMatches, "user data approved by 1 of 2 required administrators")
+	_, err = os.Stat(filepath.Join(storeDir, "users.pem"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	err = Main([]string{"usermgr", "admin", "sign", "--signing-key", bob.String(),
+		proposalPath}, s.Output)
+	c.Assert(err, IsNil)
+
+	err = Main(publishArgs, s.Output)
+	c.Assert(err, IsNil)
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "admin", "show", "--admin-key", testAdminKey,
+		filepath.Join(storeDir, "users.pem")}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(s.Output.String(), `"name": "alice"`), Equals, true)
+	c.Assert(strings.Contains(s.Output.String(), `"serial": 5`), Equals, true)
+}
+
+func (s *TestAdminCommand) TestSignRequiresKey(c *C) {
+	err := Main([]string{"usermgr", "admin", "sign", "--signing-key", "xxx",
+		filepath.Join(s.tempDir, "proposal.pem")}, s.Output)
+	c.Assert(err, ErrorMatches, "cannot parse signing key: incorrect key format")
+}
+
+func (s *TestAdminCommand) TestPublishRequiresSigner(c *C) {
+	err := Main([]string{"usermgr", "admin", "publish",
+		filepath.Join(s.tempDir, "proposal.pem")}, s.Output)
+	c.Assert(err, ErrorMatches, "at least one signer must be specified")
+}
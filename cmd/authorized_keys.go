@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/codegangsta/cli"
-	"github.com/crewjam/usermgr"
 )
 
 var authorizedKeysCommand = cli.Command{
@@ -43,7 +42,7 @@ func AuthorizedKeys(ctx *cli.Context) error {
 		return err
 	}
 
-	userData, err := usermgr.GetLocalCache(config.CacheDir, config.HostKey)
+	userData, err := config.LocalCache().Get()
 	if err != nil {
 		return err
 	}
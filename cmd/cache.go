@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+)
+
+var cacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "Show the versions of the account database kept on this host and pin one of them",
+	Subcommands: []cli.Command{
+		{
+			Name:   "history",
+			Usage:  "List the versions of the account database in the cache, newest first",
+			Action: WithError(CacheHistoryCommand),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "The output format: text or json",
+				},
+			},
+		},
+		{
+			Name:   "rollback",
+			Usage:  "Pin the cache to a previous version, identified by its ID or serial number",
+			Action: WithError(CacheRollbackCommand),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "The ID or serial number of the version (see: usermgr cache history)",
+				},
+			},
+		},
+		{
+			Name:   "unpin",
+			Usage:  "Undo a rollback, so that the newest version is used again",
+			Action: WithError(CacheUnpinCommand),
+		},
+	},
+}
+
+// CacheHistoryCommand implements the "cache history" command.
+func CacheHistoryCommand(ctx *cli.Context) error {
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	localCache := config.LocalCache()
+	history, err := localCache.History()
+	if err != nil {
+		return err
+	}
+	pinned, err := localCache.Pinned()
+	if err != nil {
+		return err
+	}
+
+	switch ctx.String("format") {
+	case "text":
+		tw := tabwriter.NewWriter(ctx.App.Writer, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "ID\tSERIAL\tFETCHED\t\n")
+		for i, entry := range history {
+			note := ""
+			switch {
+			case entry.ID == pinned:
+				note = "pinned"
+			case i == 0 && pinned == "":
+				note = "current"
+			case i == 0:
+				note = "newest"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", entry.ID, entry.Serial, formatTime(&entry.FetchTime), note)
+		}
+		return tw.Flush()
+	case "json":
+		buf, err := json.MarshalIndent(history, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.App.Writer, "%s\n", buf)
+		return nil
+	default:
+		return fmt.Errorf("unknown format: %s", ctx.String("format"))
+	}
+}
+
+// CacheRollbackCommand implements the "cache rollback" command, which pins
+// the cache to a previous version during an emergency.
+func CacheRollbackCommand(ctx *cli.Context) error {
+	if ctx.String("to") == "" {
+		return fmt.Errorf("usage: usermgr cache rollback --to VERSION")
+	}
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	entry, err := config.LocalCache().Rollback(ctx.String("to"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.App.Writer, "pinned the cache to %s (serial %d)\n", entry.ID, entry.Serial)
+	fmt.Fprintf(ctx.App.Writer, "Run `usermgr sync` to apply it, and `usermgr cache unpin` to return to the newest version.\n")
+	return nil
+}
+
+// CacheUnpinCommand implements the "cache unpin" command.
+func CacheUnpinCommand(ctx *cli.Context) error {
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+	if err := config.LocalCache().Unpin(); err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.App.Writer, "the cache is no longer pinned\n")
+	fmt.Fprintf(ctx.App.Writer, "Run `usermgr sync` to apply the newest version.\n")
+	return nil
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestCacheCommand struct {
+	tempDir    string
+	configPath string
+	Output     *bytes.Buffer
+}
+
+var _ = Suite(&TestCacheCommand{})
+
+func (s *TestCacheCommand) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+
+	adminKey := usermgr.AdminKey{}
+	adminKey.UnmarshalText([]byte(testAdminKey))
+	os.MkdirAll(filepath.Join(s.tempDir, "history"), 0755)
+	versions := []struct {
+		ID    string
+		Users []usermgr.User
+	}{
+		{"20060102T150405Z-1", []usermgr.User{{Name: "alice", Groups: []string{"users"}}}},
+		{"20060102T160405Z-2", []usermgr.User{{Name: "alice", Groups: []string{"users"}}, {Name: "mallory", Groups: []string{"users"}}}},
+	}
+	for i, version := range versions {
+		usersData := usermgr.UsersData{Serial: uint64(i + 1), Users: version.Users}
+		signedData, err := usersData.SignedString(adminKey)
+		c.Assert(err, IsNil)
+		ioutil.WriteFile(filepath.Join(s.tempDir, "history", version.ID+".pem"), signedData, 0644)
+		ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+		ioutil.WriteFile(filepath.Join(s.tempDir, "users.serial"), []byte(fmt.Sprintf("%d", i+1)), 0644)
+	}
+
+	s.configPath = filepath.Join(s.tempDir, "usermgr.conf")
+	ioutil.WriteFile(s.configPath, []byte(""+
+		fmt.Sprintf("CacheDir = %q\n", s.tempDir)+
+		fmt.Sprintf("HostKey = %q\n", adminKey.HostKey.String())), 0644)
+}
+
+func (s *TestCacheCommand) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestCacheCommand) TestHistory(c *C) {
+	err := Main([]string{"usermgr", "--config", s.configPath, "cache", "history"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, ""+
+		"ID                  SERIAL  FETCHED               \n"+
+		"20060102T160405Z-2  2       2006-01-02T16:04:05Z  current\n"+
+		"20060102T150405Z-1  1       2006-01-02T15:04:05Z  \n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", s.configPath, "cache", "history", "--format", "json"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, `[
+  {
+    "id": "20060102T160405Z-2",
+    "serial": 2,
+    "fetch_time": "2006-01-02T16:04:05Z"
+  },
+  {
+    "id": "20060102T150405Z-1",
+    "serial": 1,
+    "fetch_time": "2006-01-02T15:04:05Z"
+  }
+]
+`)
+}
+
+func (s *TestCacheCommand) TestRollback(c *C) {
+	err := Main([]string{"usermgr", "--config", s.configPath, "cache", "rollback"}, s.Output)
+	c.Assert(err, ErrorMatches, "usage: usermgr cache rollback --to VERSION")
+
+	err = Main([]string{"usermgr", "--config", s.configPath, "cache", "rollback", "--to", "1"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, ""+
+		"pinned the cache to 20060102T150405Z-1 (serial 1)\n"+
+		"Run `usermgr sync` to apply it, and `usermgr cache unpin` to return to the newest version.\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", s.configPath, "list"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, "alice\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", s.configPath, "cache", "history"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, ""+
+		"ID                  SERIAL  FETCHED               \n"+
+		"20060102T160405Z-2  2       2006-01-02T16:04:05Z  newest\n"+
+		"20060102T150405Z-1  1       2006-01-02T15:04:05Z  pinned\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", s.configPath, "status", "--format", "nagios"}, s.Output)
+	c.Assert(err, NotNil)
+	c.Assert(s.Output.String(), Matches, "(?s).*the cache is pinned to 20060102T150405Z-1.*")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", s.configPath, "cache", "unpin"}, s.Output)
+	c.Assert(err, IsNil)
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", s.configPath, "list"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, "alice\nmallory\n")
+}
+
+func (s *TestCacheCommand) TestRollbackToMissingVersion(c *C) {
+	err := Main([]string{"usermgr", "--config", s.configPath, "cache", "rollback", "--to", "20060102T150405Z-3"}, s.Output)
+	c.Assert(err, ErrorMatches, "20060102T150405Z-3: no such version in the cache history")
+}
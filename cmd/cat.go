@@ -5,22 +5,30 @@ import (
 	"fmt"
 
 	"github.com/codegangsta/cli"
-	"github.com/crewjam/usermgr"
 )
 
 var catCommand = cli.Command{
 	Name:   "cat",
 	Usage:  "Show an account",
 	Action: WithError(CatCommand),
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "raw",
+			Usage: "Show the data as stored, including the salts and hashes of codes",
+		},
+	},
 }
 
+// CatCommand implements the "cat" command, which shows one account or the
+// whole account database. Unless --raw is specified, hashes and secrets are
+// left out and SSH keys are shown by fingerprint.
 func CatCommand(ctx *cli.Context) error {
 	config, err := LoadConfig(ctx.GlobalString("config"))
 	if err != nil {
 		return err
 	}
 
-	userData, err := usermgr.GetLocalCache(config.CacheDir, config.HostKey)
+	userData, err := config.LocalCache().Get()
 	if err != nil {
 		return err
 	}
@@ -32,19 +40,34 @@ func CatCommand(ctx *cli.Context) error {
 			return fmt.Errorf("%s: not found\n", name)
 		}
 
-		buf, err := json.MarshalIndent(user, "", "  ")
+		if ctx.Bool("raw") {
+			buf, err := json.MarshalIndent(user, "", "  ")
+			if err != nil {
+				return err
+			}
+			ctx.App.Writer.Write(buf)
+			return nil
+		}
+		buf, err := json.MarshalIndent(user.Summary(), "", "  ")
 		if err != nil {
 			return err
 		}
-		ctx.App.Writer.Write(buf)
+		fmt.Fprintf(ctx.App.Writer, "%s\n", buf)
 		return nil
 	}
 
-	buf, err := json.MarshalIndent(userData, "", "  ")
+	if ctx.Bool("raw") {
+		buf, err := json.MarshalIndent(userData, "", "  ")
+		if err != nil {
+			return err
+		}
+		ctx.App.Writer.Write(buf)
+		return nil
+	}
+	buf, err := json.MarshalIndent(userData.Summary(), "", "  ")
 	if err != nil {
 		return err
 	}
-	ctx.App.Writer.Write(buf)
+	fmt.Fprintf(ctx.App.Writer, "%s\n", buf)
 	return nil
-
 }
@@ -49,7 +49,7 @@ func (s *TestCatCommand) TearDownTest(c *C) {
 
 func (s *TestCatCommand) TestCanPrintUser(c *C) {
 	err := Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
-		"cat", "alice"}, s.Output)
+		"cat", "--raw", "alice"}, s.Output)
 	c.Assert(err, IsNil)
 	c.Assert(string(s.Output.Bytes()), Equals, ""+
 		"{\n"+
@@ -70,7 +70,7 @@ func (s *TestCatCommand) TestCanPrintUser(c *C) {
 
 func (s *TestCatCommand) TestCanPrintAll(c *C) {
 	err := Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
-		"cat"}, s.Output)
+		"cat", "--raw"}, s.Output)
 	c.Assert(err, IsNil)
 	c.Assert(string(s.Output.Bytes()), Equals, ""+
 		"{\n"+
@@ -93,6 +93,34 @@ func (s *TestCatCommand) TestCanPrintAll(c *C) {
 		"}")
 }
 
+func (s *TestCatCommand) TestRedactsSecrets(c *C) {
+	err := Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
+		"cat", "alice"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(string(s.Output.Bytes()), Equals, ""+
+		"{\n"+
+		"  \"name\": \"alice\",\n"+
+		"  \"real_name\": \"Alice Smith\",\n"+
+		"  \"authorized_keys\": [\n"+
+		"    {\n"+
+		"      \"type\": \"ssh-rsa\",\n"+
+		"      \"fingerprint\": \"SHA256:V1cfUeuoS+neLmaAFaDp0RLKOMF5PG/I+P57hoR/0Us\",\n"+
+		"      \"comment\": \"ross@rm\"\n"+
+		"    }\n"+
+		"  ],\n"+
+		"  \"backup_codes\": [\n"+
+		"    \"2006-01-02T15:04:05Z\"\n"+
+		"  ]\n"+
+		"}\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
+		"cat"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(string(s.Output.Bytes()), Matches, "(?s){\n  \"users\": \\[\n    {\n      \"name\": \"alice\",\n.*")
+	c.Assert(string(s.Output.Bytes()), Not(Matches), "(?s).*(salt|hash|AAAAB3Nza).*")
+}
+
 func (s *TestCatCommand) TestInvalidUser(c *C) {
 	err := Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
 		"cat", "bob"}, s.Output)
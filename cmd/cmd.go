@@ -33,6 +33,13 @@ func Main(args []string, output io.Writer) error {
 		listCommand,
 		shellCommand,
 		keygenCommand,
+		adminCommand,
+		enrollCommand,
+		inspectCommand,
+		verifyCommand,
+		diffCommand,
+		statusCommand,
+		cacheCommand,
 		webCommand,
 	}
 
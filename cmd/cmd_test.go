@@ -62,6 +62,7 @@ func (s *TestMainCommand) TestCanPrintUser(c *C) {
 		LoginGroups:      []string{"users"},
 		SudoGroups:       []string{"wheel"},
 		LoginMFARequried: false,
+		HistorySize:      10,
 	})
 
 	config, err = LoadConfig(filepath.Join(s.tempDir, "missing"))
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"io/ioutil"
+	"math/rand"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/crewjam/usermgr"
@@ -13,9 +15,27 @@ var DefaultConfigPath string = "/etc/usermgr.conf"
 // Config describes the host configuration
 type Config struct {
 	// The URL where the account database is stored. This URL can also
-	// point to a storage service, i.e. "https://s3.amazonaws.com/example/users.pem"
+	// point to a storage service, i.e. "https://s3.amazonaws.com/example/users.pem",
+	// or to a private S3 bucket, i.e. "s3://example/users.pem", a local
+	// file, i.e. "file:///etc/usermgr/users.pem", or a command that prints
+	// the data, i.e. "exec:///usr/local/bin/get-users"
 	URL string
 
+	// The URL of a stream of server-sent events announcing changes to the
+	// account database, which `usermgr sync --daemon` subscribes to. Set to
+	// "none" to only poll. (Default: "/events" after the first of URL and
+	// URLs that is the web server's /users.pem)
+	EventsURL string
+
+	// Additional URLs where copies of the account database are stored. The
+	// data are fetched from URL and from each of these, and the copy with
+	// the highest serial number is used.
+	URLs []string
+
+	// If true then the mirrors are tried in a random order rather than in
+	// the order they are listed.
+	RandomizeURLs bool
+
 	// Specifies the host key used to decrypt and verify the database
 	HostKey usermgr.HostKey
 
@@ -33,6 +53,121 @@ type Config struct {
 
 	// If true then all remote users must specify an MFA token to login.
 	LoginMFARequried bool
+
+	// Specifies which groups may still log in once the account database
+	// has expired. If empty, no one can log in with expired data.
+	BreakGlassGroups []string
+
+	// Specifies the signing keys of the administrators who must approve the
+	// account database before it is accepted. If empty, no approvals are
+	// required.
+	AdminSigningKeys []usermgr.SigningPublicKey
+
+	// Specifies how many of AdminSigningKeys must approve the account
+	// database. (Default: all of them)
+	AdminSigningThreshold int
+
+	// Specifies how long to wait for a connection to the server, including
+	// the TLS handshake. (Default: 10s)
+	ConnectTimeout Duration
+
+	// Specifies how long a request to the server may take in total.
+	// (Default: 1m)
+	Timeout Duration
+
+	// Specifies a file of PEM encoded CA certificates that are trusted
+	// instead of the system's CAs.
+	CAFile string
+
+	// Specifies the base64 encoded SHA-256 hashes of public keys, one of
+	// which must be in the server's certificate chain.
+	PinnedKeys []string
+
+	// Specifies the URL of an HTTP proxy. (Default: from HTTPS_PROXY and
+	// HTTP_PROXY)
+	Proxy string
+
+	// Specifies the client certificate and key presented to the server.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// Specifies the largest account database that is accepted, in bytes.
+	// (Default: 16 MiB)
+	MaxDataSize int64
+
+	// Specifies how many versions of the account database are kept in
+	// CacheDir. (Default: 10)
+	HistorySize int
+
+	// Specifies how long versions of the account database are kept in
+	// CacheDir. If zero, they are only pruned by HistorySize.
+	HistoryMaxAge Duration
+}
+
+// Duration is a time.Duration that is written as a string like "30s" in the
+// configuration file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// HTTPOptions returns the options for the client used to talk to the
+// server.
+func (config *Config) HTTPOptions() usermgr.HTTPOptions {
+	return usermgr.HTTPOptions{
+		ConnectTimeout: config.ConnectTimeout.Duration,
+		Timeout:        config.Timeout.Duration,
+		CAFile:         config.CAFile,
+		PinnedKeys:     config.PinnedKeys,
+		Proxy:          config.Proxy,
+		ClientCertFile: config.ClientCertFile,
+		ClientKeyFile:  config.ClientKeyFile,
+	}
+}
+
+// Mirrors returns the URLs where the account database is fetched from, in
+// the order they are tried.
+func (config *Config) Mirrors() []string {
+	rv := []string{}
+	seen := map[string]bool{}
+	for _, u := range append([]string{config.URL}, config.URLs...) {
+		if u == "" || seen[u] {
+			continue
+		}
+		rv = append(rv, u)
+		seen[u] = true
+	}
+	if config.RandomizeURLs {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i, j := range r.Perm(len(rv)) {
+			rv[i], rv[j] = rv[j], rv[i]
+		}
+	}
+	return rv
+}
+
+// LocalCache returns the local copy of the account database described by
+// the configuration.
+func (config *Config) LocalCache() usermgr.LocalCache {
+	return usermgr.LocalCache{
+		Path:             config.CacheDir,
+		HostKey:          config.HostKey,
+		BreakGlassGroups: config.BreakGlassGroups,
+		SignaturePolicy: usermgr.SignaturePolicy{
+			Keys:      config.AdminSigningKeys,
+			Threshold: config.AdminSigningThreshold,
+		},
+		HTTP:          config.HTTPOptions(),
+		MaxDataSize:   config.MaxDataSize,
+		HistorySize:   config.HistorySize,
+		HistoryMaxAge: config.HistoryMaxAge.Duration,
+	}
 }
 
 // LoadConfig returns a new config object by reading the file at path.
@@ -41,6 +176,7 @@ func LoadConfig(path string) (*Config, error) {
 		CacheDir:    "/var/lib/usermgr",
 		LoginGroups: []string{"users"},
 		SudoGroups:  []string{"wheel"},
+		HistorySize: 10,
 	}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
+)
+
+var diffCommand = cli.Command{
+	Name:   "diff",
+	Usage:  "Show the changes between two account databases: diff OLD NEW, or diff --against-cache [NEW]",
+	Action: WithError(DiffCommand),
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "against-cache",
+			Usage: "Compare the copy in the cache directory to NEW or, if not specified, to the current upstream data",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "The output format: text or json",
+		},
+	}, inspectFlags...),
+}
+
+// DiffCommand implements the "diff" command, which decrypts two versions
+// of the account database and describes the changes between them.
+func DiffCommand(ctx *cli.Context) error {
+	var oldData, newData *usermgr.UsersData
+	var err error
+	if ctx.Bool("against-cache") {
+		oldData, newData, err = loadAgainstCache(ctx)
+	} else {
+		oldData, newData, err = loadDiffFiles(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	diff := usermgr.DiffUsersData(oldData, newData)
+	switch ctx.String("format") {
+	case "text":
+		writeDiff(ctx.App.Writer, diff)
+		return nil
+	case "json":
+		buf, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.App.Writer, "%s\n", buf)
+		return nil
+	default:
+		return fmt.Errorf("unknown format: %s", ctx.String("format"))
+	}
+}
+
+// loadDiffFiles reads the two files named on the command line with the key
+// specified on the command line.
+func loadDiffFiles(ctx *cli.Context) (*usermgr.UsersData, *usermgr.UsersData, error) {
+	if len(ctx.Args()) != 2 {
+		return nil, nil, fmt.Errorf("usage: usermgr diff OLD NEW")
+	}
+	adminKey, hostKey, err := readKeyFromContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rv := []*usermgr.UsersData{}
+	for _, path := range ctx.Args() {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		var usersData *usermgr.UsersData
+		if adminKey != nil {
+			usersData, err = usermgr.LoadUsersDataAsAdmin(buf, *adminKey)
+		} else {
+			usersData, err = usermgr.LoadUsersData(buf, hostKey)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", path, err)
+		}
+		rv = append(rv, usersData)
+	}
+	return rv[0], rv[1], nil
+}
+
+// loadAgainstCache reads the host's cached data and either the file named
+// on the command line or the upstream data, using the keys the cache trusts.
+func loadAgainstCache(ctx *cli.Context) (*usermgr.UsersData, *usermgr.UsersData, error) {
+	if len(ctx.Args()) > 1 {
+		return nil, nil, fmt.Errorf("usage: usermgr diff --against-cache [NEW]")
+	}
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return nil, nil, err
+	}
+	localCache := config.LocalCache()
+	oldData, err := localCache.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buf []byte
+	if len(ctx.Args()) == 1 {
+		buf, err = ioutil.ReadFile(ctx.Args()[0])
+	} else {
+		buf, err = fetchAny(localCache, config.Mirrors())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	newData, err := localCache.Load(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return oldData, newData, nil
+}
+
+// fetchAny returns the data from the first of urls that responds.
+func fetchAny(localCache usermgr.LocalCache, urls []string) ([]byte, error) {
+	err := fmt.Errorf("no URL configured")
+	for _, url := range urls {
+		var buf []byte
+		if buf, err = localCache.Fetch(url); err == nil {
+			return buf, nil
+		}
+	}
+	return nil, err
+}
+
+func writeDiff(w io.Writer, diff usermgr.Diff) {
+	fmt.Fprintf(w, "serial: %d -> %d\n", diff.OldSerial, diff.NewSerial)
+	if diff.Empty() {
+		fmt.Fprintf(w, "no changes\n")
+		return
+	}
+	for _, name := range diff.UsersAdded {
+		fmt.Fprintf(w, "+ user %s\n", name)
+	}
+	for _, name := range diff.UsersRemoved {
+		fmt.Fprintf(w, "- user %s\n", name)
+	}
+	for _, userDiff := range diff.UsersChanged {
+		fmt.Fprintf(w, "~ user %s\n", userDiff.Name)
+		for _, attribute := range userDiff.AttributesChanged {
+			fmt.Fprintf(w, "    ~ %s\n", attribute)
+		}
+		for _, group := range userDiff.GroupsAdded {
+			fmt.Fprintf(w, "    + group %s\n", group)
+		}
+		for _, group := range userDiff.GroupsRemoved {
+			fmt.Fprintf(w, "    - group %s\n", group)
+		}
+		for _, key := range userDiff.KeysAdded {
+			fmt.Fprintf(w, "    + key %s\n", key)
+		}
+		for _, key := range userDiff.KeysRemoved {
+			fmt.Fprintf(w, "    - key %s\n", key)
+		}
+		for _, device := range userDiff.MFADevicesAdded {
+			fmt.Fprintf(w, "    + mfa %s\n", device)
+		}
+		for _, device := range userDiff.MFADevicesRemoved {
+			fmt.Fprintf(w, "    - mfa %s\n", device)
+		}
+		if userDiff.BackupCodesAdded > 0 {
+			fmt.Fprintf(w, "    + %d backup codes\n", userDiff.BackupCodesAdded)
+		}
+		if userDiff.BackupCodesRemoved > 0 {
+			fmt.Fprintf(w, "    - %d backup codes\n", userDiff.BackupCodesRemoved)
+		}
+	}
+}
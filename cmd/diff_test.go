@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestDiffCommand struct {
+	tempDir  string
+	Output   *bytes.Buffer
+	AdminKey usermgr.AdminKey
+}
+
+var _ = Suite(&TestDiffCommand{})
+
+func (s *TestDiffCommand) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+	s.AdminKey.UnmarshalText([]byte(testAdminKey))
+
+	s.write(c, "old.pem", usermgr.UsersData{Serial: 1, Users: []usermgr.User{
+		{Name: "alice", Groups: []string{"users"}},
+		{Name: "bob"},
+	}})
+	s.write(c, "new.pem", usermgr.UsersData{Serial: 2, Users: []usermgr.User{
+		{Name: "alice", Groups: []string{"wheel"}},
+		{Name: "charlie"},
+	}})
+}
+
+func (s *TestDiffCommand) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestDiffCommand) write(c *C, name string, ud usermgr.UsersData) string {
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+	path := filepath.Join(s.tempDir, name)
+	ioutil.WriteFile(path, signedData, 0644)
+	return path
+}
+
+func (s *TestDiffCommand) TestDiffFiles(c *C) {
+	err := Main([]string{"usermgr", "diff", "--host-key", s.AdminKey.HostKey.String(),
+		filepath.Join(s.tempDir, "old.pem"), filepath.Join(s.tempDir, "new.pem")}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, ""+
+		"serial: 1 -> 2\n"+
+		"+ user charlie\n"+
+		"- user bob\n"+
+		"~ user alice\n"+
+		"    + group wheel\n"+
+		"    - group users\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "diff", "--admin-key", testAdminKey, "--format", "json",
+		filepath.Join(s.tempDir, "old.pem"), filepath.Join(s.tempDir, "old.pem")}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, "{\n  \"old_serial\": 1,\n  \"new_serial\": 1\n}\n")
+}
+
+func (s *TestDiffCommand) TestDiffAgainstCache(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(s.tempDir, "new.pem"))
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(s.tempDir, "cache")
+	os.Mkdir(cacheDir, 0755)
+	buf, _ := ioutil.ReadFile(filepath.Join(s.tempDir, "old.pem"))
+	ioutil.WriteFile(filepath.Join(cacheDir, "users.pem"), buf, 0644)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "usermgr.conf"), []byte(""+
+		fmt.Sprintf("URL = %q\n", server.URL+"/users.pem")+
+		fmt.Sprintf("CacheDir = %q\n", cacheDir)+
+		fmt.Sprintf("HostKey = %q\n", s.AdminKey.HostKey.String())), 0644)
+
+	err := Main([]string{"usermgr", "--config", filepath.Join(s.tempDir, "usermgr.conf"),
+		"diff", "--against-cache"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Matches, "serial: 1 -> 2\n\\+ user charlie\n(?s).*")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", filepath.Join(s.tempDir, "usermgr.conf"),
+		"diff", "--against-cache", filepath.Join(s.tempDir, "old.pem")}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, "serial: 1 -> 1\nno changes\n")
+}
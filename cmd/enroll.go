@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
+)
+
+var enrollCommand = cli.Command{
+	Name:   "enroll",
+	Usage:  "Ask the web interface to encrypt the account database to this host's own key",
+	Action: WithError(EnrollCommand),
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "name",
+			Value: "",
+			Usage: "The name of this host (Default: the hostname)",
+		},
+		cli.StringFlag{
+			Name:  "server",
+			Value: "",
+			Usage: "The root URL of the web interface (Default: URL from the configuration file, without users.pem)",
+		},
+	},
+}
+
+// EnrollCommand implements the "enroll" command, which generates a key pair
+// for this host and registers the public key with the web interface. Once
+// an administrator approves the host, the account database is encrypted to
+// its key, and the host can be revoked without replacing the shared host key
+// on every other host.
+func EnrollCommand(ctx *cli.Context) error {
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return err
+	}
+
+	host := usermgr.Host{Name: ctx.String("name")}
+	if host.Name == "" {
+		host.Name, err = os.Hostname()
+		if err != nil {
+			return err
+		}
+	}
+	server := ctx.String("server")
+	if server == "" {
+		server = strings.TrimSuffix(config.URL, "/users.pem")
+	}
+
+	host.PublicKey, err = config.LocalCache().OwnPublicKey()
+	if err != nil {
+		return err
+	}
+
+	// the shared host key shows that the request comes from one of our hosts
+	proof, err := host.EnrollmentProof(config.HostKey)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(struct {
+		usermgr.Host
+		Proof []byte `json:"proof"`
+	}{host, proof})
+	if err != nil {
+		return err
+	}
+	client, err := config.HTTPOptions().Client()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(strings.TrimSuffix(server, "/")+"/hosts/", "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("enrollment failed: %s", resp.Status)
+	}
+
+	fmt.Fprintf(ctx.App.Writer, "requested enrollment of %s with key %s\n", host.Name, host.PublicKey)
+	fmt.Fprintf(ctx.App.Writer, "An administrator must approve this host before the data are encrypted to its key.\n")
+	return nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestEnrollCommand struct {
+	tempDir string
+	Output  *bytes.Buffer
+	Server  *httptest.Server
+	Hosts   []usermgr.Host
+	Proofs  [][]byte
+}
+
+var _ = Suite(&TestEnrollCommand{})
+
+func (s *TestEnrollCommand) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+	s.Hosts = nil
+	s.Proofs = nil
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/hosts/" {
+			http.NotFound(w, r)
+			return
+		}
+		request := struct {
+			usermgr.Host
+			Proof []byte `json:"proof"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&request)
+		s.Hosts = append(s.Hosts, request.Host)
+		s.Proofs = append(s.Proofs, request.Proof)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	ioutil.WriteFile(filepath.Join(s.tempDir, "usermgr.conf"), []byte(""+
+		fmt.Sprintf("URL = %q\n", s.Server.URL+"/users.pem")+
+		fmt.Sprintf("CacheDir = %q\n", s.tempDir)+
+		"HostKey = \"m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8Pg\"\n"), 0644)
+}
+
+func (s *TestEnrollCommand) TearDownTest(c *C) {
+	s.Server.Close()
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestEnrollCommand) TestCanEnroll(c *C) {
+	err := Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
+		"enroll", "--name", "web1"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(len(s.Hosts), Equals, 1)
+	c.Assert(s.Hosts[0].Name, Equals, "web1")
+	c.Assert(len(s.Proofs[0]), Not(Equals), 0)
+	c.Assert(s.Output.String(), Equals, ""+
+		"requested enrollment of web1 with key "+s.Hosts[0].PublicKey.String()+"\n"+
+		"An administrator must approve this host before the data are encrypted to its key.\n")
+
+	// enrolling again reuses the same key
+	err = Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
+		"enroll", "--name", "web1"}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Hosts[1].PublicKey, Equals, s.Hosts[0].PublicKey)
+}
+
+func (s *TestEnrollCommand) TestEnrollFails(c *C) {
+	err := Main([]string{"usermgr", "--config=" + filepath.Join(s.tempDir, "usermgr.conf"),
+		"enroll", "--server", s.Server.URL + "/nope"}, s.Output)
+	c.Assert(err, ErrorMatches, "enrollment failed: 404 Not Found")
+}
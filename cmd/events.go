@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventRetryDelay is how long to wait before reconnecting to the event
+// stream after it drops, unless the server specifies otherwise.
+var EventRetryDelay = 10 * time.Second
+
+// EventIdleTimeout is how long the event stream may be silent before it is
+// considered dead. The server sends a keep-alive more often than this.
+var EventIdleTimeout = 90 * time.Second
+
+// eventsURL returns the URL of the stream of events announcing changes to
+// the account database, or an empty string if there is none. Unless
+// EventsURL is configured, the web server's stream is used, next to the
+// first of URL and URLs that is the web server's /users.pem.
+func (config *Config) eventsURL() string {
+	switch {
+	case config.EventsURL == "none":
+		return ""
+	case config.EventsURL != "":
+		return config.EventsURL
+	}
+	for _, u := range append([]string{config.URL}, config.URLs...) {
+		if (strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) &&
+			strings.HasSuffix(u, "/users.pem") {
+			return u + "/events"
+		}
+	}
+	return ""
+}
+
+// eventWatcher subscribes to the stream of server-sent events published by
+// the web server and signals Changed for each announced version.
+type eventWatcher struct {
+	Client  *http.Client
+	URL     string
+	Changed chan struct{}
+
+	lastID     string
+	retryDelay time.Duration
+}
+
+func newEventWatcher(client *http.Client, url string) *eventWatcher {
+	return &eventWatcher{
+		Client:     client,
+		URL:        url,
+		Changed:    make(chan struct{}, 1),
+		retryDelay: EventRetryDelay,
+	}
+}
+
+// signal notifies Changed without blocking. Several changes that arrive
+// while a sync is running only cause one more sync.
+func (ew *eventWatcher) signal() {
+	select {
+	case ew.Changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run reads the event stream until stop is closed, reconnecting whenever
+// the stream drops.
+func (ew *eventWatcher) Run(stop <-chan struct{}) {
+	for {
+		if err := ew.watch(stop); err != nil {
+			fmt.Fprintf(os.Stderr, "watching %s: %s\n", ew.URL, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(ew.retryDelay):
+		}
+	}
+}
+
+// watch reads the event stream until it drops or stop is closed.
+func (ew *eventWatcher) watch(stop <-chan struct{}) error {
+	req, err := http.NewRequest("GET", ew.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if ew.lastID != "" {
+		req.Header.Set("Last-Event-ID", ew.lastID)
+	}
+	resp, err := ew.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	// Closing the body interrupts the read below, both when stopping and
+	// when the stream has been idle for too long.
+	var closeOnce sync.Once
+	closeBody := func() { closeOnce.Do(func() { resp.Body.Close() }) }
+	idle := time.AfterFunc(EventIdleTimeout, closeBody)
+	defer idle.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			closeBody()
+		case <-done:
+		}
+	}()
+
+	eventType, id := "", ""
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return fmt.Errorf("stream closed: %s", err)
+		}
+		idle.Reset(EventIdleTimeout)
+
+		line = strings.TrimRight(line, "\r\n")
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "":
+			// a blank line dispatches the event, a comment is ignored
+			if line == "" && id != "" && (eventType == "" || eventType == "etag") && id != ew.lastID {
+				ew.lastID = id
+				ew.signal()
+			}
+			if line == "" {
+				eventType, id = "", ""
+			}
+		case "event":
+			eventType = value
+		case "id":
+			id = value
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				ew.retryDelay = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
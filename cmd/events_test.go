@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestEvents struct {
+	tempDir  string
+	AdminKey usermgr.AdminKey
+
+	mu          sync.Mutex
+	Data        []byte
+	Events      chan string
+	LastEventID []string
+}
+
+var _ = Suite(&TestEvents{})
+
+func (s *TestEvents) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.AdminKey.UnmarshalText([]byte(testAdminKey))
+	s.Events = make(chan string, 10)
+	s.LastEventID = nil
+}
+
+func (s *TestEvents) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+// ServeHTTP serves users.pem and a stream of the events sent to s.Events.
+// Sending an empty event drops the stream.
+func (s *TestEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/users.pem" {
+		w.Write(s.Data)
+		return
+	}
+	s.LastEventID = append(s.LastEventID, r.Header.Get("Last-Event-ID"))
+	s.mu.Unlock()
+	defer s.mu.Lock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprintf(w, "retry: 10\n\n")
+	w.(http.Flusher).Flush()
+	for event := range s.Events {
+		if event == "" {
+			return
+		}
+		fmt.Fprintf(w, "%s\n\n", event)
+		w.(http.Flusher).Flush()
+	}
+}
+
+func (s *TestEvents) publish(c *C, serial uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usersData := usermgr.UsersData{Serial: serial, Users: []usermgr.User{{Name: "alice"}}}
+	var err error
+	s.Data, err = usersData.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestEvents) TestEventsURL(c *C) {
+	config := Config{URL: "https://users.example.com/users.pem"}
+	c.Assert(config.eventsURL(), Equals, "https://users.example.com/users.pem/events")
+	config.EventsURL = "https://events.example.com/"
+	c.Assert(config.eventsURL(), Equals, "https://events.example.com/")
+	config.EventsURL = "none"
+	c.Assert(config.eventsURL(), Equals, "")
+	config = Config{URL: "s3://example/users.pem"}
+	c.Assert(config.eventsURL(), Equals, "")
+	config = Config{URL: "https://cdn.example.com/users"}
+	c.Assert(config.eventsURL(), Equals, "")
+
+	// the web server may be one of the mirrors
+	config = Config{URL: "s3://example/users.pem", URLs: []string{
+		"file:///mnt/users.pem", "https://users.example.com/users.pem", "https://backup.example.com/users.pem"}}
+	c.Assert(config.eventsURL(), Equals, "https://users.example.com/users.pem/events")
+}
+
+func (s *TestEvents) TestWatcher(c *C) {
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer close(s.Events)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	watcher := newEventWatcher(http.DefaultClient, server.URL+"/users.pem/events")
+	go watcher.Run(stop)
+	changed := func() bool {
+		select {
+		case <-watcher.Changed:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	s.Events <- "event: etag\nid: \"abc\"\ndata: \"abc\""
+	c.Assert(changed(), Equals, true)
+	s.Events <- ": keep-alive"
+	s.Events <- "event: etag\nid: \"abc\"\ndata: \"abc\""
+	s.Events <- "event: other\nid: \"def\"\ndata: \"def\""
+	c.Assert(changed(), Equals, false)
+
+	// the watcher reconnects, resuming from the last event
+	s.Events <- ""
+	s.Events <- "event: etag\nid: \"ghi\"\ndata: \"ghi\""
+	c.Assert(changed(), Equals, true)
+	s.mu.Lock()
+	c.Assert(s.LastEventID, DeepEquals, []string{"", "\"abc\""})
+	s.mu.Unlock()
+}
+
+func (s *TestEvents) TestIdleTimeout(c *C) {
+	defer func(idleTimeout time.Duration) { EventIdleTimeout = idleTimeout }(EventIdleTimeout)
+	EventIdleTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(s)
+	defer server.Close()
+	defer close(s.Events)
+
+	watcher := newEventWatcher(http.DefaultClient, server.URL+"/users.pem/events")
+	err := watcher.watch(make(chan struct{}))
+	c.Assert(err, ErrorMatches, "stream closed: .*")
+}
+
+func (s *TestEvents) TestDaemon(c *C) {
+	defer func(interval time.Duration) { SyncInterval = interval }(SyncInterval)
+	SyncInterval = time.Hour
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	config := &Config{
+		URL:         server.URL + "/users.pem",
+		CacheDir:    s.tempDir,
+		HostKey:     s.AdminKey.HostKey,
+		LoginGroups: []string{"users"},
+		SudoGroups:  []string{"wheel"},
+	}
+	localCache := config.LocalCache()
+	waitForSerial := func(serial uint64) bool {
+		for i := 0; i < 100; i++ {
+			if cached, _ := localCache.Serial(); cached == serial {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	s.publish(c, 1)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- SyncDaemon(config, true, ioutil.Discard, stop) }()
+	c.Assert(waitForSerial(1), Equals, true)
+
+	// a new version is fetched as soon as it is announced
+	s.publish(c, 2)
+	s.Events <- "event: etag\nid: \"2\"\ndata: \"2\""
+	c.Assert(waitForSerial(2), Equals, true)
+
+	close(stop)
+	close(s.Events)
+	c.Assert(<-done, IsNil)
+	_, err := os.Stat(filepath.Join(s.tempDir, "users.pem"))
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
+)
+
+var inspectFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "host-key",
+		Value:  "",
+		Usage:  "The host key used to read the file (Default: the host key from the configuration file)",
+		EnvVar: "UM_HOST_KEY",
+	},
+	adminKeyFlag,
+	adminKeyFileFlag,
+	passphraseFileFlag,
+}
+
+var inspectCommand = cli.Command{
+	Name:   "inspect",
+	Usage:  "Describe a signed account database and report problems: inspect FILE",
+	Action: WithError(InspectCommand),
+	Flags:  inspectFlags,
+}
+
+var verifyCommand = cli.Command{
+	Name:   "verify",
+	Usage:  "Report problems with a signed account database: verify FILE",
+	Action: WithError(VerifyCommand),
+	Flags:  inspectFlags,
+}
+
+// readKeyFromContext returns the key specified on the command line for
+// reading an account database. If an admin key is specified it is returned,
+// otherwise the host key, which defaults to the one from the configuration
+// file, is returned.
+func readKeyFromContext(ctx *cli.Context) (*usermgr.AdminKey, usermgr.HostKey, error) {
+	if ctx.String("admin-key") != "" || ctx.String("admin-key-file") != "" {
+		adminKey, err := adminKeyFromContext(ctx)
+		if err != nil {
+			return nil, usermgr.HostKey{}, err
+		}
+		return &adminKey, adminKey.HostKey, nil
+	}
+
+	hostKey := usermgr.HostKey{}
+	if ctx.String("host-key") != "" {
+		if err := hostKey.UnmarshalText([]byte(ctx.String("host-key"))); err != nil {
+			return nil, hostKey, fmt.Errorf("cannot parse host key: %s", err)
+		}
+		return nil, hostKey, nil
+	}
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		return nil, hostKey, fmt.Errorf("specify --host-key or --admin-key, or a configuration file: %s", err)
+	}
+	return nil, config.HostKey, nil
+}
+
+// inspectFile reads the file named on the command line with the key
+// specified on the command line and returns a report describing it.
+func inspectFile(ctx *cli.Context, commandName string) (*usermgr.Report, error) {
+	if len(ctx.Args()) != 1 {
+		return nil, fmt.Errorf("usage: usermgr %s FILE", commandName)
+	}
+	buf, err := ioutil.ReadFile(ctx.Args()[0])
+	if err != nil {
+		return nil, err
+	}
+
+	adminKey, hostKey, err := readKeyFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if adminKey != nil {
+		return usermgr.InspectAsAdmin(buf, *adminKey)
+	}
+	return usermgr.Inspect(buf, hostKey)
+}
+
+// problemsError returns an error if report has any warnings, so that the
+// command exits non-zero.
+func problemsError(report *usermgr.Report) error {
+	switch len(report.Warnings) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("1 problem found")
+	default:
+		return fmt.Errorf("%d problems found", len(report.Warnings))
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// InspectCommand implements the "inspect" command, which describes any
+// users.pem file, not only the one in the host's cache.
+func InspectCommand(ctx *cli.Context) error {
+	report, err := inspectFile(ctx, "inspect")
+	if err != nil {
+		return err
+	}
+
+	w := ctx.App.Writer
+	fmt.Fprintf(w, "version: %d\n", report.Version)
+	fmt.Fprintf(w, "serial: %d\n", report.Serial)
+	if report.IssueTime != nil {
+		fmt.Fprintf(w, "issued: %s\n", formatTime(report.IssueTime))
+	}
+	fmt.Fprintf(w, "expires: %s\n", formatTime(report.ExpireTime))
+	if report.SignedBy != nil {
+		fmt.Fprintf(w, "signed by: %s\n", report.SignedBy)
+	} else {
+		fmt.Fprintf(w, "signed by: not verified\n")
+	}
+	for _, approver := range report.Approvers {
+		fmt.Fprintf(w, "approved by: %s\n", approver)
+	}
+	for _, recipient := range report.Recipients {
+		fmt.Fprintf(w, "recipient: %s\n", recipient)
+	}
+	fmt.Fprintf(w, "users: %d\n", report.Users)
+	fmt.Fprintf(w, "groups: %d (%s)\n", len(report.Groups), strings.Join(report.Groups, ", "))
+	for _, horizon := range report.TOTPHorizons {
+		fmt.Fprintf(w, "totp codes: %s/%s until %s\n", horizon.User, horizon.Device,
+			formatTime(&horizon.Horizon))
+	}
+	users := []string{}
+	for user := range report.BackupCodes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		fmt.Fprintf(w, "backup codes: %s has %d\n", user, report.BackupCodes[user])
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	return problemsError(report)
+}
+
+// VerifyCommand implements the "verify" command, which is like "inspect"
+// but only prints problems. It is meant to be used to check a file before
+// publishing it.
+func VerifyCommand(ctx *cli.Context) error {
+	report, err := inspectFile(ctx, "verify")
+	if err != nil {
+		return err
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(ctx.App.Writer, "warning: %s\n", warning)
+	}
+	return problemsError(report)
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestInspectCommand struct {
+	tempDir  string
+	Output   *bytes.Buffer
+	AdminKey usermgr.AdminKey
+}
+
+var _ = Suite(&TestInspectCommand{})
+
+func (s *TestInspectCommand) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+	s.AdminKey.UnmarshalText([]byte(testAdminKey))
+}
+
+func (s *TestInspectCommand) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestInspectCommand) writeUsers(c *C, users ...usermgr.User) string {
+	ud := usermgr.UsersData{Users: users, Serial: 3}
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+	path := filepath.Join(s.tempDir, "users.pem")
+	ioutil.WriteFile(path, signedData, 0644)
+	return path
+}
+
+func (s *TestInspectCommand) TestInspect(c *C) {
+	path := s.writeUsers(c,
+		usermgr.User{Name: "alice", Groups: []string{"users"}},
+		usermgr.User{Name: "bob", Groups: []string{"users", "wheel"}})
+
+	err := Main([]string{"usermgr", "inspect", "--host-key", s.AdminKey.HostKey.String(), path}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, ""+
+		"version: 1\n"+
+		"serial: 3\n"+
+		"expires: never\n"+
+		"signed by: not verified\n"+
+		"users: 2\n"+
+		"groups: 2 (users, wheel)\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "verify", "--admin-key", testAdminKey, path}, s.Output)
+	c.Assert(err, IsNil)
+	c.Assert(s.Output.String(), Equals, "")
+}
+
+func (s *TestInspectCommand) TestVerifyFails(c *C) {
+	path := s.writeUsers(c, usermgr.User{Name: "alice"}, usermgr.User{Name: "alice"})
+
+	err := Main([]string{"usermgr", "verify", "--host-key", s.AdminKey.HostKey.String(), path}, s.Output)
+	c.Assert(err, ErrorMatches, "1 problem found")
+	c.Assert(s.Output.String(), Equals, "warning: user \"alice\" appears more than once\n")
+
+	otherKey := usermgr.GenerateKeyPair()
+	err = Main([]string{"usermgr", "verify", "--host-key", otherKey.HostKey.String(), path}, s.Output)
+	c.Assert(err, ErrorMatches, "user data is not signed")
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/codegangsta/cli"
 	"github.com/crewjam/usermgr"
@@ -11,11 +12,149 @@ var keygenCommand = cli.Command{
 	Name:   "keygen",
 	Usage:  "Generate a keypair",
 	Action: WithError(KeygenCommand),
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "admin-key-file",
+			Value: "",
+			Usage: "Write the admin key to this file, protected by a passphrase, instead of printing it",
+		},
+		passphraseFileFlag,
+	},
+	Subcommands: []cli.Command{
+		{
+			Name:   "rotate",
+			Usage:  "Generate a keypair to replace the current admin key",
+			Action: WithError(KeygenRotateCommand),
+			Flags: []cli.Flag{
+				adminKeyFlag,
+				adminKeyFileFlag,
+				passphraseFileFlag,
+				cli.StringFlag{
+					Name:  "next-admin-key-file",
+					Value: "",
+					Usage: "With --admin-key-file, write the new admin key to this file, protected by the same passphrase (Default: the admin key file with .next appended)",
+				},
+			},
+		},
+		{
+			Name:   "signing",
+			Usage:  "Generate a signing key for approving changes",
+			Action: WithError(KeygenSigningCommand),
+		},
+	},
 }
 
+// KeygenCommand implements the "keygen" command which generates a new key
+// pair. With --admin-key-file the admin key is written to a file encrypted
+// under a passphrase rather than printed, so that it does not end up in
+// terminal scrollback or process listings when it is used.
 func KeygenCommand(ctx *cli.Context) error {
 	adminKey := usermgr.GenerateKeyPair()
+	if path := ctx.String("admin-key-file"); path != "" {
+		passphrase, err := readPassphrase(ctx, true)
+		if err != nil {
+			return err
+		}
+		if err := writeAdminKeyFile(path, adminKey, passphrase); err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.App.Writer, "admin key file: %s\n", path)
+		fmt.Fprintf(ctx.App.Writer, "host key: %s\n", adminKey.HostKey)
+		return nil
+	}
+
 	fmt.Fprintf(ctx.App.Writer, "admin key: %s\n", adminKey)
 	fmt.Fprintf(ctx.App.Writer, "host key: %s\n", adminKey.HostKey)
 	return nil
 }
+
+// writeAdminKeyFile writes adminKey, encrypted under passphrase, to a new
+// file at path that only its owner can read.
+func writeAdminKeyFile(path string, adminKey usermgr.AdminKey, passphrase []byte) error {
+	buf, err := usermgr.EncryptAdminKey(adminKey, passphrase)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// KeygenRotateCommand implements the "keygen rotate" subcommand which
+// generates a key pair to replace the current admin key and explains how
+// to roll it out without touching the configuration of every host.
+//
+// Rotation happens in two phases. First the web interface is run with
+// the new key as the next admin key, which causes every version of the
+// account database to announce the new key. Hosts remember the announced
+// key when they sync. Once all the hosts have synced, the web interface is
+// run with the new key as the admin key and the old key as a previous admin
+// key. The next time the database is signed, hosts switch to the new key and
+// stop trusting the old one.
+//
+// If the current key is in a file, the new key is written to a file
+// protected by the same passphrase, and neither key is printed.
+func KeygenRotateCommand(ctx *cli.Context) error {
+	keys := &keyFileReader{ctx: ctx}
+	currentAdminKey, err := keys.adminKey()
+	if err != nil {
+		return err
+	}
+
+	nextAdminKey := usermgr.GenerateKeyPair()
+	if currentPath := ctx.String("admin-key-file"); currentPath != "" {
+		nextPath := ctx.String("next-admin-key-file")
+		if nextPath == "" {
+			nextPath = currentPath + ".next"
+		}
+		if err := writeAdminKeyFile(nextPath, nextAdminKey, keys.passphrase); err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.App.Writer, "admin key file: %s\n", nextPath)
+		fmt.Fprintf(ctx.App.Writer, "host key: %s\n", nextAdminKey.HostKey)
+		fmt.Fprintf(ctx.App.Writer, "\n"+
+			"1. Announce the new key to hosts by running the web interface with:\n"+
+			"\n"+
+			"     UM_ADMIN_KEY_FILE=%s\n"+
+			"     UM_NEXT_ADMIN_KEY_FILE=%s\n"+
+			"\n"+
+			"2. After every host has synced, switch to the new key by running the web interface with:\n"+
+			"\n"+
+			"     UM_ADMIN_KEY_FILE=%s\n"+
+			"     UM_PREVIOUS_ADMIN_KEY_FILE=%s\n",
+			currentPath, nextPath, nextPath, currentPath)
+		return nil
+	}
+
+	fmt.Fprintf(ctx.App.Writer, "admin key: %s\n", nextAdminKey)
+	fmt.Fprintf(ctx.App.Writer, "host key: %s\n", nextAdminKey.HostKey)
+	fmt.Fprintf(ctx.App.Writer, "\n"+
+		"1. Announce the new key to hosts by running the web interface with:\n"+
+		"\n"+
+		"     UM_ADMIN_KEY=%s\n"+
+		"     UM_NEXT_ADMIN_KEY=%s\n"+
+		"\n"+
+		"2. After every host has synced, switch to the new key by running the web interface with:\n"+
+		"\n"+
+		"     UM_ADMIN_KEY=%s\n"+
+		"     UM_PREVIOUS_ADMIN_KEY=%s\n",
+		currentAdminKey, nextAdminKey, nextAdminKey, currentAdminKey)
+	return nil
+}
+
+// KeygenSigningCommand implements the "keygen signing" subcommand which
+// generates the signing key an administrator uses to approve changes (see
+// "usermgr admin sign"). The public key goes in AdminSigningKeys in the
+// host configuration.
+func KeygenSigningCommand(ctx *cli.Context) error {
+	signingKey := usermgr.GenerateSigningKey()
+	fmt.Fprintf(ctx.App.Writer, "signing key: %s\n", signingKey)
+	fmt.Fprintf(ctx.App.Writer, "public key: %s\n", signingKey.PublicKey)
+	return nil
+}
@@ -2,9 +2,13 @@ package cmd
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/crewjam/usermgr"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -31,3 +35,83 @@ func (s *TestKeygenCommand) TestCanPrintUser(c *C) {
 	c.Assert(lines[0], Matches, "admin key: [A-Za-z0-9_\\-]+")
 	c.Assert(lines[1], Matches, "host key: [A-Za-z0-9_\\-]+")
 }
+
+func (s *TestKeygenCommand) TestCanRotate(c *C) {
+	err := Main([]string{"usermgr", "keygen", "rotate", "--admin-key",
+		"m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"}, s.Output)
+	c.Assert(err, IsNil)
+
+	lines := strings.Split(string(s.Output.Bytes()), "\n")
+	c.Assert(lines[0], Matches, "admin key: [A-Za-z0-9_\\-]+")
+	c.Assert(lines[1], Matches, "host key: [A-Za-z0-9_\\-]+")
+	c.Assert(lines[6], Equals, "     UM_NEXT_ADMIN_KEY="+strings.TrimPrefix(lines[0], "admin key: "))
+	c.Assert(lines[11], Equals, "     UM_PREVIOUS_ADMIN_KEY=m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw")
+}
+
+func (s *TestKeygenCommand) TestRotateRequiresKey(c *C) {
+	err := Main([]string{"usermgr", "keygen", "rotate", "--admin-key", "xxx"}, s.Output)
+	c.Assert(err, ErrorMatches, "cannot parse key: incorrect key format")
+}
+
+func (s *TestKeygenCommand) TestCanGenerateSigningKey(c *C) {
+	err := Main([]string{"usermgr", "keygen", "signing"}, s.Output)
+	c.Assert(err, IsNil)
+
+	lines := strings.Split(string(s.Output.Bytes()), "\n")
+	c.Assert(lines[0], Matches, "signing key: [A-Za-z0-9_\\-]{86}")
+	c.Assert(lines[1], Matches, "public key: [A-Za-z0-9_\\-]{43}")
+}
+
+func (s *TestKeygenCommand) TestCanWriteAdminKeyFile(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	keyPath := filepath.Join(s.tempDir, "admin.key")
+	passphrasePath := filepath.Join(s.tempDir, "passphrase")
+	ioutil.WriteFile(passphrasePath, []byte("hunter2\n"), 0600)
+
+	err := Main([]string{"usermgr", "keygen", "--admin-key-file", keyPath,
+		"--passphrase-file", passphrasePath}, s.Output)
+	c.Assert(err, IsNil)
+	lines := strings.Split(string(s.Output.Bytes()), "\n")
+	c.Assert(lines[0], Equals, "admin key file: "+keyPath)
+	c.Assert(lines[1], Matches, "host key: [A-Za-z0-9_\\-]+")
+	st, err := os.Stat(keyPath)
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// the file is not overwritten
+	err = Main([]string{"usermgr", "keygen", "--admin-key-file", keyPath,
+		"--passphrase-file", passphrasePath}, s.Output)
+	c.Assert(err, ErrorMatches, ".*file exists")
+
+	// the file can be used wherever an admin key is needed
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "keygen", "rotate", "--admin-key-file", keyPath,
+		"--passphrase-file", passphrasePath}, s.Output)
+	c.Assert(err, IsNil)
+	lines = strings.Split(s.Output.String(), "\n")
+	c.Assert(lines[0], Equals, "admin key file: "+keyPath+".next")
+	c.Assert(strings.Contains(s.Output.String(), "UM_PREVIOUS_ADMIN_KEY_FILE="+keyPath), Equals, true)
+	c.Assert(strings.Contains(s.Output.String(), "UM_PREVIOUS_ADMIN_KEY="), Equals, false)
+	st, err = os.Stat(keyPath + ".next")
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// the new key is protected by the same passphrase, and no key is printed
+	passphrase, _ := ioutil.ReadFile(passphrasePath)
+	buf, _ := ioutil.ReadFile(keyPath + ".next")
+	nextAdminKey, err := usermgr.DecryptAdminKey(buf, passphrase[:len(passphrase)-1])
+	c.Assert(err, IsNil)
+	nextAdminKeyText, _ := nextAdminKey.MarshalText()
+	c.Assert(strings.Contains(s.Output.String(), string(nextAdminKeyText)), Equals, false)
+	c.Assert(lines[1], Equals, "host key: "+nextAdminKey.HostKey.String())
+
+	// an existing next key file is not overwritten
+	err = Main([]string{"usermgr", "keygen", "rotate", "--admin-key-file", keyPath,
+		"--passphrase-file", passphrasePath}, s.Output)
+	c.Assert(err, ErrorMatches, ".*file exists")
+
+	ioutil.WriteFile(passphrasePath, []byte("hunter3\n"), 0600)
+	err = Main([]string{"usermgr", "keygen", "rotate", "--admin-key-file", keyPath,
+		"--passphrase-file", passphrasePath}, s.Output)
+	c.Assert(err, ErrorMatches, "cannot read .*: cannot decrypt admin key. Wrong passphrase\\?")
+}
@@ -1,7 +1,14 @@
 package cmd
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
 
 	"github.com/codegangsta/cli"
 	"github.com/crewjam/usermgr"
@@ -11,6 +18,128 @@ var listCommand = cli.Command{
 	Name:   "list",
 	Usage:  "List all user accounts",
 	Action: WithError(ListCommand),
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "group",
+			Usage: "Only list members of this group. Specify multiple times to list members of any of the groups.",
+		},
+		cli.BoolFlag{
+			Name:  "has-mfa",
+			Usage: "Only list users with at least one MFA device",
+		},
+		cli.BoolFlag{
+			Name:  "login-enabled-here",
+			Usage: "Only list users who can log in to this host",
+		},
+		cli.BoolFlag{
+			Name:  "sudo-here",
+			Usage: "Only list users who can sudo to root on this host",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "",
+			Usage: "The output format: table, json, csv or a Go template such as '{{.Name}} {{.Email}}' (Default: one name per line)",
+		},
+	},
+}
+
+// listEntry describes a user as printed by the "list" command. It is also
+// the value that templates are executed with.
+type listEntry struct {
+	Name         string   `json:"name"`
+	RealName     string   `json:"real_name,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	Groups       []string `json:"groups"`
+	Keys         int      `json:"keys"`
+	MFADevices   []string `json:"mfa_devices"`
+	BackupCodes  int      `json:"backup_codes"`
+	LoginEnabled bool     `json:"login_enabled"`
+	Sudo         bool     `json:"sudo"`
+}
+
+func newListEntry(config *Config, user usermgr.User) listEntry {
+	groups := user.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	loginEnabled := user.InAnyGroup(config.LoginGroups)
+	return listEntry{
+		Name:         user.Name,
+		RealName:     user.RealName,
+		Email:        user.Email,
+		Groups:       groups,
+		Keys:         len(user.AuthorizedKeys),
+		MFADevices:   user.MFADevices(),
+		BackupCodes:  len(user.BackupCodes),
+		LoginEnabled: loginEnabled,
+
+		// sudoers only grants root to users who can log in, see SyncSudoers
+		Sudo: loginEnabled && user.InAnyGroup(config.SudoGroups),
+	}
+}
+
+// listFilter returns true if entry matches the filters specified on the
+// command line.
+func listFilter(ctx *cli.Context, user usermgr.User, entry listEntry) bool {
+	if groups := ctx.StringSlice("group"); len(groups) > 0 && !user.InAnyGroup(groups) {
+		return false
+	}
+	if ctx.Bool("has-mfa") && len(entry.MFADevices) == 0 {
+		return false
+	}
+	if ctx.Bool("login-enabled-here") && !entry.LoginEnabled {
+		return false
+	}
+	if ctx.Bool("sudo-here") && !entry.Sudo {
+		return false
+	}
+	return true
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func writeListTable(w io.Writer, entries []listEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tREAL NAME\tGROUPS\tKEYS\tMFA\tLOGIN\tSUDO\n")
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", entry.Name, entry.RealName,
+			strings.Join(entry.Groups, ","), entry.Keys, strings.Join(entry.MFADevices, ","),
+			formatYesNo(entry.LoginEnabled), formatYesNo(entry.Sudo))
+	}
+	return tw.Flush()
+}
+
+func writeListCSV(w io.Writer, entries []listEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "real_name", "email", "groups", "keys", "mfa_devices",
+		"backup_codes", "login_enabled", "sudo"})
+	for _, entry := range entries {
+		cw.Write([]string{entry.Name, entry.RealName, entry.Email,
+			strings.Join(entry.Groups, " "), strconv.Itoa(entry.Keys),
+			strings.Join(entry.MFADevices, " "), strconv.Itoa(entry.BackupCodes),
+			strconv.FormatBool(entry.LoginEnabled), strconv.FormatBool(entry.Sudo)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeListTemplate(w io.Writer, format string, entries []listEntry) error {
+	tmpl, err := template.New("list").Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid format: %s", err)
+	}
+	for _, entry := range entries {
+		if err := tmpl.Execute(w, entry); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return nil
 }
 
 func ListCommand(ctx *cli.Context) error {
@@ -19,13 +148,40 @@ func ListCommand(ctx *cli.Context) error {
 		return err
 	}
 
-	userData, err := usermgr.GetLocalCache(config.CacheDir, config.HostKey)
+	userData, err := config.LocalCache().Get()
 	if err != nil {
 		return err
 	}
 
+	entries := []listEntry{}
 	for _, user := range userData.Users {
-		fmt.Fprintf(ctx.App.Writer, "%s\n", user.Name)
+		entry := newListEntry(config, user)
+		if listFilter(ctx, user, entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	w := ctx.App.Writer
+	switch format := ctx.String("format"); {
+	case format == "":
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\n", entry.Name)
+		}
+		return nil
+	case format == "table":
+		return writeListTable(w, entries)
+	case format == "json":
+		buf, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", buf)
+		return nil
+	case format == "csv":
+		return writeListCSV(w, entries)
+	case strings.Contains(format, "{{"):
+		return writeListTemplate(w, format, entries)
+	default:
+		return fmt.Errorf("unknown format: %s", format)
 	}
-	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/crewjam/usermgr"
 	. "gopkg.in/check.v1"
 )
 
@@ -71,3 +72,112 @@ func (s *TestList) TestBadConfig(c *C) {
 	c.Assert(err, ErrorMatches, ".*: no such file or directory")
 	c.Assert(string(s.Output.Bytes()), Equals, "")
 }
+
+type TestListFormats struct {
+	tempDir    string
+	configPath string
+	Output     *bytes.Buffer
+}
+
+var _ = Suite(&TestListFormats{})
+
+func (s *TestListFormats) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+
+	adminKey := usermgr.AdminKey{}
+	adminKey.UnmarshalText([]byte(testAdminKey))
+	usersData := usermgr.UsersData{Users: []usermgr.User{
+		{
+			Name:           "alice",
+			RealName:       "Alice Smith",
+			Email:          "alice@example.com",
+			Groups:         []string{"users", "wheel"},
+			AuthorizedKeys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO4VcGDGQfFyCEbooEqnQSqzlcJa5tvjND4j243jpBd5 alice@laptop"},
+			TOTPDevices:    []usermgr.TOTPDevice{{Name: "phone"}},
+		},
+		{
+			Name:   "bob",
+			Groups: []string{"users"},
+		},
+		{
+			Name:     "carol",
+			RealName: "Carol, Contractor",
+			Groups:   []string{"contractors", "wheel"},
+			Yubikeys: []usermgr.YubikeyDevice{{DeviceID: "cccccc"}},
+		},
+	}}
+	signedData, err := usersData.SignedString(adminKey)
+	c.Assert(err, IsNil)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+
+	s.configPath = filepath.Join(s.tempDir, "usermgr.conf")
+	ioutil.WriteFile(s.configPath, []byte(""+
+		fmt.Sprintf("CacheDir = %q\n", s.tempDir)+
+		fmt.Sprintf("HostKey = %q\n", adminKey.HostKey.String())), 0644)
+}
+
+func (s *TestListFormats) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestListFormats) list(c *C, args ...string) string {
+	s.Output.Reset()
+	err := Main(append([]string{"usermgr", "--config", s.configPath, "list"}, args...), s.Output)
+	c.Assert(err, IsNil)
+	return s.Output.String()
+}
+
+func (s *TestListFormats) TestFilters(c *C) {
+	c.Assert(s.list(c), Equals, "alice\nbob\ncarol\n")
+	c.Assert(s.list(c, "--group", "wheel"), Equals, "alice\ncarol\n")
+	c.Assert(s.list(c, "--group", "contractors", "--group", "nobody"), Equals, "carol\n")
+	c.Assert(s.list(c, "--has-mfa"), Equals, "alice\ncarol\n")
+	c.Assert(s.list(c, "--login-enabled-here"), Equals, "alice\nbob\n")
+	c.Assert(s.list(c, "--sudo-here"), Equals, "alice\n")
+	c.Assert(s.list(c, "--has-mfa", "--login-enabled-here"), Equals, "alice\n")
+}
+
+func (s *TestListFormats) TestFormats(c *C) {
+	c.Assert(s.list(c, "--format", "table", "--group", "wheel"), Equals, ""+
+		"NAME   REAL NAME          GROUPS             KEYS  MFA             LOGIN  SUDO\n"+
+		"alice  Alice Smith        users,wheel        1     totp:phone      yes    yes\n"+
+		"carol  Carol, Contractor  contractors,wheel  0     yubikey:cccccc  no     no\n")
+
+	c.Assert(s.list(c, "--format", "csv", "--group", "wheel"), Equals, ""+
+		"name,real_name,email,groups,keys,mfa_devices,backup_codes,login_enabled,sudo\n"+
+		"alice,Alice Smith,alice@example.com,users wheel,1,totp:phone,0,true,true\n"+
+		"carol,\"Carol, Contractor\",,contractors wheel,0,yubikey:cccccc,0,false,false\n")
+
+	c.Assert(s.list(c, "--format", "json", "--group", "users", "--has-mfa"), Equals, ""+
+		"[\n"+
+		"  {\n"+
+		"    \"name\": \"alice\",\n"+
+		"    \"real_name\": \"Alice Smith\",\n"+
+		"    \"email\": \"alice@example.com\",\n"+
+		"    \"groups\": [\n"+
+		"      \"users\",\n"+
+		"      \"wheel\"\n"+
+		"    ],\n"+
+		"    \"keys\": 1,\n"+
+		"    \"mfa_devices\": [\n"+
+		"      \"totp:phone\"\n"+
+		"    ],\n"+
+		"    \"backup_codes\": 0,\n"+
+		"    \"login_enabled\": true,\n"+
+		"    \"sudo\": true\n"+
+		"  }\n"+
+		"]\n")
+
+	c.Assert(s.list(c, "--format", "{{.Name}} <{{.Email}}> sudo={{.Sudo}}", "--login-enabled-here"), Equals, ""+
+		"alice <alice@example.com> sudo=true\n"+
+		"bob <> sudo=false\n")
+}
+
+func (s *TestListFormats) TestBadFormat(c *C) {
+	err := Main([]string{"usermgr", "--config", s.configPath, "list", "--format", "xml"}, s.Output)
+	c.Assert(err, ErrorMatches, "unknown format: xml")
+
+	err = Main([]string{"usermgr", "--config", s.configPath, "list", "--format", "{{.Name"}, s.Output)
+	c.Assert(err, ErrorMatches, "invalid format: .*")
+}
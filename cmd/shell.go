@@ -33,7 +33,7 @@ func ShellCommand(ctx *cli.Context) error {
 		return err
 	}
 
-	userData, err := usermgr.GetLocalCache(config.CacheDir, config.HostKey)
+	userData, err := config.LocalCache().Get()
 	if err != nil {
 		return err
 	}
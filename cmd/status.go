@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
+)
+
+var statusCommand = cli.Command{
+	Name:   "status",
+	Usage:  "Report the health of this host",
+	Action: WithError(StatusCommand),
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "The output format: text, json or nagios",
+		},
+		cli.DurationFlag{
+			Name:  "warning",
+			Value: 30 * time.Minute,
+			Usage: "Warn if the cache has not been updated for this long",
+		},
+		cli.DurationFlag{
+			Name:  "critical",
+			Value: 2 * time.Hour,
+			Usage: "Fail if the cache has not been updated for this long",
+		},
+		cli.DurationFlag{
+			Name:  "totp-warning",
+			Value: 72 * time.Hour,
+			Usage: "Warn if the TOTP codes of a local user run out within this long",
+		},
+	},
+}
+
+// statusLevel is the severity of a problem. The values are the exit codes
+// that Nagios expects from a check.
+type statusLevel int
+
+const (
+	statusOK statusLevel = iota
+	statusWarning
+	statusCritical
+	statusUnknown
+)
+
+func (l statusLevel) String() string {
+	switch l {
+	case statusOK:
+		return "OK"
+	case statusWarning:
+		return "WARNING"
+	case statusCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (l statusLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// statusError is returned by the "status" command when the host is not
+// healthy, so that the command exits with the Nagios exit code.
+type statusError struct {
+	Level statusLevel
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("status: %s", e.Level)
+}
+
+func (e statusError) ExitCode() int {
+	return int(e.Level)
+}
+
+// statusProblem is something wrong with the host.
+type statusProblem struct {
+	Level   statusLevel `json:"level"`
+	Message string      `json:"message"`
+}
+
+// totpExpiry is the time after which the codes of a TOTP device run out.
+type totpExpiry struct {
+	User   string    `json:"user"`
+	Device string    `json:"device"`
+	Time   time.Time `json:"time"`
+}
+
+// hostStatus describes the health of a host. The fields of checks that
+// could not be made are nil.
+type hostStatus struct {
+	Status          statusLevel            `json:"status"`
+	LastUpdate      *time.Time             `json:"last_update,omitempty"`
+	ETag            string                 `json:"etag,omitempty"`
+	Pinned          string                 `json:"pinned,omitempty"`
+	CacheAgeSeconds *int64                 `json:"cache_age_seconds,omitempty"`
+	Serial          *uint64                `json:"serial,omitempty"`
+	ExpireTime      *time.Time             `json:"expire_time,omitempty"`
+	TOTPExpiry      *totpExpiry            `json:"totp_expiry,omitempty"`
+	Mirrors         []usermgr.MirrorStatus `json:"mirrors,omitempty"`
+	SshdConfigured  *bool                  `json:"sshd_configured,omitempty"`
+	SudoersInSync   *bool                  `json:"sudoers_in_sync,omitempty"`
+	UsersMissing    []string               `json:"users_missing,omitempty"`
+	UsersExtra      []string               `json:"users_extra,omitempty"`
+	Problems        []statusProblem        `json:"problems,omitempty"`
+}
+
+// addProblem records a problem and raises the status to level.
+func (s *hostStatus) addProblem(level statusLevel, format string, args ...interface{}) {
+	s.Problems = append(s.Problems, statusProblem{Level: level, Message: fmt.Sprintf(format, args...)})
+	if level > s.Status {
+		s.Status = level
+	}
+}
+
+// getStatus checks the health of the host described by config.
+func getStatus(ctx *cli.Context, config *Config) *hostStatus {
+	status := &hostStatus{}
+	now := time.Now()
+
+	localCache := config.LocalCache()
+	info, err := localCache.Info()
+	if err != nil {
+		status.addProblem(statusUnknown, "cannot read cache: %s", err)
+		return status
+	}
+	status.LastUpdate = info.LastUpdate
+	status.ETag = info.ETag
+	status.Pinned = info.Pinned
+	if info.Pinned != "" {
+		status.addProblem(statusWarning, "the cache is pinned to %s", info.Pinned)
+	}
+	if info.FetchTime != nil {
+		cacheAge := int64(now.Sub(*info.FetchTime).Seconds())
+		status.CacheAgeSeconds = &cacheAge
+	}
+	if info.LastUpdate == nil {
+		status.addProblem(statusCritical, "the cache has never been updated")
+	} else {
+		sinceUpdate := now.Sub(*info.LastUpdate)
+		sinceUpdate -= sinceUpdate % time.Second
+		switch {
+		case sinceUpdate >= ctx.Duration("critical"):
+			status.addProblem(statusCritical, "the cache was last updated %s ago", sinceUpdate)
+		case sinceUpdate >= ctx.Duration("warning"):
+			status.addProblem(statusWarning, "the cache was last updated %s ago", sinceUpdate)
+		}
+	}
+
+	if mirrors, err := localCache.Mirrors(); err != nil {
+		status.addProblem(statusWarning, "cannot read the state of the mirrors: %s", err)
+	} else {
+		status.Mirrors = mirrors
+		for _, mirror := range mirrors {
+			if mirror.Failures > 0 {
+				status.addProblem(statusWarning, "mirror %s: %s", mirror.URL, mirror.LastError)
+			}
+		}
+	}
+
+	userData, err := localCache.Get()
+	if err != nil {
+		status.addProblem(statusCritical, "%s", err)
+		return status
+	}
+	for _, mirror := range status.Mirrors {
+		if mirror.Failures == 0 && mirror.LastSuccess != nil && mirror.Serial < userData.Serial {
+			status.addProblem(statusWarning, "mirror %s serves serial %d", mirror.URL, mirror.Serial)
+		}
+	}
+	status.Serial = &userData.Serial
+	status.ExpireTime = userData.ExpireTime
+	if userData.ExpireTime != nil && !now.Before(*userData.ExpireTime) {
+		status.addProblem(statusCritical, "the data expired at %s", formatTime(userData.ExpireTime))
+	}
+
+	for _, user := range userData.Users {
+		if !user.InAnyGroup(config.LoginGroups) {
+			continue
+		}
+		for _, device := range user.TOTPDevices {
+			horizon := device.Horizon()
+			if status.TOTPExpiry == nil || horizon.Before(status.TOTPExpiry.Time) {
+				status.TOTPExpiry = &totpExpiry{User: user.Name, Device: device.Name, Time: horizon}
+			}
+		}
+	}
+	if expiry := status.TOTPExpiry; expiry != nil {
+		if !now.Before(expiry.Time) {
+			status.addProblem(statusCritical, "TOTP device %q of user %q has no codes after %s",
+				expiry.Device, expiry.User, formatTime(&expiry.Time))
+		} else if expiry.Time.Sub(now) < ctx.Duration("totp-warning") {
+			status.addProblem(statusWarning, "TOTP device %q of user %q has no codes after %s",
+				expiry.Device, expiry.User, formatTime(&expiry.Time))
+		}
+	}
+
+	checkHost(config, userData, status)
+	return status
+}
+
+// StatusCommand implements the "status" command, which reports whether the
+// host is healthy. It exits with the Nagios exit code for the status in
+// every output format.
+func StatusCommand(ctx *cli.Context) error {
+	var status *hostStatus
+	config, err := LoadConfig(ctx.GlobalString("config"))
+	if err != nil {
+		status = &hostStatus{}
+		status.addProblem(statusUnknown, "cannot load configuration: %s", err)
+	} else {
+		status = getStatus(ctx, config)
+	}
+
+	switch ctx.String("format") {
+	case "text":
+		writeStatus(ctx.App.Writer, status)
+	case "json":
+		buf, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.App.Writer, "%s\n", buf)
+	case "nagios":
+		writeNagiosStatus(ctx.App.Writer, status)
+	default:
+		return fmt.Errorf("unknown format: %s", ctx.String("format"))
+	}
+
+	if status.Status != statusOK {
+		return statusError{Level: status.Status}
+	}
+	return nil
+}
+
+func formatBool(b *bool, yes, no string) string {
+	switch {
+	case b == nil:
+		return "not checked"
+	case *b:
+		return yes
+	default:
+		return no
+	}
+}
+
+func writeStatus(w io.Writer, status *hostStatus) {
+	fmt.Fprintf(w, "status: %s\n", status.Status)
+	fmt.Fprintf(w, "last update: %s\n", formatTime(status.LastUpdate))
+	if status.ETag != "" {
+		fmt.Fprintf(w, "etag: %s\n", status.ETag)
+	}
+	if status.Pinned != "" {
+		fmt.Fprintf(w, "pinned: %s\n", status.Pinned)
+	}
+	if status.CacheAgeSeconds != nil {
+		fmt.Fprintf(w, "cache age: %s\n", time.Duration(*status.CacheAgeSeconds)*time.Second)
+	}
+	if status.Serial != nil {
+		fmt.Fprintf(w, "serial: %d\n", *status.Serial)
+		fmt.Fprintf(w, "expires: %s\n", formatTime(status.ExpireTime))
+	}
+	for _, mirror := range status.Mirrors {
+		if mirror.Failures > 0 {
+			fmt.Fprintf(w, "mirror: %s failed %d times\n", mirror.URL, mirror.Failures)
+		} else {
+			fmt.Fprintf(w, "mirror: %s serial %d\n", mirror.URL, mirror.Serial)
+		}
+	}
+	if expiry := status.TOTPExpiry; expiry != nil {
+		fmt.Fprintf(w, "totp codes: %s/%s until %s\n", expiry.User, expiry.Device, formatTime(&expiry.Time))
+	}
+	fmt.Fprintf(w, "sshd: %s\n", formatBool(status.SshdConfigured, "configured", "not configured"))
+	fmt.Fprintf(w, "sudoers: %s\n", formatBool(status.SudoersInSync, "in sync", "out of sync"))
+	for _, name := range status.UsersMissing {
+		fmt.Fprintf(w, "passwd: %s missing\n", name)
+	}
+	for _, name := range status.UsersExtra {
+		fmt.Fprintf(w, "passwd: %s not in database\n", name)
+	}
+	for _, problem := range status.Problems {
+		fmt.Fprintf(w, "%s: %s\n", strings.ToLower(problem.Level.String()), problem.Message)
+	}
+}
+
+// writeNagiosStatus writes the status as the single line of output, with
+// performance data, that Nagios expects from a check.
+func writeNagiosStatus(w io.Writer, status *hostStatus) {
+	messages := []string{}
+	for _, problem := range status.Problems {
+		messages = append(messages, problem.Message)
+	}
+	if len(messages) == 0 && status.Serial != nil {
+		messages = append(messages, fmt.Sprintf("serial %d", *status.Serial))
+	}
+
+	perfData := []string{}
+	if status.CacheAgeSeconds != nil {
+		perfData = append(perfData, fmt.Sprintf("cache_age=%ds", *status.CacheAgeSeconds))
+	}
+	if status.Serial != nil {
+		perfData = append(perfData, fmt.Sprintf("serial=%d", *status.Serial))
+	}
+
+	fmt.Fprintf(w, "USERMGR %s - %s", status.Status, strings.Join(messages, "; "))
+	if len(perfData) > 0 {
+		fmt.Fprintf(w, " | %s", strings.Join(perfData, " "))
+	}
+	fmt.Fprintf(w, "\n")
+}
@@ -0,0 +1,10 @@
+package cmd
+
+import (
+	"github.com/crewjam/usermgr"
+)
+
+// checkHost does nothing because sync does not manage the local
+// configuration files on this platform.
+func checkHost(config *Config, userData *usermgr.UsersData, status *hostStatus) {
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"github.com/crewjam/usermgr"
+)
+
+// checkHost records in status whether the local configuration files agree
+// with userData.
+func checkHost(config *Config, userData *usermgr.UsersData, status *hostStatus) {
+	if configured, err := usermgr.AuthorizedKeysCommandConfigured(); err != nil {
+		status.addProblem(statusWarning, "cannot check sshd: %s", err)
+	} else {
+		status.SshdConfigured = &configured
+		if !configured {
+			status.addProblem(statusCritical, "sshd is not configured with usermgr as AuthorizedKeysCommand")
+		}
+	}
+
+	if inSync, err := usermgr.SudoersInSync(userData, config.LoginGroups, config.SudoGroups); err != nil {
+		status.addProblem(statusWarning, "cannot check sudoers: %s", err)
+	} else {
+		status.SudoersInSync = &inSync
+		if !inSync {
+			status.addProblem(statusWarning, "the sudoers file is out of sync")
+		}
+	}
+
+	missing, extra, err := usermgr.UsersDrift(userData, config.LoginGroups)
+	if err != nil {
+		status.addProblem(statusWarning, "cannot check passwd: %s", err)
+	}
+	status.UsersMissing, status.UsersExtra = missing, extra
+	if len(missing) > 0 || len(extra) > 0 {
+		status.addProblem(statusWarning, "passwd has %d missing and %d extra users", len(missing), len(extra))
+	}
+}
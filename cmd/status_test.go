@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/crewjam/usermgr"
+	. "gopkg.in/check.v1"
+)
+
+type TestStatus struct {
+	tempDir    string
+	configPath string
+	Output     *bytes.Buffer
+}
+
+var _ = Suite(&TestStatus{})
+
+func (s *TestStatus) SetUpTest(c *C) {
+	s.tempDir, _ = ioutil.TempDir("", "unittest")
+	s.Output = bytes.NewBuffer(nil)
+
+	adminKey := usermgr.AdminKey{}
+	adminKey.UnmarshalText([]byte(testAdminKey))
+	usersData := usermgr.UsersData{Serial: 7, Users: []usermgr.User{
+		{
+			Name:   "alice",
+			Groups: []string{"users"},
+			TOTPDevices: []usermgr.TOTPDevice{{
+				Name:  "phone",
+				Codes: []usermgr.TOTPCode{{Time: time.Now().Add(time.Hour)}},
+			}},
+		},
+	}}
+	signedData, err := usersData.SignedString(adminKey)
+	c.Assert(err, IsNil)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem.etag"), []byte("\"abc\""), 0644)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.updated"),
+		[]byte(time.Now().UTC().Format(time.RFC3339)), 0644)
+
+	s.configPath = filepath.Join(s.tempDir, "usermgr.conf")
+	ioutil.WriteFile(s.configPath, []byte(""+
+		fmt.Sprintf("CacheDir = %q\n", s.tempDir)+
+		fmt.Sprintf("HostKey = %q\n", adminKey.HostKey.String())), 0644)
+}
+
+func (s *TestStatus) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestStatus) TestText(c *C) {
+	err := Main([]string{"usermgr", "--config", s.configPath, "status"}, s.Output)
+	c.Assert(err, NotNil)
+	c.Assert(err.(statusError).ExitCode() >= 1, Equals, true)
+	c.Assert(s.Output.String(), Matches, "(?s)status: (WARNING|CRITICAL)\n"+
+		"last update: .*\n"+
+		"etag: \"abc\"\n"+
+		"cache age: .*\n"+
+		"serial: 7\n"+
+		"expires: never\n"+
+		"totp codes: alice/phone until .*\n"+
+		".*warning: TOTP device \"phone\" of user \"alice\" has no codes after .*")
+}
+
+func (s *TestStatus) TestJSON(c *C) {
+	Main([]string{"usermgr", "--config", s.configPath, "status", "--format", "json",
+		"--totp-warning", "0"}, s.Output)
+
+	status := struct {
+		ETag       string
+		Serial     uint64
+		TOTPExpiry struct {
+			User   string
+			Device string
+		} `json:"totp_expiry"`
+		Problems []struct {
+			Level   string
+			Message string
+		}
+	}{}
+	c.Assert(json.Unmarshal(s.Output.Bytes(), &status), IsNil)
+	c.Assert(status.ETag, Equals, "\"abc\"")
+	c.Assert(status.Serial, Equals, uint64(7))
+	c.Assert(status.TOTPExpiry.User, Equals, "alice")
+	c.Assert(status.TOTPExpiry.Device, Equals, "phone")
+	for _, problem := range status.Problems {
+		c.Assert(problem.Message, Not(Matches), "TOTP.*")
+	}
+}
+
+func (s *TestStatus) TestNagios(c *C) {
+	os.Remove(filepath.Join(s.tempDir, "users.updated"))
+	err := Main([]string{"usermgr", "--config", s.configPath, "status", "--format", "nagios"}, s.Output)
+	c.Assert(err, ErrorMatches, "status: CRITICAL")
+	c.Assert(err.(statusError).ExitCode(), Equals, 2)
+	c.Assert(s.Output.String(), Matches, "USERMGR CRITICAL - the cache has never been updated; .* \\| cache_age=[0-9]+s serial=7\n")
+
+	s.Output.Reset()
+	os.Remove(filepath.Join(s.tempDir, "users.pem"))
+	err = Main([]string{"usermgr", "--config", s.configPath, "status", "--format", "nagios"}, s.Output)
+	c.Assert(err.(statusError).ExitCode(), Equals, 2)
+	c.Assert(s.Output.String(), Equals, "USERMGR CRITICAL - the cache has never been updated; "+
+		"Cannot read users data: open "+filepath.Join(s.tempDir, "users.pem")+": no such file or directory\n")
+
+	s.Output.Reset()
+	err = Main([]string{"usermgr", "--config", filepath.Join(s.tempDir, "missing.conf"), "status", "--format", "nagios"}, s.Output)
+	c.Assert(err.(statusError).ExitCode(), Equals, 3)
+	c.Assert(s.Output.String(), Matches, "USERMGR UNKNOWN - cannot load configuration: .*\n")
+}
+
+func (s *TestStatus) TestStaleCache(c *C) {
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.updated"),
+		[]byte(time.Now().Add(-3*time.Hour).UTC().Format(time.RFC3339)), 0644)
+	err := Main([]string{"usermgr", "--config", s.configPath, "status"}, s.Output)
+	c.Assert(err, ErrorMatches, "status: CRITICAL")
+	c.Assert(s.Output.String(), Matches, "(?s).*critical: the cache was last updated 3h0m[0-9]+s ago\n.*")
+}
+
+func (s *TestStatus) TestUnknownFormat(c *C) {
+	err := Main([]string{"usermgr", "--config", s.configPath, "status", "--format", "xml"}, s.Output)
+	c.Assert(err, ErrorMatches, "unknown format: xml")
+}
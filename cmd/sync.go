@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/codegangsta/cli"
-	"github.com/crewjam/usermgr"
 )
 
 var SyncInterval = time.Minute * 9
@@ -20,15 +19,19 @@ var syncCommand = cli.Command{
 			Name:  "dry-run",
 			Usage: "don't actually change anything, just print what would be changed",
 		},
+		cli.BoolFlag{
+			Name:  "daemon",
+			Usage: "keep running, syncing periodically and whenever the web server announces a change",
+		},
 	},
 	Action: WithError(Sync),
 }
 
 func SyncOnce(config *Config, dryRun bool, stdout io.Writer) error {
-	usersData, err := usermgr.UpdateLocalCache(config.CacheDir, config.URL, config.HostKey)
+	usersData, err := config.LocalCache().Update(config.Mirrors()...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "updating user data: %s\n", err)
-		usersData, err = usermgr.GetLocalCache(config.CacheDir, config.HostKey)
+		usersData, err = config.LocalCache().Get()
 		if err != nil {
 			return err
 		}
@@ -37,11 +40,45 @@ func SyncOnce(config *Config, dryRun bool, stdout io.Writer) error {
 	return syncOnce(config, usersData, dryRun, stdout)
 }
 
+// SyncDaemon runs SyncOnce now, every SyncInterval, and as soon as the web
+// server announces a change (see eventWatcher), until stop is closed. While
+// the event stream is down the host keeps syncing every SyncInterval.
+func SyncDaemon(config *Config, dryRun bool, stdout io.Writer, stop <-chan struct{}) error {
+	var changed <-chan struct{}
+	if eventsURL := config.eventsURL(); eventsURL != "" {
+		client, err := config.HTTPOptions().Client()
+		if err != nil {
+			return err
+		}
+		// the stream stays open indefinitely, see EventIdleTimeout
+		client.Timeout = 0
+		watcher := newEventWatcher(client, eventsURL)
+		go watcher.Run(stop)
+		changed = watcher.Changed
+	}
+
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := SyncOnce(config, dryRun, stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "sync: %s\n", err)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
 func Sync(ctx *cli.Context) error {
 	config, err := LoadConfig(ctx.GlobalString("config"))
 	if err != nil {
 		return err
 	}
-	// TODO(ross): implement daemon mode
+	if ctx.Bool("daemon") {
+		return SyncDaemon(config, ctx.Bool("dry-run"), ctx.App.Writer, nil)
+	}
 	return SyncOnce(config, ctx.Bool("dry-run"), ctx.App.Writer)
 }
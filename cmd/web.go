@@ -1,15 +1,20 @@
 package cmd
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 
 	"github.com/codegangsta/cli"
+	"github.com/crewjam/usermgr"
 	"github.com/crewjam/usermgr/web"
 	"github.com/zenazn/goji/web/middleware"
 )
@@ -25,12 +30,38 @@ var webCommand = cli.Command{
 			Usage:  "Address to bind on.",
 			EnvVar: "UM_BIND",
 		},
+		adminKeyFlag,
+		adminKeyFileFlag,
+		passphraseFileFlag,
 		cli.StringFlag{
-			Name:   "admin-key",
+			Name:   "next-admin-key",
 			Value:  "",
-			Usage:  "The admin key",
-			EnvVar: "UM_ADMIN_KEY",
+			Usage:  "The admin key that will replace the admin key (see: usermgr keygen rotate)",
+			EnvVar: "UM_NEXT_ADMIN_KEY",
 		},
+		cli.StringFlag{
+			Name:   "next-admin-key-file",
+			Value:  "",
+			Usage:  "The path to the next admin key, protected by the same passphrase as the admin key file",
+			EnvVar: "UM_NEXT_ADMIN_KEY_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "previous-admin-key",
+			Usage:  "An admin key that was replaced by the admin key. Specify multiple times for multiple keys.",
+			EnvVar: "UM_PREVIOUS_ADMIN_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "previous-admin-key-file",
+			Usage:  "The path to a previous admin key, protected by the same passphrase as the admin key file. Specify multiple times for multiple keys.",
+			EnvVar: "UM_PREVIOUS_ADMIN_KEY_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "lifetime",
+			Usage:  "How long hosts trust each version of the data. If zero, the data never expire.",
+			EnvVar: "UM_LIFETIME",
+		},
+		signerFlag,
+		thresholdFlag,
 		cli.StringFlag{
 			Name:   "store",
 			Value:  "",
@@ -52,29 +83,211 @@ var webCommand = cli.Command{
 		cli.StringFlag{
 			Name:   "token-key",
 			Value:  "",
-			Usage:  "the key used to sign auth tokens. should be random and secret",
+			Usage:  "the key used to sign auth tokens. should be random and secret. Required for oauth and oidc auth",
 			EnvVar: "UM_TOKEN_KEY",
 		},
 	},
 }
 
-func WebCommand(ctx *cli.Context) error {
-	config := web.Config{}
+// requireSQLDriver returns an error if the SQL driver name was left out of
+// this build of usermgr, because it is only built in with the build tag.
+func requireSQLDriver(name, tag string) error {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("this usermgr was built without the %s driver; build it with `go build -tags %s`", name, tag)
+}
 
-	if err := config.AdminKey.UnmarshalText([]byte(ctx.String("admin-key"))); err != nil {
-		return fmt.Errorf("cannot parse key: %s", err)
+// storeHistorySize returns the number of versions to keep given by the
+// history parameter of the store URL u, or 0 if it has none. The parameter
+// is removed from u, so that the rest can be passed on to a database driver.
+func storeHistorySize(u *url.URL) (int, error) {
+	query := u.Query()
+	history := query.Get("history")
+	if history == "" {
+		return 0, nil
+	}
+	query.Del("history")
+	u.RawQuery = query.Encode()
+	historySize, err := strconv.Atoi(history)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse history in store URL: %s", err)
 	}
+	return historySize, nil
+}
 
-	storeURL, err := url.Parse(ctx.String("store"))
+// openStorage returns the storage service described by storeURL.
+func openStorage(storeURL string) (web.Storage, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse store URL: %s", err)
+	}
+	historySize, err := storeHistorySize(u)
 	if err != nil {
-		return fmt.Errorf("cannot parse store URL: %s", err)
+		return nil, err
 	}
-	switch storeURL.Scheme {
+	switch u.Scheme {
 	case "file":
-		config.Storage = web.FileStorage{Path: storeURL.Path}
+		return web.FileStorage{Path: u.Path, HistorySize: historySize}, nil
+	case "git", "gitdir":
+		return &web.GitStorage{Path: u.Path, Remote: u.Query().Get("remote"), HistorySize: historySize}, nil
+	case "bolt":
+		kv, err := web.OpenBoltKV(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open store: %s", err)
+		}
+		return &web.KVStorage{KV: kv, HistorySize: historySize}, nil
+	case "sqlite", "sqlite3":
+		if err := requireSQLDriver("sqlite3", "sqlite"); err != nil {
+			return nil, err
+		}
+		db, err := sql.Open("sqlite3", "file:"+u.Path+"?_txlock=immediate&_busy_timeout=10000")
+		if err != nil {
+			return nil, err
+		}
+		storage, err := web.NewSQLStorage(db, "sqlite3")
+		if err != nil {
+			return nil, fmt.Errorf("cannot open store: %s", err)
+		}
+		storage.HistorySize = historySize
+		return storage, nil
+	case "postgres", "postgresql":
+		if err := requireSQLDriver("postgres", "postgres"); err != nil {
+			return nil, err
+		}
+		db, err := sql.Open("postgres", u.String())
+		if err != nil {
+			return nil, err
+		}
+		storage, err := web.NewSQLStorage(db, "postgres")
+		if err != nil {
+			return nil, fmt.Errorf("cannot open store: %s", err)
+		}
+		storage.HistorySize = historySize
+		return storage, nil
 	default:
-		return fmt.Errorf("unknown scheme in store URL: %s", storeURL.String())
+		return nil, fmt.Errorf("unknown scheme in store URL: %s", u.String())
 	}
+}
+
+// newHeaderAuth returns the header authentication described by authURL,
+// for example header://?name=X-Remote-User&trusted_proxies=10.0.0.0/8.
+func newHeaderAuth(authURL *url.URL) (web.HeaderAuth, error) {
+	query := authURL.Query()
+	headerAuth := web.HeaderAuth{
+		Header:       query.Get("name"),
+		EmailHeader:  query.Get("email"),
+		GroupsHeader: query.Get("groups"),
+	}
+	for _, value := range query["trusted_proxies"] {
+		for _, proxy := range strings.Split(value, ",") {
+			if !strings.Contains(proxy, "/") {
+				if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+					proxy += "/32"
+				} else {
+					proxy += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(proxy)
+			if err != nil {
+				return web.HeaderAuth{}, fmt.Errorf("cannot parse trusted proxy: %s", err)
+			}
+			headerAuth.TrustedProxies = append(headerAuth.TrustedProxies, network)
+		}
+	}
+	if len(headerAuth.TrustedProxies) == 0 {
+		return web.HeaderAuth{}, fmt.Errorf("header auth requires trusted_proxies")
+	}
+	for _, value := range query["admin_group"] {
+		headerAuth.AdminGroups = append(headerAuth.AdminGroups, strings.Split(value, ",")...)
+	}
+	if len(headerAuth.AdminGroups) != 0 && headerAuth.GroupsHeader == "" {
+		return web.HeaderAuth{}, fmt.Errorf("admin_group requires groups")
+	}
+	return headerAuth, nil
+}
+
+// newOIDCAuth returns the OpenID Connect authentication described by
+// authURL, for example
+// oidc://accounts.google.com?client_id=XXX&client_secret=YYY. The host and
+// path of authURL are those of the issuer, which is reached over https.
+func newOIDCAuth(authURL *url.URL, baseURL string, tokenKey string) (*web.OIDCAuth, error) {
+	query := authURL.Query()
+	if authURL.Host == "" {
+		return nil, fmt.Errorf("oidc auth requires an issuer")
+	}
+	if query.Get("client_id") == "" {
+		return nil, fmt.Errorf("oidc auth requires client_id")
+	}
+	// cookies signed with an empty key could be forged by anyone
+	if tokenKey == "" {
+		return nil, fmt.Errorf("oidc auth requires --token-key")
+	}
+	return &web.OIDCAuth{
+		Issuer:          "https://" + authURL.Host + authURL.Path,
+		ClientID:        query.Get("client_id"),
+		ClientSecret:    query.Get("client_secret"),
+		RedirectURL:     fmt.Sprintf("%s/oauth2callback", baseURL),
+		Scopes:          query["scope"],
+		UsernameClaim:   query.Get("username_claim"),
+		EmailSuffix:     query.Get("email_suffix"),
+		TokenSigningKey: []byte(tokenKey),
+	}, nil
+}
+
+func WebCommand(ctx *cli.Context) error {
+	config := web.Config{}
+
+	keys := &keyFileReader{ctx: ctx}
+	adminKey, err := keys.adminKey()
+	if err != nil {
+		return err
+	}
+	config.AdminKey = adminKey
+	if ctx.String("next-admin-key") != "" {
+		config.NextAdminKey = &usermgr.AdminKey{}
+		if err := config.NextAdminKey.UnmarshalText([]byte(ctx.String("next-admin-key"))); err != nil {
+			return fmt.Errorf("cannot parse next admin key: %s", err)
+		}
+	}
+	if path := ctx.String("next-admin-key-file"); path != "" {
+		if config.NextAdminKey != nil {
+			return fmt.Errorf("specify only one of --next-admin-key and --next-admin-key-file")
+		}
+		nextAdminKey, err := keys.read(path)
+		if err != nil {
+			return err
+		}
+		config.NextAdminKey = &nextAdminKey
+	}
+	for _, previousAdminKeyStr := range ctx.StringSlice("previous-admin-key") {
+		previousAdminKey := usermgr.AdminKey{}
+		if err := previousAdminKey.UnmarshalText([]byte(previousAdminKeyStr)); err != nil {
+			return fmt.Errorf("cannot parse previous admin key: %s", err)
+		}
+		config.PreviousAdminKeys = append(config.PreviousAdminKeys, previousAdminKey)
+	}
+	for _, path := range ctx.StringSlice("previous-admin-key-file") {
+		previousAdminKey, err := keys.read(path)
+		if err != nil {
+			return err
+		}
+		config.PreviousAdminKeys = append(config.PreviousAdminKeys, previousAdminKey)
+	}
+
+	config.DataLifetime = ctx.Duration("lifetime")
+	config.SignaturePolicy, err = signaturePolicyFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	storage, err := openStorage(ctx.String("store"))
+	if err != nil {
+		return err
+	}
+	config.Storage = storage
 
 	authURL, err := url.Parse(ctx.String("auth"))
 	if err != nil {
@@ -82,6 +295,10 @@ func WebCommand(ctx *cli.Context) error {
 	}
 	switch authURL.Scheme {
 	case "oauth":
+		// cookies signed with an empty key could be forged by anyone
+		if ctx.String("token-key") == "" {
+			return fmt.Errorf("oauth auth requires --token-key")
+		}
 		scopes, ok := authURL.Query()["scope"]
 		if !ok {
 			scopes = []string{"openid", "profile", "email"}
@@ -110,6 +327,18 @@ func WebCommand(ctx *cli.Context) error {
 			EmailSuffix:     authURL.Query().Get("email_suffix"),
 			TokenSigningKey: []byte(ctx.String("token-key")),
 		}
+	case "oidc":
+		oidcAuth, err := newOIDCAuth(authURL, ctx.String("url"), ctx.String("token-key"))
+		if err != nil {
+			return err
+		}
+		config.Auth = oidcAuth
+	case "header":
+		headerAuth, err := newHeaderAuth(authURL)
+		if err != nil {
+			return err
+		}
+		config.Auth = headerAuth
 	default:
 		return fmt.Errorf("unknown scheme in auth URL: %s", authURL.String())
 	}
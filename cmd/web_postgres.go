@@ -0,0 +1,8 @@
+//go:build postgres
+// +build postgres
+
+package cmd
+
+// The PostgreSQL driver is only built into usermgr with the postgres build
+// tag, so that the binaries that hosts run do not carry it.
+import _ "github.com/lib/pq"
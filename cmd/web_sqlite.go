@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package cmd
+
+// The SQLite driver uses cgo, so it is only built into usermgr with the
+// sqlite build tag, and is not in the binaries that hosts run.
+import _ "github.com/mattn/go-sqlite3"
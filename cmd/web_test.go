@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+type TestWebCommand struct{}
+
+var _ = Suite(&TestWebCommand{})
+
+func (s *TestWebCommand) TestHeaderAuth(c *C) {
+	authURL, _ := url.Parse("header://?name=X-User&trusted_proxies=10.0.0.0/8,192.0.2.1&trusted_proxies=::1" +
+		"&email=X-Email&groups=X-Groups&admin_group=ops,sre")
+	headerAuth, err := newHeaderAuth(authURL)
+	c.Assert(err, IsNil)
+	c.Assert(headerAuth.Header, Equals, "X-User")
+	c.Assert(headerAuth.EmailHeader, Equals, "X-Email")
+	c.Assert(headerAuth.GroupsHeader, Equals, "X-Groups")
+	c.Assert(headerAuth.AdminGroups, DeepEquals, []string{"ops", "sre"})
+	networks := []string{}
+	for _, network := range headerAuth.TrustedProxies {
+		networks = append(networks, network.String())
+	}
+	c.Assert(networks, DeepEquals, []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"})
+
+	authURL, _ = url.Parse("header://")
+	_, err = newHeaderAuth(authURL)
+	c.Assert(err, ErrorMatches, "header auth requires trusted_proxies")
+
+	authURL, _ = url.Parse("header://?trusted_proxies=10.0.0.0/33")
+	_, err = newHeaderAuth(authURL)
+	c.Assert(err, ErrorMatches, "cannot parse trusted proxy: .*")
+
+	authURL, _ = url.Parse("header://?trusted_proxies=10.0.0.0/8&admin_group=ops")
+	_, err = newHeaderAuth(authURL)
+	c.Assert(err, ErrorMatches, "admin_group requires groups")
+}
+
+func (s *TestWebCommand) TestOIDCAuth(c *C) {
+	authURL, _ := url.Parse("oidc://login.example.com/tenant?client_id=usermgr&client_secret=xyz" +
+		"&scope=openid&scope=email&username_claim=preferred_username&email_suffix=@example.com")
+	oidcAuth, err := newOIDCAuth(authURL, "https://users.example.com", "key")
+	c.Assert(err, IsNil)
+	c.Assert(oidcAuth.Issuer, Equals, "https://login.example.com/tenant")
+	c.Assert(oidcAuth.ClientID, Equals, "usermgr")
+	c.Assert(oidcAuth.ClientSecret, Equals, "xyz")
+	c.Assert(oidcAuth.RedirectURL, Equals, "https://users.example.com/oauth2callback")
+	c.Assert(oidcAuth.Scopes, DeepEquals, []string{"openid", "email"})
+	c.Assert(oidcAuth.UsernameClaim, Equals, "preferred_username")
+	c.Assert(oidcAuth.EmailSuffix, Equals, "@example.com")
+	c.Assert(string(oidcAuth.TokenSigningKey), Equals, "key")
+
+	authURL, _ = url.Parse("oidc://?client_id=usermgr")
+	_, err = newOIDCAuth(authURL, "https://users.example.com", "key")
+	c.Assert(err, ErrorMatches, "oidc auth requires an issuer")
+
+	authURL, _ = url.Parse("oidc://accounts.google.com")
+	_, err = newOIDCAuth(authURL, "https://users.example.com", "key")
+	c.Assert(err, ErrorMatches, "oidc auth requires client_id")
+
+	authURL, _ = url.Parse("oidc://accounts.google.com?client_id=usermgr")
+	_, err = newOIDCAuth(authURL, "https://users.example.com", "")
+	c.Assert(err, ErrorMatches, "oidc auth requires --token-key")
+}
+
+func (s *TestWebCommand) TestOpenStorageWithoutDriver(c *C) {
+	// the SQL drivers are only built in with build tags
+	if requireSQLDriver("sqlite3", "sqlite") == nil {
+		c.Skip("built with the sqlite tag")
+	}
+	_, err := openStorage("sqlite3:///var/usermgr/users.db")
+	c.Assert(err, ErrorMatches, "this usermgr was built without the sqlite3 driver; build it with `go build -tags sqlite`")
+}
+
+func (s *TestWebCommand) TestStoreHistorySize(c *C) {
+	u, _ := url.Parse("postgres://db.example.com/usermgr?history=500&sslmode=verify-full")
+	historySize, err := storeHistorySize(u)
+	c.Assert(err, IsNil)
+	c.Assert(historySize, Equals, 500)
+	// the rest of the URL is left for the driver
+	c.Assert(u.String(), Equals, "postgres://db.example.com/usermgr?sslmode=verify-full")
+
+	u, _ = url.Parse("file:///var/usermgr/?history=lots")
+	_, err = storeHistorySize(u)
+	c.Assert(err, ErrorMatches, "cannot parse history in store URL: .*")
+}
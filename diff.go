@@ -0,0 +1,151 @@
+package usermgr
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UserDiff describes how a user changed between two versions of the
+// account database.
+type UserDiff struct {
+	Name               string   `json:"name"`
+	AttributesChanged  []string `json:"attributes_changed,omitempty"`
+	GroupsAdded        []string `json:"groups_added,omitempty"`
+	GroupsRemoved      []string `json:"groups_removed,omitempty"`
+	KeysAdded          []string `json:"keys_added,omitempty"`
+	KeysRemoved        []string `json:"keys_removed,omitempty"`
+	MFADevicesAdded    []string `json:"mfa_devices_added,omitempty"`
+	MFADevicesRemoved  []string `json:"mfa_devices_removed,omitempty"`
+	BackupCodesAdded   int      `json:"backup_codes_added,omitempty"`
+	BackupCodesRemoved int      `json:"backup_codes_removed,omitempty"`
+}
+
+// Diff describes the differences between two versions of the account
+// database. See DiffUsersData.
+type Diff struct {
+	OldSerial    uint64     `json:"old_serial"`
+	NewSerial    uint64     `json:"new_serial"`
+	UsersAdded   []string   `json:"users_added,omitempty"`
+	UsersRemoved []string   `json:"users_removed,omitempty"`
+	UsersChanged []UserDiff `json:"users_changed,omitempty"`
+}
+
+// Empty returns true if no users changed.
+func (d Diff) Empty() bool {
+	return len(d.UsersAdded) == 0 && len(d.UsersRemoved) == 0 && len(d.UsersChanged) == 0
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of an SSH public key in
+// authorized_keys format, as printed by ssh-keygen -l. If the key cannot
+// be parsed, the key itself is returned.
+func KeyFingerprint(authorizedKey string) string {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return strings.TrimSpace(authorizedKey)
+	}
+	return ssh.FingerprintSHA256(publicKey)
+}
+
+// setDiff returns the elements of newItems that are not in oldItems, and
+// the elements of oldItems that are not in newItems.
+func setDiff(oldItems, newItems []string) (added, removed []string) {
+	oldSet := map[string]bool{}
+	for _, item := range oldItems {
+		oldSet[item] = true
+	}
+	newSet := map[string]bool{}
+	for _, item := range newItems {
+		newSet[item] = true
+	}
+	for _, item := range newItems {
+		if !oldSet[item] {
+			added = append(added, item)
+			oldSet[item] = true
+		}
+	}
+	for _, item := range oldItems {
+		if !newSet[item] {
+			removed = append(removed, item)
+			newSet[item] = true
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func (u User) keyFingerprints() []string {
+	rv := []string{}
+	for _, key := range u.AuthorizedKeys {
+		rv = append(rv, KeyFingerprint(key))
+	}
+	return rv
+}
+
+func (u User) backupCodeHashes() []string {
+	rv := []string{}
+	for _, code := range u.BackupCodes {
+		rv = append(rv, string(code.Hash))
+	}
+	return rv
+}
+
+func diffUser(oldUser, newUser User) UserDiff {
+	d := UserDiff{Name: newUser.Name}
+	if oldUser.RealName != newUser.RealName {
+		d.AttributesChanged = append(d.AttributesChanged, "real_name")
+	}
+	if oldUser.Email != newUser.Email {
+		d.AttributesChanged = append(d.AttributesChanged, "email")
+	}
+	d.GroupsAdded, d.GroupsRemoved = setDiff(oldUser.Groups, newUser.Groups)
+	d.KeysAdded, d.KeysRemoved = setDiff(oldUser.keyFingerprints(), newUser.keyFingerprints())
+	d.MFADevicesAdded, d.MFADevicesRemoved = setDiff(oldUser.MFADevices(), newUser.MFADevices())
+	backupCodesAdded, backupCodesRemoved := setDiff(oldUser.backupCodeHashes(), newUser.backupCodeHashes())
+	d.BackupCodesAdded, d.BackupCodesRemoved = len(backupCodesAdded), len(backupCodesRemoved)
+	return d
+}
+
+func (d UserDiff) empty() bool {
+	return len(d.AttributesChanged) == 0 &&
+		len(d.GroupsAdded) == 0 && len(d.GroupsRemoved) == 0 &&
+		len(d.KeysAdded) == 0 && len(d.KeysRemoved) == 0 &&
+		len(d.MFADevicesAdded) == 0 && len(d.MFADevicesRemoved) == 0 &&
+		d.BackupCodesAdded == 0 && d.BackupCodesRemoved == 0
+}
+
+// DiffUsersData returns the differences between the users in oldData and
+// newData. SSH keys are compared by fingerprint, and MFA devices by type
+// and name.
+func DiffUsersData(oldData, newData *UsersData) Diff {
+	d := Diff{OldSerial: oldData.Serial, NewSerial: newData.Serial}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, users := range [][]User{oldData.Users, newData.Users} {
+		for _, user := range users {
+			if !seen[user.Name] {
+				names = append(names, user.Name)
+				seen[user.Name] = true
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldUser, newUser := oldData.GetUserByName(name), newData.GetUserByName(name)
+		switch {
+		case oldUser == nil:
+			d.UsersAdded = append(d.UsersAdded, name)
+		case newUser == nil:
+			d.UsersRemoved = append(d.UsersRemoved, name)
+		default:
+			if userDiff := diffUser(*oldUser, *newUser); !userDiff.empty() {
+				d.UsersChanged = append(d.UsersChanged, userDiff)
+			}
+		}
+	}
+	return d
+}
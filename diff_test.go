@@ -0,0 +1,72 @@
+package usermgr
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestDiff{})
+
+type TestDiff struct {
+}
+
+const (
+	testLaptopKey  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO4VcGDGQfFyCEbooEqnQSqzlcJa5tvjND4j243jpBd5 alice@laptop"
+	testDesktopKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIH6kkwh1CqSUs9pu2zyICfTi2dpFOB0hjPdXCNZQcpVF alice@desktop"
+)
+
+func (s *TestDiff) TestKeyFingerprint(c *C) {
+	c.Assert(KeyFingerprint(testLaptopKey), Equals, "SHA256:42Km5PAnonerEyro7GtCEyQESZm69uWuTZilwDQHteE")
+	c.Assert(KeyFingerprint("not a key "), Equals, "not a key")
+}
+
+func (s *TestDiff) TestDiff(c *C) {
+	oldData := &UsersData{
+		Serial: 3,
+		Users: []User{
+			{
+				Name:           "alice",
+				Email:          "alice@example.com",
+				Groups:         []string{"users"},
+				AuthorizedKeys: []string{testLaptopKey},
+				TOTPDevices:    []TOTPDevice{{Name: "phone"}},
+				BackupCodes:    []BackupCode{{Hash: []byte("1")}, {Hash: []byte("2")}},
+			},
+			{Name: "bob"},
+			{Name: "charlie"},
+		},
+	}
+	newData := &UsersData{
+		Serial: 4,
+		Users: []User{
+			{
+				Name:   "alice",
+				Email:  "alice@example.org",
+				Groups: []string{"users", "wheel"},
+				// the comment does not matter
+				AuthorizedKeys: []string{testDesktopKey, testLaptopKey + "-renamed"},
+				Yubikeys:       []YubikeyDevice{{DeviceID: "cccccc"}},
+				BackupCodes:    []BackupCode{{Hash: []byte("2")}},
+			},
+			{Name: "charlie"},
+			{Name: "dave"},
+		},
+	}
+
+	c.Assert(DiffUsersData(oldData, newData), DeepEquals, Diff{
+		OldSerial:    3,
+		NewSerial:    4,
+		UsersAdded:   []string{"dave"},
+		UsersRemoved: []string{"bob"},
+		UsersChanged: []UserDiff{{
+			Name:               "alice",
+			AttributesChanged:  []string{"email"},
+			GroupsAdded:        []string{"wheel"},
+			KeysAdded:          []string{"SHA256:vtn5ypLe6O3aNzWcmx9V2kgOXtzf4ubAGl4dPH7tZSs"},
+			MFADevicesAdded:    []string{"yubikey:cccccc"},
+			MFADevicesRemoved:  []string{"totp:phone"},
+			BackupCodesRemoved: 1,
+		}},
+	})
+
+	c.Assert(DiffUsersData(oldData, oldData).Empty(), Equals, true)
+}
@@ -0,0 +1,224 @@
+package usermgr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyDir is the name of the directory in the cache directory that holds
+// previous versions of the data.
+const historyDir = "history"
+
+// pinnedFile is the name of the file in the cache directory that holds the
+// ID of the version the cache is pinned to.
+const pinnedFile = "users.pinned"
+
+// historyTimeFormat is the format of the fetch time in the ID of a version.
+const historyTimeFormat = "20060102T150405Z"
+
+// HistoryEntry describes a version of the data that was accepted into the
+// cache. See LocalCache.History.
+type HistoryEntry struct {
+	// ID identifies the version, see LocalCache.Rollback.
+	ID        string    `json:"id"`
+	Serial    uint64    `json:"serial"`
+	FetchTime time.Time `json:"fetch_time"`
+}
+
+// parseHistoryEntry returns the entry described by the name of a file in
+// the history directory, or nil if the name is not of a version.
+func parseHistoryEntry(name string) *HistoryEntry {
+	if !strings.HasSuffix(name, ".pem") {
+		return nil
+	}
+	id := strings.TrimSuffix(name, ".pem")
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	fetchTime, err := time.Parse(historyTimeFormat, parts[0])
+	if err != nil {
+		return nil
+	}
+	serial, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &HistoryEntry{ID: id, Serial: serial, FetchTime: fetchTime}
+}
+
+// History returns the versions of the data kept in the cache, newest first.
+func (lc LocalCache) History() ([]HistoryEntry, error) {
+	fileInfos, err := ioutil.ReadDir(filepath.Join(lc.Path, historyDir))
+	if os.IsNotExist(err) {
+		return []HistoryEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := []HistoryEntry{}
+	for _, fi := range fileInfos {
+		if entry := parseHistoryEntry(fi.Name()); entry != nil {
+			rv = append(rv, *entry)
+		}
+	}
+	sort.Sort(sort.Reverse(historyByTime(rv)))
+	return rv, nil
+}
+
+type historyByTime []HistoryEntry
+
+func (h historyByTime) Len() int      { return len(h) }
+func (h historyByTime) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h historyByTime) Less(i, j int) bool {
+	if h[i].FetchTime.Equal(h[j].FetchTime) {
+		return h[i].Serial < h[j].Serial
+	}
+	return h[i].FetchTime.Before(h[j].FetchTime)
+}
+
+// addToHistory records dataBuf, which have been accepted into the cache, as
+// the newest version and prunes the history. Nothing is recorded if
+// HistorySize is zero, and the history is only pruned if the data are the
+// same as the newest version.
+func (lc LocalCache) addToHistory(dataBuf []byte, serial uint64) error {
+	if lc.HistorySize <= 0 {
+		return nil
+	}
+	history, err := lc.History()
+	if err != nil {
+		return err
+	}
+	if len(history) > 0 {
+		newest, err := ioutil.ReadFile(lc.historyPath(history[0].ID))
+		if err == nil && bytes.Equal(newest, dataBuf) {
+			return lc.pruneHistory(history)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(lc.Path, historyDir), 0755); err != nil {
+		return err
+	}
+	entry := HistoryEntry{
+		ID:        fmt.Sprintf("%s-%d", timeNow().UTC().Format(historyTimeFormat), serial),
+		Serial:    serial,
+		FetchTime: timeNow(),
+	}
+	if err := ioutil.WriteFile(lc.historyPath(entry.ID), dataBuf, 0644); err != nil {
+		return err
+	}
+	return lc.pruneHistory(append([]HistoryEntry{entry}, history...))
+}
+
+// pruneHistory removes the versions beyond the HistorySize newest, and
+// those fetched longer than HistoryMaxAge ago. The newest version and the
+// version the cache is pinned to are always kept.
+func (lc LocalCache) pruneHistory(history []HistoryEntry) error {
+	pinned, err := lc.Pinned()
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	for i, entry := range history {
+		if i == 0 || entry.ID == pinned {
+			continue
+		}
+		tooOld := lc.HistoryMaxAge > 0 && now.Sub(entry.FetchTime) > lc.HistoryMaxAge
+		if i >= lc.HistorySize || tooOld {
+			if err := os.Remove(lc.historyPath(entry.ID)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (lc LocalCache) historyPath(id string) string {
+	return filepath.Join(lc.Path, historyDir, id+".pem")
+}
+
+// findVersion returns the version identified by version, which is either
+// the ID of a version or a serial number, in which case the newest version
+// with that serial number is returned.
+func (lc LocalCache) findVersion(version string) (*HistoryEntry, error) {
+	history, err := lc.History()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range history {
+		if entry.ID == version || strconv.FormatUint(entry.Serial, 10) == version {
+			return &entry, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no such version in the cache history", version)
+}
+
+// Pinned returns the ID of the version the cache is pinned to, or an empty
+// string if it is not pinned.
+func (lc LocalCache) Pinned() (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(lc.Path, pinnedFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// Rollback pins the cache to a previous version of the data, identified by
+// its ID or serial number, for use in an emergency. While the cache is
+// pinned Get and Update return the pinned version, although Update still
+// fetches new versions into the cache and its history. The pinned version
+// is exempt from the serial number check, but not from expiry.
+func (lc LocalCache) Rollback(version string) (*HistoryEntry, error) {
+	entry, err := lc.findVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	dataBuf, err := ioutil.ReadFile(lc.historyPath(entry.ID))
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := lc.load(dataBuf); err != nil {
+		return nil, fmt.Errorf("%s: %s", entry.ID, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(lc.Path, pinnedFile), []byte(entry.ID), 0644); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Unpin undoes Rollback, so that the newest data in the cache are used
+// again.
+func (lc LocalCache) Unpin() error {
+	if err := os.Remove(filepath.Join(lc.Path, pinnedFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getPinned returns the version the cache is pinned to, or nil if it is
+// not pinned.
+func (lc LocalCache) getPinned() (*UsersData, error) {
+	pinned, err := lc.Pinned()
+	if err != nil || pinned == "" {
+		return nil, err
+	}
+	dataBuf, err := ioutil.ReadFile(lc.historyPath(pinned))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pinned version: %s", err)
+	}
+	userData, _, err := lc.load(dataBuf)
+	if err != nil {
+		return nil, err
+	}
+	return lc.checkExpiry(userData)
+}
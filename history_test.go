@@ -0,0 +1,165 @@
+package usermgr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestHistory{})
+
+type TestHistory struct {
+	localCacheFixture
+	Now    time.Time
+	Data   []byte
+	Server *httptest.Server
+}
+
+func (s *TestHistory) SetUpTest(c *C) {
+	s.localCacheFixture.SetUpTest(c)
+	s.Now = timeNow()
+	timeNow = func() time.Time {
+		return s.Now
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(s.Data)
+	}))
+}
+
+func (s *TestHistory) TearDownTest(c *C) {
+	s.Server.Close()
+	s.localCacheFixture.TearDownTest(c)
+}
+
+// publish makes the test server serve data with the given serial number
+// from an hour after the previous version.
+func (s *TestHistory) publish(c *C, serial uint64) {
+	s.Data = s.signedData(c, serial)
+	s.Now = s.Now.Add(time.Hour)
+}
+
+func (s *TestHistory) TestHistory(c *C) {
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey, HistorySize: 3}
+	history, err := lc.History()
+	c.Assert(err, IsNil)
+	c.Assert(history, DeepEquals, []HistoryEntry{})
+
+	for serial := uint64(1); serial <= 4; serial++ {
+		s.publish(c, serial)
+		_, err := lc.Update(s.Server.URL)
+		c.Assert(err, IsNil)
+	}
+
+	// the same data are only recorded once
+	_, err = lc.Update(s.Server.URL)
+	c.Assert(err, IsNil)
+
+	history, err = lc.History()
+	c.Assert(err, IsNil)
+	c.Assert(len(history), Equals, 3)
+	c.Assert(history[0].ID, Equals, "20060102T190405Z-4")
+	c.Assert(history[0].Serial, Equals, uint64(4))
+	c.Assert(history[0].FetchTime.Format(time.RFC3339), Equals, "2006-01-02T19:04:05Z")
+	c.Assert(history[1].ID, Equals, "20060102T180405Z-3")
+	c.Assert(history[2].ID, Equals, "20060102T170405Z-2")
+
+	cached, _ := ioutil.ReadFile(filepath.Join(s.tempDir, "users.pem"))
+	newest, _ := ioutil.ReadFile(filepath.Join(s.tempDir, "history", history[0].ID+".pem"))
+	c.Assert(newest, DeepEquals, cached)
+}
+
+func (s *TestHistory) TestMaxAge(c *C) {
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey, HistorySize: 10,
+		HistoryMaxAge: 90 * time.Minute}
+	for serial := uint64(1); serial <= 4; serial++ {
+		s.publish(c, serial)
+		_, err := lc.Update(s.Server.URL)
+		c.Assert(err, IsNil)
+	}
+	history, err := lc.History()
+	c.Assert(err, IsNil)
+	c.Assert(len(history), Equals, 2)
+	c.Assert(history[0].Serial, Equals, uint64(4))
+	c.Assert(history[1].Serial, Equals, uint64(3))
+
+	// the newest version is kept no matter how old
+	s.Now = s.Now.Add(24 * time.Hour)
+	c.Assert(lc.addToHistory(s.Data, 4), IsNil)
+	history, err = lc.History()
+	c.Assert(err, IsNil)
+	c.Assert(len(history), Equals, 1)
+}
+
+func (s *TestHistory) TestNoHistory(c *C) {
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey}
+	s.publish(c, 1)
+	_, err := lc.Update(s.Server.URL)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(s.tempDir, "history"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestHistory) TestRollback(c *C) {
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey, HistorySize: 2}
+	for serial := uint64(1); serial <= 2; serial++ {
+		s.publish(c, serial)
+		_, err := lc.Update(s.Server.URL)
+		c.Assert(err, IsNil)
+	}
+
+	_, err := lc.Rollback("7")
+	c.Assert(err, ErrorMatches, "7: no such version in the cache history")
+
+	entry, err := lc.Rollback("1")
+	c.Assert(err, IsNil)
+	c.Assert(entry.ID, Equals, "20060102T160405Z-1")
+	info, err := lc.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info.Pinned, Equals, "20060102T160405Z-1")
+
+	userData, err := lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(userData.Serial, Equals, uint64(1))
+
+	// new versions are fetched, but the pinned version is used and is not
+	// pruned from the history
+	s.publish(c, 3)
+	userData, err = lc.Update(s.Server.URL)
+	c.Assert(err, IsNil)
+	c.Assert(userData.Serial, Equals, uint64(1))
+	serial, _ := lc.Serial()
+	c.Assert(serial, Equals, uint64(3))
+	history, _ := lc.History()
+	c.Assert(len(history), Equals, 3)
+
+	c.Assert(lc.Unpin(), IsNil)
+	userData, err = lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(userData.Serial, Equals, uint64(3))
+
+	// the pinned version is pruned once unpinned
+	s.publish(c, 4)
+	_, err = lc.Update(s.Server.URL)
+	c.Assert(err, IsNil)
+	history, _ = lc.History()
+	c.Assert(len(history), Equals, 2)
+	c.Assert(history[1].Serial, Equals, uint64(3))
+}
+
+func (s *TestHistory) TestRollbackToInvalidData(c *C) {
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey, HistorySize: 2}
+	os.MkdirAll(filepath.Join(s.tempDir, "history"), 0755)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "history", "20060102T150405Z-1.pem"), []byte("garbage"), 0644)
+	_, err := lc.Rollback("1")
+	c.Assert(err, ErrorMatches, "20060102T150405Z-1: invalid encoding")
+
+	// pinning to a version that is gone fails loudly
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pinned"), []byte("20060102T150405Z-2"), 0644)
+	_, err = lc.Get()
+	c.Assert(err, ErrorMatches, "cannot read pinned version: .*")
+}
@@ -0,0 +1,255 @@
+package usermgr
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// recipientHeaderPrefix is the prefix of the PEM headers that hold the
+// content key of an envelope encrypted to each recipient. The rest of the
+// header name is the recipient's public key.
+const recipientHeaderPrefix = "Recipient-"
+
+// HostPublicKey is the public part of the key pair of a single host.
+type HostPublicKey [32]byte
+
+func (pk HostPublicKey) MarshalText() (text []byte, err error) {
+	return encodeKey(pk[:]), nil
+}
+
+func (pk *HostPublicKey) UnmarshalText(text []byte) error {
+	buf, err := decodeKey(text)
+	if err != nil || len(buf) != 32 {
+		return ErrIncorrectKeyFormat
+	}
+	copy(pk[:], buf)
+	return nil
+}
+
+func (pk HostPublicKey) String() string {
+	text, _ := pk.MarshalText()
+	return string(text)
+}
+
+// PublicKey returns the public key that corresponds to the host private key.
+func (hk HostKey) PublicKey() HostPublicKey {
+	var rv [32]byte
+	curve25519.ScalarBaseMult(&rv, &hk.HostPrivateKey)
+	return HostPublicKey(rv)
+}
+
+// WithPrivateKey returns a copy of hk that uses privateKey in place of the
+// shared host private key. Hosts that have enrolled their own key use it
+// to read data encrypted to them individually.
+func (hk HostKey) WithPrivateKey(privateKey [32]byte) HostKey {
+	hk.HostPrivateKey = privateKey
+	return hk
+}
+
+// Host is a server that has enrolled its own key pair, so that it can be
+// cut off from future versions of the data without replacing the key on
+// every other host.
+type Host struct {
+	Name      string        `json:"name"`
+	PublicKey HostPublicKey `json:"public_key"`
+
+	// Approved is true once an administrator has accepted the enrollment.
+	// The data are only encrypted to approved hosts.
+	Approved bool `json:"approved,omitempty"`
+}
+
+// GetHostByName returns the host having the specified name or nil if no
+// such host exists.
+func (ud UsersData) GetHostByName(name string) *Host {
+	for _, host := range ud.Hosts {
+		if host.Name == name {
+			return &host
+		}
+	}
+	return nil
+}
+
+// SetHost adds or replaces `host` in the list of hosts.
+func (ud *UsersData) SetHost(host Host) {
+	for i, h := range ud.Hosts {
+		if h.Name == host.Name {
+			ud.Hosts[i] = host
+			return
+		}
+	}
+	ud.Hosts = append(ud.Hosts, host)
+}
+
+// DeleteHost removes a host from the list of hosts. Versions of the data
+// signed afterwards are not encrypted to the host.
+func (ud *UsersData) DeleteHost(name string) {
+	newHosts := []Host{}
+	for _, h := range ud.Hosts {
+		if h.Name == name {
+			continue
+		}
+		newHosts = append(newHosts, h)
+	}
+	ud.Hosts = newHosts
+}
+
+// enrollmentMessage is the message that proves who requested the enrollment
+// of host.
+func (host Host) enrollmentMessage() []byte {
+	return []byte(host.Name + "\n" + host.PublicKey.String())
+}
+
+// EnrollmentProof returns evidence that the enrollment of host was requested
+// by a holder of hostKey, the shared host key. It is sealed to the admin key,
+// which verifies it with VerifyEnrollmentProof.
+func (host Host) EnrollmentProof(hostKey HostKey) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(randReader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return box.Seal(nonce[:], host.enrollmentMessage(), &nonce,
+		&hostKey.AdminPublicKey, &hostKey.HostPrivateKey), nil
+}
+
+// VerifyEnrollmentProof returns true if proof was made by EnrollmentProof
+// for host with the shared host key that belongs to adminKey.
+func (host Host) VerifyEnrollmentProof(proof []byte, adminKey AdminKey) bool {
+	if len(proof) < 24 {
+		return false
+	}
+	var nonce [24]byte
+	copy(nonce[:], proof[:24])
+	message, ok := box.Open(nil, proof[24:], &nonce, &adminKey.HostPublicKey, &adminKey.AdminPrivateKey)
+	return ok && string(message) == string(host.enrollmentMessage())
+}
+
+// usesEnvelope returns true if the data must be encrypted to more than the
+// shared host key.
+func (ud UsersData) usesEnvelope() bool {
+	if ud.ExcludeSharedHostKey {
+		return true
+	}
+	for _, host := range ud.Hosts {
+		if host.Approved {
+			return true
+		}
+	}
+	return false
+}
+
+// recipients returns the public keys to which the data are encrypted. The
+// admin key is always a recipient so that it can read the data back.
+func (ud UsersData) recipients(adminKey AdminKey) []HostPublicKey {
+	rv := []HostPublicKey{HostPublicKey(adminKey.AdminPublicKey)}
+	if !ud.ExcludeSharedHostKey {
+		rv = append(rv, HostPublicKey(adminKey.HostPublicKey))
+	}
+	for _, host := range ud.Hosts {
+		if host.Approved {
+			rv = append(rv, host.PublicKey)
+		}
+	}
+	return rv
+}
+
+// sealEnvelope encrypts plaintext with a random content key and returns the
+// ciphertext and, for each recipient, a PEM header holding the content key
+// sealed from the admin key to the recipient.
+func sealEnvelope(plaintext []byte, adminKey AdminKey, recipients []HostPublicKey) ([]byte, map[string]string, error) {
+	var contentKey [32]byte
+	if _, err := io.ReadFull(randReader, contentKey[:]); err != nil {
+		return nil, nil, err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(randReader, nonce[:]); err != nil {
+		return nil, nil, err
+	}
+	ciphertext := secretbox.Seal(nonce[:], plaintext, &nonce, &contentKey)
+
+	headers := map[string]string{}
+	for _, recipient := range recipients {
+		var recipientNonce [24]byte
+		if _, err := io.ReadFull(randReader, recipientNonce[:]); err != nil {
+			return nil, nil, err
+		}
+		recipientKey := [32]byte(recipient)
+		sealedKey := box.Seal(recipientNonce[:], contentKey[:], &recipientNonce,
+			&recipientKey, &adminKey.AdminPrivateKey)
+		headers[recipientHeaderPrefix+recipient.String()] = base64.StdEncoding.EncodeToString(sealedKey)
+	}
+	return ciphertext, headers, nil
+}
+
+// openEnvelope returns the plaintext of an envelope encrypted to hostKey.
+func openEnvelope(dataBlock *pem.Block, hostKey HostKey) ([]byte, error) {
+	sealedKeyStr, ok := dataBlock.Headers[recipientHeaderPrefix+hostKey.PublicKey().String()]
+	if !ok {
+		return nil, fmt.Errorf("user data are not encrypted to this host key")
+	}
+	sealedKey, err := base64.StdEncoding.DecodeString(sealedKeyStr)
+	if err != nil || len(sealedKey) < 24 {
+		return nil, fmt.Errorf("invalid encoding")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealedKey[:24])
+	contentKeyBuf, ok := box.Open(nil, sealedKey[24:], &nonce,
+		&hostKey.AdminPublicKey, &hostKey.HostPrivateKey)
+	if !ok || len(contentKeyBuf) != 32 {
+		return nil, fmt.Errorf("cannot decrypt user data. Wrong key?")
+	}
+	var contentKey [32]byte
+	copy(contentKey[:], contentKeyBuf)
+
+	copy(nonce[:], dataBlock.Bytes[:24])
+	plaintext, ok := secretbox.Open(nil, dataBlock.Bytes[24:], &nonce, &contentKey)
+	if !ok {
+		return nil, fmt.Errorf("cannot decrypt user data. Wrong key?")
+	}
+	return plaintext, nil
+}
+
+// Recipients returns the public keys to which signedData are encrypted,
+// or an empty list if the data are only encrypted to the shared host key.
+func Recipients(signedData []byte) ([]HostPublicKey, error) {
+	dataBlock, _ := pem.Decode(signedData)
+	if dataBlock == nil || dataBlock.Type != "USERMGR DATA" {
+		return nil, fmt.Errorf("invalid encoding")
+	}
+	names := []string{}
+	for name := range dataBlock.Headers {
+		if strings.HasPrefix(name, recipientHeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	rv := []HostPublicKey{}
+	for _, name := range names {
+		pk := HostPublicKey{}
+		if err := pk.UnmarshalText([]byte(strings.TrimPrefix(name, recipientHeaderPrefix))); err != nil {
+			continue
+		}
+		rv = append(rv, pk)
+	}
+	return rv, nil
+}
+
+// LoadUsersDataAsAdmin is like LoadUsersData but reads the data with the
+// admin key, which can read data regardless of the hosts they are
+// encrypted to.
+func LoadUsersDataAsAdmin(data []byte, adminKey AdminKey) (*UsersData, error) {
+	dataBlock, _ := pem.Decode(data)
+	if dataBlock != nil && dataBlock.Headers["Version"] == "3" {
+		return LoadUsersData(data, adminKey.HostKey.WithPrivateKey(adminKey.AdminPrivateKey))
+	}
+	return LoadUsersData(data, adminKey.HostKey)
+}
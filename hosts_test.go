@@ -0,0 +1,161 @@
+package usermgr
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestHosts{})
+
+type TestHosts struct {
+	AdminKey AdminKey
+}
+
+func (s *TestHosts) SetUpTest(c *C) {
+	randReader = &testRandomReader{Next: 1}
+	s.AdminKey = GenerateKeyPair()
+
+	// the host keys must not repeat the shared host key
+	randReader = rand.Reader
+}
+
+// newHostKey returns the key of a host that has generated its own key pair.
+func (s *TestHosts) newHostKey(c *C) (HostKey, HostPublicKey) {
+	lc := LocalCache{Path: c.MkDir()}
+	publicKey, err := lc.OwnPublicKey()
+	c.Assert(err, IsNil)
+	return s.AdminKey.HostKey.WithPrivateKey(*lc.ownPrivateKey()), publicKey
+}
+
+func (s *TestHosts) TestEnvelope(c *C) {
+	aliceKey, alicePublicKey := s.newHostKey(c)
+	bobKey, bobPublicKey := s.newHostKey(c)
+	c.Assert(aliceKey.PublicKey(), Equals, alicePublicKey)
+
+	ud := UsersData{
+		Users: []User{{Name: "alice"}},
+		Hosts: []Host{
+			{Name: "alice", PublicKey: alicePublicKey, Approved: true},
+			{Name: "bob", PublicKey: bobPublicKey},
+		},
+	}
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+
+	// approved hosts, the shared host key and the admin key can read the data
+	rv, err := LoadUsersData(signedData, aliceKey)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "alice")
+	_, err = LoadUsersData(signedData, s.AdminKey.HostKey)
+	c.Assert(err, IsNil)
+	_, err = LoadUsersDataAsAdmin(signedData, s.AdminKey)
+	c.Assert(err, IsNil)
+
+	// hosts that have not been approved cannot
+	_, err = LoadUsersData(signedData, bobKey)
+	c.Assert(err, ErrorMatches, "user data are not encrypted to this host key")
+
+	recipients, err := Recipients(signedData)
+	c.Assert(err, IsNil)
+	c.Assert(len(recipients), Equals, 3)
+
+	// once the shared key is excluded, only the approved hosts can read it
+	ud.ExcludeSharedHostKey = true
+	ud.SetHost(Host{Name: "bob", PublicKey: bobPublicKey, Approved: true})
+	signedData, err = ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+	_, err = LoadUsersData(signedData, s.AdminKey.HostKey)
+	c.Assert(err, ErrorMatches, "user data are not encrypted to this host key")
+	_, err = LoadUsersData(signedData, bobKey)
+	c.Assert(err, IsNil)
+	_, err = LoadUsersDataAsAdmin(signedData, s.AdminKey)
+	c.Assert(err, IsNil)
+
+	// a revoked host cannot read subsequent versions
+	ud.DeleteHost("alice")
+	c.Assert(ud.GetHostByName("alice"), IsNil)
+	signedData, err = ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+	_, err = LoadUsersData(signedData, aliceKey)
+	c.Assert(err, ErrorMatches, "user data are not encrypted to this host key")
+	_, err = LoadUsersData(signedData, bobKey)
+	c.Assert(err, IsNil)
+
+	// the envelope is signed
+	forgedData := []byte(string(signedData))
+	forgedData[len(forgedData)-40] ^= 1
+	_, err = LoadUsersData(forgedData, bobKey)
+	c.Assert(err, NotNil)
+}
+
+func (s *TestHosts) TestLegacyFormatWithoutHosts(c *C) {
+	ud := UsersData{
+		Users: []User{{Name: "alice"}},
+		Hosts: []Host{{Name: "pending", Approved: false}},
+	}
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+	recipients, err := Recipients(signedData)
+	c.Assert(err, IsNil)
+	c.Assert(len(recipients), Equals, 0)
+
+	_, err = LoadUsersDataAsAdmin(signedData, s.AdminKey)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestHosts) TestLocalCacheUsesOwnKey(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	lc := LocalCache{Path: tempDir, HostKey: s.AdminKey.HostKey}
+	publicKey, err := lc.OwnPublicKey()
+	c.Assert(err, IsNil)
+	publicKey2, err := lc.OwnPublicKey()
+	c.Assert(err, IsNil)
+	c.Assert(publicKey2, Equals, publicKey)
+	st, err := os.Stat(filepath.Join(tempDir, "host.key"))
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode().Perm(), Equals, os.FileMode(0600))
+
+	ud := UsersData{
+		Users:                []User{{Name: "alice"}},
+		Hosts:                []Host{{Name: "host", PublicKey: publicKey, Approved: true}},
+		ExcludeSharedHostKey: true,
+	}
+	signedData, _ := ud.SignedString(s.AdminKey)
+	ioutil.WriteFile(filepath.Join(tempDir, "users.pem"), signedData, 0644)
+
+	rv, err := lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "alice")
+
+	ud.DeleteHost("host")
+	signedData, _ = ud.SignedString(s.AdminKey)
+	ioutil.WriteFile(filepath.Join(tempDir, "users.pem"), signedData, 0644)
+	_, err = lc.Get()
+	c.Assert(err, ErrorMatches, "user data are not encrypted to this host key")
+}
+
+func (s *TestHosts) TestEnrollmentProof(c *C) {
+	_, publicKey := s.newHostKey(c)
+	host := Host{Name: "web1", PublicKey: publicKey}
+	proof, err := host.EnrollmentProof(s.AdminKey.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(host.VerifyEnrollmentProof(proof, s.AdminKey), Equals, true)
+
+	// the proof covers the name and the key
+	c.Assert(Host{Name: "web2", PublicKey: publicKey}.VerifyEnrollmentProof(proof, s.AdminKey), Equals, false)
+	c.Assert(Host{Name: "web1"}.VerifyEnrollmentProof(proof, s.AdminKey), Equals, false)
+
+	// a host key of its own does not prove anything
+	ownKey, _ := s.newHostKey(c)
+	proof, err = host.EnrollmentProof(ownKey)
+	c.Assert(err, IsNil)
+	c.Assert(host.VerifyEnrollmentProof(proof, s.AdminKey), Equals, false)
+	c.Assert(host.VerifyEnrollmentProof(nil, s.AdminKey), Equals, false)
+}
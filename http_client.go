@@ -0,0 +1,158 @@
+package usermgr
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultConnectTimeout is used when HTTPOptions.ConnectTimeout is zero.
+const DefaultConnectTimeout = 10 * time.Second
+
+// DefaultTimeout is used when HTTPOptions.Timeout is zero.
+const DefaultTimeout = time.Minute
+
+// DefaultMaxDataSize is used when LocalCache.MaxDataSize is zero. It is far
+// larger than any real account database.
+const DefaultMaxDataSize = 16 << 20
+
+// HTTPOptions describes the HTTP client used to fetch the account database.
+// The zero value is a client with the default timeouts that trusts the
+// system's CAs and uses the proxy from the environment.
+type HTTPOptions struct {
+	// ConnectTimeout limits the time to connect to the server, including
+	// the TLS handshake.
+	ConnectTimeout time.Duration
+
+	// Timeout limits the time of the whole request, including reading the
+	// response. It also limits the time an exec:// command runs.
+	Timeout time.Duration
+
+	// CAFile is the path to a file of PEM encoded certificates that are
+	// trusted instead of the system's CAs.
+	CAFile string
+
+	// PinnedKeys are base64 encoded SHA-256 hashes of public keys, as in
+	// "sha256/AAAA...=" or just "AAAA...=". If not empty, one of the
+	// certificates in the server's verified chain must have one of these
+	// keys.
+	PinnedKeys []string
+
+	// Proxy is the URL of an HTTP proxy. If empty, the proxy is taken from
+	// the HTTPS_PROXY and HTTP_PROXY environment variables.
+	Proxy string
+
+	// ClientCertFile and ClientKeyFile are the paths to a PEM encoded
+	// certificate and private key that the client presents to the server.
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// publicKeyPin returns the pin of the public key in cert, see
+// HTTPOptions.PinnedKeys.
+func publicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPins returns an error unless one of the certificates in
+// verifiedChains has one of pinnedKeys.
+func verifyPins(pinnedKeys []string, verifiedChains [][]*x509.Certificate) error {
+	pins := map[string]bool{}
+	for _, pin := range pinnedKeys {
+		pins[strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")] = true
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if pins[publicKeyPin(cert)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no pinned public key in the server's certificate chain")
+}
+
+func (o HTTPOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return o.Timeout
+}
+
+// Client returns an HTTP client configured by the options.
+func (o HTTPOptions) Client() (*http.Client, error) {
+	connectTimeout := o.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	timeout := o.timeout()
+
+	tlsConfig := &tls.Config{}
+	if o.CAFile != "" {
+		pemBuf, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemBuf) {
+			return nil, fmt.Errorf("%s: no certificates found", o.CAFile)
+		}
+	}
+	if len(o.PinnedKeys) > 0 {
+		pinnedKeys := o.PinnedKeys
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyPins(pinnedKeys, verifiedChains)
+		}
+	}
+	if o.ClientCertFile != "" || o.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		proxyURL, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   connectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: connectTimeout,
+			TLSClientConfig:     tlsConfig,
+		},
+	}, nil
+}
+
+// readLimited reads r, returning an error if it holds more than maxSize
+// bytes, so that a malicious server cannot exhaust the memory of the host.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > maxSize {
+		return nil, fmt.Errorf("data exceed the limit of %d bytes", maxSize)
+	}
+	return buf, nil
+}
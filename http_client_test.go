@@ -0,0 +1,199 @@
+package usermgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestHTTPClient{})
+
+type TestHTTPClient struct {
+	localCacheFixture
+	SignedData []byte
+}
+
+func (s *TestHTTPClient) SetUpTest(c *C) {
+	s.localCacheFixture.SetUpTest(c)
+	s.SignedData = s.signedData(c, 1)
+}
+
+func (s *TestHTTPClient) serveData(w http.ResponseWriter, r *http.Request) {
+	w.Write(s.SignedData)
+}
+
+func (s *TestHTTPClient) localCache(options HTTPOptions) LocalCache {
+	return LocalCache{
+		Path:    filepath.Join(s.tempDir, "cache"),
+		HostKey: s.AdminKey.HostKey,
+		HTTP:    options,
+	}
+}
+
+// writeCertificate writes the certificate of server to a file and returns
+// its path.
+func (s *TestHTTPClient) writeCertificate(c *C, server *httptest.Server) string {
+	path := filepath.Join(s.tempDir, "ca.pem")
+	c.Assert(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.TLS.Certificates[0].Certificate[0],
+	}), 0644), IsNil)
+	return path
+}
+
+func (s *TestHTTPClient) TestTimeout(c *C) {
+	done := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	_, err := s.localCache(HTTPOptions{Timeout: 50 * time.Millisecond}).Update(server.URL)
+	c.Assert(err, ErrorMatches, ".*(Client.Timeout|timeout).*")
+}
+
+func (s *TestHTTPClient) TestDialUsesContext(c *C) {
+	client, err := HTTPOptions{}.Client()
+	c.Assert(err, IsNil)
+	transport := client.Transport.(*http.Transport)
+	c.Assert(transport.Dial, IsNil)
+	c.Assert(transport.DialContext, NotNil)
+}
+
+func (s *TestHTTPClient) TestCAFile(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(s.serveData))
+	defer server.Close()
+
+	_, err := s.localCache(HTTPOptions{}).Update(server.URL)
+	c.Assert(err, ErrorMatches, ".*certificate.*")
+
+	rv, err := s.localCache(HTTPOptions{CAFile: s.writeCertificate(c, server)}).Update(server.URL)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(1))
+
+	_, err = HTTPOptions{CAFile: filepath.Join(s.tempDir, "missing.pem")}.Client()
+	c.Assert(err, ErrorMatches, "open .*/missing.pem: no such file or directory")
+
+	ioutil.WriteFile(filepath.Join(s.tempDir, "empty.pem"), []byte("not a certificate"), 0644)
+	_, err = HTTPOptions{CAFile: filepath.Join(s.tempDir, "empty.pem")}.Client()
+	c.Assert(err, ErrorMatches, ".*/empty.pem: no certificates found")
+}
+
+func (s *TestHTTPClient) TestPinnedKeys(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(s.serveData))
+	defer server.Close()
+	caFile := s.writeCertificate(c, server)
+	cert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	c.Assert(err, IsNil)
+
+	rv, err := s.localCache(HTTPOptions{
+		CAFile:     caFile,
+		PinnedKeys: []string{"sha256/" + publicKeyPin(cert)},
+	}).Update(server.URL)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(1))
+
+	_, err = s.localCache(HTTPOptions{
+		CAFile:     caFile,
+		PinnedKeys: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}).Update(server.URL)
+	c.Assert(err, ErrorMatches, ".*no pinned public key in the server's certificate chain")
+}
+
+func (s *TestHTTPClient) TestClientCertificate(c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "web1.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certBuf, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, _ := x509.ParseCertificate(certBuf)
+	keyBuf, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certFile := filepath.Join(s.tempDir, "client.pem")
+	keyFile := filepath.Join(s.tempDir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBuf}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBuf}), 0600)
+
+	clientName := ""
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientName = r.TLS.PeerCertificates[0].Subject.CommonName
+		s.serveData(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(cert)
+	server.StartTLS()
+	defer server.Close()
+	caFile := s.writeCertificate(c, server)
+
+	_, err = s.localCache(HTTPOptions{CAFile: caFile}).Update(server.URL)
+	c.Assert(err, NotNil)
+
+	rv, err := s.localCache(HTTPOptions{
+		CAFile:         caFile,
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+	}).Update(server.URL)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(1))
+	c.Assert(clientName, Equals, "web1.example.com")
+
+	_, err = HTTPOptions{ClientCertFile: certFile}.Client()
+	c.Assert(err, ErrorMatches, "open : no such file or directory")
+}
+
+func (s *TestHTTPClient) TestProxy(c *C) {
+	requestedURL := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedURL = r.URL.String()
+		s.serveData(w, r)
+	}))
+	defer proxy.Close()
+
+	rv, err := s.localCache(HTTPOptions{Proxy: proxy.URL}).Update("http://users.example.com/users.pem")
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(1))
+	c.Assert(requestedURL, Equals, "http://users.example.com/users.pem")
+}
+
+func (s *TestHTTPClient) TestMaxDataSize(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(s.serveData))
+	defer server.Close()
+	chunkedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the end of the response prevents a Content-Length
+		w.Write(s.SignedData[:10])
+		w.(http.Flusher).Flush()
+		w.Write(s.SignedData[10:])
+	}))
+	defer chunkedServer.Close()
+
+	lc := s.localCache(HTTPOptions{})
+	lc.MaxDataSize = 100
+	_, err := lc.Update(server.URL)
+	c.Assert(err, ErrorMatches, "data exceed the limit of 100 bytes")
+	_, err = lc.Update(chunkedServer.URL)
+	c.Assert(err, ErrorMatches, "data exceed the limit of 100 bytes")
+
+	lc.MaxDataSize = int64(len(s.SignedData))
+	rv, err := lc.Update(server.URL)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(1))
+}
@@ -0,0 +1,149 @@
+package usermgr
+
+import (
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TOTPHorizon is the time until which a TOTP device has pre-generated
+// codes. Hosts cannot validate codes from the device after that time.
+type TOTPHorizon struct {
+	User    string
+	Device  string
+	Horizon time.Time
+}
+
+// Report describes a signed account database. See Inspect.
+type Report struct {
+	// Version is the version of the file format.
+	Version int
+
+	Serial     uint64
+	IssueTime  *time.Time
+	ExpireTime *time.Time
+
+	// SignedBy is the signing key that the signature was verified against,
+	// or nil if the signature was not verified.
+	SignedBy *SigningPublicKey
+
+	// Approvers are the administrators who have approved the data. See
+	// SignaturePolicy.
+	Approvers []SigningPublicKey
+
+	// Recipients are the keys that the data are encrypted to, or empty if
+	// the data are only encrypted to the shared host key.
+	Recipients []HostPublicKey
+
+	Users        int
+	Groups       []string
+	TOTPHorizons []TOTPHorizon
+	BackupCodes  map[string]int
+
+	// Warnings describe problems with the data that would prevent them
+	// from working as intended on hosts.
+	Warnings []string
+}
+
+// Inspect reads signedData with hostKey and returns a report describing
+// them. It returns an error if the data cannot be read, while problems with
+// the contents of the data are reported in Report.Warnings.
+func Inspect(signedData []byte, hostKey HostKey) (*Report, error) {
+	usersData, err := LoadUsersData(signedData, hostKey)
+	if err != nil {
+		return nil, err
+	}
+	return newReport(signedData, usersData, hostKey)
+}
+
+// InspectAsAdmin is like Inspect but reads the data with the admin key.
+// See LoadUsersDataAsAdmin.
+func InspectAsAdmin(signedData []byte, adminKey AdminKey) (*Report, error) {
+	usersData, err := LoadUsersDataAsAdmin(signedData, adminKey)
+	if err != nil {
+		return nil, err
+	}
+	return newReport(signedData, usersData, adminKey.HostKey)
+}
+
+func newReport(signedData []byte, usersData *UsersData, hostKey HostKey) (*Report, error) {
+	dataBlock, _ := pem.Decode(signedData)
+	if dataBlock == nil {
+		return nil, fmt.Errorf("invalid encoding")
+	}
+
+	report := Report{
+		Version:     1,
+		Serial:      usersData.Serial,
+		IssueTime:   usersData.IssueTime,
+		ExpireTime:  usersData.ExpireTime,
+		Users:       len(usersData.Users),
+		BackupCodes: map[string]int{},
+	}
+	if version, err := strconv.Atoi(dataBlock.Headers["Version"]); err == nil {
+		report.Version = version
+	}
+
+	// LoadUsersData has already verified the signature if the key has a
+	// signing key.
+	_, hasSignature := dataBlock.Headers["Signature"]
+	if hostKey.HasSigningKey() {
+		signingKey := SigningPublicKey(hostKey.AdminSigningPublicKey)
+		report.SignedBy = &signingKey
+	} else if hasSignature {
+		report.Warnings = append(report.Warnings,
+			"the signature was not verified because the key does not include a signing key")
+	}
+
+	var err error
+	if report.Approvers, err = Approvers(signedData); err != nil {
+		return nil, err
+	}
+	if report.Recipients, err = Recipients(signedData); err != nil {
+		return nil, err
+	}
+
+	now := timeNow()
+	if usersData.ExpireTime != nil && !now.Before(*usersData.ExpireTime) {
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("the data expired at %s", usersData.ExpireTime.Format(time.RFC3339)))
+	}
+
+	seenUsers := map[string]bool{}
+	groups := map[string]bool{}
+	for _, user := range usersData.Users {
+		if seenUsers[user.Name] {
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("user %q appears more than once", user.Name))
+		}
+		seenUsers[user.Name] = true
+		if !sudoersUserNameRegexp.MatchString(user.Name) {
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("user name %q not allowed in sudoers", user.Name))
+		}
+		for _, group := range user.Groups {
+			groups[group] = true
+		}
+
+		for _, device := range user.TOTPDevices {
+			horizon := TOTPHorizon{User: user.Name, Device: device.Name, Horizon: device.Horizon()}
+			report.TOTPHorizons = append(report.TOTPHorizons, horizon)
+			if horizon.Horizon.Before(now) {
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("TOTP device %q of user %q has no codes after %s",
+						device.Name, user.Name, horizon.Horizon.Format(time.RFC3339)))
+			}
+		}
+		if len(user.BackupCodes) > 0 {
+			report.BackupCodes[user.Name] += len(user.BackupCodes)
+		}
+	}
+	for group := range groups {
+		report.Groups = append(report.Groups, group)
+	}
+	sort.Strings(report.Groups)
+
+	return &report, nil
+}
@@ -0,0 +1,97 @@
+package usermgr
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestInspect{})
+
+type TestInspect struct {
+	AdminKey AdminKey
+	Now      time.Time
+}
+
+func (s *TestInspect) SetUpTest(c *C) {
+	s.Now, _ = time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
+	timeNow = func() time.Time { return s.Now }
+	randReader = &testRandomReader{Next: 1}
+	s.AdminKey = GenerateKeyPair()
+}
+
+func (s *TestInspect) TearDownTest(c *C) {
+	timeNow = time.Now
+}
+
+func (s *TestInspect) TestGoodData(c *C) {
+	expireTime := s.Now.Add(time.Hour)
+	ud := UsersData{
+		Users: []User{
+			{
+				Name:        "alice",
+				Groups:      []string{"wheel", "users"},
+				BackupCodes: []BackupCode{{}, {}},
+				TOTPDevices: []TOTPDevice{{
+					Name:  "phone",
+					Codes: []TOTPCode{{Time: s.Now}, {Time: s.Now.Add(2 * time.Hour)}},
+				}},
+			},
+			{Name: "bob", Groups: []string{"users"}},
+		},
+		Serial:     7,
+		ExpireTime: &expireTime,
+	}
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+
+	report, err := Inspect(signedData, s.AdminKey.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(report.Version, Equals, 2)
+	c.Assert(report.Serial, Equals, uint64(7))
+	c.Assert(*report.SignedBy, Equals, SigningPublicKey(s.AdminKey.AdminSigningPublicKey))
+	c.Assert(report.Users, Equals, 2)
+	c.Assert(report.Groups, DeepEquals, []string{"users", "wheel"})
+	c.Assert(report.TOTPHorizons, DeepEquals, []TOTPHorizon{
+		{User: "alice", Device: "phone", Horizon: s.Now.Add(2 * time.Hour)}})
+	c.Assert(report.BackupCodes, DeepEquals, map[string]int{"alice": 2})
+	c.Assert(report.Warnings, IsNil)
+
+	report, err = InspectAsAdmin(signedData, s.AdminKey)
+	c.Assert(err, IsNil)
+	c.Assert(report.Users, Equals, 2)
+
+	_, err = Inspect([]byte("xxx"), s.AdminKey.HostKey)
+	c.Assert(err, ErrorMatches, "invalid encoding")
+}
+
+func (s *TestInspect) TestWarnings(c *C) {
+	expireTime := s.Now.Add(-time.Hour)
+	ud := UsersData{
+		Users: []User{
+			{Name: "alice", TOTPDevices: []TOTPDevice{{
+				Name:  "phone",
+				Codes: []TOTPCode{{Time: s.Now.Add(-time.Minute)}},
+			}}},
+			{Name: "alice"},
+			{Name: "bob smith"},
+		},
+		ExpireTime: &expireTime,
+	}
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+
+	// keys without a signing key cannot verify the signature
+	legacyHostKey := s.AdminKey.HostKey
+	legacyHostKey.AdminSigningPublicKey = [32]byte{}
+	report, err := Inspect(signedData, legacyHostKey)
+	c.Assert(err, IsNil)
+	c.Assert(report.SignedBy, IsNil)
+	c.Assert(report.Warnings, DeepEquals, []string{
+		"the signature was not verified because the key does not include a signing key",
+		"the data expired at 2006-01-02T14:04:05Z",
+		"TOTP device \"phone\" of user \"alice\" has no codes after 2006-01-02T15:03:05Z",
+		"user \"alice\" appears more than once",
+		"user name \"bob smith\" not allowed in sudoers",
+	})
+}
@@ -1,11 +1,13 @@
 package usermgr
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -17,26 +19,47 @@ type AdminKey struct {
 	HostKey
 	AdminPrivateKey [32]byte
 	HostPublicKey   [32]byte
+
+	// AdminSigningPrivateKey is the seed of the ED25519 private key that
+	// signs the account database.
+	AdminSigningPrivateKey [32]byte
+}
+
+// encodeKey returns the text form of a key, which is URL-safe base64 without
+// padding.
+func encodeKey(buf []byte) []byte {
+	rv := make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
+	base64.RawURLEncoding.Encode(rv, buf)
+	return rv
+}
+
+// decodeKey returns the bytes of a key in text form.
+func decodeKey(text []byte) ([]byte, error) {
+	text = bytes.TrimRight(text, "=")
+	buf := make([]byte, base64.RawURLEncoding.DecodedLen(len(text)))
+	n, err := base64.RawURLEncoding.Decode(buf, text)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
 }
 
 func (ak AdminKey) MarshalText() (text []byte, err error) {
-	buf := make([]byte, 128)
+	buf := make([]byte, 128, 192)
 	copy(buf[0:32], ak.AdminPublicKey[:])
 	copy(buf[32:64], ak.HostPrivateKey[:])
 	copy(buf[64:96], ak.AdminPrivateKey[:])
 	copy(buf[96:128], ak.HostPublicKey[:])
-
-	rv := make([]byte, base64.URLEncoding.EncodedLen(len(buf)))
-	base64.URLEncoding.Encode(rv, buf)
-	rv = rv[:len(rv)-1] // strip the trailing '='
-	return rv, nil
+	if ak.HasSigningKey() {
+		buf = append(buf, ak.AdminSigningPublicKey[:]...)
+		buf = append(buf, ak.AdminSigningPrivateKey[:]...)
+	}
+	return encodeKey(buf), nil
 }
 
 func (ak *AdminKey) UnmarshalText(text []byte) error {
-	text = append(text, '=')
-	buf := make([]byte, base64.URLEncoding.DecodedLen(len(text)))
-	n, err := base64.URLEncoding.Decode(buf, text)
-	if err != nil || n != 128 {
+	buf, err := decodeKey(text)
+	if err != nil || (len(buf) != 128 && len(buf) != 192) {
 		return ErrIncorrectKeyFormat
 	}
 
@@ -50,6 +73,16 @@ func (ak *AdminKey) UnmarshalText(text []byte) error {
 	buf = buf[32:]
 
 	copy(ak.HostPublicKey[:], buf[0:32])
+	buf = buf[32:]
+
+	ak.HostKey.AdminSigningPublicKey = [32]byte{}
+	ak.AdminSigningPrivateKey = [32]byte{}
+	if len(buf) > 0 {
+		copy(ak.HostKey.AdminSigningPublicKey[:], buf[0:32])
+		buf = buf[32:]
+
+		copy(ak.AdminSigningPrivateKey[:], buf[0:32])
+	}
 	return nil
 }
 
@@ -74,26 +107,55 @@ func (ak AdminKey) String() string {
 	return string(text)
 }
 
+// Sign returns the ED25519 signature of message. It returns nil if the key
+// does not have a signing key.
+func (ak AdminKey) Sign(message []byte) []byte {
+	if !ak.HasSigningKey() {
+		return nil
+	}
+	return ed25519.Sign(ed25519.NewKeyFromSeed(ak.AdminSigningPrivateKey[:]), message)
+}
+
 type HostKey struct {
 	AdminPublicKey [32]byte
 	HostPrivateKey [32]byte
+
+	// AdminSigningPublicKey is the ED25519 public key that verifies the
+	// signature on the account database. Keys generated before signatures
+	// were introduced do not have one, in which case it is all zeros.
+	AdminSigningPublicKey [32]byte
+}
+
+// HasSigningKey returns true if the key includes an ED25519 signing key.
+// Data signed with such a key can only be produced by holders of the admin
+// key, while data sealed with older keys can be produced by anyone holding
+// the host key.
+func (hk HostKey) HasSigningKey() bool {
+	return hk.AdminSigningPublicKey != [32]byte{}
+}
+
+// Verify returns true if signature is a valid signature of message by the
+// admin signing key.
+func (hk HostKey) Verify(message []byte, signature []byte) bool {
+	if !hk.HasSigningKey() || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(hk.AdminSigningPublicKey[:]), message, signature)
 }
 
 func (hk HostKey) MarshalText() (text []byte, err error) {
-	buf := make([]byte, 64)
+	buf := make([]byte, 64, 96)
 	copy(buf[0:32], hk.AdminPublicKey[:])
 	copy(buf[32:64], hk.HostPrivateKey[:])
-	rv := make([]byte, base64.URLEncoding.EncodedLen(64))
-	base64.URLEncoding.Encode(rv, buf)
-	rv = rv[:len(rv)-2] // strip the two trailing '='
-	return rv, nil
+	if hk.HasSigningKey() {
+		buf = append(buf, hk.AdminSigningPublicKey[:]...)
+	}
+	return encodeKey(buf), nil
 }
 
 func (hk *HostKey) UnmarshalText(text []byte) error {
-	text = append(text, '=', '=')
-	buf := make([]byte, base64.URLEncoding.DecodedLen(len(text)))
-	n, err := base64.URLEncoding.Decode(buf, text)
-	if err != nil || n != 64 {
+	buf, err := decodeKey(text)
+	if err != nil || (len(buf) != 64 && len(buf) != 96) {
 		return ErrIncorrectKeyFormat
 	}
 
@@ -101,6 +163,12 @@ func (hk *HostKey) UnmarshalText(text []byte) error {
 	buf = buf[32:]
 
 	copy(hk.HostPrivateKey[:], buf[0:32])
+	buf = buf[32:]
+
+	hk.AdminSigningPublicKey = [32]byte{}
+	if len(buf) > 0 {
+		copy(hk.AdminSigningPublicKey[:], buf[0:32])
+	}
 	return nil
 }
 
@@ -140,5 +208,12 @@ func GenerateKeyPair() AdminKey {
 	}
 	ak.AdminPublicKey, ak.AdminPrivateKey = *pub, *priv
 
+	signingPub, signingPriv, err := ed25519.GenerateKey(randReader)
+	if err != nil {
+		panic(err)
+	}
+	copy(ak.AdminSigningPublicKey[:], signingPub)
+	copy(ak.AdminSigningPrivateKey[:], signingPriv.Seed())
+
 	return ak
 }
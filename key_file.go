@@ -0,0 +1,82 @@
+package usermgr
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// keyFileSaltBytes is the size of the salt used to derive the encryption key
+// of an admin key file from the passphrase.
+const keyFileSaltBytes = 32
+
+// EncryptAdminKey returns adminKey encrypted under passphrase, suitable for
+// storing in a file. The encryption key is derived from the passphrase with
+// scrypt and the admin key is sealed with NaCL secretbox.
+func EncryptAdminKey(adminKey AdminKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+
+	salt := make([]byte, keyFileSaltBytes)
+	if _, err := io.ReadFull(randReader, salt); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(randReader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key, err := keyFileKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, _ := adminKey.MarshalText()
+	buf := append(salt, nonce[:]...)
+	buf = secretbox.Seal(buf, plaintext, &nonce, key)
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "USERMGR ADMIN KEY",
+		Bytes: buf,
+	}), nil
+}
+
+// DecryptAdminKey returns the admin key from data, which is the output of
+// EncryptAdminKey, using passphrase.
+func DecryptAdminKey(data []byte, passphrase []byte) (*AdminKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "USERMGR ADMIN KEY" || len(block.Bytes) < keyFileSaltBytes+24 {
+		return nil, fmt.Errorf("invalid encoding")
+	}
+
+	salt := block.Bytes[:keyFileSaltBytes]
+	var nonce [24]byte
+	copy(nonce[:], block.Bytes[keyFileSaltBytes:keyFileSaltBytes+24])
+	key, err := keyFileKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := secretbox.Open(nil, block.Bytes[keyFileSaltBytes+24:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("cannot decrypt admin key. Wrong passphrase?")
+	}
+	adminKey := AdminKey{}
+	if err := adminKey.UnmarshalText(plaintext); err != nil {
+		return nil, err
+	}
+	return &adminKey, nil
+}
+
+// keyFileKey derives the secretbox key for an admin key file.
+func keyFileKey(passphrase, salt []byte) (*[32]byte, error) {
+	buf, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], buf)
+	return &key, nil
+}
@@ -0,0 +1,35 @@
+package usermgr
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestKeyFile{})
+
+type TestKeyFile struct {
+}
+
+func (s *TestKeyFile) SetUpTest(c *C) {
+	randReader = &testRandomReader{}
+}
+
+func (s *TestKeyFile) TestCanEncryptAndDecrypt(c *C) {
+	adminKey := GenerateKeyPair()
+
+	data, err := EncryptAdminKey(adminKey, []byte("hunter2"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, "(?s)-----BEGIN USERMGR ADMIN KEY-----\n.*")
+
+	rv, err := DecryptAdminKey(data, []byte("hunter2"))
+	c.Assert(err, IsNil)
+	c.Assert(*rv, Equals, adminKey)
+
+	_, err = DecryptAdminKey(data, []byte("hunter3"))
+	c.Assert(err, ErrorMatches, "cannot decrypt admin key. Wrong passphrase\\?")
+
+	_, err = DecryptAdminKey([]byte("xxx"), []byte("hunter2"))
+	c.Assert(err, ErrorMatches, "invalid encoding")
+
+	_, err = EncryptAdminKey(adminKey, []byte{})
+	c.Assert(err, ErrorMatches, "passphrase must not be empty")
+}
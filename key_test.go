@@ -106,6 +106,29 @@ func (s *TestKey) TestInvalidHostKey(c *C) {
 
 func (s *TestKey) TestCanGenerateKey(c *C) {
 	ak := GenerateKeyPair()
-	c.Assert(ak.String(), Equals, "m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw")
-	c.Assert(ak.HostKey.String(), Equals, "m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8Pg")
+	c.Assert(ak.String(), Equals, "m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXxCxslVGKf0d_FMPxcSFU04k4CtiZS0oenvfKu5nGAUBYCChIaIioyOkJKUlpianJ6goqSmqKqsrrCytLa4ury-")
+	c.Assert(ak.HostKey.String(), Equals, "m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkLGyVUYp_R38Uw_FxIVTTiTgK2JlLSh6e98q7mcYBQF")
+	c.Assert(ak.HasSigningKey(), Equals, true)
+
+	ak2 := AdminKey{}
+	c.Assert(ak2.UnmarshalText([]byte(ak.String())), IsNil)
+	c.Assert(ak2, DeepEquals, ak)
+
+	hk2 := HostKey{}
+	c.Assert(hk2.UnmarshalText([]byte(ak.HostKey.String())), IsNil)
+	c.Assert(hk2, DeepEquals, ak.HostKey)
+}
+
+func (s *TestKey) TestSignature(c *C) {
+	ak := GenerateKeyPair()
+	signature := ak.Sign([]byte("hello"))
+	c.Assert(ak.HostKey.Verify([]byte("hello"), signature), Equals, true)
+	c.Assert(ak.HostKey.Verify([]byte("Hello"), signature), Equals, false)
+	c.Assert(ak.HostKey.Verify([]byte("hello"), signature[1:]), Equals, false)
+
+	// keys without a signing key neither sign nor verify
+	ak.AdminSigningPrivateKey = [32]byte{}
+	ak.AdminSigningPublicKey = [32]byte{}
+	c.Assert(ak.Sign([]byte("hello")), IsNil)
+	c.Assert(ak.HostKey.Verify([]byte("hello"), signature), Equals, false)
 }
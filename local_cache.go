@@ -1,79 +1,541 @@
 package usermgr
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/errset"
 )
 
-// UpdateLocalCache fetches the user data from upstreamURL if it is unchanged.
-// If the response is valid, the cache files in path are replaced and the
-// new data are returned.
-func UpdateLocalCache(path string, upstreamURL string, hostKey HostKey) (*UsersData, error) {
-	var userData *UsersData
+// trustedKeyFile is the name of the file in the cache directory that holds
+// the host key learned through a key rotation. When present it supersedes
+// the host key from the configuration file.
+const trustedKeyFile = "users.key"
 
-	etag := ""
-	etagBuf, err := ioutil.ReadFile(filepath.Join(path, "users.pem.etag"))
-	if os.IsNotExist(err) {
-		etag = ""
-	} else if err != nil {
-		return nil, err
-	} else {
-		// Check that the existing data are valid. If not, then we set the
-		// etag to "" so we can do an unconditional fetch.
-		dataBuf, err := ioutil.ReadFile(filepath.Join(path, "users.pem"))
-		if err == nil {
-			userData, err = LoadUsersData(dataBuf, hostKey)
-			if err == nil {
-				etag = string(etagBuf)
-			}
+// nextKeyFile is the name of the file in the cache directory that holds the
+// key announced by the current account database as the one that will be used
+// to sign future versions.
+const nextKeyFile = "users.next-key"
+
+// serialFile is the name of the file in the cache directory that holds the
+// highest serial number of any data accepted into the cache.
+const serialFile = "users.serial"
+
+// updatedFile is the name of the file in the cache directory that holds the
+// time of the last successful Update, whether or not the data changed.
+const updatedFile = "users.updated"
+
+// ownKeyFile is the name of the file in the cache directory that holds the
+// private key of the host's own key pair, which is generated when the host
+// enrolls with the web interface.
+const ownKeyFile = "host.key"
+
+// ErrExpired is returned when the cached data have expired and there is
+// no break-glass group to fall back to.
+var ErrExpired = errors.New("user data have expired")
+
+// LocalCache is the copy of the account database stored on a host.
+type LocalCache struct {
+	// Path is the directory where the cached data are stored.
+	Path string
+
+	// HostKey is used to verify the data until a rotation announced by the
+	// data itself (see UsersData.NextKey) has taken place, after which the
+	// key learned from the announcement, which is stored in Path, is used
+	// instead.
+	HostKey HostKey
+
+	// BreakGlassGroups determines what happens when the data have expired.
+	// If empty, expired data are refused. Otherwise only the users who are
+	// members of one of these groups are returned.
+	BreakGlassGroups []string
+
+	// SignaturePolicy lists the administrators who must approve the data
+	// before they are accepted. See SignaturePolicy.
+	SignaturePolicy SignaturePolicy
+
+	// HTTP configures the client used to fetch the data over HTTP and from
+	// S3.
+	HTTP HTTPOptions
+
+	// MaxDataSize is the largest response from a server, file or command
+	// that is read. If zero, DefaultMaxDataSize is used.
+	MaxDataSize int64
+
+	// HistorySize is the number of versions of the data that are kept in
+	// the cache, see History. If zero, no history is kept.
+	HistorySize int
+
+	// HistoryMaxAge is how long versions of the data are kept in the
+	// history. If zero, they are kept until there are more than HistorySize.
+	HistoryMaxAge time.Duration
+}
+
+func (lc LocalCache) maxDataSize() int64 {
+	if lc.MaxDataSize == 0 {
+		return DefaultMaxDataSize
+	}
+	return lc.MaxDataSize
+}
+
+// trustedKeys returns the host key that the cache currently trusts, and the
+// announced next key, if any.
+func (lc LocalCache) trustedKeys() (HostKey, *HostKey) {
+	hostKey := lc.HostKey
+	if buf, err := ioutil.ReadFile(filepath.Join(lc.Path, trustedKeyFile)); err == nil {
+		trustedKey := HostKey{}
+		if err := trustedKey.UnmarshalText(buf); err == nil {
+			hostKey = trustedKey
+		}
+	}
+
+	var nextKey *HostKey
+	if buf, err := ioutil.ReadFile(filepath.Join(lc.Path, nextKeyFile)); err == nil {
+		k := HostKey{}
+		if err := k.UnmarshalText(buf); err == nil && k != hostKey {
+			nextKey = &k
 		}
 	}
+	return hostKey, nextKey
+}
 
-	// make an HTTP request to fetch the new data
-	req, err := http.NewRequest("GET", upstreamURL, nil)
+// ownPrivateKey returns the private key of the host's own key pair, or nil
+// if the host has not generated one.
+func (lc LocalCache) ownPrivateKey() *[32]byte {
+	buf, err := ioutil.ReadFile(filepath.Join(lc.Path, ownKeyFile))
 	if err != nil {
-		return nil, err
+		return nil
+	}
+	keyBuf, err := decodeKey(bytes.TrimSpace(buf))
+	if err != nil || len(keyBuf) != 32 {
+		return nil
+	}
+	var privateKey [32]byte
+	copy(privateKey[:], keyBuf)
+	return &privateKey
+}
+
+// OwnPublicKey returns the public key of the host's own key pair,
+// generating the key pair if it does not exist yet. Once an administrator
+// approves the host (see Host), the data are encrypted to this key.
+func (lc LocalCache) OwnPublicKey() (HostPublicKey, error) {
+	if privateKey := lc.ownPrivateKey(); privateKey != nil {
+		return HostKey{HostPrivateKey: *privateKey}.PublicKey(), nil
+	}
+
+	var privateKey [32]byte
+	if _, err := io.ReadFull(randReader, privateKey[:]); err != nil {
+		return HostPublicKey{}, err
 	}
-	if etag != "" {
-		req.Header.Add("If-None-Match", etag)
+	os.MkdirAll(lc.Path, 0700)
+	if err := ioutil.WriteFile(filepath.Join(lc.Path, ownKeyFile), encodeKey(privateKey[:]), 0600); err != nil {
+		return HostPublicKey{}, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	return HostKey{HostPrivateKey: privateKey}.PublicKey(), nil
+}
+
+// loadWithKey parses data using the host's own private key, if any, and
+// then hostKey.
+func (lc LocalCache) loadWithKey(data []byte, hostKey HostKey) (*UsersData, error) {
+	if privateKey := lc.ownPrivateKey(); privateKey != nil {
+		if userData, err := LoadUsersData(data, hostKey.WithPrivateKey(*privateKey)); err == nil {
+			return userData, nil
+		}
+	}
+	return LoadUsersData(data, hostKey)
+}
+
+// load parses data using the announced next key or, failing that, the key
+// currently trusted by the cache. It returns the key that was used.
+//
+// The next key is tried first because it may share its encryption keys with
+// the current key and differ only in requiring a signature, in which case
+// data produced with the next key would also be accepted by the current one.
+func (lc LocalCache) load(data []byte) (*UsersData, HostKey, error) {
+	currentKey, nextKey := lc.trustedKeys()
+	if err := lc.SignaturePolicy.Verify(data); err != nil {
+		return nil, currentKey, err
+	}
+	if nextKey != nil {
+		if userData, err := lc.loadWithKey(data, *nextKey); err == nil {
+			return userData, *nextKey, nil
+		}
+	}
+	userData, err := lc.loadWithKey(data, currentKey)
 	if err != nil {
-		return nil, err
+		return nil, currentKey, err
 	}
-	if resp.StatusCode == http.StatusNotModified && userData != nil {
-		// The response is that the file is unchanged, so we just return
-		// the parsed, cached data.
+	return userData, currentKey, nil
+}
+
+// Load parses data with the keys that the cache trusts, without storing
+// the data in the cache.
+func (lc LocalCache) Load(data []byte) (*UsersData, error) {
+	userData, _, err := lc.load(data)
+	return userData, err
+}
+
+// updateTrustedKeys records the key that signed userData as the trusted key
+// for the cache and remembers the next key that userData announces. Once
+// data signed by the announced key is seen, the previous key is no longer
+// trusted.
+func (lc LocalCache) updateTrustedKeys(userData *UsersData, signingKey HostKey) error {
+	currentKey, _ := lc.trustedKeys()
+	if signingKey != currentKey {
+		text, _ := signingKey.MarshalText()
+		if err := writeKeyFile(filepath.Join(lc.Path, trustedKeyFile), text); err != nil {
+			return err
+		}
+	}
+
+	if userData.NextKey == nil || *userData.NextKey == signingKey {
+		if err := os.Remove(filepath.Join(lc.Path, nextKeyFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	text, _ := userData.NextKey.MarshalText()
+	return writeKeyFile(filepath.Join(lc.Path, nextKeyFile), text)
+}
+
+// writeKeyFile writes a marshalled key, which includes the host private key,
+// to a file that only its owner can read. Files written by older versions
+// are made private too.
+func writeKeyFile(path string, text []byte) error {
+	if err := ioutil.WriteFile(path, text, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// Serial returns the highest serial number of any data that were accepted
+// into the cache, or zero if there are none.
+func (lc LocalCache) Serial() (uint64, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(lc.Path, serialFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+// checkSerial returns an error if userData are older than data that were
+// previously accepted into the cache.
+func (lc LocalCache) checkSerial(userData *UsersData) error {
+	serial, err := lc.Serial()
+	if err != nil {
+		return err
+	}
+	if userData.Serial < serial {
+		return fmt.Errorf("user data serial %d is older than cached serial %d",
+			userData.Serial, serial)
+	}
+	return nil
+}
+
+// checkExpiry applies the expiry policy to userData, returning either the
+// data, the data restricted to the break-glass groups or ErrExpired.
+func (lc LocalCache) checkExpiry(userData *UsersData) (*UsersData, error) {
+	if userData.ExpireTime == nil || timeNow().Before(*userData.ExpireTime) {
 		return userData, nil
 	}
+	if len(lc.BreakGlassGroups) == 0 {
+		return nil, ErrExpired
+	}
+	users := []User{}
+	for _, user := range userData.Users {
+		if user.InAnyGroup(lc.BreakGlassGroups) {
+			users = append(users, user)
+		}
+	}
+	userData.Users = users
+	return userData, nil
+}
+
+// recordUpdate remembers that Update succeeded at the current time.
+func (lc LocalCache) recordUpdate() error {
+	return ioutil.WriteFile(filepath.Join(lc.Path, updatedFile),
+		[]byte(timeNow().UTC().Format(time.RFC3339)), 0644)
+}
+
+// CacheInfo describes the state of the local cache. See LocalCache.Info.
+type CacheInfo struct {
+	// LastUpdate is the time of the last successful Update, or nil if it
+	// has never succeeded.
+	LastUpdate *time.Time
+
+	// FetchTime is the time the cached copy of the data was fetched, or nil
+	// if there is no cached copy.
+	FetchTime *time.Time
+
+	// ETag is the entity tag of the cached copy as reported by the server.
+	ETag string
+
+	// Pinned is the ID of the version the cache is pinned to, or empty if
+	// it is not pinned. See Rollback.
+	Pinned string
+}
+
+// Info returns the state of the local cache. It does not read the data
+// themselves, see Get.
+func (lc LocalCache) Info() (CacheInfo, error) {
+	info := CacheInfo{}
+	if buf, err := ioutil.ReadFile(filepath.Join(lc.Path, updatedFile)); err == nil {
+		lastUpdate, err := time.Parse(time.RFC3339, strings.TrimSpace(string(buf)))
+		if err != nil {
+			return info, fmt.Errorf("%s: %s", updatedFile, err)
+		}
+		info.LastUpdate = &lastUpdate
+	} else if !os.IsNotExist(err) {
+		return info, err
+	}
+
+	if fi, err := os.Stat(filepath.Join(lc.Path, "users.pem")); err == nil {
+		fetchTime := fi.ModTime()
+		info.FetchTime = &fetchTime
+	} else if !os.IsNotExist(err) {
+		return info, err
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(lc.Path, "users.pem.etag")); err == nil {
+		info.ETag = string(buf)
+	} else if !os.IsNotExist(err) {
+		return info, err
+	}
+
+	pinned, err := lc.Pinned()
+	if err != nil {
+		return info, err
+	}
+	info.Pinned = pinned
+	return info, nil
+}
+
+// fetchResult is a valid copy of the data served by a mirror.
+type fetchResult struct {
+	dataBuf    []byte
+	etag       string
+	userData   *UsersData
+	signingKey HostKey
+}
+
+// fetchHTTP requests the data from upstreamURL. If etag is not empty the
+// request is conditional, and if the server responds that the data are
+// unchanged the data returned are nil.
+//
+// URLs like s3://bucket/key are fetched from S3 with signed requests, see
+// newS3Request.
+func fetchHTTP(client *http.Client, upstreamURL string, etag string, maxSize int64) ([]byte, string, error) {
+	isS3 := strings.HasPrefix(upstreamURL, "s3://")
+	var req *http.Request
+	var err error
+	if isS3 {
+		req, err = newS3Request(upstreamURL, etag)
+	} else {
+		req, err = http.NewRequest("GET", upstreamURL, nil)
+		if err == nil && etag != "" {
+			req.Header.Add("If-None-Match", etag)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return nil, "", nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s", resp.Status)
+		if isS3 {
+			return nil, "", s3Error(resp)
+		}
+		return nil, "", fmt.Errorf("%s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, "", fmt.Errorf("data exceed the limit of %d bytes", maxSize)
+	}
+	dataBuf, err := readLimited(resp.Body, maxSize)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataBuf, resp.Header.Get("ETag"), nil
+}
+
+// fetchData gets the data from upstreamURL, which is either an HTTP(S) or
+// S3 URL (see fetchHTTP), a file:// URL (see fetchFile) or an exec:// URL
+// (see fetchCommand). If etag is not empty and the data are unchanged the
+// data returned are nil.
+func (lc LocalCache) fetchData(client *http.Client, upstreamURL string, etag string) ([]byte, string, error) {
+	switch {
+	case strings.HasPrefix(upstreamURL, "file://"):
+		return fetchFile(upstreamURL, etag, lc.maxDataSize())
+	case strings.HasPrefix(upstreamURL, "exec://"):
+		return fetchCommand(upstreamURL, etag, lc.HTTP.timeout(), lc.maxDataSize())
+	default:
+		return fetchHTTP(client, upstreamURL, etag, lc.maxDataSize())
+	}
+}
+
+// Fetch returns the data at upstreamURL without verifying them or storing
+// them in the cache.
+func (lc LocalCache) Fetch(upstreamURL string) ([]byte, error) {
+	client, err := lc.HTTP.Client()
+	if err != nil {
+		return nil, err
+	}
+	dataBuf, _, err := lc.fetchData(client, upstreamURL, "")
+	return dataBuf, err
+}
+
+// fetch gets the data from upstreamURL, see fetchData, and verifies them.
+// If etag is not empty and the data are unchanged the result is nil. Data
+// from every kind of source are verified the same way.
+func (lc LocalCache) fetch(client *http.Client, upstreamURL string, etag string) (*fetchResult, error) {
+	dataBuf, newETag, err := lc.fetchData(client, upstreamURL, etag)
+	if err != nil {
+		return nil, err
+	}
+	if dataBuf == nil && etag != "" {
+		return nil, nil
 	}
 
 	// Verify that the response contains a valid message
-	dataBuf, err := ioutil.ReadAll(resp.Body)
+	userData, signingKey, err := lc.load(dataBuf)
 	if err != nil {
 		return nil, err
 	}
-	userData, err = LoadUsersData(dataBuf, hostKey)
+	if err := lc.checkSerial(userData); err != nil {
+		return nil, err
+	}
+	return &fetchResult{
+		dataBuf:    dataBuf,
+		etag:       newETag,
+		userData:   userData,
+		signingKey: signingKey,
+	}, nil
+}
+
+// Update fetches the user data from each of the mirrors in upstreamURLs,
+// using a conditional request to each mirror if the cached data are valid.
+// If any mirror returns valid data, the cache files are replaced with the
+// copy having the highest serial number and the new data are returned.
+// Which mirror served the data does not matter, because the data are
+// trusted only for their signature.
+//
+// Data having a serial number lower than that of data previously accepted
+// into the cache are rejected, so that an old copy of the data cannot be
+// replayed.
+//
+// Mirrors that fail are skipped for a while, unless all of them have
+// failed. See MirrorStatus.
+//
+// New data are also added to the history of the cache, see History. If the
+// cache is pinned to a previous version, that version is returned instead.
+func (lc LocalCache) Update(upstreamURLs ...string) (*UsersData, error) {
+	path := lc.Path
+	if len(upstreamURLs) == 0 {
+		return nil, fmt.Errorf("no upstream URL specified")
+	}
+	mirrors, err := lc.mirrorStatus(upstreamURLs)
+	if err != nil {
+		return nil, err
+	}
+	client, err := lc.HTTP.Client()
 	if err != nil {
 		return nil, err
 	}
 
+	// Check that the existing data are valid. If not, then we make
+	// unconditional requests.
+	var cachedData *UsersData
+	if dataBuf, err := ioutil.ReadFile(filepath.Join(path, "users.pem")); err == nil {
+		if userData, _, err := lc.load(dataBuf); err == nil {
+			cachedData = userData
+		}
+	}
+
+	now := timeNow()
+	anyAvailable := false
+	for _, mirror := range mirrors {
+		if !now.Before(mirror.backoffUntil()) {
+			anyAvailable = true
+		}
+	}
+
+	errs := errset.ErrSet{}
+	unchanged := false
+	var best *fetchResult
+	for i := range mirrors {
+		mirror := &mirrors[i]
+		if anyAvailable && now.Before(mirror.backoffUntil()) {
+			continue
+		}
+
+		etag := ""
+		if cachedData != nil {
+			etag = mirror.ETag
+		}
+		result, err := lc.fetch(client, mirror.URL, etag)
+		if err != nil {
+			mirror.failed(err)
+			if len(mirrors) > 1 {
+				err = fmt.Errorf("%s: %s", mirror.URL, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if result == nil {
+			mirror.succeeded(mirror.ETag, mirror.Serial)
+			unchanged = true
+			continue
+		}
+		mirror.succeeded(result.etag, result.userData.Serial)
+		if best == nil || result.userData.Serial > best.userData.Serial {
+			best = result
+		}
+	}
+
 	// make sure the output directory exists. The error can be safely ignored,
 	// because it will be either because the directory already exists or a
 	// subsequent write will fail.
-	os.MkdirAll(path, 0755)
+	os.MkdirAll(path, 0700)
+
+	if best == nil {
+		if err := lc.writeMirrorStatus(mirrors); err != nil {
+			return nil, err
+		}
+		if !unchanged {
+			return nil, errs.ReturnValue()
+		}
+
+		// The response is that the file is unchanged, so we just return
+		// the parsed, cached data.
+		if err := lc.recordUpdate(); err != nil {
+			return nil, err
+		}
+		return lc.current(cachedData)
+	}
 
 	// Write the response (very carefully) to the cache location
-	if err := ioutil.WriteFile(filepath.Join(path, "users.pem~"), dataBuf, 0644); err != nil {
+	if err := ioutil.WriteFile(filepath.Join(path, "users.pem~"), best.dataBuf, 0644); err != nil {
 		return nil, err
 	}
 	if err := ioutil.WriteFile(filepath.Join(path, "users.pem.etag"),
-		[]byte(resp.Header.Get("ETag")), 0644); err != nil {
+		[]byte(best.etag), 0644); err != nil {
 		os.Remove(filepath.Join(path, "users.pem~"))
 		return nil, err
 	}
@@ -83,21 +545,67 @@ func UpdateLocalCache(path string, upstreamURL string, hostKey HostKey) (*UsersD
 		os.Remove(filepath.Join(path, "users.pem.etag"))
 		return nil, err
 	}
-	return userData, nil
+	if err := ioutil.WriteFile(filepath.Join(path, serialFile),
+		[]byte(strconv.FormatUint(best.userData.Serial, 10)), 0644); err != nil {
+		return nil, err
+	}
+	if err := lc.updateTrustedKeys(best.userData, best.signingKey); err != nil {
+		return nil, err
+	}
+	if err := lc.addToHistory(best.dataBuf, best.userData.Serial); err != nil {
+		return nil, err
+	}
+	if err := lc.writeMirrorStatus(mirrors); err != nil {
+		return nil, err
+	}
+	if err := lc.recordUpdate(); err != nil {
+		return nil, err
+	}
+	return lc.current(best.userData)
 }
 
-// GetLocalCache returns the local cached data in path if it is valid. It
-// does not attempt to update the cache.
-func GetLocalCache(path string, hostKey HostKey) (*UsersData, error) {
-	dataBuf, err := ioutil.ReadFile(filepath.Join(path, "users.pem"))
+// current returns the version of the data in use, which is userData
+// unless the cache is pinned to a previous version.
+func (lc LocalCache) current(userData *UsersData) (*UsersData, error) {
+	if pinned, err := lc.getPinned(); pinned != nil || err != nil {
+		return pinned, err
+	}
+	return lc.checkExpiry(userData)
+}
+
+// Get returns the local cached data if it is valid, or the pinned version
+// if the cache is pinned (see Rollback). It does not attempt to update the
+// cache.
+func (lc LocalCache) Get() (*UsersData, error) {
+	if pinned, err := lc.getPinned(); pinned != nil || err != nil {
+		return pinned, err
+	}
+
+	dataBuf, err := ioutil.ReadFile(filepath.Join(lc.Path, "users.pem"))
 	if err != nil {
 		return nil, fmt.Errorf("Cannot read users data: %s", err)
 	}
 
-	userData, err := LoadUsersData(dataBuf, hostKey)
+	userData, _, err := lc.load(dataBuf)
 	if err != nil {
 		return nil, err
 	}
+	if err := lc.checkSerial(userData); err != nil {
+		return nil, err
+	}
 
-	return userData, nil
+	return lc.checkExpiry(userData)
+}
+
+// UpdateLocalCache fetches the user data from upstreamURL if it is unchanged.
+// If the response is valid, the cache files in path are replaced and the
+// new data are returned. See LocalCache.Update.
+func UpdateLocalCache(path string, upstreamURL string, hostKey HostKey) (*UsersData, error) {
+	return LocalCache{Path: path, HostKey: hostKey}.Update(upstreamURL)
+}
+
+// GetLocalCache returns the local cached data in path if it is valid. It
+// does not attempt to update the cache. See LocalCache.Get.
+func GetLocalCache(path string, hostKey HostKey) (*UsersData, error) {
+	return LocalCache{Path: path, HostKey: hostKey}.Get()
 }
@@ -1,6 +1,7 @@
 package usermgr
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -14,6 +15,42 @@ import (
 
 var _ = Suite(&TestLocal{})
 
+// localCacheFixture is embedded in the suites that fetch signed data into a
+// local cache. It fixes the time and the random numbers, and provides a
+// temporary directory and an admin key to sign the data with.
+type localCacheFixture struct {
+	tempDir  string
+	AdminKey AdminKey
+}
+
+func (f *localCacheFixture) SetUpTest(c *C) {
+	timeNow = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
+		return t
+	}
+	randReader = &testRandomReader{Next: 1}
+
+	var err error
+	f.tempDir, err = ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	f.AdminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
+}
+
+func (f *localCacheFixture) TearDownTest(c *C) {
+	os.RemoveAll(f.tempDir)
+	timeNow = time.Now
+	randReader = rand.Reader
+}
+
+// signedData returns data for the user alice with the specified serial
+// number, signed with the admin key.
+func (f *localCacheFixture) signedData(c *C, serial uint64) []byte {
+	ud := UsersData{Serial: serial, Users: []User{{Name: "alice"}}}
+	signedData, err := ud.SignedString(f.AdminKey)
+	c.Assert(err, IsNil)
+	return signedData
+}
+
 type TestLocal struct {
 	tempDir string
 	HostKey HostKey
@@ -115,11 +152,19 @@ func (s *TestLocal) TestCanRead(c *C) {
 
 	// now try with an existing etag
 	testServerMissCount = 0
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.updated"), []byte("2006-01-01T00:00:00Z"), 0644)
 	ud, err = UpdateLocalCache(s.tempDir, testServer.URL, s.HostKey)
 	c.Assert(err, IsNil)
 	c.Assert(ud, DeepEquals, expectedUserData)
 	c.Assert(testServerMissCount, Equals, 0)
 
+	// an unchanged response still counts as an update
+	info, err := LocalCache{Path: s.tempDir}.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info.LastUpdate.Equal(timeNow()), Equals, true)
+	c.Assert(info.FetchTime, NotNil)
+	c.Assert(info.ETag, Equals, "this-is-the-etag")
+
 	// if the cached data is invalid, we don't use it
 	testServerMissCount = 0
 	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), []byte("wrong-content"), 0644)
@@ -130,7 +175,8 @@ func (s *TestLocal) TestCanRead(c *C) {
 
 	// try again with an old etag
 	testServerMissCount = 0
-	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem.etag"), []byte("wrong-etag"), 0644)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.mirrors"), []byte(
+		fmt.Sprintf(`[{"url": %q, "etag": "wrong-etag"}]`, testServer.URL)), 0644)
 	ud, err = UpdateLocalCache(s.tempDir, testServer.URL, s.HostKey)
 	c.Assert(err, IsNil)
 	c.Assert(ud, DeepEquals, expectedUserData)
@@ -148,7 +194,7 @@ func (s *TestLocal) TestCanRead(c *C) {
 
 func (s *TestLocal) TestCannotReadEtagFile(c *C) {
 	_, err := UpdateLocalCache("/dev/null", "", s.HostKey)
-	c.Assert(err, ErrorMatches, "open /dev/null/users.pem.etag: not a directory")
+	c.Assert(err, ErrorMatches, "open /dev/null/users.mirrors: not a directory")
 }
 
 func (s *TestLocal) TestInvalidURLs(c *C) {
@@ -268,3 +314,189 @@ func (s *TestLocal) TestGetLocalCacheFail(c *C) {
 	_, err = GetLocalCache(s.tempDir, s.HostKey)
 	c.Assert(err, ErrorMatches, ".*: permission denied")
 }
+
+func (s *TestLocal) TestKeyRotation(c *C) {
+	currentAdminKey := AdminKey{}
+	currentAdminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
+	randReader = &testRandomReader{Next: 1}
+	nextAdminKey := GenerateKeyPair()
+
+	var signedData []byte
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signedData)
+	}))
+	defer testServer.Close()
+
+	// phase 1: data signed by the current key announces the next key
+	ud := UsersData{Users: []User{{Name: "alice"}}, NextKey: &nextAdminKey.HostKey}
+	signedData, _ = ud.SignedString(currentAdminKey)
+	_, err := UpdateLocalCache(s.tempDir, testServer.URL, s.HostKey)
+	c.Assert(err, IsNil)
+
+	buf, err := ioutil.ReadFile(filepath.Join(s.tempDir, "users.next-key"))
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, nextAdminKey.HostKey.String())
+	_, err = os.Stat(filepath.Join(s.tempDir, "users.key"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the keys include the host private key, so only root can read them
+	fi, err := os.Stat(filepath.Join(s.tempDir, "users.next-key"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// phase 2: data signed by the next key is accepted, and the next key
+	// becomes the trusted key
+	ud = UsersData{Users: []User{{Name: "bob"}}}
+	signedData, _ = ud.SignedString(nextAdminKey)
+	rv, err := UpdateLocalCache(s.tempDir, testServer.URL, s.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "bob")
+
+	buf, err = ioutil.ReadFile(filepath.Join(s.tempDir, "users.key"))
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, nextAdminKey.HostKey.String())
+	fi, err = os.Stat(filepath.Join(s.tempDir, "users.key"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	_, err = os.Stat(filepath.Join(s.tempDir, "users.next-key"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	rv, err = GetLocalCache(s.tempDir, s.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "bob")
+
+	// the old key is no longer trusted
+	ud = UsersData{Users: []User{{Name: "mallory"}}}
+	signedData, _ = ud.SignedString(currentAdminKey)
+	_, err = UpdateLocalCache(s.tempDir, testServer.URL, s.HostKey)
+	c.Assert(err, ErrorMatches, "user data is not signed")
+
+	rv, err = GetLocalCache(s.tempDir, s.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "bob")
+}
+
+func (s *TestLocal) TestRollback(c *C) {
+	adminKey := AdminKey{}
+	adminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
+
+	var signedData []byte
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signedData)
+	}))
+	defer testServer.Close()
+
+	ud := UsersData{Users: []User{{Name: "alice"}}, Serial: 5}
+	signedData, _ = ud.SignedString(adminKey)
+	_, err := UpdateLocalCache(s.tempDir, testServer.URL, s.HostKey)
+	c.Assert(err, IsNil)
+
+	lc := LocalCache{Path: s.tempDir, HostKey: s.HostKey}
+	serial, err := lc.Serial()
+	c.Assert(err, IsNil)
+	c.Assert(serial, Equals, uint64(5))
+
+	// replaying older data fails
+	ud = UsersData{Users: []User{{Name: "alice"}, {Name: "mallory"}}, Serial: 4}
+	signedData, _ = ud.SignedString(adminKey)
+	_, err = lc.Update(testServer.URL)
+	c.Assert(err, ErrorMatches, "user data serial 4 is older than cached serial 5")
+
+	// as does data without a serial
+	ud = UsersData{Users: []User{{Name: "alice"}, {Name: "mallory"}}}
+	signedData, _ = ud.SignedString(adminKey)
+	_, err = lc.Update(testServer.URL)
+	c.Assert(err, ErrorMatches, "user data serial 0 is older than cached serial 5")
+
+	rv, err := lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(len(rv.Users), Equals, 1)
+
+	// old data placed directly in the cache are not used either
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+	_, err = lc.Get()
+	c.Assert(err, ErrorMatches, "user data serial 0 is older than cached serial 5")
+
+	// newer data are accepted
+	ud = UsersData{Users: []User{{Name: "bob"}}, Serial: 6}
+	signedData, _ = ud.SignedString(adminKey)
+	rv, err = lc.Update(testServer.URL)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "bob")
+	serial, _ = lc.Serial()
+	c.Assert(serial, Equals, uint64(6))
+}
+
+func (s *TestLocal) TestExpiry(c *C) {
+	adminKey := AdminKey{}
+	adminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
+
+	expireTime := timeNow().Add(time.Minute)
+	ud := UsersData{
+		Users: []User{
+			{Name: "alice", Groups: []string{"users"}},
+			{Name: "bob", Groups: []string{"users", "oncall"}},
+		},
+		ExpireTime: &expireTime,
+	}
+	signedData, _ := ud.SignedString(adminKey)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+
+	lc := LocalCache{Path: s.tempDir, HostKey: s.HostKey}
+	rv, err := lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(len(rv.Users), Equals, 2)
+
+	// once expired, the data are refused
+	timeNow = func() time.Time {
+		return expireTime.Add(time.Second)
+	}
+	_, err = lc.Get()
+	c.Assert(err, Equals, ErrExpired)
+
+	// ... unless there are break glass groups
+	lc.BreakGlassGroups = []string{"oncall"}
+	rv, err = lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(len(rv.Users), Equals, 1)
+	c.Assert(rv.Users[0].Name, Equals, "bob")
+}
+
+func (s *TestLocal) TestSignaturePolicy(c *C) {
+	randReader = &testRandomReader{Next: 1}
+	adminKey := AdminKey{}
+	adminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
+	alice := GenerateSigningKey()
+	bob := GenerateSigningKey()
+
+	ud := UsersData{Users: []User{{Name: "alice"}}}
+	signedData, _ := ud.SignedString(adminKey)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+
+	lc := LocalCache{
+		Path:    s.tempDir,
+		HostKey: s.HostKey,
+		SignaturePolicy: SignaturePolicy{
+			Keys:      []SigningPublicKey{alice.PublicKey, bob.PublicKey},
+			Threshold: 1,
+		},
+	}
+	_, err := lc.Get()
+	c.Assert(err, ErrorMatches, "user data approved by 0 of 1 required administrators")
+
+	signedData, _ = Approve(signedData, bob)
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.pem"), signedData, 0644)
+	rv, err := lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "alice")
+}
+
+func (s *TestLocal) TestInfo(c *C) {
+	info, err := LocalCache{Path: s.tempDir}.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info, DeepEquals, CacheInfo{})
+
+	ioutil.WriteFile(filepath.Join(s.tempDir, "users.updated"), []byte("yesterday"), 0644)
+	_, err = LocalCache{Path: s.tempDir}.Info()
+	c.Assert(err, ErrorMatches, "users.updated: .*")
+}
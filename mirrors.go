@@ -0,0 +1,111 @@
+package usermgr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// mirrorsFile is the name of the file in the cache directory that holds
+// the state of each upstream mirror.
+const mirrorsFile = "users.mirrors"
+
+// maxMirrorBackoff is the longest time a failing mirror is skipped for.
+const maxMirrorBackoff = time.Hour
+
+// MirrorStatus describes the health of an upstream mirror of the account
+// database. See LocalCache.Update.
+type MirrorStatus struct {
+	URL string `json:"url"`
+
+	// ETag is the entity tag of the data the mirror last served, which is
+	// sent in conditional requests to the mirror.
+	ETag string `json:"etag,omitempty"`
+
+	// Serial is the serial number of the data the mirror last served.
+	Serial uint64 `json:"serial"`
+
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+
+	// Failures is the number of consecutive failed requests to the mirror.
+	Failures int `json:"failures,omitempty"`
+}
+
+// backoffUntil returns the time before which the mirror is not tried, so
+// that a mirror that is down does not slow down every update.
+func (ms MirrorStatus) backoffUntil() time.Time {
+	if ms.Failures == 0 || ms.LastFailure == nil {
+		return time.Time{}
+	}
+	backoff := maxMirrorBackoff
+	if ms.Failures < 7 {
+		backoff = time.Minute << uint(ms.Failures-1)
+	}
+	return ms.LastFailure.Add(backoff)
+}
+
+func (ms *MirrorStatus) succeeded(etag string, serial uint64) {
+	now := timeNow()
+	ms.ETag = etag
+	ms.Serial = serial
+	ms.LastSuccess = &now
+	ms.LastError = ""
+	ms.Failures = 0
+}
+
+func (ms *MirrorStatus) failed(err error) {
+	now := timeNow()
+	ms.LastFailure = &now
+	ms.LastError = err.Error()
+	ms.Failures++
+}
+
+// Mirrors returns the state of the mirrors that the cache has been updated
+// from.
+func (lc LocalCache) Mirrors() ([]MirrorStatus, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(lc.Path, mirrorsFile))
+	if os.IsNotExist(err) {
+		return []MirrorStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := []MirrorStatus{}
+	if err := json.Unmarshal(buf, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// mirrorStatus returns the state of each of the mirrors in upstreamURLs.
+func (lc LocalCache) mirrorStatus(upstreamURLs []string) ([]MirrorStatus, error) {
+	mirrors, err := lc.Mirrors()
+	if err != nil {
+		return nil, err
+	}
+	rv := []MirrorStatus{}
+	for _, upstreamURL := range upstreamURLs {
+		status := MirrorStatus{URL: upstreamURL}
+		for _, mirror := range mirrors {
+			if mirror.URL == upstreamURL {
+				status = mirror
+			}
+		}
+		rv = append(rv, status)
+	}
+	return rv, nil
+}
+
+// writeMirrorStatus stores the state of the mirrors. Mirrors that are no
+// longer configured are forgotten.
+func (lc LocalCache) writeMirrorStatus(mirrors []MirrorStatus) error {
+	buf, err := json.MarshalIndent(mirrors, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(lc.Path, mirrorsFile), buf, 0644)
+}
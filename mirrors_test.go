@@ -0,0 +1,171 @@
+package usermgr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestMirrors{})
+
+type TestMirrors struct {
+	localCacheFixture
+}
+
+// testMirror serves signed data with an ETag, and records the requests.
+type testMirror struct {
+	*httptest.Server
+	Data        []byte
+	ETag        string
+	Fail        bool
+	Requests    int
+	IfNoneMatch string
+}
+
+func (s *TestMirrors) newMirror(c *C, serial uint64, etag string) *testMirror {
+	m := &testMirror{Data: s.signedData(c, serial), ETag: etag}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Requests++
+		m.IfNoneMatch = r.Header.Get("If-None-Match")
+		if m.Fail {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if m.IfNoneMatch == m.ETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", m.ETag)
+		w.Write(m.Data)
+	}))
+	return m
+}
+
+func (s *TestMirrors) TestFreshestCopyWins(c *C) {
+	stale := s.newMirror(c, 1, "stale-etag")
+	defer stale.Close()
+	fresh := s.newMirror(c, 2, "fresh-etag")
+	defer fresh.Close()
+
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey}
+	ud, err := lc.Update(stale.URL, fresh.URL)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Serial, Equals, uint64(2))
+
+	info, err := lc.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info.ETag, Equals, "fresh-etag")
+
+	mirrors, err := lc.Mirrors()
+	c.Assert(err, IsNil)
+	c.Assert(len(mirrors), Equals, 2)
+	c.Assert(mirrors[0].URL, Equals, stale.URL)
+	c.Assert(mirrors[0].ETag, Equals, "stale-etag")
+	c.Assert(mirrors[0].Serial, Equals, uint64(1))
+	c.Assert(mirrors[1].URL, Equals, fresh.URL)
+	c.Assert(mirrors[1].ETag, Equals, "fresh-etag")
+	c.Assert(mirrors[1].Serial, Equals, uint64(2))
+
+	// each mirror gets a conditional request with its own etag
+	ud, err = lc.Update(stale.URL, fresh.URL)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Serial, Equals, uint64(2))
+	c.Assert(stale.IfNoneMatch, Equals, "stale-etag")
+	c.Assert(fresh.IfNoneMatch, Equals, "fresh-etag")
+
+	// the order of the mirrors does not matter
+	os.RemoveAll(s.tempDir)
+	ud, err = lc.Update(fresh.URL, stale.URL)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Serial, Equals, uint64(2))
+}
+
+func (s *TestMirrors) TestFailover(c *C) {
+	primary := s.newMirror(c, 3, "primary-etag")
+	defer primary.Close()
+	secondary := s.newMirror(c, 3, "secondary-etag")
+	defer secondary.Close()
+
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey}
+	primary.Fail = true
+	ud, err := lc.Update(primary.URL, secondary.URL)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Serial, Equals, uint64(3))
+
+	mirrors, err := lc.Mirrors()
+	c.Assert(err, IsNil)
+	c.Assert(mirrors[0].Failures, Equals, 1)
+	c.Assert(mirrors[0].LastError, Equals, "503 Service Unavailable")
+	c.Assert(mirrors[1].Failures, Equals, 0)
+
+	// the failed mirror is skipped for a while
+	ud, err = lc.Update(primary.URL, secondary.URL)
+	c.Assert(err, IsNil)
+	c.Assert(primary.Requests, Equals, 1)
+	c.Assert(secondary.Requests, Equals, 2)
+
+	// and tried again once the backoff has passed
+	primary.Fail = false
+	timeNow = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "2006-01-02T15:05:05Z")
+		return t
+	}
+	ud, err = lc.Update(primary.URL, secondary.URL)
+	c.Assert(err, IsNil)
+	c.Assert(primary.Requests, Equals, 2)
+	mirrors, err = lc.Mirrors()
+	c.Assert(err, IsNil)
+	c.Assert(mirrors[0].Failures, Equals, 0)
+	c.Assert(mirrors[0].LastError, Equals, "")
+}
+
+func (s *TestMirrors) TestAllMirrorsFail(c *C) {
+	primary := s.newMirror(c, 1, "primary-etag")
+	defer primary.Close()
+	secondary := s.newMirror(c, 1, "secondary-etag")
+	defer secondary.Close()
+	primary.Fail = true
+	secondary.Fail = true
+
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey}
+	_, err := lc.Update(primary.URL, secondary.URL)
+	c.Assert(err, ErrorMatches, primary.URL+": 503 Service Unavailable; "+secondary.URL+": 503 Service Unavailable")
+
+	// all mirrors are in backoff, so all of them are tried
+	_, err = lc.Update(primary.URL, secondary.URL)
+	c.Assert(err, NotNil)
+	c.Assert(primary.Requests, Equals, 2)
+	c.Assert(secondary.Requests, Equals, 2)
+
+	_, err = lc.Update()
+	c.Assert(err, ErrorMatches, "no upstream URL specified")
+}
+
+func (s *TestMirrors) TestRejectsReplayFromMirror(c *C) {
+	fresh := s.newMirror(c, 5, "fresh-etag")
+	defer fresh.Close()
+	stale := s.newMirror(c, 4, "stale-etag")
+	defer stale.Close()
+
+	lc := LocalCache{Path: s.tempDir, HostKey: s.AdminKey.HostKey}
+	_, err := lc.Update(fresh.URL)
+	c.Assert(err, IsNil)
+
+	_, err = lc.Update(stale.URL)
+	c.Assert(err, ErrorMatches, "user data serial 4 is older than cached serial 5")
+
+	ud, err := lc.Update(stale.URL, fresh.URL)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Serial, Equals, uint64(5))
+}
+
+func (s *TestMirrors) TestBackoff(c *C) {
+	lastFailure := timeNow()
+	c.Assert(MirrorStatus{}.backoffUntil().IsZero(), Equals, true)
+	c.Assert(MirrorStatus{Failures: 1, LastFailure: &lastFailure}.backoffUntil(), Equals, lastFailure.Add(time.Minute))
+	c.Assert(MirrorStatus{Failures: 3, LastFailure: &lastFailure}.backoffUntil(), Equals, lastFailure.Add(4*time.Minute))
+	c.Assert(MirrorStatus{Failures: 20, LastFailure: &lastFailure}.backoffUntil(), Equals, lastFailure.Add(time.Hour))
+}
@@ -0,0 +1,382 @@
+package usermgr
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// ec2MetadataURL is where EC2 instances find the credentials of their
+// instance role.
+var ec2MetadataURL = "http://169.254.169.254/latest"
+
+// ec2MetadataClient is used to query ec2MetadataURL. The timeout is short
+// because hosts outside of EC2 never get a response. The metadata service
+// is link-local, so requests for it must never go through a proxy.
+var ec2MetadataClient = &http.Client{
+	Timeout: time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: time.Second,
+		}).DialContext,
+	},
+}
+
+// maxMetadataSize is the most we read of a response from the metadata
+// service, or of an error from S3.
+const maxMetadataSize = 64 * 1024
+
+// ec2MetadataAbsent records the ec2MetadataURL that did not answer, so
+// that hosts outside of EC2 do not wait for it on every fetch.
+var ec2MetadataAbsent struct {
+	sync.Mutex
+	url string
+}
+
+// S3Credentials are the credentials used to sign requests to S3.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3CredentialsFromEnvironment returns credentials from the standard AWS
+// environment variables, or nil if they are not set.
+func s3CredentialsFromEnvironment() *S3Credentials {
+	creds := S3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil
+	}
+	return &creds
+}
+
+// s3CredentialsFromFile returns credentials from the profile named by
+// AWS_PROFILE (or "default") in the shared credentials file, or nil if
+// there is no such file or profile.
+func s3CredentialsFromFile() (*S3Credentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := S3Credentials{}
+	inProfile := false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if !inProfile || len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// s3CredentialsFromInstanceRole returns the credentials of the EC2
+// instance role, or nil if the host is not an EC2 instance with a role.
+func s3CredentialsFromInstanceRole() (*S3Credentials, error) {
+	metadataURL := ec2MetadataURL
+	ec2MetadataAbsent.Lock()
+	absent := ec2MetadataAbsent.url == metadataURL
+	ec2MetadataAbsent.Unlock()
+	if absent {
+		return nil, nil
+	}
+
+	// IMDSv2 requires a session token. If the token cannot be had, we are
+	// not on EC2.
+	req, err := http.NewRequest("PUT", metadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "60")
+	resp, err := ec2MetadataClient.Do(req)
+	if err != nil {
+		ec2MetadataAbsent.Lock()
+		ec2MetadataAbsent.url = metadataURL
+		ec2MetadataAbsent.Unlock()
+		return nil, nil
+	}
+	token, err := readLimited(resp.Body, maxMetadataSize)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", metadataURL+"/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		resp, err := ec2MetadataClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("instance metadata: %s", resp.Status)
+		}
+		return readLimited(resp.Body, maxMetadataSize)
+	}
+
+	roleBuf, err := get("")
+	if err != nil || roleBuf == nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roleBuf), "\n", 2)[0])
+	credsBuf, err := get(role)
+	if err != nil || credsBuf == nil {
+		return nil, err
+	}
+	roleCreds := struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+	}{}
+	if err := json.Unmarshal(credsBuf, &roleCreds); err != nil {
+		return nil, fmt.Errorf("instance metadata: %s", err)
+	}
+	return &S3Credentials{
+		AccessKeyID:     roleCreds.AccessKeyID,
+		SecretAccessKey: roleCreds.SecretAccessKey,
+		SessionToken:    roleCreds.Token,
+	}, nil
+}
+
+// findS3Credentials returns credentials from the environment, the shared
+// credentials file or the EC2 instance role, in that order. If none are
+// found it returns nil, and requests are made anonymously.
+func findS3Credentials() (*S3Credentials, error) {
+	if creds := s3CredentialsFromEnvironment(); creds != nil {
+		return creds, nil
+	}
+	if creds, err := s3CredentialsFromFile(); creds != nil || err != nil {
+		return creds, err
+	}
+	return s3CredentialsFromInstanceRole()
+}
+
+// s3Escape escapes s as required for the canonical URI of a signed request.
+func s3Escape(s string, escapeSlash bool) string {
+	rv := ""
+	for _, b := range []byte(s) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			rv += string(b)
+		case b == '/' && !escapeSlash:
+			rv += "/"
+		default:
+			rv += fmt.Sprintf("%%%02X", b)
+		}
+	}
+	return rv
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to
+// req, which must not have a body. The host and every header already set
+// on req are signed.
+func signS3Request(req *http.Request, creds S3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := []string{}
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := req.URL.Query()
+	queryNames := []string{}
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	canonicalQuery := []string{}
+	for _, name := range queryNames {
+		values := query[name]
+		sort.Strings(values)
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// newS3Request returns a signed GET request for an object named by a URL
+// like s3://bucket/key. The region is taken from the "region" query
+// parameter, AWS_REGION or AWS_DEFAULT_REGION, and defaults to us-east-1.
+// The "endpoint" query parameter names an S3-compatible service to use
+// instead of AWS, which is addressed with path-style URLs.
+func newS3Request(s3URL string, etag string) (*http.Request, error) {
+	u, err := url.Parse(s3URL)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("%s: expected s3://bucket/key", s3URL)
+	}
+
+	region := u.Query().Get("region")
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(name)
+		}
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	var objectURL string
+	switch endpoint := u.Query().Get("endpoint"); {
+	case endpoint != "":
+		objectURL = strings.TrimSuffix(endpoint, "/") + "/" + s3Escape(bucket, true) + "/" + s3Escape(key, false)
+	case strings.Contains(bucket, "."):
+		// virtual host names with dots do not match the certificate
+		objectURL = "https://s3." + region + ".amazonaws.com/" + bucket + "/" + s3Escape(key, false)
+	default:
+		objectURL = "https://" + bucket + ".s3." + region + ".amazonaws.com/" + s3Escape(key, false)
+	}
+
+	req, err := http.NewRequest("GET", objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Add("If-None-Match", etag)
+	}
+
+	creds, err := findS3Credentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		signS3Request(req, *creds, region, timeNow())
+	}
+	return req, nil
+}
+
+// s3Error returns an error describing a failed S3 response, including the
+// error code from the response body if there is one.
+func s3Error(resp *http.Response) error {
+	s3Err := struct {
+		Code    string
+		Message string
+	}{}
+	body, err := readLimited(resp.Body, maxMetadataSize)
+	if err != nil {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if err := xml.Unmarshal(body, &s3Err); err != nil || s3Err.Code == "" {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return fmt.Errorf("%s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+}
@@ -0,0 +1,189 @@
+package usermgr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// approvalHeaderPrefix is the prefix of the PEM header that holds the
+// signature of an administrator who approved the data. The rest of the
+// header name is the administrator's public key.
+const approvalHeaderPrefix = "Approved-By-"
+
+// SigningPublicKey is the public part of a SigningKey.
+type SigningPublicKey [32]byte
+
+func (pk SigningPublicKey) MarshalText() (text []byte, err error) {
+	return encodeKey(pk[:]), nil
+}
+
+func (pk *SigningPublicKey) UnmarshalText(text []byte) error {
+	buf, err := decodeKey(text)
+	if err != nil || len(buf) != 32 {
+		return ErrIncorrectKeyFormat
+	}
+	copy(pk[:], buf)
+	return nil
+}
+
+func (pk SigningPublicKey) String() string {
+	text, _ := pk.MarshalText()
+	return string(text)
+}
+
+// SigningKey is an ED25519 key held by a single administrator. When hosts
+// are configured to require signatures from several administrators (see
+// SignaturePolicy) each administrator approves a version of the account
+// database by adding a signature with their key.
+type SigningKey struct {
+	PublicKey  SigningPublicKey
+	PrivateKey [32]byte
+}
+
+func (sk SigningKey) MarshalText() (text []byte, err error) {
+	buf := make([]byte, 64)
+	copy(buf[0:32], sk.PublicKey[:])
+	copy(buf[32:64], sk.PrivateKey[:])
+	return encodeKey(buf), nil
+}
+
+func (sk *SigningKey) UnmarshalText(text []byte) error {
+	buf, err := decodeKey(text)
+	if err != nil || len(buf) != 64 {
+		return ErrIncorrectKeyFormat
+	}
+	copy(sk.PublicKey[:], buf[0:32])
+	copy(sk.PrivateKey[:], buf[32:64])
+	return nil
+}
+
+func (sk SigningKey) MarshalJSON() ([]byte, error) {
+	text, err := sk.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+func (sk *SigningKey) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return err
+	}
+	return sk.UnmarshalText([]byte(text))
+}
+
+func (sk SigningKey) String() string {
+	text, _ := sk.MarshalText()
+	return string(text)
+}
+
+// GenerateSigningKey returns a new signing key
+func GenerateSigningKey() SigningKey {
+	pub, priv, err := ed25519.GenerateKey(randReader)
+	if err != nil {
+		panic(err)
+	}
+	sk := SigningKey{}
+	copy(sk.PublicKey[:], pub)
+	copy(sk.PrivateKey[:], priv.Seed())
+	return sk
+}
+
+// Approve returns signedData, which is the output of UsersData.SignedString,
+// with an additional signature by key.
+func Approve(signedData []byte, key SigningKey) ([]byte, error) {
+	dataBlock, _ := pem.Decode(signedData)
+	if dataBlock == nil || dataBlock.Type != "USERMGR DATA" {
+		return nil, fmt.Errorf("invalid encoding")
+	}
+
+	signature := ed25519.Sign(ed25519.NewKeyFromSeed(key.PrivateKey[:]), dataBlock.Bytes)
+	if dataBlock.Headers == nil {
+		dataBlock.Headers = map[string]string{}
+	}
+	dataBlock.Headers[approvalHeaderPrefix+key.PublicKey.String()] =
+		base64.StdEncoding.EncodeToString(signature)
+	return pem.EncodeToMemory(dataBlock), nil
+}
+
+// Approvers returns the keys that have validly signed signedData, sorted
+// by their text representation.
+func Approvers(signedData []byte) ([]SigningPublicKey, error) {
+	dataBlock, _ := pem.Decode(signedData)
+	if dataBlock == nil || dataBlock.Type != "USERMGR DATA" {
+		return nil, fmt.Errorf("invalid encoding")
+	}
+
+	names := []string{}
+	for name := range dataBlock.Headers {
+		if strings.HasPrefix(name, approvalHeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	rv := []SigningPublicKey{}
+	for _, name := range names {
+		pk := SigningPublicKey{}
+		if err := pk.UnmarshalText([]byte(strings.TrimPrefix(name, approvalHeaderPrefix))); err != nil {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(dataBlock.Headers[name])
+		if err != nil || len(signature) != ed25519.SignatureSize {
+			continue
+		}
+		if ed25519.Verify(ed25519.PublicKey(pk[:]), dataBlock.Bytes, signature) {
+			rv = append(rv, pk)
+		}
+	}
+	return rv, nil
+}
+
+// SignaturePolicy describes the administrators who must approve the
+// account database before hosts accept it.
+type SignaturePolicy struct {
+	// Keys are the public keys of the administrators. If empty, the policy
+	// does not require any approvals.
+	Keys []SigningPublicKey
+
+	// Threshold is the number of distinct administrators from Keys who must
+	// approve the data. If zero, every administrator must approve.
+	Threshold int
+}
+
+// Verify returns an error unless signedData have been approved by enough
+// administrators to satisfy the policy.
+func (sp SignaturePolicy) Verify(signedData []byte) error {
+	if len(sp.Keys) == 0 {
+		return nil
+	}
+	threshold := sp.Threshold
+	if threshold <= 0 {
+		threshold = len(sp.Keys)
+	}
+
+	approvers, err := Approvers(signedData)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, key := range sp.Keys {
+		for _, approver := range approvers {
+			if approver == key {
+				count++
+				break
+			}
+		}
+	}
+	if count < threshold {
+		return fmt.Errorf("user data approved by %d of %d required administrators", count, threshold)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package usermgr
+
+import (
+	"encoding/pem"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestSigningKey{})
+
+type TestSigningKey struct {
+	AdminKey AdminKey
+}
+
+func (s *TestSigningKey) SetUpTest(c *C) {
+	randReader = &testRandomReader{}
+	s.AdminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
+}
+
+func (s *TestSigningKey) TestMarshal(c *C) {
+	sk := GenerateSigningKey()
+	text, err := sk.MarshalText()
+	c.Assert(err, IsNil)
+
+	sk2 := SigningKey{}
+	c.Assert(sk2.UnmarshalText(text), IsNil)
+	c.Assert(sk2, DeepEquals, sk)
+
+	pk := SigningPublicKey{}
+	c.Assert(pk.UnmarshalText([]byte(sk.PublicKey.String())), IsNil)
+	c.Assert(pk, Equals, sk.PublicKey)
+
+	c.Assert(sk2.UnmarshalText([]byte("xxx")), Equals, ErrIncorrectKeyFormat)
+	c.Assert(pk.UnmarshalText(text), Equals, ErrIncorrectKeyFormat)
+}
+
+func (s *TestSigningKey) TestThreshold(c *C) {
+	alice := GenerateSigningKey()
+	bob := GenerateSigningKey()
+	carol := GenerateSigningKey()
+	mallory := GenerateSigningKey()
+
+	ud := UsersData{Users: []User{{Name: "alice"}}}
+	signedData, err := ud.SignedString(s.AdminKey)
+	c.Assert(err, IsNil)
+
+	policy := SignaturePolicy{
+		Keys:      []SigningPublicKey{alice.PublicKey, bob.PublicKey, carol.PublicKey},
+		Threshold: 2,
+	}
+	c.Assert(policy.Verify(signedData), ErrorMatches,
+		"user data approved by 0 of 2 required administrators")
+	c.Assert(SignaturePolicy{}.Verify(signedData), IsNil)
+
+	signedData, err = Approve(signedData, alice)
+	c.Assert(err, IsNil)
+	c.Assert(policy.Verify(signedData), ErrorMatches,
+		"user data approved by 1 of 2 required administrators")
+
+	// approving twice, or by someone not in the policy, does not count
+	signedData, _ = Approve(signedData, alice)
+	signedData, _ = Approve(signedData, mallory)
+	c.Assert(policy.Verify(signedData), ErrorMatches,
+		"user data approved by 1 of 2 required administrators")
+
+	signedData, err = Approve(signedData, carol)
+	c.Assert(err, IsNil)
+	c.Assert(policy.Verify(signedData), IsNil)
+
+	// the default threshold is every administrator
+	policy.Threshold = 0
+	c.Assert(policy.Verify(signedData), ErrorMatches,
+		"user data approved by 2 of 3 required administrators")
+
+	// approvals do not prevent hosts from reading the data
+	rv, err := LoadUsersData(signedData, s.AdminKey.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Users[0].Name, Equals, "alice")
+
+	approvers, err := Approvers(signedData)
+	c.Assert(err, IsNil)
+	c.Assert(len(approvers), Equals, 3)
+
+	// approvals do not carry over to different data
+	block, _ := pem.Decode(signedData)
+	block.Bytes[len(block.Bytes)-1] ^= 0xff
+	approvers, err = Approvers(pem.EncodeToMemory(block))
+	c.Assert(err, IsNil)
+	c.Assert(len(approvers), Equals, 0)
+
+	_, err = Approve([]byte("xxx"), alice)
+	c.Assert(err, ErrorMatches, "invalid encoding")
+}
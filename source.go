@@ -0,0 +1,150 @@
+package usermgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileETag returns the entity tag of a local file holding data, which
+// combines the modification time of the file with a hash of its contents.
+func fileETag(fi os.FileInfo, data []byte) string {
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("\"%x-%s\"", fi.ModTime().UnixNano(), hex.EncodeToString(hash[:]))
+}
+
+// parseFileETag splits an entity tag produced by fileETag into the
+// modification time and the hash.
+func parseFileETag(etag string) (int64, string) {
+	parts := strings.SplitN(strings.Trim(etag, "\""), "-", 2)
+	if len(parts) != 2 {
+		return 0, ""
+	}
+	mtime, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return 0, ""
+	}
+	return mtime, parts[1]
+}
+
+// fetchFile reads the data from a URL like file:///etc/usermgr/users.pem,
+// for hosts that receive the data through configuration management. If
+// the modification time of the file matches etag the file is not read at
+// all, and if its contents match the hash in etag the data are reported as
+// unchanged by returning nil. Files larger than maxSize are refused.
+func fetchFile(fileURL string, etag string, maxSize int64) ([]byte, string, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if (u.Host != "" && u.Host != "localhost") || u.Path == "" {
+		return nil, "", fmt.Errorf("%s: expected file:///path", fileURL)
+	}
+
+	fi, err := os.Stat(u.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi.Size() > maxSize {
+		return nil, "", fmt.Errorf("%s: data exceed the limit of %d bytes", u.Path, maxSize)
+	}
+	oldMtime, oldHash := parseFileETag(etag)
+	if etag != "" && oldMtime == fi.ModTime().UnixNano() {
+		return nil, "", nil
+	}
+	data, err := ioutil.ReadFile(u.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	newETag := fileETag(fi, data)
+	if _, newHash := parseFileETag(newETag); etag != "" && newHash == oldHash {
+		return nil, "", nil
+	}
+	return data, newETag, nil
+}
+
+// fetchCommand runs the command in a URL like
+// exec:///usr/local/bin/get-users --env production and reads the data
+// from its standard output. The arguments are separated by spaces.
+//
+// The entity tag of the cached data, a hash of the output, is passed to the
+// command as USERMGR_ETAG. The command may print nothing to report that the
+// data are unchanged, otherwise data that hash to etag are reported as
+// unchanged by returning nil.
+//
+// The command is killed if it runs longer than timeout or prints more than
+// maxSize bytes.
+func fetchCommand(execURL string, etag string, timeout time.Duration, maxSize int64) ([]byte, string, error) {
+	args := strings.Fields(strings.TrimPrefix(execURL, "exec://"))
+	if len(args) == 0 {
+		return nil, "", fmt.Errorf("%s: expected exec://command", execURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "USERMGR_ETAG="+etag)
+	stderr := truncatingWriter{Max: 4096}
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, "", fmt.Errorf("%s: %s", args[0], err)
+	}
+	data, readErr := readLimited(stdout, maxSize)
+	if readErr != nil {
+		cancel()
+	}
+	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, "", fmt.Errorf("%s: timed out after %s", args[0], timeout)
+	}
+	if readErr != nil {
+		return nil, "", fmt.Errorf("%s: %s", args[0], readErr)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, "", fmt.Errorf("%s: %s: %s", args[0], err, msg)
+		}
+		return nil, "", fmt.Errorf("%s: %s", args[0], err)
+	}
+	if len(data) == 0 && etag != "" {
+		return nil, "", nil
+	}
+
+	hash := sha256.Sum256(data)
+	newETag := "\"" + hex.EncodeToString(hash[:]) + "\""
+	if newETag == etag {
+		return nil, "", nil
+	}
+	return data, newETag, nil
+}
+
+// truncatingWriter keeps the first Max bytes written to it and discards
+// the rest.
+type truncatingWriter struct {
+	bytes.Buffer
+	Max int
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if room := w.Max - w.Len(); room > 0 {
+		if len(p) > room {
+			w.Buffer.Write(p[:room])
+		} else {
+			w.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,133 @@
+package usermgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestSource{})
+
+type TestSource struct {
+	localCacheFixture
+}
+
+func (s *TestSource) writeData(c *C, path string, serial uint64) []byte {
+	signedData := s.signedData(c, serial)
+	c.Assert(ioutil.WriteFile(path, signedData, 0644), IsNil)
+	return signedData
+}
+
+func (s *TestSource) TestFile(c *C) {
+	sourcePath := filepath.Join(s.tempDir, "users.pem")
+	signedData := s.writeData(c, sourcePath, 3)
+	lc := LocalCache{Path: filepath.Join(s.tempDir, "cache"), HostKey: s.AdminKey.HostKey}
+
+	rv, err := lc.Update("file://" + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(3))
+	cached, err := ioutil.ReadFile(filepath.Join(lc.Path, "users.pem"))
+	c.Assert(err, IsNil)
+	c.Assert(cached, DeepEquals, signedData)
+	mirrors, _ := lc.Mirrors()
+	etag := mirrors[0].ETag
+
+	// touching the file does not change the data
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(sourcePath, later, later), IsNil)
+	_, newETag, err := fetchFile("file://"+sourcePath, etag, DefaultMaxDataSize)
+	c.Assert(err, IsNil)
+	c.Assert(newETag, Equals, "")
+	rv, err = lc.Update("file://" + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(3))
+
+	s.writeData(c, sourcePath, 4)
+	rv, err = lc.Update("file://" + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(4))
+	mirrors, _ = lc.Mirrors()
+	c.Assert(mirrors[0].ETag, Not(Equals), etag)
+
+	// invalid data are rejected and the cache is kept
+	c.Assert(ioutil.WriteFile(sourcePath, []byte("this is not valid data"), 0644), IsNil)
+	_, err = lc.Update("file://" + sourcePath)
+	c.Assert(err, ErrorMatches, "invalid encoding")
+	rv, err = lc.Get()
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(4))
+
+	_, err = lc.Update("file://" + filepath.Join(s.tempDir, "missing.pem"))
+	c.Assert(err, ErrorMatches, "stat .*/missing.pem: no such file or directory")
+
+	_, err = lc.Update("file://example.com/users.pem")
+	c.Assert(err, ErrorMatches, "file://example.com/users.pem: expected file:///path")
+}
+
+func (s *TestSource) TestCommand(c *C) {
+	sourcePath := filepath.Join(s.tempDir, "users.pem")
+	s.writeData(c, sourcePath, 3)
+	etagPath := filepath.Join(s.tempDir, "etag")
+	unchangedPath := filepath.Join(s.tempDir, "unchanged")
+	scriptPath := filepath.Join(s.tempDir, "get-users")
+	c.Assert(ioutil.WriteFile(scriptPath, []byte("#!/bin/sh\n"+
+		"echo -n \"$USERMGR_ETAG\" > "+etagPath+"\n"+
+		"if [ -n \"$USERMGR_ETAG\" -a -e "+unchangedPath+" ]; then exit 0; fi\n"+
+		"cat \"$1\"\n"), 0755), IsNil)
+	lc := LocalCache{Path: filepath.Join(s.tempDir, "cache"), HostKey: s.AdminKey.HostKey}
+
+	rv, err := lc.Update("exec://" + scriptPath + " " + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(3))
+	passedETag, _ := ioutil.ReadFile(etagPath)
+	c.Assert(string(passedETag), Equals, "")
+
+	rv, err = lc.Update("exec://" + scriptPath + " " + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(3))
+	mirrors, _ := lc.Mirrors()
+	passedETag, _ = ioutil.ReadFile(etagPath)
+	c.Assert(string(passedETag), Equals, mirrors[0].ETag)
+
+	// empty output means unchanged
+	s.writeData(c, sourcePath, 4)
+	c.Assert(ioutil.WriteFile(unchangedPath, []byte{}, 0644), IsNil)
+	rv, err = lc.Update("exec://" + scriptPath + " " + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(3))
+
+	os.Remove(unchangedPath)
+	rv, err = lc.Update("exec://" + scriptPath + " " + sourcePath)
+	c.Assert(err, IsNil)
+	c.Assert(rv.Serial, Equals, uint64(4))
+
+	_, err = lc.Update("exec://" + scriptPath + " " + filepath.Join(s.tempDir, "missing.pem"))
+	c.Assert(err, ErrorMatches, ".*/get-users: exit status 1: cat: .*missing.pem: No such file or directory")
+
+	_, err = lc.Update("exec://")
+	c.Assert(err, ErrorMatches, "exec://: expected exec://command")
+}
+
+func (s *TestSource) TestCommandLimits(c *C) {
+	scriptPath := filepath.Join(s.tempDir, "get-users")
+	c.Assert(ioutil.WriteFile(scriptPath, []byte("#!/bin/sh\n"+
+		"if [ \"$1\" = hang ]; then exec sleep 60; fi\n"+
+		"exec yes\n"), 0755), IsNil)
+	lc := LocalCache{
+		Path:        filepath.Join(s.tempDir, "cache"),
+		HostKey:     s.AdminKey.HostKey,
+		HTTP:        HTTPOptions{Timeout: 100 * time.Millisecond},
+		MaxDataSize: 1024,
+	}
+
+	start := time.Now()
+	_, err := lc.Update("exec://" + scriptPath + " hang")
+	c.Assert(err, ErrorMatches, ".*/get-users: timed out after 100ms")
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+
+	_, err = lc.Update("exec://" + scriptPath)
+	c.Assert(err, ErrorMatches, ".*/get-users: data exceed the limit of 1024 bytes")
+}
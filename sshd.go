@@ -0,0 +1,43 @@
+package usermgr
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var sshdConfigPath = "/etc/ssh/sshd_config"
+
+// AuthorizedKeysCommandConfigured returns true if sshd is configured to
+// look up authorized keys with usermgr, i.e. if the global section of
+// the sshd configuration has an AuthorizedKeysCommand that runs usermgr.
+func AuthorizedKeysCommandConfigured() (bool, error) {
+	f, err := os.Open(sshdConfigPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		keyword := strings.ToLower(fields[0])
+		if keyword == "match" {
+			// options in a Match block only apply to some connections
+			break
+		}
+		if keyword == "authorizedkeyscommand" {
+			// sshd uses the first value it sees for each keyword
+			return strings.HasPrefix(filepath.Base(fields[1]), "usermgr"), nil
+		}
+	}
+	return false, s.Err()
+}
@@ -0,0 +1,49 @@
+package usermgr
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestSshd{})
+
+type TestSshd struct {
+	tempDir string
+}
+
+func (s *TestSshd) SetUpTest(c *C) {
+	var err error
+	s.tempDir, err = ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	sshdConfigPath = s.tempDir + "/sshd_config"
+}
+
+func (s *TestSshd) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir)
+}
+
+func (s *TestSshd) TestAuthorizedKeysCommandConfigured(c *C) {
+	var testCases = []struct {
+		Config     string
+		Configured bool
+	}{
+		{"AuthorizedKeysCommand /opt/bin/usermgr.sshkeys\nAuthorizedKeysCommandUser nobody\n", true},
+		{"authorizedkeyscommand\t/usr/local/bin/usermgr authorized-keys\n", true},
+		{"#AuthorizedKeysCommand /opt/bin/usermgr.sshkeys\n", false},
+		{"AuthorizedKeysCommand /usr/bin/sss_ssh_authorizedkeys\nAuthorizedKeysCommand /opt/bin/usermgr.sshkeys\n", false},
+		{"Match User git\n  AuthorizedKeysCommand /opt/bin/usermgr.sshkeys\n", false},
+		{"PermitRootLogin no\n", false},
+	}
+	for _, testCase := range testCases {
+		ioutil.WriteFile(sshdConfigPath, []byte(testCase.Config), 0644)
+		configured, err := AuthorizedKeysCommandConfigured()
+		c.Assert(err, IsNil)
+		c.Assert(configured, Equals, testCase.Configured, Commentf("%q", testCase.Config))
+	}
+
+	os.Remove(sshdConfigPath)
+	_, err := AuthorizedKeysCommandConfigured()
+	c.Assert(err, ErrorMatches, ".*: no such file or directory")
+}
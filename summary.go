@@ -0,0 +1,148 @@
+package usermgr
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The summaries describe the data without the hashes, secrets and keys that
+// would let someone log in as a user or read later versions of the data, so
+// that they can be shown to people and kept in places, such as a git
+// repository, that are less protected than the data themselves.
+//
+// They are built field by field, rather than by removing secrets from a copy
+// of the data, so that a field added to the data is left out until someone
+// decides that it is safe to show.
+
+// KeySummary describes an SSH public key without the key itself.
+type KeySummary struct {
+	Type        string `json:"type,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// DeviceSummary describes an MFA device without its secret or codes.
+type DeviceSummary struct {
+	Type       string     `json:"type"`
+	Name       string     `json:"name,omitempty"`
+	DeviceID   string     `json:"device_id,omitempty"`
+	CreateTime time.Time  `json:"create_time,omitempty"`
+	ExpireTime *time.Time `json:"expire_time,omitempty"`
+}
+
+// UserSummary is a user with the hashes and secrets removed.
+type UserSummary struct {
+	Name           string          `json:"name"`
+	RealName       string          `json:"real_name,omitempty"`
+	Email          string          `json:"email,omitempty"`
+	Groups         []string        `json:"groups,omitempty"`
+	AuthorizedKeys []KeySummary    `json:"authorized_keys,omitempty"`
+	MFADevices     []DeviceSummary `json:"mfa_devices,omitempty"`
+	BackupCodes    []time.Time     `json:"backup_codes,omitempty"`
+}
+
+// HostSummary describes an enrolled host.
+type HostSummary struct {
+	Name      string        `json:"name"`
+	PublicKey HostPublicKey `json:"public_key"`
+	Approved  bool          `json:"approved,omitempty"`
+}
+
+// UsersDataSummary is the account database with the hashes, secrets and
+// keys removed.
+type UsersDataSummary struct {
+	Serial     uint64        `json:"serial,omitempty"`
+	IssueTime  *time.Time    `json:"issue_time,omitempty"`
+	ExpireTime *time.Time    `json:"expire_time,omitempty"`
+	Users      []UserSummary `json:"users"`
+	Hosts      []HostSummary `json:"hosts,omitempty"`
+
+	// ExcludeSharedHostKey is true if only approved hosts can read the
+	// data, and NextKey is true if the data announce a new admin key.
+	ExcludeSharedHostKey bool `json:"exclude_shared_host_key,omitempty"`
+	NextKey              bool `json:"next_key,omitempty"`
+
+	// YubikeyClientSecret is true if the data have a Yubikey client secret.
+	YubikeyClientID     string `json:"yubikey_client_id,omitempty"`
+	YubikeyClientSecret bool   `json:"yubikey_client_secret,omitempty"`
+}
+
+// SummarizeKey describes an authorized key by its type, fingerprint and
+// comment. Keys that cannot be parsed are described by a fingerprint of
+// their text.
+func SummarizeKey(authorizedKey string) KeySummary {
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return KeySummary{Fingerprint: KeyFingerprint(authorizedKey)}
+	}
+	return KeySummary{
+		Type:        publicKey.Type(),
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+		Comment:     strings.TrimSpace(comment),
+	}
+}
+
+// Summary returns the user without hashes and secrets. SSH keys are
+// described by their fingerprints, and backup codes by their creation
+// times.
+func (user User) Summary() UserSummary {
+	rv := UserSummary{
+		Name:     user.Name,
+		RealName: user.RealName,
+		Email:    user.Email,
+		Groups:   user.Groups,
+	}
+	for _, key := range user.AuthorizedKeys {
+		rv.AuthorizedKeys = append(rv.AuthorizedKeys, SummarizeKey(key))
+	}
+	for _, device := range user.TOTPDevices {
+		// codes are only generated up to the horizon, so that is when the
+		// device stops working on hosts.
+		horizon := device.Horizon()
+		rv.MFADevices = append(rv.MFADevices, DeviceSummary{
+			Type:       "totp",
+			Name:       device.Name,
+			CreateTime: device.CreateTime,
+			ExpireTime: &horizon,
+		})
+	}
+	for _, device := range user.Yubikeys {
+		rv.MFADevices = append(rv.MFADevices, DeviceSummary{
+			Type:       "yubikey",
+			Name:       device.Name,
+			DeviceID:   device.DeviceID,
+			CreateTime: device.CreateTime,
+		})
+	}
+	for _, code := range user.BackupCodes {
+		rv.BackupCodes = append(rv.BackupCodes, code.CreateTime)
+	}
+	return rv
+}
+
+// Summary returns the data without hashes, secrets and keys.
+func (ud UsersData) Summary() UsersDataSummary {
+	rv := UsersDataSummary{
+		Serial:               ud.Serial,
+		IssueTime:            ud.IssueTime,
+		ExpireTime:           ud.ExpireTime,
+		Users:                []UserSummary{},
+		ExcludeSharedHostKey: ud.ExcludeSharedHostKey,
+		NextKey:              ud.NextKey != nil,
+		YubikeyClientID:      ud.YubikeyClientID,
+		YubikeyClientSecret:  ud.YubikeyClientSecret != "",
+	}
+	for _, user := range ud.Users {
+		rv.Users = append(rv.Users, user.Summary())
+	}
+	for _, host := range ud.Hosts {
+		rv.Hosts = append(rv.Hosts, HostSummary{
+			Name:      host.Name,
+			PublicKey: host.PublicKey,
+			Approved:  host.Approved,
+		})
+	}
+	return rv
+}
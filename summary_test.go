@@ -0,0 +1,90 @@
+package usermgr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TestSummary{})
+
+type TestSummary struct {
+	AdminKey AdminKey
+}
+
+func (s *TestSummary) SetUpTest(c *C) {
+	timeNow = func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
+		return t
+	}
+	s.AdminKey = GenerateKeyPair()
+}
+
+func (s *TestSummary) TestSummary(c *C) {
+	device := TOTPDevice{Name: "phone", CreateTime: timeNow()}
+	device.SetSecret(s.AdminKey, "JBSWY3DPEHPK3PXP")
+	c.Assert(device.GenerateCodes(timeNow(), timeNow().Add(time.Minute), s.AdminKey), IsNil)
+	nextKey := GenerateKeyPair().HostKey
+	hostPublicKey := s.AdminKey.HostKey.WithPrivateKey([32]byte{1, 2, 3}).PublicKey()
+	ud := UsersData{
+		YubikeyClientID:     "client",
+		YubikeyClientSecret: "sekrit",
+		NextKey:             &nextKey,
+		Hosts:               []Host{{Name: "web1", PublicKey: hostPublicKey, Approved: true}},
+	}
+	ud.Set(User{
+		Name:           "alice",
+		Groups:         []string{"wheel"},
+		AuthorizedKeys: []string{testLaptopKey},
+		BackupCodes:    []BackupCode{NewBackupCode("hellohellohelloo")},
+		TOTPDevices:    []TOTPDevice{device},
+		Yubikeys:       []YubikeyDevice{{Name: "work", DeviceID: "cccccc"}},
+	})
+	ud.Set(User{Name: "bob"})
+
+	summary := ud.Summary()
+	c.Assert(summary.YubikeyClientID, Equals, "client")
+	c.Assert(summary.YubikeyClientSecret, Equals, true)
+	c.Assert(summary.NextKey, Equals, true)
+	c.Assert(summary.Hosts, DeepEquals, []HostSummary{{Name: "web1", PublicKey: hostPublicKey, Approved: true}})
+	horizon := device.Horizon()
+	c.Assert(summary.Users, DeepEquals, []UserSummary{
+		{
+			Name:   "alice",
+			Groups: []string{"wheel"},
+			AuthorizedKeys: []KeySummary{{
+				Type:        "ssh-ed25519",
+				Fingerprint: "SHA256:42Km5PAnonerEyro7GtCEyQESZm69uWuTZilwDQHteE",
+				Comment:     "alice@laptop",
+			}},
+			MFADevices: []DeviceSummary{
+				{Type: "totp", Name: "phone", CreateTime: timeNow(), ExpireTime: &horizon},
+				{Type: "yubikey", Name: "work", DeviceID: "cccccc"},
+			},
+			BackupCodes: []time.Time{timeNow()},
+		},
+		{Name: "bob"},
+	})
+
+	// no secret or key makes it into the rendering
+	buf, err := json.Marshal(summary)
+	c.Assert(err, IsNil)
+	rendered := string(buf)
+	nextKeyText, _ := nextKey.MarshalText()
+	secrets := []string{
+		"sekrit",
+		string(nextKeyText),
+		base64.StdEncoding.EncodeToString(nextKey.HostPrivateKey[:]),
+		base64.RawURLEncoding.EncodeToString(nextKey.HostPrivateKey[:]),
+		strings.Fields(testLaptopKey)[1],
+		base64.StdEncoding.EncodeToString(ud.Users[0].BackupCodes[0].Hash),
+		base64.StdEncoding.EncodeToString(device.SecretEncrypted),
+		base64.StdEncoding.EncodeToString(device.Codes[0].Hash),
+	}
+	for _, secret := range secrets {
+		c.Assert(strings.Contains(rendered, secret), Equals, false, Commentf("%s", secret))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"regexp"
 	"strings"
@@ -13,12 +14,13 @@ var sudoersFilePath = "/etc/sudoers.d/usermgr"
 
 var sudoersUserNameRegexp = regexp.MustCompile("^[a-zA-Z0-9\\-\\_]+$")
 
-func SyncSudoers(ud *UsersData, loginGroups []string, sudoGroups []string, dryRun bool) error {
+// sudoersFile returns the contents of the sudoers file for ud.
+func sudoersFile(ud *UsersData, loginGroups []string, sudoGroups []string) ([]byte, error) {
 	newSudoersFile := bytes.NewBuffer(nil)
 	fmt.Fprintf(newSudoersFile, "# automatically generated by usermgr\n")
 	for _, nominalUser := range ud.Users {
 		if !sudoersUserNameRegexp.MatchString(nominalUser.Name) {
-			return fmt.Errorf("user name %q not allowed in sudoers", nominalUser.Name)
+			return nil, fmt.Errorf("user name %q not allowed in sudoers", nominalUser.Name)
 		}
 		if !nominalUser.InAnyGroup(loginGroups) {
 			continue
@@ -29,16 +31,41 @@ func SyncSudoers(ud *UsersData, loginGroups []string, sudoGroups []string, dryRu
 			fmt.Fprintf(newSudoersFile, "%s ALL=(ALL) NOPASSWD: ALL\n", nominalUser.Name)
 		}
 	}
+	return newSudoersFile.Bytes(), nil
+}
+
+// SudoersInSync returns true if the sudoers file is the one that
+// SyncSudoers would write for ud.
+func SudoersInSync(ud *UsersData, loginGroups []string, sudoGroups []string) (bool, error) {
+	newSudoersFile, err := sudoersFile(ud, loginGroups, sudoGroups)
+	if err != nil {
+		return false, err
+	}
+	existingSudoersFile, err := ioutil.ReadFile(sudoersFilePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(existingSudoersFile, newSudoersFile), nil
+}
+
+func SyncSudoers(ud *UsersData, loginGroups []string, sudoGroups []string, dryRun bool) error {
+	newSudoersFile, err := sudoersFile(ud, loginGroups, sudoGroups)
+	if err != nil {
+		return err
+	}
 
 	existingSudoersFile, err := ioutil.ReadFile(sudoersFilePath)
-	if err == nil && bytes.Equal(existingSudoersFile, newSudoersFile.Bytes()) {
+	if err == nil && bytes.Equal(existingSudoersFile, newSudoersFile) {
 		// The file would not be changed, so don't mess with it
 		return nil
 	}
 
 	// check the new file with visudo
 	cmd := exec.Command("visudo", "-f", "-", "-c")
-	cmd.Stdin = bytes.NewBuffer(newSudoersFile.Bytes())
+	cmd.Stdin = bytes.NewBuffer(newSudoersFile)
 	if checkOutput, err := cmd.CombinedOutput(); err != nil {
 		// visudo will have printed output to stderr
 		return fmt.Errorf("%s", strings.Replace(string(checkOutput), "\n", "; ", -1))
@@ -48,7 +75,7 @@ func SyncSudoers(ud *UsersData, loginGroups []string, sudoGroups []string, dryRu
 		return nil
 	}
 
-	err = ioutil.WriteFile(sudoersFilePath, newSudoersFile.Bytes(), 0600)
+	err = ioutil.WriteFile(sudoersFilePath, newSudoersFile, 0600)
 	if err != nil {
 		return err
 	}
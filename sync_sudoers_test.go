@@ -129,3 +129,26 @@ func (s *TestSyncSudoers) TestCannotWrite(c *C) {
 	err := SyncSudoers(s.DB, s.LoginGroups, s.SudoGroups, false)
 	c.Assert(err, ErrorMatches, ".*permission denied.*")
 }
+
+func (s *TestSyncSudoers) TestSudoersInSync(c *C) {
+	inSync, err := SudoersInSync(s.DB, s.LoginGroups, s.SudoGroups)
+	c.Assert(err, IsNil)
+	c.Assert(inSync, Equals, false)
+
+	ioutil.WriteFile(sudoersFilePath, []byte(""+
+		"# automatically generated by usermgr\n"+
+		"alice ALL=(alice) NOPASSWD: ALL\n"+
+		"alice ALL=(ALL) NOPASSWD: ALL\n"), 0600)
+	inSync, err = SudoersInSync(s.DB, s.LoginGroups, s.SudoGroups)
+	c.Assert(err, IsNil)
+	c.Assert(inSync, Equals, true)
+
+	s.DB.Users[0].Groups = []string{"myapp-user"}
+	inSync, err = SudoersInSync(s.DB, s.LoginGroups, s.SudoGroups)
+	c.Assert(err, IsNil)
+	c.Assert(inSync, Equals, false)
+
+	s.DB.Users[0].Name = "alice bob"
+	_, err = SudoersInSync(s.DB, s.LoginGroups, s.SudoGroups)
+	c.Assert(err, ErrorMatches, "user name \"alice bob\" not allowed in sudoers")
+}
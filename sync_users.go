@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -108,13 +109,13 @@ func getActualUserNames() (map[string]struct{}, error) {
 	return rv, errs.ReturnValue()
 }
 
-func SyncUsers(ud *UsersData, groups []string, dryRun bool, stdout io.Writer) error {
-	errs := errset.ErrSet{}
-
+// UsersDrift compares the local users in the passwd file with the users in
+// ud who are members of groups. It returns the users that are missing from
+// the passwd file and the local users that should not exist. If the passwd
+// file cannot be read completely, the users that could be read are compared
+// and the error is returned as well.
+func UsersDrift(ud *UsersData, groups []string) (missing []string, extra []string, err error) {
 	actualUserNames, err := getActualUserNames()
-	if err != nil {
-		errs = append(errs, fmt.Errorf("list users: %s", err))
-	}
 	if actualUserNames == nil {
 		actualUserNames = map[string]struct{}{}
 	}
@@ -123,34 +124,49 @@ func SyncUsers(ud *UsersData, groups []string, dryRun bool, stdout io.Writer) er
 		if !nominalUser.InAnyGroup(groups) {
 			continue
 		}
+		if _, userExists := actualUserNames[nominalUser.Name]; !userExists {
+			missing = append(missing, nominalUser.Name)
+		}
+	}
 
-		if _, userExists := actualUserNames[nominalUser.Name]; userExists {
-			continue
+	for actualUserName := range actualUserNames {
+		existingNominalUser := ud.GetUserByName(actualUserName)
+		if existingNominalUser == nil || !existingNominalUser.InAnyGroup(groups) {
+			extra = append(extra, actualUserName)
 		}
+	}
+	sort.Strings(extra)
+
+	return missing, extra, err
+}
+
+func SyncUsers(ud *UsersData, groups []string, dryRun bool, stdout io.Writer) error {
+	errs := errset.ErrSet{}
 
-		fmt.Fprintf(stdout, "%s: create\n", nominalUser.Name)
+	missing, extra, err := UsersDrift(ud, groups)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("list users: %s", err))
+	}
+
+	for _, userName := range missing {
+		fmt.Fprintf(stdout, "%s: create\n", userName)
 		if dryRun {
 			continue
 		}
-		err := runCommand("useradd", "-c", nominalUser.RealName,
-			"-p", "*", "--create-home", nominalUser.Name)
+		err := runCommand("useradd", "-c", ud.GetUserByName(userName).RealName,
+			"-p", "*", "--create-home", userName)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("%s: %s", nominalUser.Name, err))
+			errs = append(errs, fmt.Errorf("%s: %s", userName, err))
 		}
 	}
 
-	for actualUserName := range actualUserNames {
-		existingNominalUser := ud.GetUserByName(actualUserName)
-		if existingNominalUser != nil && existingNominalUser.InAnyGroup(groups) {
-			continue
-		}
-
-		fmt.Fprintf(stdout, "%s: remove\n", actualUserName)
+	for _, userName := range extra {
+		fmt.Fprintf(stdout, "%s: remove\n", userName)
 		if dryRun {
 			continue
 		}
-		if err := runCommand("userdel", actualUserName); err != nil {
-			errs = append(errs, fmt.Errorf("%s: %s", actualUserName, err))
+		if err := runCommand("userdel", userName); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", userName, err))
 		}
 	}
 
@@ -107,6 +107,13 @@ func (s *TestUsers) TestCanSync(c *C) {
 	c.Assert(err.Error(), Equals, "badluckbrian: Bad Luck, Brian! Cannot do it")
 }
 
+func (s *TestUsers) TestUsersDrift(c *C) {
+	missing, extra, err := UsersDrift(s.DB, s.LoginGroups)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []string{"badluckbrian", "dave"})
+	c.Assert(extra, DeepEquals, []string{"charlie"})
+}
+
 func (s *TestUsers) TestBadLoginDefs(c *C) {
 	os.Remove(loginDefsPath)
 	min, max, err := getUserIDRange()
@@ -101,6 +101,18 @@ func (d *TOTPDevice) GenerateCodes(startTime, endTime time.Time, adminKey AdminK
 	return nil
 }
 
+// Horizon returns the time of the last pre-generated code. Hosts cannot
+// validate codes from the device after that time.
+func (d TOTPDevice) Horizon() time.Time {
+	horizon := time.Time{}
+	for _, code := range d.Codes {
+		if code.Time.After(horizon) {
+			horizon = code.Time
+		}
+	}
+	return horizon
+}
+
 var ErrIncorrectCode = errors.New("code is invalid")
 
 func (d TOTPDevice) VerifyCode(now time.Time, skew time.Duration, userCode string) error {
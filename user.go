@@ -12,6 +12,11 @@ type User struct {
 	Yubikeys       []YubikeyDevice `json:"yubikeys,omitempty"`
 	BackupCodes    []BackupCode    `json:"backup_codes,omitempty"`
 	TOTPDevices    []TOTPDevice    `json:"totp_devices,omitempty"`
+
+	// Subject, if specified, is the identity provider's ID for the user. It
+	// binds the account to that login when the provider does not guarantee
+	// the user name (see web.OIDCAuth.UsernameClaim).
+	Subject string `json:"subject,omitempty"`
 }
 
 // InGroup returns true if the user is a member of the specified group
@@ -34,6 +39,24 @@ func (u User) InAnyGroup(groupNames []string) bool {
 	return false
 }
 
+// MFADevices returns the type and name of each of the user's MFA devices,
+// i.e. "totp:phone" or "yubikey:work". Yubikeys without a name are
+// identified by their device ID.
+func (u User) MFADevices() []string {
+	rv := []string{}
+	for _, device := range u.TOTPDevices {
+		rv = append(rv, "totp:"+device.Name)
+	}
+	for _, device := range u.Yubikeys {
+		name := device.Name
+		if name == "" {
+			name = device.DeviceID
+		}
+		rv = append(rv, "yubikey:"+name)
+	}
+	return rv
+}
+
 type YubikeyDevice struct {
 	Name       string    `json:"name,omitempty"`
 	CreateTime time.Time `json:"create_time,omitempty"`
@@ -2,9 +2,11 @@ package usermgr
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
@@ -15,6 +17,30 @@ type UsersData struct {
 	Users               []User `json:"users"`
 	YubikeyClientID     string `json:"yubikey_client_id,omitempty"`
 	YubikeyClientSecret string `json:"yubikey_client_secret,omitempty"`
+
+	// NextKey announces the key that will be used to sign future versions
+	// of the data. Hosts that see the announcement remember the key and
+	// switch to it once they receive data signed by it.
+	NextKey *HostKey `json:"next_key,omitempty"`
+
+	// Serial increases each time the data are signed. Hosts refuse data
+	// with a lower serial number than data they have already seen.
+	Serial uint64 `json:"serial,omitempty"`
+
+	// IssueTime is the time when the data were signed.
+	IssueTime *time.Time `json:"issue_time,omitempty"`
+
+	// ExpireTime, if specified, is the time after which hosts stop trusting
+	// the data.
+	ExpireTime *time.Time `json:"expire_time,omitempty"`
+
+	// Hosts are the servers that have enrolled their own key pairs. The data
+	// are encrypted to each approved host in addition to the shared host key.
+	Hosts []Host `json:"hosts,omitempty"`
+
+	// ExcludeSharedHostKey, if true, stops the data from being encrypted to
+	// the shared host key so that only approved hosts can read them.
+	ExcludeSharedHostKey bool `json:"exclude_shared_host_key,omitempty"`
 }
 
 // GetUserByName returns the user having the specified name or
@@ -61,24 +87,50 @@ func (ud *UsersData) Delete(userName string) {
 
 // SignedString returns a serialized version of the user database
 // signed with the given key.
+//
+// The data are encrypted so that they can be read by holders of the host
+// key. If the key has an ED25519 signing key, the ciphertext is also signed
+// so that holders of the host key cannot produce data that other hosts would
+// accept. The signature is stored in the headers of the PEM block, which older
+// versions of usermgr ignore.
+//
+// If any hosts have enrolled their own keys (see Hosts), the data are instead
+// encrypted with a random content key which is sealed to each approved host,
+// the admin key and, unless ExcludeSharedHostKey is set, the shared host key.
+// The recipients are recomputed every time the data are signed, so removing
+// a host from Hosts cuts it off from subsequent versions.
 func (ud UsersData) SignedString(adminKey AdminKey) ([]byte, error) {
 	unsignedData, err := json.Marshal(ud)
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := [24]byte{}
-	randReader.Read(nonce[:])
-	ciphertext := nonce[:]
-	ciphertext = box.Seal(ciphertext, unsignedData, &nonce, &adminKey.HostPublicKey,
-		&adminKey.AdminPrivateKey)
+	block := &pem.Block{
+		Type: "USERMGR DATA",
+	}
+	if ud.usesEnvelope() {
+		ciphertext, headers, err := sealEnvelope(unsignedData, adminKey, ud.recipients(adminKey))
+		if err != nil {
+			return nil, err
+		}
+		block.Bytes = ciphertext
+		block.Headers = headers
+		block.Headers["Version"] = "3"
+	} else {
+		nonce := [24]byte{}
+		randReader.Read(nonce[:])
+		block.Bytes = box.Seal(nonce[:], unsignedData, &nonce, &adminKey.HostPublicKey,
+			&adminKey.AdminPrivateKey)
+		if adminKey.HasSigningKey() {
+			block.Headers = map[string]string{"Version": "2"}
+		}
+	}
+	if adminKey.HasSigningKey() {
+		block.Headers["Signature"] = base64.StdEncoding.EncodeToString(adminKey.Sign(block.Bytes))
+	}
 
 	buf := bytes.NewBuffer(nil)
-	err = pem.Encode(buf, &pem.Block{
-		Type:  "USERMGR DATA",
-		Bytes: ciphertext,
-	})
-	if err != nil {
+	if err := pem.Encode(buf, block); err != nil {
 		return nil, err
 	}
 
@@ -88,19 +140,44 @@ func (ud UsersData) SignedString(adminKey AdminKey) ([]byte, error) {
 // LoadUsersData reads signedData, verifies that it was signed by
 // the specified publicKey and if all is well, returns a new
 // instance of UserData.
+//
+// If hostKey has a signing key then the data must carry a valid signature.
+// Otherwise the signature, if any, is ignored and the data are only checked
+// to have been sealed by the admin key.
 func LoadUsersData(data []byte, hostKey HostKey) (*UsersData, error) {
 	dataBlock, _ := pem.Decode(data)
-	if dataBlock == nil || dataBlock.Type != "USERMGR DATA" {
+	if dataBlock == nil || dataBlock.Type != "USERMGR DATA" || len(dataBlock.Bytes) < 24 {
 		return nil, fmt.Errorf("invalid encoding")
 	}
 
-	nonce := [24]byte{}
-	copy(nonce[:], dataBlock.Bytes[:24])
+	if hostKey.HasSigningKey() {
+		signatureStr, ok := dataBlock.Headers["Signature"]
+		if !ok {
+			return nil, fmt.Errorf("user data is not signed")
+		}
+		signature, err := base64.StdEncoding.DecodeString(signatureStr)
+		if err != nil || !hostKey.Verify(dataBlock.Bytes, signature) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	}
+
+	var plaintext []byte
+	if dataBlock.Headers["Version"] == "3" {
+		var err error
+		plaintext, err = openEnvelope(dataBlock, hostKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nonce := [24]byte{}
+		copy(nonce[:], dataBlock.Bytes[:24])
 
-	plaintext, ok := box.Open(nil, dataBlock.Bytes[24:], &nonce,
-		&hostKey.AdminPublicKey, &hostKey.HostPrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("cannot decrypt user data. Wrong key?")
+		var ok bool
+		plaintext, ok = box.Open(nil, dataBlock.Bytes[24:], &nonce,
+			&hostKey.AdminPublicKey, &hostKey.HostPrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("cannot decrypt user data. Wrong key?")
+		}
 	}
 
 	ud := UsersData{}
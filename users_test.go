@@ -112,3 +112,45 @@ func (s *TestUsersData) TestCanLoadAndStore(c *C) {
 	c.Assert(err, ErrorMatches, "cannot decrypt user data. Wrong key\\?")
 
 }
+
+func (s *TestUsersData) TestSignature(c *C) {
+	randReader = &testRandomReader{Next: 1}
+	adminKey := GenerateKeyPair()
+	ud := &UsersData{Users: []User{{Name: "alice"}}}
+
+	signedData, err := ud.SignedString(adminKey)
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode(signedData)
+	c.Assert(block.Headers["Version"], Equals, "2")
+
+	ud, err = LoadUsersData(signedData, adminKey.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Users[0].Name, Equals, "alice")
+
+	// keys without a signing key can still read the data
+	legacyHostKey := adminKey.HostKey
+	legacyHostKey.AdminSigningPublicKey = [32]byte{}
+	ud, err = LoadUsersData(signedData, legacyHostKey)
+	c.Assert(err, IsNil)
+	c.Assert(ud.Users[0].Name, Equals, "alice")
+
+	// a holder of the host key can seal data, but not sign it
+	hostKey := adminKey.HostKey
+	forgedData := func() []byte {
+		nonce := [24]byte{}
+		ciphertext := box.Seal(nonce[:], []byte(`{"users":[{"name":"mallory"}]}`),
+			&nonce, &hostKey.AdminPublicKey, &hostKey.HostPrivateKey)
+		block.Bytes = ciphertext
+		return pem.EncodeToMemory(block)
+	}()
+	_, err = LoadUsersData(forgedData, adminKey.HostKey)
+	c.Assert(err, ErrorMatches, "invalid signature")
+
+	delete(block.Headers, "Signature")
+	_, err = LoadUsersData(pem.EncodeToMemory(block), adminKey.HostKey)
+	c.Assert(err, ErrorMatches, "user data is not signed")
+
+	block.Headers["Signature"] = "!!!"
+	_, err = LoadUsersData(pem.EncodeToMemory(block), adminKey.HostKey)
+	c.Assert(err, ErrorMatches, "invalid signature")
+}
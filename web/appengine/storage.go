@@ -4,17 +4,43 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"time"
 
+	"github.com/crewjam/usermgr/web"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 )
 
+// StoredData is the current version of the data. The newest versions are
+// also stored as StoredDataVersion entities in its entity group.
 type StoredData struct {
-	Data []byte
-	Etag string
+	Data    []byte
+	Etag    string
+	ModTime time.Time
 }
 
+// maxVersionDeletes is how many old versions Put removes at most.
+const maxVersionDeletes = 100
+
 type Storage struct {
+	// HistorySize, if specified, is how many versions are kept. By default
+	// web.DefaultHistorySize are kept, and if it is negative they are all
+	// kept.
+	HistorySize int
+}
+
+// historySize returns how many versions are kept, or 0 if they all are.
+func (s Storage) historySize() int {
+	switch {
+	case s.HistorySize < 0:
+		return 0
+	case s.HistorySize == 0:
+		return web.DefaultHistorySize
+	default:
+		return s.HistorySize
+	}
 }
 
 func (Storage) Get(ctx context.Context, existingEtag string) ([]byte, string, error) {
@@ -33,12 +59,144 @@ func (Storage) Get(ctx context.Context, existingEtag string) ([]byte, string, er
 	return storedData.Data, storedData.Etag, nil
 }
 
-func (Storage) Put(ctx context.Context, data []byte) (string, error) {
+// Put replaces the data. The check of expectedEtag and the write happen in
+// a transaction, so that concurrent requests cannot overwrite each other's
+// changes. Versions beyond HistorySize are removed in the same transaction.
+func (s Storage) Put(ctx context.Context, data []byte, expectedEtag string) (string, error) {
 	key := datastore.NewKey(ctx, "StoredData", "stored_data", 0, nil)
-	etag := fmt.Sprintf("%x", sha1.Sum(data))
-	_, err := datastore.Put(ctx, key, &StoredData{Data: data, Etag: etag})
+	etag := fmt.Sprintf("\"%x\"", sha1.Sum(data))
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if expectedEtag != "" {
+			storedData := StoredData{}
+			err := datastore.Get(ctx, key, &storedData)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if storedData.Etag != expectedEtag {
+				return web.ErrConflict
+			}
+		}
+		// queries in the transaction do not see the version added below, so
+		// one fewer of the existing versions are kept. A transaction can
+		// only write so many entities, so a long history is removed a
+		// little at a time.
+		if historySize := s.historySize(); historySize > 0 {
+			oldKeys, err := datastore.NewQuery("StoredDataVersion").Ancestor(key).
+				Order("-ModTime").Offset(historySize-1).Limit(maxVersionDeletes).
+				KeysOnly().GetAll(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := datastore.DeleteMulti(ctx, oldKeys); err != nil {
+				return err
+			}
+		}
+
+		storedData := StoredData{Data: data, Etag: etag, ModTime: time.Now()}
+		if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "StoredDataVersion", key), &storedData); err != nil {
+			return err
+		}
+		_, err := datastore.Put(ctx, key, &storedData)
+		return err
+	}, nil)
 	if err != nil {
 		return "", err
 	}
 	return etag, nil
 }
+
+// ModTime returns the time the data were last stored, or the zero time for
+// data stored before it was recorded.
+func (Storage) ModTime(ctx context.Context) (time.Time, error) {
+	storedData := StoredData{}
+	key := datastore.NewKey(ctx, "StoredData", "stored_data", 0, nil)
+	if err := datastore.Get(ctx, key, &storedData); err != nil {
+		return time.Time{}, err
+	}
+	return storedData.ModTime, nil
+}
+
+// Versions returns the versions of the data, newest first.
+func (Storage) Versions(ctx context.Context) ([]web.StorageVersion, error) {
+	key := datastore.NewKey(ctx, "StoredData", "stored_data", 0, nil)
+	storedVersions := []StoredData{}
+	keys, err := datastore.NewQuery("StoredDataVersion").Ancestor(key).GetAll(ctx, &storedVersions)
+	if err != nil {
+		return nil, err
+	}
+	versions := []web.StorageVersion{}
+	for i, storedVersion := range storedVersions {
+		versions = append(versions, web.StorageVersion{
+			ID:   strconv.FormatInt(keys[i].IntID(), 10),
+			Etag: storedVersion.Etag,
+			Time: storedVersion.ModTime,
+		})
+	}
+	sort.Sort(byTimeDescending(versions))
+	return versions, nil
+}
+
+// GetVersion returns the data stored as version id.
+func (Storage) GetVersion(ctx context.Context, id string) ([]byte, error) {
+	intID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	parentKey := datastore.NewKey(ctx, "StoredData", "stored_data", 0, nil)
+	storedData := StoredData{}
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "StoredDataVersion", "", intID, parentKey), &storedData)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storedData.Data, nil
+}
+
+// StoredPendingHosts holds the enrollment requests waiting for approval.
+// They are not signed, so they are kept apart from StoredData.
+type StoredPendingHosts struct {
+	Data []byte
+	Etag string
+}
+
+// GetPendingHosts returns the enrollment requests waiting for approval.
+func (Storage) GetPendingHosts(ctx context.Context) ([]byte, string, error) {
+	stored := StoredPendingHosts{}
+	key := datastore.NewKey(ctx, "StoredPendingHosts", "pending_hosts", 0, nil)
+	err := datastore.Get(ctx, key, &stored)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return stored.Data, stored.Etag, nil
+}
+
+// PutPendingHosts replaces the enrollment requests waiting for approval, in
+// a transaction that checks that they still have the entity tag
+// expectedEtag.
+func (Storage) PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error {
+	key := datastore.NewKey(ctx, "StoredPendingHosts", "pending_hosts", 0, nil)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		stored := StoredPendingHosts{}
+		err := datastore.Get(ctx, key, &stored)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if stored.Etag != expectedEtag {
+			return web.ErrConflict
+		}
+		stored = StoredPendingHosts{Data: data, Etag: fmt.Sprintf("\"%x\"", sha1.Sum(data))}
+		_, err = datastore.Put(ctx, key, &stored)
+		return err
+	}, nil)
+}
+
+type byTimeDescending []web.StorageVersion
+
+func (v byTimeDescending) Len() int           { return len(v) }
+func (v byTimeDescending) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byTimeDescending) Less(i, j int) bool { return v[i].Time.After(v[j].Time) }
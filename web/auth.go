@@ -1,6 +1,7 @@
 package web
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/crewjam/httperr"
@@ -13,11 +14,50 @@ type Auth interface {
 	RequireUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error)
 }
 
+// userInfoAuth is implemented by Auth that learns more about the user than
+// their name.
+type userInfoAuth interface {
+	// UserInfo returns the email address of the user that RequireUser
+	// authenticated, if known, and whether the authentication mechanism
+	// says that they can administer usermgr.
+	UserInfo(r *http.Request) (email string, isAdmin bool)
+}
+
+// subjectAuth is implemented by Auth whose user names are chosen by the
+// users themselves, which must then be bound to the provider's stable ID
+// for the user so that nobody can take over an account by choosing its
+// name.
+type subjectAuth interface {
+	// Subject returns the ID of the user that RequireUser authenticated,
+	// or "" if the user name can be trusted.
+	Subject(r *http.Request) string
+}
+
+// errSubjectMismatch is returned when a login names an account that is
+// bound to another login.
+var errSubjectMismatch = httperr.Error{
+	StatusCode:   http.StatusForbidden,
+	PrivateError: fmt.Errorf("the account belongs to another login"),
+}
+
 func (s *Server) RequireUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (*RemoteUser, error) {
 	remoteUserName, err := s.Auth.RequireUser(ctx, w, r)
 	if err != nil {
 		return nil, err
 	}
+	if name, ok := ctx.Value(remoteUserKey).(*string); ok {
+		*name = remoteUserName
+	}
+
+	var email string
+	var isAdmin bool
+	if userInfoAuth, ok := s.Auth.(userInfoAuth); ok {
+		email, isAdmin = userInfoAuth.UserInfo(r)
+	}
+	var subject string
+	if subjectAuth, ok := s.Auth.(subjectAuth); ok {
+		subject = subjectAuth.Subject(r)
+	}
 
 	usersData, _, err := s.loadData(ctx)
 	if err != nil {
@@ -26,22 +66,38 @@ func (s *Server) RequireUser(ctx context.Context, w http.ResponseWriter, r *http
 
 	user := usersData.GetUserByName(remoteUserName)
 	if user == nil {
-		// auto create the user
-		user = &usermgr.User{
-			Name: remoteUserName,
-		}
-		if len(usersData.Users) == 0 {
-			// First user is automatically an admin
-			user.Groups = []string{"usermgr-admin"}
-		}
-		usersData.Set(*user)
+		err := s.mutateUsersData(ctx, func(usersData *usermgr.UsersData) error {
+			// another request may have created the user in the meantime
+			user = usersData.GetUserByName(remoteUserName)
+			if user != nil {
+				return nil
+			}
 
-		if err := s.storeData(ctx, usersData); err != nil {
+			// auto create the user
+			user = &usermgr.User{
+				Name:    remoteUserName,
+				Email:   email,
+				Subject: subject,
+			}
+			if len(usersData.Users) == 0 {
+				// First user is automatically an admin
+				user.Groups = []string{"usermgr-admin"}
+			}
+			usersData.Set(*user)
+			return nil
+		})
+		if err != nil {
 			return nil, err
 		}
 	}
+	// accounts that were not created by this login, including ones
+	// created before logins were bound, are refused until an admin sets
+	// their subject
+	if subject != "" && user.Subject != subject {
+		return nil, errSubjectMismatch
+	}
 
-	return &RemoteUser{Name: remoteUserName, IsAdmin: user.InGroup("usermgr-admin")}, nil
+	return &RemoteUser{Name: remoteUserName, IsAdmin: isAdmin || user.InGroup("usermgr-admin")}, nil
 }
 
 func (s *Server) requireUserOrAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) (*RemoteUser, error) {
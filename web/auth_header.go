@@ -0,0 +1,89 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/crewjam/httperr"
+	"golang.org/x/net/context"
+)
+
+// HeaderAuth authenticates users by a header set by a reverse proxy, such
+// as Apache or nginx, that handles the authentication itself.
+type HeaderAuth struct {
+	// Header is the header holding the user name, X-Remote-User by default.
+	Header string
+
+	// TrustedProxies are the networks that requests may come from. Requests
+	// from anywhere else are refused, since anyone could set the headers.
+	TrustedProxies []*net.IPNet
+
+	// EmailHeader, if specified, is the header holding the user's email
+	// address, which is recorded when the user is created.
+	EmailHeader string
+
+	// GroupsHeader, if specified, is the header holding a comma separated
+	// list of the groups the proxy knows the user to be in.
+	GroupsHeader string
+
+	// AdminGroups are groups in GroupsHeader whose members can administer
+	// usermgr as if they were in the usermgr-admin group.
+	AdminGroups []string
+}
+
+// checkProxy returns an error unless r comes from one of TrustedProxies.
+func (a HeaderAuth) checkProxy(r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range a.TrustedProxies {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return httperr.Error{
+		StatusCode:   http.StatusForbidden,
+		PrivateError: fmt.Errorf("request from %s, which is not a trusted proxy", r.RemoteAddr),
+	}
+}
+
+func (a HeaderAuth) RequireUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error) {
+	if err := a.checkProxy(r); err != nil {
+		return "", err
+	}
+	header := a.Header
+	if header == "" {
+		header = "X-Remote-User"
+	}
+	remoteUser := strings.TrimSpace(r.Header.Get(header))
+	if remoteUser == "" {
+		return "", httperr.Error{
+			StatusCode:   http.StatusUnauthorized,
+			PrivateError: fmt.Errorf("request has no %s header", header),
+		}
+	}
+	return remoteUser, nil
+}
+
+// UserInfo returns the email address in EmailHeader, and whether the user
+// is in one of AdminGroups according to GroupsHeader.
+func (a HeaderAuth) UserInfo(r *http.Request) (email string, isAdmin bool) {
+	if a.EmailHeader != "" {
+		email = strings.TrimSpace(r.Header.Get(a.EmailHeader))
+	}
+	if a.GroupsHeader != "" {
+		for _, group := range strings.Split(r.Header.Get(a.GroupsHeader), ",") {
+			for _, adminGroup := range a.AdminGroups {
+				if strings.TrimSpace(group) == adminGroup {
+					isAdmin = true
+				}
+			}
+		}
+	}
+	return email, isAdmin
+}
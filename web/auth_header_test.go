@@ -0,0 +1,65 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestWeb) TestHeaderAuth(c *C) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	suite.Server.Auth = HeaderAuth{
+		TrustedProxies: []*net.IPNet{proxies},
+		EmailHeader:    "X-Remote-Email",
+		GroupsHeader:   "X-Remote-Groups",
+		AdminGroups:    []string{"ops"},
+	}
+
+	get := func(remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/users/", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		suite.Server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// requests that do not come from a trusted proxy are refused, since
+	// anyone could set the headers
+	w := get("192.0.2.1:1234", http.Header{"X-Remote-User": {"alice"}})
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	w = get("10.1.2.3:1234", http.Header{})
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	w = get("10.1.2.3:1234", http.Header{"X-Remote-User": {"alice"}})
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	// new users are created with their email address
+	w = get("10.1.2.3:1234", http.Header{
+		"X-Remote-User":  {"charlie"},
+		"X-Remote-Email": {"charlie@example.com"},
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "\"email\":\"charlie@example.com\""), Equals, true)
+	c.Assert(strings.Contains(w.Body.String(), "bob"), Equals, false)
+
+	// members of an admin group are admins without being in usermgr-admin
+	w = get("10.1.2.3:1234", http.Header{
+		"X-Remote-User":   {"charlie"},
+		"X-Remote-Groups": {"dev, ops"},
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "bob"), Equals, true)
+	usersData, _, err := suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(len(usersData.Users), Equals, 3)
+	c.Assert(usersData.GetUserByName("charlie").Groups, IsNil)
+}
@@ -86,6 +86,12 @@ func (a OauthAuth) HandleCallback(ctx context.Context, w http.ResponseWriter, r
 	if err != nil {
 		return err
 	}
+	if !strings.HasSuffix(userInfo.Email, a.EmailSuffix) {
+		return httperr.Error{
+			StatusCode:   http.StatusForbidden,
+			PrivateError: fmt.Errorf("email address %q does not end with %q", userInfo.Email, a.EmailSuffix),
+		}
+	}
 	remoteUser := strings.TrimSuffix(userInfo.Email, a.EmailSuffix)
 
 	// generate a token for the user
@@ -0,0 +1,479 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/httperr"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const oidcLoginCookieName = "oidc_login"
+
+// oidcLoginMaxAge is how long a user has to log in at the issuer.
+const oidcLoginMaxAge = 10 * time.Minute
+
+// OIDCAuth authenticates users with OpenID Connect. The endpoints and keys
+// of the issuer are found by discovery. Logins use the authorization code
+// flow with PKCE, and the ID token returned by the issuer is verified
+// against the keys it publishes before the user is trusted.
+type OIDCAuth struct {
+	// Issuer is the URL of the issuer, for example
+	// https://accounts.google.com.
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// Scopes are the scopes to request. The default is openid, profile and
+	// email.
+	Scopes []string
+
+	// UsernameClaim is the claim of the ID token that holds the user name.
+	// The default is email, in which case the email address must be
+	// verified and EmailSuffix is removed from it.
+	//
+	// Other claims, such as preferred_username, can often be chosen by the
+	// users themselves, so with them each account is bound to the subject
+	// (the sub claim) of the login that created it, and other logins with
+	// the same user name are refused (see usermgr.User.Subject).
+	UsernameClaim string
+
+	// EmailSuffix, if specified, is required at the end of the user's
+	// verified email address.
+	EmailSuffix string
+
+	// TokenSigningKey signs the cookies that hold the session and the state
+	// of a login. It is required.
+	TokenSigningKey []byte
+
+	// HTTPClient, if specified, is used to talk to the issuer.
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey
+}
+
+// oidcProvider is the part of the issuer's discovery document that we use.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is a key in the issuer's JWK set. Only RSA keys are used.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (a *OIDCAuth) httpClient() *http.Client {
+	if a.HTTPClient != nil {
+		return a.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (a *OIDCAuth) getJSON(url string, v interface{}) error {
+	resp, err := a.httpClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", url, err)
+	}
+	return nil
+}
+
+// discover returns the issuer's discovery document, which is fetched once.
+func (a *OIDCAuth) discover() (*oidcProvider, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.provider != nil {
+		return a.provider, nil
+	}
+
+	provider := oidcProvider{}
+	if err := a.getJSON(strings.TrimSuffix(a.Issuer, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != a.Issuer {
+		return nil, fmt.Errorf("discovery: issuer is %q, expected %q", provider.Issuer, a.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery: %s does not publish the required endpoints", a.Issuer)
+	}
+	a.provider = &provider
+	return a.provider, nil
+}
+
+// publicKey returns the issuer's key with the specified ID. The keys are
+// fetched again if the ID is unknown, since the issuer may have rotated them.
+func (a *OIDCAuth) publicKey(provider *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := a.getJSON(provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	a.keys = map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		a.keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key with ID %q in %s", kid, provider.JWKSURI)
+}
+
+// randomString returns a random URL-safe string for a state, nonce or PKCE
+// code verifier.
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (a *OIDCAuth) oauth2Config(provider *oidcProvider) oauth2.Config {
+	scopes := a.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	return oauth2.Config{
+		ClientID:     a.ClientID,
+		ClientSecret: a.ClientSecret,
+		RedirectURL:  a.RedirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  provider.AuthorizationEndpoint,
+			TokenURL: provider.TokenEndpoint,
+		},
+	}
+}
+
+// errNoTokenSigningKey is returned instead of signing or accepting cookies
+// with an empty key, which anyone could forge.
+var errNoTokenSigningKey = fmt.Errorf("oidc auth requires a token signing key")
+
+// signCookie returns token signed with TokenSigningKey.
+func (a *OIDCAuth) signCookie(token *jwt.Token) (string, error) {
+	if len(a.TokenSigningKey) == 0 {
+		return "", errNoTokenSigningKey
+	}
+	return token.SignedString(a.TokenSigningKey)
+}
+
+// parseSignedCookie returns the claims of the JWT in the named cookie.
+func (a *OIDCAuth) parseSignedCookie(r *http.Request, name string) (map[string]interface{}, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		if len(a.TokenSigningKey) == 0 {
+			return nil, errNoTokenSigningKey
+		}
+		return a.TokenSigningKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("%s cookie is not valid", name)
+	}
+	return token.Claims, nil
+}
+
+// usernameIsEmail returns true if user names are verified email addresses,
+// which the issuer guarantees, rather than claims users may choose.
+func (a *OIDCAuth) usernameIsEmail() bool {
+	return a.UsernameClaim == "" || a.UsernameClaim == "email"
+}
+
+func (a *OIDCAuth) RequireUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error) {
+	if claims, err := a.parseSignedCookie(r, cookieName); err == nil {
+		sub, _ := claims["sub"].(string)
+		subject, _ := claims["subject"].(string)
+		// sessions that do not say whose login they are for cannot be
+		// checked against the account, so the user logs in again
+		if sub != "" && (a.usernameIsEmail() || subject != "") {
+			return sub, nil
+		}
+	}
+
+	provider, err := a.discover()
+	if err != nil {
+		return "", err
+	}
+
+	// The nonce and the PKCE code verifier are kept in a cookie rather than
+	// in the state, which passes through the URL.
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	login := jwt.New(jwt.SigningMethodHS256)
+	login.Claims["state"] = state
+	login.Claims["nonce"] = nonce
+	login.Claims["verifier"] = verifier
+	login.Claims["url"] = r.URL.Path
+	login.Claims["exp"] = TimeNow().Add(oidcLoginMaxAge).Unix()
+	loginString, err := a.signCookie(login)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate login JWT: %s", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookieName,
+		Value:    loginString,
+		Path:     "/",
+		MaxAge:   int(oidcLoginMaxAge / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	config := a.oauth2Config(provider)
+	http.Redirect(w, r, config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256")),
+		http.StatusFound)
+	return "", httperr.Error{StatusCode: http.StatusFound}
+}
+
+// forbidden returns an error that denies the login for the reason given
+// by format, which is logged but not shown to the user.
+func forbidden(format string, args ...interface{}) error {
+	return httperr.Error{
+		StatusCode:   http.StatusForbidden,
+		PrivateError: fmt.Errorf(format, args...),
+	}
+}
+
+// verifyIDToken checks the signature and the claims of an ID token and
+// returns the claims.
+func (a *OIDCAuth) verifyIDToken(provider *oidcProvider, rawIDToken string, nonce string) (map[string]interface{}, error) {
+	idToken, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return a.publicKey(provider, kid)
+	})
+	if err != nil {
+		return nil, forbidden("id token: %s", err)
+	}
+	if !idToken.Valid {
+		return nil, forbidden("id token is not valid")
+	}
+	claims := idToken.Claims
+
+	if iss, _ := claims["iss"].(string); iss != provider.Issuer {
+		return nil, forbidden("id token: issuer is %q, expected %q", iss, provider.Issuer)
+	}
+
+	audiences := []string{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	audienceOK := false
+	for _, aud := range audiences {
+		if aud == a.ClientID {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return nil, forbidden("id token: audience %v does not include %s", audiences, a.ClientID)
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != a.ClientID {
+		return nil, forbidden("id token: authorized party is %q, expected %q", azp, a.ClientID)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || TimeNow().After(time.Unix(int64(exp), 0)) {
+		return nil, forbidden("id token is expired")
+	}
+	if iat, ok := claims["iat"].(float64); !ok || time.Unix(int64(iat), 0).After(TimeNow().Add(5*time.Minute)) {
+		return nil, forbidden("id token: issue time is missing or in the future")
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, forbidden("id token: nonce does not match")
+	}
+	return claims, nil
+}
+
+// username returns the user name from the claims of an ID token.
+func (a *OIDCAuth) username(claims map[string]interface{}) (string, error) {
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+	if a.EmailSuffix != "" {
+		if !emailVerified {
+			return "", forbidden("email address %q is not verified", email)
+		}
+		if !strings.HasSuffix(email, a.EmailSuffix) {
+			return "", forbidden("email address %q does not end with %q", email, a.EmailSuffix)
+		}
+	}
+
+	usernameClaim := a.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "email"
+	}
+	username, _ := claims[usernameClaim].(string)
+	if usernameClaim == "email" {
+		if !emailVerified {
+			return "", forbidden("email address %q is not verified", email)
+		}
+		username = strings.TrimSuffix(username, a.EmailSuffix)
+	}
+	if username == "" {
+		return "", forbidden("id token has no %s claim", usernameClaim)
+	}
+	return username, nil
+}
+
+// Subject returns the subject of the login that the session belongs to if
+// the user name comes from a claim users may choose, so that the account
+// can be bound to it.
+func (a *OIDCAuth) Subject(r *http.Request) string {
+	if a.usernameIsEmail() {
+		return ""
+	}
+	claims, err := a.parseSignedCookie(r, cookieName)
+	if err != nil {
+		return ""
+	}
+	subject, _ := claims["subject"].(string)
+	return subject
+}
+
+// HandleCallback completes a login when the issuer redirects the user back.
+func (a *OIDCAuth) HandleCallback(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	login, err := a.parseSignedCookie(r, oidcLoginCookieName)
+	if err != nil {
+		return forbidden("login: %s", err)
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcLoginCookieName, Path: "/", MaxAge: -1})
+	if state, _ := login["state"].(string); state == "" || state != r.FormValue("state") {
+		return forbidden("login: state does not match")
+	}
+	if errorCode := r.FormValue("error"); errorCode != "" {
+		return forbidden("login: %s: %s", errorCode, r.FormValue("error_description"))
+	}
+
+	provider, err := a.discover()
+	if err != nil {
+		return err
+	}
+	config := a.oauth2Config(provider)
+	verifier, _ := login["verifier"].(string)
+	oauthToken, err := config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, a.httpClient()),
+		r.FormValue("code"), oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return forbidden("login: %s", err)
+	}
+	rawIDToken, _ := oauthToken.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return forbidden("login: the token response has no id_token")
+	}
+	nonce, _ := login["nonce"].(string)
+	claims, err := a.verifyIDToken(provider, rawIDToken, nonce)
+	if err != nil {
+		return err
+	}
+	remoteUser, err := a.username(claims)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s logged in as %s", claims["sub"], remoteUser)
+
+	session := jwt.New(jwt.SigningMethodHS256)
+	session.Claims["sub"] = remoteUser
+	if !a.usernameIsEmail() {
+		subject, _ := claims["sub"].(string)
+		if subject == "" {
+			return forbidden("id token has no sub claim")
+		}
+		session.Claims["subject"] = subject
+	}
+	session.Claims["exp"] = TimeNow().Add(cookieMaxAge).Unix()
+	sessionString, err := a.signCookie(session)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    sessionString,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+	})
+	url, _ := login["url"].(string)
+	if !strings.HasPrefix(url, "/") || strings.HasPrefix(url, "//") {
+		url = "/"
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+	return nil
+}
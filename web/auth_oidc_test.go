@@ -0,0 +1,299 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+// mockIssuer is an OpenID Connect issuer that issues an ID token with
+// Claims, signed by Key, for any code.
+type mockIssuer struct {
+	*httptest.Server
+	Key       *rsa.PrivateKey
+	KeyID     string
+	Claims    map[string]interface{}
+	Challenge string
+	Nonce     string
+}
+
+func newMockIssuer(c *C) *mockIssuer {
+	issuer := &mockIssuer{KeyID: "key1"}
+	var err error
+	issuer.Key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": issuer.KeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(issuer.Key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.Key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != issuer.Challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		idToken := jwt.New(jwt.SigningMethodRS256)
+		idToken.Header["kid"] = issuer.KeyID
+		for k, v := range issuer.Claims {
+			idToken.Claims[k] = v
+		}
+		idTokenString, err := idToken.SignedString(issuer.Key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idTokenString,
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (suite *TestWeb) TestOIDCAuth(c *C) {
+	issuer := newMockIssuer(c)
+	defer issuer.Close()
+
+	auth := &OIDCAuth{
+		Issuer:          issuer.URL,
+		ClientID:        "usermgr",
+		ClientSecret:    "secret",
+		RedirectURL:     "https://users.example.com/oauth2callback",
+		EmailSuffix:     "@example.com",
+		TokenSigningKey: []byte("key"),
+	}
+	server := New(Config{
+		Storage:  suite.FakeStorage,
+		Auth:     auth,
+		AdminKey: suite.AdminKey,
+	})
+
+	serve := func(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		server.Mux.ServeHTTP(w, r)
+		return w
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == name && cookie.MaxAge >= 0 {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	// login starts a login at /users/, lets claims modify the claims of
+	// the ID token, and returns the response to the callback.
+	login := func(claims func(map[string]interface{})) *httptest.ResponseRecorder {
+		w := serve("/users/", nil)
+		c.Assert(w.Code, Equals, http.StatusFound)
+		location, err := url.Parse(w.Header().Get("Location"))
+		c.Assert(err, IsNil)
+		c.Assert(location.Path, Equals, "/authorize")
+		query := location.Query()
+		c.Assert(query.Get("client_id"), Equals, "usermgr")
+		c.Assert(query.Get("redirect_uri"), Equals, "https://users.example.com/oauth2callback")
+		c.Assert(query.Get("scope"), Equals, "openid profile email")
+		c.Assert(query.Get("code_challenge_method"), Equals, "S256")
+		issuer.Challenge = query.Get("code_challenge")
+
+		issuer.Claims = map[string]interface{}{
+			"iss":            issuer.URL,
+			"sub":            "1234",
+			"aud":            "usermgr",
+			"exp":            TimeNow().Add(cookieMaxAge).Unix(),
+			"iat":            TimeNow().Unix(),
+			"nonce":          query.Get("nonce"),
+			"email":          "alice@example.com",
+			"email_verified": true,
+		}
+		if claims != nil {
+			claims(issuer.Claims)
+		}
+
+		loginCookie := cookie(w, oidcLoginCookieName)
+		c.Assert(loginCookie, NotNil)
+		c.Assert(loginCookie.HttpOnly, Equals, true)
+		return serve("/oauth2callback?code=code&state="+url.QueryEscape(query.Get("state")),
+			[]*http.Cookie{loginCookie})
+	}
+
+	w := login(nil)
+	c.Assert(w.Code, Equals, http.StatusFound)
+	c.Assert(w.Header().Get("Location"), Equals, "/users/")
+	session := cookie(w, cookieName)
+	c.Assert(session, NotNil)
+	w = serve("/users/", []*http.Cookie{session})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "bob"), Equals, true)
+
+	// the ID token must be for this login
+	w = login(func(claims map[string]interface{}) { claims["nonce"] = "replayed" })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// the email address must be verified and end with the suffix
+	w = login(func(claims map[string]interface{}) { claims["email_verified"] = false })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = login(func(claims map[string]interface{}) { delete(claims, "email_verified") })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = login(func(claims map[string]interface{}) { claims["email"] = "alice@example.com.evil.com" })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// the ID token must be issued by the issuer for us, and be current
+	w = login(func(claims map[string]interface{}) { claims["aud"] = "someone-else" })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = login(func(claims map[string]interface{}) { claims["aud"] = []interface{}{"someone-else", "usermgr"} })
+	c.Assert(w.Code, Equals, http.StatusFound)
+	w = login(func(claims map[string]interface{}) {
+		claims["aud"] = []interface{}{"someone-else", "usermgr"}
+		claims["azp"] = "someone-else"
+	})
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = login(func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = login(func(claims map[string]interface{}) { delete(claims, "exp") })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = login(func(claims map[string]interface{}) { delete(claims, "iat") })
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// a token signed with a key the issuer does not publish is refused
+	goodKey := issuer.Key
+	issuer.Key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	w = login(nil)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// when the issuer rotates its keys, the new ones are fetched
+	issuer.KeyID = "key2"
+	w = login(nil)
+	c.Assert(w.Code, Equals, http.StatusFound)
+	issuer.Key = goodKey
+	issuer.KeyID = "key1"
+
+	// the state must match the login cookie
+	w = serve("/users/", nil)
+	loginCookie := cookie(w, oidcLoginCookieName)
+	w = serve("/oauth2callback?code=code&state=forged", []*http.Cookie{loginCookie})
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	w = serve("/oauth2callback?code=code&state=forged", nil)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// the user name can come from another claim
+	auth.UsernameClaim = "preferred_username"
+	auth.EmailSuffix = ""
+	w = login(func(claims map[string]interface{}) {
+		claims["preferred_username"] = "charlie"
+		claims["email_verified"] = false
+	})
+	c.Assert(w.Code, Equals, http.StatusFound)
+	w = serve("/users/", []*http.Cookie{cookie(w, cookieName)})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "charlie"), Equals, true)
+	w = login(nil)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// such a name can be chosen by the user, so the account is bound to
+	// the login that created it
+	usersData, _, err := server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(usersData.GetUserByName("charlie").Subject, Equals, "1234")
+	loginAs := func(sub, username string) int {
+		w := login(func(claims map[string]interface{}) {
+			claims["sub"] = sub
+			claims["preferred_username"] = username
+		})
+		c.Assert(w.Code, Equals, http.StatusFound)
+		return serve("/users/", []*http.Cookie{cookie(w, cookieName)}).Code
+	}
+	c.Assert(loginAs("1234", "charlie"), Equals, http.StatusOK)
+	c.Assert(loginAs("5678", "charlie"), Equals, http.StatusForbidden)
+
+	// accounts created otherwise are refused until an admin binds them
+	c.Assert(loginAs("1234", "alice"), Equals, http.StatusForbidden)
+	usersData, _, _ = server.loadData(context.TODO())
+	alice := usersData.GetUserByName("alice")
+	alice.Subject = "5678"
+	usersData.Set(*alice)
+	suite.FakeStorage.Data, _ = usersData.SignedString(suite.AdminKey)
+	c.Assert(loginAs("5678", "alice"), Equals, http.StatusOK)
+
+	// sessions that do not name the login must log in again
+	session = &http.Cookie{Name: cookieName, Value: signedCookie(c, auth.TokenSigningKey, "alice", "")}
+	c.Assert(serve("/users/", []*http.Cookie{session}).Code, Equals, http.StatusFound)
+
+	// cookies are never signed or accepted with an empty key, which
+	// anyone could forge
+	auth.UsernameClaim = ""
+	session = &http.Cookie{Name: cookieName, Value: signedCookie(c, []byte{}, "alice", "")}
+	auth.TokenSigningKey = nil
+	w = serve("/users/", []*http.Cookie{session})
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+}
+
+// signedCookie returns a session for username signed with key.
+func signedCookie(c *C, key []byte, username, subject string) string {
+	session := jwt.New(jwt.SigningMethodHS256)
+	session.Claims["sub"] = username
+	if subject != "" {
+		session.Claims["subject"] = subject
+	}
+	session.Claims["exp"] = TimeNow().Add(cookieMaxAge).Unix()
+	value, err := session.SignedString(key)
+	c.Assert(err, IsNil)
+	return value
+}
+
+func (suite *TestWeb) TestOIDCAuthDiscovery(c *C) {
+	issuer := newMockIssuer(c)
+	defer issuer.Close()
+
+	// the issuer in the discovery document must match
+	auth := &OIDCAuth{Issuer: issuer.URL + "/other", TokenSigningKey: []byte("key")}
+	_, err := auth.discover()
+	c.Assert(err, NotNil)
+
+	auth = &OIDCAuth{Issuer: issuer.URL, TokenSigningKey: []byte("key")}
+	provider, err := auth.discover()
+	c.Assert(err, IsNil)
+	c.Assert(provider.TokenEndpoint, Equals, issuer.URL+"/token")
+}
@@ -26,7 +26,7 @@ func (s *Server) getUsersList(ctx context.Context, w http.ResponseWriter, r *htt
 		usersData.Users = []usermgr.User{*user}
 	}
 
-	w.Header().Set("ETag", etag)
+	w.Header().Set("ETag", quoteETag(etag))
 	w.Header().Set("Content-type", "application/json")
 	json.NewEncoder(w).Encode(usersData)
 	return nil
@@ -48,7 +48,7 @@ func (s *Server) getUser(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return httperr.NotFound
 	}
 
-	w.Header().Set("ETag", etag)
+	w.Header().Set("ETag", quoteETag(etag))
 	w.Header().Set("Content-type", "application/json")
 	json.NewEncoder(w).Encode(user)
 	return nil
@@ -72,13 +72,25 @@ func (s *Server) putUser(ctx context.Context, w http.ResponseWriter, r *http.Req
 	}
 	user.Name = Param(ctx, "user")
 
-	err = s.mutateUsersData(ctx, func(usersData *usermgr.UsersData) error {
+	// A client that sends the entity tag returned by getUser in If-Match
+	// gets 412 instead of overwriting changes made since it read the user.
+	mutate := s.mutateUsersData
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		mutate = func(ctx context.Context, f func(usersData *usermgr.UsersData) error) error {
+			return s.mutateUsersDataIfMatch(ctx, ifMatch, f)
+		}
+	}
+
+	err = mutate(ctx, func(usersData *usermgr.UsersData) error {
 		if !remoteUser.IsAdmin {
 			existingUser := usersData.GetUserByName(Param(ctx, "user"))
 			if existingUser == nil {
 				return httperr.Forbidden
 			}
 
+			// the account stays bound to the same login
+			user.Subject = existingUser.Subject
+
 			// forbid the user from adding a group
 			for _, group := range user.Groups {
 				if !existingUser.InGroup(group) {
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/crewjam/httperr"
+	"golang.org/x/net/context"
 
 	. "gopkg.in/check.v1"
 )
@@ -18,7 +19,7 @@ func (suite *TestWeb) TestCanGetUsers(c *C) {
 	suite.Server.Mux.ServeHTTP(w, r)
 	c.Assert(w.Code, Equals, 200)
 	c.Assert(w.Header(), DeepEquals, http.Header{
-		"Etag":         []string{"34cfb4411e1ed35d1183e544202c0608e3c91c0c"},
+		"Etag":         []string{"\"34cfb4411e1ed35d1183e544202c0608e3c91c0c\""},
 		"Content-Type": []string{"application/json"},
 	})
 	c.Assert(string(w.Body.Bytes()), Equals, "{\"users\":[{\"name\":\"alice\",\"real_name\":\"Alice Smith\",\"groups\":[\"usermgr-admin\"],\"authorized_keys\":[\"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC+ui4gptEr2ovoLD3vRhdRXXDLserFKhHcJrwBS79gO1J4KLzhgx0Pd/Mt7UyN3orxjKh06fd4N4P/5/c16BXK1Qe4DC/qClgkE5TyOyf8d04xXXVQlcn+LuRt4lAFgMxbfa2Sc0L0BJeu2VbW4DkIlYACwAdO6acWlOvJnMuYyomVgrcvle4yQWPU9L1Ql3E+RVIcdjR9aIN+QqgPNYZmvcuWzaKSbcnAwSsAIaoLxd8y14N6NvQdu4nvvZjBpkDTZI/IXIkwtZGkycSelNKnhPFWSL1qlgwqjH7U9/F3JxX4g0KjfzoCBjt9fKqn1fxneSZavFH1Q0LZNkfAUrov ross@rm\"],\"backup_codes\":[{\"create_time\":\"2006-01-02T15:04:05Z\",\"salt\":\"QEJERkhKTE5QUlRWWFpcXmBiZGZoamxucHJ0dnh6fH4=\",\"hash\":\"P+yRmvoi7Gjw0vrdojCdZJlVqr6i5vUXzWuHxNXd7cOWvHWQG/ea8W/cs3YfVhcuECmozmhGPHYx/uku9/Impw==\"}]},{\"name\":\"bob\",\"groups\":[\"wheel\"]}]}\n")
@@ -131,6 +132,16 @@ func (suite *TestWeb) TestPutUserNonAdmin(c *C) {
 		strings.NewReader("{\"name\":\"alice\",\"groups\":[\"wheel\"]}"))
 	suite.Server.Mux.ServeHTTP(w, r)
 	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	// I can't bind my account to another login
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"groups\":[\"wheel\"],\"subject\":\"1234\"}"))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 204)
+	usersData, _, err := suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(usersData.GetUserByName("bob").Subject, Equals, "")
 }
 
 func (suite *TestWeb) TestPutUserAdmin(c *C) {
@@ -185,3 +196,81 @@ func (suite *TestWeb) TestDeleteUserAdmin(c *C) {
 	suite.Server.Mux.ServeHTTP(w, r)
 	c.Assert(w.Code, Equals, http.StatusUnauthorized)
 }
+
+func (suite *TestWeb) TestPutUserIfMatch(c *C) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/users/bob", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 200)
+	etag := w.Header().Get("ETag")
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"real_name\": \"Bob Smith\", \"groups\":[\"wheel\"]}"))
+	r.Header.Set("If-Match", etag)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 204)
+
+	// the etag is stale now
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"groups\":[\"wheel\"]}"))
+	r.Header.Set("If-Match", etag)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusPreconditionFailed)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/users/bob", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(string(w.Body.Bytes()), Equals, "{\"name\":\"bob\",\"real_name\":\"Bob Smith\",\"groups\":[\"wheel\"]}\n")
+	etag = w.Header().Get("ETag")
+
+	// the data change between loading and storing them
+	suite.FakeStorage.BeforePut = func() {
+		suite.FakeStorage.BeforePut = nil
+		suite.FakeStorage.Etag = "\"changed\""
+	}
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"groups\":[\"wheel\"]}"))
+	r.Header.Set("If-Match", etag)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusPreconditionFailed)
+}
+
+func (suite *TestWeb) TestPutUserRetriesConflicts(c *C) {
+	// another request changes alice while bob is being changed
+	suite.FakeStorage.BeforePut = func() {
+		suite.FakeStorage.BeforePut = nil
+		usersData, etag, err := suite.Server.loadData(context.TODO())
+		c.Assert(err, IsNil)
+		alice := usersData.GetUserByName("alice")
+		alice.RealName = "Alice Jones"
+		usersData.Set(*alice)
+		c.Assert(suite.Server.storeData(context.TODO(), usersData, etag), IsNil)
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"real_name\": \"Bob Smith\", \"groups\":[\"wheel\"]}"))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 204)
+
+	// neither change is lost
+	usersData, _, err := suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(usersData.GetUserByName("alice").RealName, Equals, "Alice Jones")
+	c.Assert(usersData.GetUserByName("bob").RealName, Equals, "Bob Smith")
+
+	// a change that keeps conflicting eventually fails
+	changes := 0
+	suite.FakeStorage.BeforePut = func() {
+		changes++
+		suite.FakeStorage.Etag = fmt.Sprintf("\"changed-%d\"", changes)
+	}
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"groups\":[\"wheel\"]}"))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusConflict)
+	c.Assert(changes, Equals, maxMutateAttempts)
+}
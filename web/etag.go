@@ -0,0 +1,59 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// quoteETag returns etag as a quoted string as required by RFC 7232.
+// Entity tags from storage that predates quoting are quoted, or hex encoded
+// if they are binary.
+func quoteETag(etag string) string {
+	if etag == "" || strings.HasPrefix(etag, "\"") || strings.HasPrefix(etag, "W/\"") {
+		return etag
+	}
+	for _, c := range []byte(etag) {
+		if c < 0x21 || c > 0x7e || c == '"' {
+			return fmt.Sprintf("\"%x\"", etag)
+		}
+	}
+	return "\"" + etag + "\""
+}
+
+// opaqueTag returns the entity tag without the weakness indicator and the
+// quotes, for the weak comparison of RFC 7232 section 2.3.2.
+func opaqueTag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), "\"")
+}
+
+// etagMatches returns true if etag is in header, a list of entity tags as
+// in If-None-Match and If-Match, or if header is "*".
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate != "" && opaqueTag(candidate) == opaqueTag(etag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified returns true if the conditional request r can be answered
+// with 304 Not Modified for the data having etag and modified at modTime.
+// If-Modified-Since is only considered without If-None-Match, and only if
+// modTime is known.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(ifModifiedSince)
+}
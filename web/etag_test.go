@@ -0,0 +1,63 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestWeb) TestQuoteETag(c *C) {
+	c.Assert(quoteETag(""), Equals, "")
+	c.Assert(quoteETag(`"abc"`), Equals, `"abc"`)
+	c.Assert(quoteETag(`W/"abc"`), Equals, `W/"abc"`)
+	c.Assert(quoteETag("abc"), Equals, `"abc"`)
+	c.Assert(quoteETag("a\nb"), Equals, `"610a62"`)
+}
+
+func (suite *TestWeb) TestETagMatches(c *C) {
+	c.Assert(etagMatches(`"abc"`, `"abc"`), Equals, true)
+	c.Assert(etagMatches(`"xyz", W/"abc"`, `"abc"`), Equals, true)
+	c.Assert(etagMatches(`*`, `"abc"`), Equals, true)
+	c.Assert(etagMatches(`abc`, `"abc"`), Equals, true)
+	c.Assert(etagMatches(`"xyz"`, `"abc"`), Equals, false)
+	c.Assert(etagMatches(``, `"abc"`), Equals, false)
+}
+
+func (suite *TestWeb) TestConditionalGet(c *C) {
+	etag := suite.FakeStorage.Etag
+	get := func(method string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "/users.pem", nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		suite.Server.Mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("GET", "If-None-Match", `"xyz", `+etag)
+	c.Assert(w.Code, Equals, http.StatusNotModified)
+	c.Assert(w.Header().Get("ETag"), Equals, etag)
+	c.Assert(w.Header().Get("Cache-Control"), Equals, "no-cache")
+
+	w = get("GET", "If-None-Match", `"xyz"`)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.Bytes(), DeepEquals, suite.FakeStorage.Data)
+
+	w = get("HEAD")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("ETag"), Equals, etag)
+
+	// the fake storage does not know the modification time, so
+	// If-Modified-Since is ignored
+	w = get("GET", "If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Last-Modified"), Equals, "")
+
+	suite.FakeStorage.Err = os.ErrNotExist
+	w = get("GET")
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
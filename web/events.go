@@ -0,0 +1,153 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crewjam/httperr"
+	"golang.org/x/net/context"
+)
+
+// EventKeepAlive is how often a comment is sent on an idle event stream so
+// that clients and proxies can tell that it is still alive.
+var EventKeepAlive = 30 * time.Second
+
+// EventPollInterval is how often an event stream checks the storage for
+// changes made outside of this server, for example by another instance of
+// it or by `usermgr admin publish`. Storage that can watch for changes is
+// also watched. The streams share what they read, so the storage is read
+// about twice per interval however many hosts are connected.
+var EventPollInterval = 10 * time.Second
+
+// changeNotifier wakes up the event streams when the data change, and keeps
+// the entity tag of the current data, so that the streams share one read of
+// the storage rather than each reading it after every change and poll.
+type changeNotifier struct {
+	mu         sync.Mutex
+	ch         chan struct{}
+	generation uint64
+
+	// etag was read in etagGeneration at etagTime.
+	etagMu         sync.Mutex
+	etag           string
+	etagGeneration uint64
+	etagTime       time.Time
+}
+
+// wait returns a channel that is closed on the next change.
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+	}
+	n.ch = make(chan struct{})
+	n.generation++
+}
+
+// currentEtag returns the entity tag of the current data. It is only read
+// with get if there was a change since it was last read, or if it was read
+// more than maxAge ago, which finds the changes that nobody announced.
+func (n *changeNotifier) currentEtag(maxAge time.Duration, get func() (string, error)) (string, error) {
+	n.mu.Lock()
+	generation := n.generation
+	n.mu.Unlock()
+
+	n.etagMu.Lock()
+	defer n.etagMu.Unlock()
+	if !n.etagTime.IsZero() && n.etagGeneration == generation && time.Since(n.etagTime) < maxAge {
+		return n.etag, nil
+	}
+	readTime := time.Now()
+	etag, err := get()
+	if err != nil {
+		return "", err
+	}
+	n.etag, n.etagGeneration, n.etagTime = etag, generation, readTime
+	return etag, nil
+}
+
+// watchStorage announces the changes that storage which can watch for them
+// reports, including those made by other servers. It is started once, by
+// the first event stream.
+func (s *Server) watchStorage() {
+	watcher, ok := s.Storage.(changeWatcher)
+	if !ok {
+		return
+	}
+	go func() {
+		for range watcher.Watch(nil) {
+			s.changes.notify()
+		}
+	}()
+}
+
+// getEvents serves a stream of server-sent events announcing each new
+// version of /users.pem. Every event has the type "etag" and the entity tag
+// of the new version as its ID and data. The current version is announced
+// when the stream starts, unless the client reports having seen it in
+// Last-Event-ID.
+func (s *Server) getEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return httperr.Error{
+			StatusCode:   http.StatusNotImplemented,
+			PrivateError: fmt.Errorf("events: streaming is not supported"),
+		}
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", EventPollInterval/time.Millisecond)
+	flusher.Flush()
+
+	s.watchOnce.Do(s.watchStorage)
+	poll := time.NewTicker(EventPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(EventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		changed := s.changes.wait()
+		etag, err := s.changes.currentEtag(EventPollInterval/2, func() (string, error) {
+			_, etag, err := s.Storage.Get(ctx, "")
+			return etag, err
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil
+		}
+		if id := quoteETag(etag); err == nil && id != lastID {
+			fmt.Fprintf(w, "event: etag\nid: %s\ndata: %s\n\n", id, id)
+			flusher.Flush()
+			lastID = id
+		}
+
+		// keep-alives do not need the storage to be read again
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return nil
+			case <-changed:
+				waiting = false
+			case <-poll.C:
+				waiting = false
+			case <-keepAlive.C:
+				fmt.Fprintf(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+// readEvent returns the lines of the next event or comment in the stream.
+func readEvent(c *C, r *bufio.Reader) []string {
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		c.Assert(err, IsNil)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (suite *TestWeb) TestEvents(c *C) {
+	defer func(pollInterval, keepAlive time.Duration) {
+		EventPollInterval, EventKeepAlive = pollInterval, keepAlive
+	}(EventPollInterval, EventKeepAlive)
+	EventPollInterval = time.Hour
+	EventKeepAlive = time.Hour
+
+	server := httptest.NewServer(suite.Server.Mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/users.pem/events")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/event-stream")
+	r := bufio.NewReader(resp.Body)
+	c.Assert(readEvent(c, r), DeepEquals, []string{"retry: 3600000"})
+
+	// the current version is announced
+	etag := suite.FakeStorage.Etag
+	c.Assert(readEvent(c, r), DeepEquals, []string{"event: etag", "id: " + etag, "data: " + etag})
+
+	// changes made by the server are announced immediately
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", strings.NewReader("yubikey_client_id=one"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	suite.Server.Mux.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(suite.FakeStorage.Etag, Not(Equals), etag)
+	etag = suite.FakeStorage.Etag
+	c.Assert(readEvent(c, r), DeepEquals, []string{"event: etag", "id: " + etag, "data: " + etag})
+}
+
+func (suite *TestWeb) TestEventsResume(c *C) {
+	defer func(pollInterval, keepAlive time.Duration) {
+		EventPollInterval, EventKeepAlive = pollInterval, keepAlive
+	}(EventPollInterval, EventKeepAlive)
+	EventPollInterval = 20 * time.Millisecond
+	EventKeepAlive = 50 * time.Millisecond
+
+	server := httptest.NewServer(suite.Server.Mux)
+	defer server.Close()
+
+	// a client that has seen the current version is not told about it again
+	req, _ := http.NewRequest("GET", server.URL+"/users.pem/events", nil)
+	req.Header.Set("Last-Event-ID", suite.FakeStorage.Etag)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	c.Assert(readEvent(c, r), DeepEquals, []string{"retry: 20"})
+	c.Assert(readEvent(c, r), DeepEquals, []string{": keep-alive"})
+
+	// changes made elsewhere are found by polling the storage
+	suite.FakeStorage.Put(context.TODO(), []byte("new data"), "")
+	etag := suite.FakeStorage.Etag
+	for {
+		event := readEvent(c, r)
+		if event[0] != ": keep-alive" {
+			c.Assert(event, DeepEquals, []string{"event: etag", "id: " + etag, "data: " + etag})
+			break
+		}
+	}
+}
+
+func (suite *TestWeb) TestEventsShareReads(c *C) {
+	n := changeNotifier{}
+	reads := 0
+	get := func() (string, error) {
+		reads++
+		return "etag" + strconv.Itoa(reads), nil
+	}
+
+	// the streams read the storage once for every change
+	for i := 0; i < 3; i++ {
+		etag, err := n.currentEtag(time.Hour, get)
+		c.Assert(err, IsNil)
+		c.Assert(etag, Equals, "etag1")
+	}
+	n.notify()
+	for i := 0; i < 3; i++ {
+		etag, err := n.currentEtag(time.Hour, get)
+		c.Assert(err, IsNil)
+		c.Assert(etag, Equals, "etag2")
+	}
+	c.Assert(reads, Equals, 2)
+
+	// and again once what they read is older than maxAge
+	etag, err := n.currentEtag(0, get)
+	c.Assert(err, IsNil)
+	c.Assert(etag, Equals, "etag3")
+}
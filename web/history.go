@@ -0,0 +1,177 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/crewjam/httperr"
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+)
+
+// historyEntry describes a version of the data in the response to
+// getHistory.
+type historyEntry struct {
+	StorageVersion
+	Serial    uint64     `json:"serial,omitempty"`
+	IssueTime *time.Time `json:"issue_time,omitempty"`
+}
+
+const (
+	// defaultHistoryLimit is how many versions getHistory lists unless the
+	// request asks for fewer, and maxHistoryLimit is the most it lists.
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// queryInt returns the non-negative integer in the query parameter name of
+// r, or defaultValue if there is none.
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, httperr.Error{
+			StatusCode:   http.StatusBadRequest,
+			PrivateError: fmt.Errorf("invalid %s: %q", name, value),
+		}
+	}
+	return n, nil
+}
+
+// loadVersion returns the version of the data named in the URL.
+func (s *Server) loadVersion(ctx context.Context) (*usermgr.UsersData, error) {
+	buf, err := s.Storage.GetVersion(ctx, Param(ctx, "version"))
+	if os.IsNotExist(err) {
+		return nil, httperr.NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.parseData(buf)
+}
+
+// getHistory lists the stored versions of the data, newest first. Only the
+// versions from offset to offset+limit, given in the query, are listed, so
+// that only those need to be decrypted to report their serial numbers. If
+// there are more, the Link header points to the next page.
+func (s *Server) getHistory(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	remoteUser, err := s.RequireUser(ctx, w, r)
+	if err != nil {
+		return err
+	}
+	if !remoteUser.IsAdmin {
+		return httperr.Forbidden
+	}
+
+	limit, err := queryInt(r, "limit", defaultHistoryLimit)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.Storage.Versions(ctx)
+	if err != nil {
+		return err
+	}
+	if offset > len(versions) {
+		offset = len(versions)
+	}
+	if offset+limit < len(versions) {
+		w.Header().Set("Link", fmt.Sprintf("</history/?offset=%d&limit=%d>; rel=\"next\"",
+			offset+limit, limit))
+		versions = versions[:offset+limit]
+	}
+	versions = versions[offset:]
+
+	entries := []historyEntry{}
+	for _, version := range versions {
+		entry := historyEntry{StorageVersion: version}
+		entry.Etag = quoteETag(entry.Etag)
+
+		// versions signed with a key we no longer have are listed without
+		// their serial number
+		if buf, err := s.Storage.GetVersion(ctx, version.ID); err == nil {
+			if usersData, err := s.parseData(buf); err == nil {
+				entry.Serial = usersData.Serial
+				entry.IssueTime = usersData.IssueTime
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+	return nil
+}
+
+// getHistoryVersion returns a stored version of the data.
+func (s *Server) getHistoryVersion(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	remoteUser, err := s.RequireUser(ctx, w, r)
+	if err != nil {
+		return err
+	}
+	if !remoteUser.IsAdmin {
+		return httperr.Forbidden
+	}
+
+	usersData, err := s.loadVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(usersData)
+	return nil
+}
+
+// restoreHistoryVersion replaces the data with a stored version. The old
+// content is signed again with the next serial number, so that hosts accept
+// it as the newest version.
+//
+// The hosts, and whether the shared host key is a recipient, are not
+// restored: they decide who can read the data, and restoring them would
+// silently let revoked hosts read every later version.
+func (s *Server) restoreHistoryVersion(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	remoteUser, err := s.RequireUser(ctx, w, r)
+	if err != nil {
+		return err
+	}
+	if !remoteUser.IsAdmin {
+		return httperr.Forbidden
+	}
+
+	oldUsersData, err := s.loadVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.mutateUsersData(ctx, func(usersData *usermgr.UsersData) error {
+		serial := usersData.Serial
+		hosts, excludeSharedHostKey := usersData.Hosts, usersData.ExcludeSharedHostKey
+		*usersData = *oldUsersData
+		usersData.Serial = serial
+		usersData.Hosts, usersData.ExcludeSharedHostKey = hosts, excludeSharedHostKey
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,133 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestWeb) TestHistory(c *C) {
+	original, _, err := suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"real_name\": \"Bob Smith\", \"groups\":[\"wheel\"]}"))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 204)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/history/", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 200)
+	entries := []historyEntry{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &entries), IsNil)
+	c.Assert(len(entries), Equals, 2)
+	c.Assert(entries[0].ID, Equals, "2")
+	c.Assert(entries[0].Serial, Equals, original.Serial+1)
+	c.Assert(entries[1].ID, Equals, "1")
+	c.Assert(entries[1].Serial, Equals, original.Serial)
+	c.Assert(entries[1].Etag, Equals, "\"34cfb4411e1ed35d1183e544202c0608e3c91c0c\"")
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/history/1", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 200)
+	c.Assert(strings.Contains(w.Body.String(), "Bob Smith"), Equals, false)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/history/3", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// restoring the first version signs it again with the next serial
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/history/1/restore", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 204)
+
+	usersData, _, err := suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(usersData.Serial, Equals, original.Serial+2)
+	c.Assert(usersData.GetUserByName("bob").RealName, Equals, "")
+	c.Assert(usersData.GetUserByName("alice").RealName, Equals, "Alice Smith")
+	c.Assert(len(suite.FakeStorage.History), Equals, 3)
+
+	// only admins see the history
+	suite.FakeAuth.User = "bob"
+	for _, method := range []string{"GET /history/", "GET /history/1", "POST /history/1/restore"} {
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest(strings.Fields(method)[0], strings.Fields(method)[1], nil)
+		suite.Server.Mux.ServeHTTP(w, r)
+		c.Assert(w.Code, Equals, http.StatusForbidden, Commentf("%s", method))
+	}
+}
+
+func (suite *TestWeb) TestHistoryPages(c *C) {
+	for len(suite.FakeStorage.History) < 25 {
+		suite.FakeStorage.History = append(suite.FakeStorage.History, suite.FakeStorage.Data)
+	}
+	get := func(path string) ([]historyEntry, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", path, nil)
+		suite.Server.Mux.ServeHTTP(w, r)
+		entries := []historyEntry{}
+		if w.Code == http.StatusOK {
+			c.Assert(json.Unmarshal(w.Body.Bytes(), &entries), IsNil)
+		}
+		return entries, w
+	}
+
+	entries, w := get("/history/")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(len(entries), Equals, defaultHistoryLimit)
+	c.Assert(entries[0].ID, Equals, "25")
+	c.Assert(w.Header().Get("Link"), Equals, `</history/?offset=20&limit=20>; rel="next"`)
+
+	entries, w = get("/history/?offset=20&limit=20")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(len(entries), Equals, 5)
+	c.Assert(entries[0].ID, Equals, "5")
+	c.Assert(w.Header().Get("Link"), Equals, "")
+
+	entries, w = get("/history/?offset=30")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(len(entries), Equals, 0)
+
+	_, w = get("/history/?limit=-1")
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+}
+
+func (suite *TestWeb) TestHistoryRestoreKeepsHosts(c *C) {
+	usersData, _, err := suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	publicKey := suite.AdminKey.HostKey.WithPrivateKey([32]byte{1, 2, 3}).PublicKey()
+	usersData.Hosts = []usermgr.Host{{Name: "web1", PublicKey: publicKey, Approved: true}}
+	usersData.ExcludeSharedHostKey = true
+	data, err := usersData.SignedString(suite.AdminKey)
+	c.Assert(err, IsNil)
+	suite.FakeStorage.Put(context.TODO(), data, "")
+
+	// revoking web1 and restoring the version that approved it does not
+	// let it read the data again
+	usersData.Hosts = nil
+	data, err = usersData.SignedString(suite.AdminKey)
+	c.Assert(err, IsNil)
+	suite.FakeStorage.Put(context.TODO(), data, "")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/history/2/restore", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	usersData, _, err = suite.Server.loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(usersData.Hosts, HasLen, 0)
+	c.Assert(usersData.ExcludeSharedHostKey, Equals, true)
+}
@@ -0,0 +1,383 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crewjam/httperr"
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+)
+
+// maxPendingHosts is the number of enrollment requests that can wait for
+// approval at once.
+const maxPendingHosts = 100
+
+// pendingHostLifetime is how long an enrollment request waits for approval
+// before it is dropped, so that requests nobody approves do not take up
+// room forever.
+const pendingHostLifetime = 7 * 24 * time.Hour
+
+// pendingHost is an enrollment request that an administrator has not
+// approved yet. Requests are kept out of the signed data, so that they do
+// not change the data hosts receive.
+type pendingHost struct {
+	usermgr.Host
+	RequestTime time.Time `json:"request_time"`
+}
+
+// memoryPendingHosts keeps the enrollment requests in memory for storage
+// that cannot keep them, in which case they are lost when the server
+// restarts.
+type memoryPendingHosts struct {
+	mu       sync.Mutex
+	data     []byte
+	revision int
+}
+
+func (m *memoryPendingHosts) GetPendingHosts(ctx context.Context) ([]byte, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.revision == 0 {
+		return nil, "", nil
+	}
+	return m.data, strconv.Itoa(m.revision), nil
+}
+
+func (m *memoryPendingHosts) PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	etag := ""
+	if m.revision != 0 {
+		etag = strconv.Itoa(m.revision)
+	}
+	if etag != expectedEtag {
+		return ErrConflict
+	}
+	m.data = data
+	m.revision++
+	return nil
+}
+
+// pendingHostStorage returns where the enrollment requests are kept.
+func (s *Server) pendingHostStorage() pendingHostStorage {
+	if storage, ok := s.Storage.(pendingHostStorage); ok {
+		return storage
+	}
+	return &s.pendingHosts
+}
+
+// loadPendingHosts returns the enrollment requests that have not expired,
+// sorted by name, and the entity tag of the stored requests.
+func (s *Server) loadPendingHosts(ctx context.Context) ([]pendingHost, string, error) {
+	data, etag, err := s.pendingHostStorage().GetPendingHosts(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	hosts := []pendingHost{}
+	if data != nil {
+		storedHosts := []pendingHost{}
+		if err := json.Unmarshal(data, &storedHosts); err != nil {
+			return nil, "", err
+		}
+		for _, host := range storedHosts {
+			if TimeNow().Sub(host.RequestTime) < pendingHostLifetime {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Sort(pendingHostsByName(hosts))
+	return hosts, etag, nil
+}
+
+// mutatePendingHosts applies f to the enrollment requests and stores the
+// result. Like mutateUsersData, if the requests were changed by another
+// request in the meantime, f is applied again to the new requests.
+func (s *Server) mutatePendingHosts(ctx context.Context, f func(hosts []pendingHost) ([]pendingHost, error)) error {
+	var err error
+	for attempt := 0; attempt < maxMutateAttempts; attempt++ {
+		var hosts []pendingHost
+		var etag string
+		hosts, etag, err = s.loadPendingHosts(ctx)
+		if err != nil {
+			return err
+		}
+		hosts, err = f(hosts)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(hosts)
+		if err != nil {
+			return err
+		}
+		err = s.pendingHostStorage().PutPendingHosts(ctx, data, etag)
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return httperr.Error{StatusCode: http.StatusConflict, PrivateError: err}
+}
+
+// addPendingHost records the enrollment request for host. A host cannot
+// replace the key of a pending request with the same name, but repeating a
+// request restarts its lifetime.
+func (s *Server) addPendingHost(ctx context.Context, host usermgr.Host) error {
+	return s.mutatePendingHosts(ctx, func(hosts []pendingHost) ([]pendingHost, error) {
+		for i, existingHost := range hosts {
+			if existingHost.Name != host.Name {
+				continue
+			}
+			if existingHost.PublicKey != host.PublicKey {
+				return nil, httperr.Error{
+					StatusCode:   http.StatusConflict,
+					PrivateError: fmt.Errorf("host %s has already requested enrollment with a different key", host.Name),
+				}
+			}
+			hosts[i].RequestTime = TimeNow()
+			return hosts, nil
+		}
+		if len(hosts) >= maxPendingHosts {
+			return nil, httperr.Error{
+				StatusCode:   http.StatusServiceUnavailable,
+				PrivateError: fmt.Errorf("too many hosts are waiting for approval"),
+			}
+		}
+		return append(hosts, pendingHost{Host: host, RequestTime: TimeNow()}), nil
+	})
+}
+
+// removePendingHost removes the enrollment request of the named host, if
+// there is one.
+func (s *Server) removePendingHost(ctx context.Context, name string) error {
+	hosts, _, err := s.loadPendingHosts(ctx)
+	if err != nil {
+		return err
+	}
+	if getPendingHost(hosts, name) == nil {
+		return nil
+	}
+	return s.mutatePendingHosts(ctx, func(hosts []pendingHost) ([]pendingHost, error) {
+		rv := []pendingHost{}
+		for _, host := range hosts {
+			if host.Name != name {
+				rv = append(rv, host)
+			}
+		}
+		return rv, nil
+	})
+}
+
+// getPendingHost returns the request of the named host in hosts, or nil.
+func getPendingHost(hosts []pendingHost, name string) *pendingHost {
+	for i := range hosts {
+		if hosts[i].Name == name {
+			return &hosts[i]
+		}
+	}
+	return nil
+}
+
+type pendingHostsByName []pendingHost
+
+func (h pendingHostsByName) Len() int           { return len(h) }
+func (h pendingHostsByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h pendingHostsByName) Less(i, j int) bool { return h[i].Name < h[j].Name }
+
+// enrollRequest is the body of a request to enroll a host.
+type enrollRequest struct {
+	usermgr.Host
+
+	// Proof shows that the host holds the shared host key (see
+	// usermgr.Host.EnrollmentProof).
+	Proof []byte `json:"proof"`
+}
+
+// postHost handles a request from a host to enroll its own key pair. The
+// request must be made with the shared host key, but the host is not
+// trusted until an administrator approves it with putHost.
+func (s *Server) postHost(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	request := enrollRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return httperr.BadRequest
+	}
+	host := request.Host
+	if host.Name == "" || host.PublicKey == (usermgr.HostPublicKey{}) {
+		return httperr.Error{
+			StatusCode:   http.StatusBadRequest,
+			PrivateError: fmt.Errorf("host name and public key are required"),
+		}
+	}
+	if !host.VerifyEnrollmentProof(request.Proof, s.AdminKey) {
+		return httperr.Error{
+			StatusCode:   http.StatusUnauthorized,
+			PrivateError: fmt.Errorf("enrollment of %s is not proven with the host key", host.Name),
+		}
+	}
+	host.Approved = false
+
+	usersData, _, err := s.loadData(ctx)
+	if err != nil {
+		return err
+	}
+	if existingHost := usersData.GetHostByName(host.Name); existingHost != nil {
+		if existingHost.PublicKey != host.PublicKey {
+			return httperr.Error{
+				StatusCode:   http.StatusConflict,
+				PrivateError: fmt.Errorf("host %s is already enrolled with a different key", host.Name),
+			}
+		}
+	} else if err := s.addPendingHost(ctx, host); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func (s *Server) getHostsList(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	remoteUser, err := s.RequireUser(ctx, w, r)
+	if err != nil {
+		return err
+	}
+	if !remoteUser.IsAdmin {
+		return httperr.Forbidden
+	}
+
+	usersData, etag, err := s.loadData(ctx)
+	if err != nil {
+		return err
+	}
+	pendingHosts, _, err := s.loadPendingHosts(ctx)
+	if err != nil {
+		return err
+	}
+	hosts := append([]usermgr.Host{}, usersData.Hosts...)
+	for _, host := range pendingHosts {
+		if usersData.GetHostByName(host.Name) == nil {
+			hosts = append(hosts, host.Host)
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+	return nil
+}
+
+// putHost approves (or un-approves) the enrollment of a host.
+func (s *Server) putHost(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	remoteUser, err := s.RequireUser(ctx, w, r)
+	if err != nil {
+		return err
+	}
+	if !remoteUser.IsAdmin {
+		return httperr.Forbidden
+	}
+
+	request := struct {
+		Approved bool `json:"approved"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return httperr.BadRequest
+	}
+
+	name := Param(ctx, "host")
+	pendingHosts, _, err := s.loadPendingHosts(ctx)
+	if err != nil {
+		return err
+	}
+	pendingHost := getPendingHost(pendingHosts, name)
+	if pendingHost != nil && !request.Approved {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	err = s.mutateUsersData(ctx, func(usersData *usermgr.UsersData) error {
+		host := usersData.GetHostByName(name)
+		if host == nil {
+			if pendingHost == nil {
+				return httperr.NotFound
+			}
+			host = &pendingHost.Host
+		}
+		if host.Approved && !request.Approved {
+			if err := checkRevocable(usersData, name); err != nil {
+				return err
+			}
+		}
+		host.Approved = request.Approved
+		usersData.SetHost(*host)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.removePendingHost(ctx, name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// checkRevocable returns an error if the data are still encrypted to the
+// shared host key, which every host holds, so that revoking the named host
+// would not stop it from reading them.
+func checkRevocable(usersData *usermgr.UsersData, name string) error {
+	if usersData.ExcludeSharedHostKey {
+		return nil
+	}
+	return httperr.Error{
+		StatusCode: http.StatusConflict,
+		PrivateError: fmt.Errorf("cannot revoke host %s: the data are still encrypted to the shared host key, "+
+			"which it holds (set exclude_shared_host_key first)", name),
+	}
+}
+
+// deleteHost revokes a host, or rejects its enrollment request. Subsequent
+// versions of the data are not encrypted to the host's key. Since a host also
+// holds the shared host key, a host can only be revoked once the data are
+// no longer encrypted to that key.
+func (s *Server) deleteHost(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	remoteUser, err := s.RequireUser(ctx, w, r)
+	if err != nil {
+		return err
+	}
+	if !remoteUser.IsAdmin {
+		return httperr.Forbidden
+	}
+	name := Param(ctx, "host")
+	if err := s.removePendingHost(ctx, name); err != nil {
+		return err
+	}
+	usersData, _, err := s.loadData(ctx)
+	if err != nil {
+		return err
+	}
+	if usersData.GetHostByName(name) == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	err = s.mutateUsersData(ctx, func(usersData *usermgr.UsersData) error {
+		host := usersData.GetHostByName(name)
+		if host == nil {
+			return nil
+		}
+		if host.Approved {
+			if err := checkRevocable(usersData, name); err != nil {
+				return err
+			}
+		}
+		usersData.DeleteHost(name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
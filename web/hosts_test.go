@@ -0,0 +1,255 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+// enrollBody returns the body of a request to enroll a host with the
+// specified name and key, proven with sharedHostKey.
+func enrollBody(c *C, name string, publicKey usermgr.HostPublicKey, sharedHostKey usermgr.HostKey) string {
+	host := usermgr.Host{Name: name, PublicKey: publicKey}
+	proof, err := host.EnrollmentProof(sharedHostKey)
+	c.Assert(err, IsNil)
+	body, err := json.Marshal(enrollRequest{Host: host, Proof: proof})
+	c.Assert(err, IsNil)
+	return string(body)
+}
+
+func (suite *TestWeb) TestEnrollHost(c *C) {
+	hostKey := suite.AdminKey.HostKey.WithPrivateKey([32]byte{1, 2, 3})
+	publicKey := hostKey.PublicKey()
+	body := enrollBody(c, "web1", publicKey, suite.AdminKey.HostKey)
+	data := string(suite.FakeStorage.Data)
+
+	// any host holding the shared host key can request enrollment
+	suite.FakeAuth.User = ""
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/hosts/", strings.NewReader(body))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hosts/", strings.NewReader(`{"name": "web1"}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hosts/", strings.NewReader(
+		`{"name": "web2", "public_key": "`+publicKey.String()+`"}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hosts/", strings.NewReader(enrollBody(c, "web2", publicKey, hostKey)))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	// a pending request cannot be replaced with another key
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hosts/", strings.NewReader(
+		enrollBody(c, "web1", suite.AdminKey.HostKey.PublicKey(), suite.AdminKey.HostKey)))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusConflict)
+
+	// requests do not change the data
+	c.Assert(string(suite.FakeStorage.Data), Equals, data)
+
+	// but only admins can approve it
+	suite.FakeAuth.User = "bob"
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/hosts/web1", strings.NewReader(`{"approved": true}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	suite.FakeAuth.User = "alice"
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/hosts/", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	hosts := []usermgr.Host{}
+	json.NewDecoder(w.Body).Decode(&hosts)
+	c.Assert(hosts, DeepEquals, []usermgr.Host{{Name: "web1", PublicKey: publicKey}})
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/hosts/web1", strings.NewReader(`{"approved": true}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/hosts/web2", strings.NewReader(`{"approved": true}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	ud, err := usermgr.LoadUsersData(suite.FakeStorage.Data, hostKey)
+	c.Assert(err, IsNil)
+	c.Assert(ud.GetUserByName("alice"), NotNil)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/hosts/", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	hosts = []usermgr.Host{}
+	json.NewDecoder(w.Body).Decode(&hosts)
+	c.Assert(hosts, DeepEquals, []usermgr.Host{{Name: "web1", PublicKey: publicKey, Approved: true}})
+
+	// once approved, another host cannot take over the name
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hosts/", strings.NewReader(
+		enrollBody(c, "web1", suite.AdminKey.HostKey.PublicKey(), suite.AdminKey.HostKey)))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusConflict)
+
+	// a host holds the shared host key, so it cannot be revoked while the
+	// data are encrypted to it
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "/hosts/web1", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusConflict)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/hosts/web1", strings.NewReader(`{"approved": false}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusConflict)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/", strings.NewReader("exclude_shared_host_key=true"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	_, err = usermgr.LoadUsersData(suite.FakeStorage.Data, suite.AdminKey.HostKey)
+	c.Assert(err, ErrorMatches, "user data are not encrypted to this host key")
+
+	// revoked hosts cannot read subsequent versions
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "/hosts/web1", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	_, err = usermgr.LoadUsersData(suite.FakeStorage.Data, hostKey)
+	c.Assert(err, ErrorMatches, "user data are not encrypted to this host key")
+}
+
+func (suite *TestWeb) TestEnrollHostLimit(c *C) {
+	for i := 0; i < maxPendingHosts; i++ {
+		c.Assert(suite.Server.addPendingHost(context.TODO(), usermgr.Host{Name: strings.Repeat("x", i+1)}), IsNil)
+	}
+	publicKey := suite.AdminKey.HostKey.WithPrivateKey([32]byte{1, 2, 3}).PublicKey()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/hosts/", strings.NewReader(
+		enrollBody(c, "web1", publicKey, suite.AdminKey.HostKey)))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+
+	// rejecting a request makes room for another
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "/hosts/x", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hosts/", strings.NewReader(
+		enrollBody(c, "web1", publicKey, suite.AdminKey.HostKey)))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+}
+
+func (suite *TestWeb) TestEnrollHostExpires(c *C) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	TimeNow = func() time.Time { return now }
+	defer func() { TimeNow = time.Now }()
+	for i := 0; i < maxPendingHosts; i++ {
+		c.Assert(suite.Server.addPendingHost(context.TODO(), usermgr.Host{Name: strings.Repeat("x", i+1)}), IsNil)
+	}
+
+	// requests that nobody approved make room for new ones when they expire
+	now = now.Add(pendingHostLifetime)
+	publicKey := suite.AdminKey.HostKey.WithPrivateKey([32]byte{1, 2, 3}).PublicKey()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/hosts/", strings.NewReader(
+		enrollBody(c, "web1", publicKey, suite.AdminKey.HostKey)))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+
+	hosts, _, err := suite.Server.loadPendingHosts(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(hosts, HasLen, 1)
+	c.Assert(hosts[0].Name, Equals, "web1")
+}
+
+// sharedPendingHostStorage is storage that keeps the enrollment requests in
+// memory where every server using it sees them, like the storage shared by
+// several web servers.
+type sharedPendingHostStorage struct {
+	*FakeStorage
+	memoryPendingHosts
+}
+
+func (suite *TestWeb) TestEnrollHostOnAnotherServer(c *C) {
+	storage := &sharedPendingHostStorage{FakeStorage: suite.FakeStorage}
+	servers := []*Server{}
+	for i := 0; i < 2; i++ {
+		servers = append(servers, New(Config{Storage: storage, Auth: suite.FakeAuth, AdminKey: suite.AdminKey}))
+	}
+
+	// the request reaches one server and the administrator another
+	publicKey := suite.AdminKey.HostKey.WithPrivateKey([32]byte{1, 2, 3}).PublicKey()
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/hosts/", strings.NewReader(
+		enrollBody(c, "web1", publicKey, suite.AdminKey.HostKey)))
+	servers[0].Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/hosts/", nil)
+	servers[1].Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	hosts := []usermgr.Host{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &hosts), IsNil)
+	c.Assert(hosts, DeepEquals, []usermgr.Host{{Name: "web1", PublicKey: publicKey}})
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/hosts/web1", strings.NewReader(`{"approved": true}`))
+	servers[1].Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	pendingHosts, _, err := servers[0].loadPendingHosts(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(pendingHosts, HasLen, 0)
+	usersData, _, err := servers[0].loadData(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(usersData.GetHostByName("web1").Approved, Equals, true)
+}
+
+// checkPendingHostStorage checks that storage replaces the enrollment
+// requests only if they have not changed.
+func checkPendingHostStorage(c *C, storage pendingHostStorage) {
+	data, etag, err := storage.GetPendingHosts(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+	c.Assert(etag, Equals, "")
+
+	c.Assert(storage.PutPendingHosts(context.TODO(), []byte("[1]"), ""), IsNil)
+	c.Assert(storage.PutPendingHosts(context.TODO(), []byte("[2]"), ""), Equals, ErrConflict)
+	data, etag, err = storage.GetPendingHosts(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "[1]")
+
+	c.Assert(storage.PutPendingHosts(context.TODO(), []byte("[3]"), `"stale"`), Equals, ErrConflict)
+	c.Assert(storage.PutPendingHosts(context.TODO(), []byte("[3]"), etag), IsNil)
+	c.Assert(storage.PutPendingHosts(context.TODO(), []byte("[4]"), etag), Equals, ErrConflict)
+	data, _, err = storage.GetPendingHosts(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "[3]")
+}
+
+func (suite *TestWeb) TestMemoryPendingHosts(c *C) {
+	checkPendingHostStorage(c, &memoryPendingHosts{})
+}
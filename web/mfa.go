@@ -1,11 +1,8 @@
 package web
 
 import (
-	"crypto/rand"
-	"encoding/base32"
 	"encoding/json"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/crewjam/usermgr"
@@ -44,11 +41,10 @@ func (s *Server) totpSecret(ctx context.Context, w http.ResponseWriter, r *http.
 }
 
 func (s *Server) makeBackupCode(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	buf := make([]byte, 10)
-	if _, err := rand.Reader.Read(buf); err != nil {
-		panic(err)
+	code, err := usermgr.NewBackupCodeString()
+	if err != nil {
+		return err
 	}
-	code := strings.ToLower(base32.StdEncoding.EncodeToString(buf))
 
 	bc := usermgr.NewBackupCode(code)
 
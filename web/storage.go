@@ -1,8 +1,108 @@
 package web
 
-import "golang.org/x/net/context"
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+)
+
+// DefaultHistorySize is how many versions of the data are kept by storage
+// that is not configured otherwise.
+const DefaultHistorySize = 100
+
+// ErrConflict is returned by Storage.Put when the stored data no longer
+// have the expected entity tag because they were changed by someone else.
+var ErrConflict = errors.New("the data were changed by another request")
 
 type Storage interface {
 	Get(ctx context.Context, etag string) (data []byte, newEtag string, err error)
-	Put(ctx context.Context, data []byte) (etag string, err error)
+
+	// Put replaces the data, keeping the previous versions. If expectedEtag
+	// is not empty and the stored data have a different entity tag Put
+	// returns ErrConflict.
+	Put(ctx context.Context, data []byte, expectedEtag string) (etag string, err error)
+
+	// Versions returns the versions of the data that were stored, newest
+	// first.
+	Versions(ctx context.Context) ([]StorageVersion, error)
+
+	// GetVersion returns the data stored as the version with the specified
+	// ID. If there is no such version the error satisfies os.IsNotExist.
+	GetVersion(ctx context.Context, id string) ([]byte, error)
+}
+
+// StorageVersion describes a version of the data kept by a Storage.
+type StorageVersion struct {
+	ID   string    `json:"id"`
+	Etag string    `json:"etag"`
+	Time time.Time `json:"time"`
+}
+
+// modTimer is implemented by storage that knows when the data were last
+// changed, which is reported to clients in Last-Modified.
+type modTimer interface {
+	ModTime(ctx context.Context) (time.Time, error)
+}
+
+// changeWatcher is implemented by storage that can tell when anyone changes
+// the data, which lets event streams announce changes made by other servers
+// without waiting for the next poll.
+type changeWatcher interface {
+	// Watch returns a channel that receives a value after each change,
+	// until stop is closed.
+	Watch(stop <-chan struct{}) <-chan struct{}
 }
+
+// pendingHostStorage is implemented by storage that can keep the enrollment
+// requests waiting for approval (see Server.postHost), so that every web
+// server sharing the storage sees them and they survive restarts. They are
+// kept apart from the data and their versions, since they are not signed.
+type pendingHostStorage interface {
+	// GetPendingHosts returns the stored requests and their entity tag, or
+	// nil and an empty entity tag if none were stored.
+	GetPendingHosts(ctx context.Context) (data []byte, etag string, err error)
+
+	// PutPendingHosts replaces the stored requests if their entity tag is
+	// still expectedEtag, which is empty if none were stored, and
+	// otherwise returns ErrConflict.
+	PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error
+}
+
+// renderingStorage is implemented by storage that keeps a readable
+// rendering of the data next to them, such as GitStorage.
+type renderingStorage interface {
+	// setDefaultRender sets the function that renders the data, unless
+	// one was configured.
+	setDefaultRender(render func(data []byte) ([]byte, error))
+}
+
+// RedactedJSON renders the summary of usersData (see
+// usermgr.UsersData.Summary), which leaves out hashes, secrets and keys, as
+// indented JSON with the users and hosts sorted by name, so that a diff of
+// two renderings shows only what changed.
+func RedactedJSON(usersData *usermgr.UsersData) ([]byte, error) {
+	summary := usersData.Summary()
+	sort.Sort(userSummariesByName(summary.Users))
+	sort.Sort(hostSummariesByName(summary.Hosts))
+	buf, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+type userSummariesByName []usermgr.UserSummary
+
+func (u userSummariesByName) Len() int           { return len(u) }
+func (u userSummariesByName) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u userSummariesByName) Less(i, j int) bool { return u[i].Name < u[j].Name }
+
+type hostSummariesByName []usermgr.HostSummary
+
+func (h hostSummariesByName) Len() int           { return len(h) }
+func (h hostSummariesByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hostSummariesByName) Less(i, j int) bool { return h[i].Name < h[j].Name }
@@ -0,0 +1,150 @@
+//go:build !appengine
+// +build !appengine
+
+package web
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var boltBucket = []byte("usermgr")
+
+// BoltKV is a KV in a BoltDB database file, for running a single web
+// server without an external service. Each value is stored after its
+// revision, an 8 byte big-endian sequence number.
+type BoltKV struct {
+	DB *bolt.DB
+
+	mu       sync.Mutex
+	watchers map[string]map[chan struct{}]bool
+}
+
+// OpenBoltKV opens the database file at path, creating it if needed. Only
+// one process can have the file open at a time.
+func OpenBoltKV(path string) (*BoltKV, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltKV{DB: db}, nil
+}
+
+// Get returns the value of key and its revision.
+func (b *BoltKV) Get(key string) ([]byte, uint64, error) {
+	var value []byte
+	var revision uint64
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(boltBucket).Get([]byte(key))
+		if buf == nil {
+			return os.ErrNotExist
+		}
+		revision = binary.BigEndian.Uint64(buf[:8])
+		value = append([]byte(nil), buf[8:]...)
+		return nil
+	})
+	return value, revision, err
+}
+
+// CompareAndSwap sets key to value if its revision is still revision.
+func (b *BoltKV) CompareAndSwap(key string, value []byte, revision uint64) (uint64, error) {
+	var newRevision uint64
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		var currentRevision uint64
+		if buf := bucket.Get([]byte(key)); buf != nil {
+			currentRevision = binary.BigEndian.Uint64(buf[:8])
+		}
+		if currentRevision != revision {
+			return ErrConflict
+		}
+
+		var err error
+		newRevision, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 8, 8+len(value))
+		binary.BigEndian.PutUint64(buf, newRevision)
+		return bucket.Put([]byte(key), append(buf, value...))
+	})
+	if err != nil {
+		return 0, err
+	}
+	b.notify(key)
+	return newRevision, nil
+}
+
+// Delete removes key, if it exists.
+func (b *BoltKV) Delete(key string) error {
+	err := b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	b.notify(key)
+	return nil
+}
+
+// Keys returns the keys that start with prefix.
+func (b *BoltKV) Keys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Watch returns a channel that receives a value after each change to key
+// made through b.
+func (b *BoltKV) Watch(key string, stop <-chan struct{}) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	if b.watchers == nil {
+		b.watchers = map[string]map[chan struct{}]bool{}
+	}
+	if b.watchers[key] == nil {
+		b.watchers[key] = map[chan struct{}]bool{}
+	}
+	b.watchers[key][ch] = true
+	b.mu.Unlock()
+
+	go func() {
+		<-stop
+		b.mu.Lock()
+		delete(b.watchers[key], ch)
+		b.mu.Unlock()
+	}()
+	return ch
+}
+
+func (b *BoltKV) notify(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.watchers[key] {
+		// a watcher that has not yet received the previous change will
+		// see this one too
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !appengine
+// +build !appengine
+
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestWeb) TestBoltKV(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	kv, err := OpenBoltKV(filepath.Join(tempDir, "users.db"))
+	c.Assert(err, IsNil)
+	defer kv.DB.Close()
+
+	_, _, err = kv.Get("a")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	watch := kv.Watch("a", stop)
+
+	revision, err := kv.CompareAndSwap("a", []byte("one"), 0)
+	c.Assert(err, IsNil)
+	value, currentRevision, err := kv.Get("a")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "one")
+	c.Assert(currentRevision, Equals, revision)
+	select {
+	case <-watch:
+	case <-time.After(time.Second):
+		c.Fatal("the watch did not fire")
+	}
+
+	// a stale revision is rejected, including for creating the key
+	_, err = kv.CompareAndSwap("a", []byte("two"), 0)
+	c.Assert(err, Equals, ErrConflict)
+	_, err = kv.CompareAndSwap("a", []byte("two"), revision+100)
+	c.Assert(err, Equals, ErrConflict)
+	newRevision, err := kv.CompareAndSwap("a", []byte("two"), revision)
+	c.Assert(err, IsNil)
+	c.Assert(newRevision > revision, Equals, true)
+
+	_, err = kv.CompareAndSwap("ab", []byte("x"), 0)
+	c.Assert(err, IsNil)
+	_, err = kv.CompareAndSwap("b", []byte("x"), 0)
+	c.Assert(err, IsNil)
+	keys, err := kv.Keys("a")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"a", "ab"})
+
+	c.Assert(kv.Delete("ab"), IsNil)
+	_, _, err = kv.Get("ab")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(kv.Delete("ab"), IsNil)
+}
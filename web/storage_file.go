@@ -1,21 +1,59 @@
+//go:build !appengine
+// +build !appengine
+
 package web
 
 import (
 	"crypto/sha1"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 )
 
+// FileStorage stores the data in users.pem in the directory Path, and its
+// entity tag, a quoted hex SHA-1 of the data, in users.pem.etag. Every
+// version is also kept in the history directory as users.pem.N, where N
+// counts up from 1. The enrollment requests waiting for approval are kept in
+// pending-hosts.json.
 type FileStorage struct {
 	Path string
+
+	// HistorySize, if specified, is how many versions are kept in the
+	// history. By default DefaultHistorySize are kept, and if it is
+	// negative they are all kept.
+	HistorySize int
+}
+
+func fileStorageETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", sha1.Sum(data))
 }
 
+// Get returns the data, or nil if they match etag. If there are no data the
+// error satisfies os.IsNotExist.
 func (fs FileStorage) Get(ctx context.Context, etag string) ([]byte, string, error) {
-	existingEtagBuf, _ := ioutil.ReadFile(filepath.Join(fs.Path, "users.pem.etag"))
-	if etag != "" && etag == string(existingEtagBuf) {
+	existingEtagBuf, err := ioutil.ReadFile(filepath.Join(fs.Path, "users.pem.etag"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+	existingEtag := string(existingEtagBuf)
+
+	// Older versions stored the hash in binary, in which case, or if the
+	// etag file is missing, the etag is computed from the data.
+	if !strings.HasPrefix(existingEtag, "\"") {
+		existingEtag = ""
+	}
+	if etag != "" && etag == existingEtag {
+		if _, err := os.Stat(filepath.Join(fs.Path, "users.pem")); err != nil {
+			return nil, "", err
+		}
 		return nil, etag, nil
 	}
 
@@ -23,20 +61,254 @@ func (fs FileStorage) Get(ctx context.Context, etag string) ([]byte, string, err
 	if err != nil {
 		return nil, "", err
 	}
-
-	return buf, string(existingEtagBuf), nil
+	if existingEtag == "" {
+		existingEtag = fileStorageETag(buf)
+	}
+	if etag != "" && etag == existingEtag {
+		return nil, etag, nil
+	}
+	return buf, existingEtag, nil
 }
 
-func (fs FileStorage) Put(ctx context.Context, data []byte) (string, error) {
-	etag := sha1.Sum(data)
-	err := ioutil.WriteFile(filepath.Join(fs.Path, "users.pem.etag"), etag[:], 0644)
+// Put replaces the data. The etag file is removed first, so that a failure
+// part way through cannot leave an etag that describes other data.
+//
+// The check of expectedEtag and the write happen while holding an exclusive
+// lock on users.pem.lock, so concurrent writers, including other processes,
+// cannot overwrite each other's changes.
+func (fs FileStorage) Put(ctx context.Context, data []byte, expectedEtag string) (string, error) {
+	unlock, err := lockFile(filepath.Join(fs.Path, "users.pem.lock"))
 	if err != nil {
 		return "", err
 	}
-	err = ioutil.WriteFile(filepath.Join(fs.Path, "users.pem"), data, 0644)
-	if err != nil {
-		os.Remove(filepath.Join(fs.Path, "users.pem.etag"))
+	defer unlock()
+
+	if expectedEtag != "" {
+		_, currentEtag, err := fs.Get(ctx, expectedEtag)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if currentEtag != expectedEtag {
+			return "", ErrConflict
+		}
+	}
+
+	if err := fs.addVersion(data); err != nil {
+		return "", err
+	}
+
+	etag := fileStorageETag(data)
+	etagPath := filepath.Join(fs.Path, "users.pem.etag")
+	if err := os.Remove(etagPath); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(fs.Path, "users.pem~"), data, 0644); err != nil {
 		return "", err
 	}
-	return string(etag[:]), err
+	if err := os.Rename(filepath.Join(fs.Path, "users.pem~"), filepath.Join(fs.Path, "users.pem")); err != nil {
+		os.Remove(filepath.Join(fs.Path, "users.pem~"))
+		return "", err
+	}
+	if err := ioutil.WriteFile(etagPath, []byte(etag), 0644); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// readFileWithETag returns the content of the file at path and its entity
+// tag, or nil and an empty entity tag if it does not exist.
+func readFileWithETag(path string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, fileStorageETag(data), nil
+}
+
+// writeFileIfMatch replaces the file at path with data if its entity tag,
+// which is empty if it does not exist, is still expectedEtag. The check and
+// the write happen while holding an exclusive lock on path+".lock".
+func writeFileIfMatch(path string, data []byte, expectedEtag string) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, etag, err := readFileWithETag(path)
+	if err != nil {
+		return err
+	}
+	if etag != expectedEtag {
+		return ErrConflict
+	}
+	if err := ioutil.WriteFile(path+"~", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+"~", path); err != nil {
+		os.Remove(path + "~")
+		return err
+	}
+	return nil
+}
+
+// GetPendingHosts returns the enrollment requests in pending-hosts.json.
+func (fs FileStorage) GetPendingHosts(ctx context.Context) ([]byte, string, error) {
+	return readFileWithETag(filepath.Join(fs.Path, "pending-hosts.json"))
+}
+
+// PutPendingHosts replaces the enrollment requests in pending-hosts.json.
+func (fs FileStorage) PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error {
+	return writeFileIfMatch(filepath.Join(fs.Path, "pending-hosts.json"), data, expectedEtag)
+}
+
+// lockFile waits for an exclusive lock on the file at path, creating it if
+// needed, and returns a function that releases the lock.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// ModTime returns the time the data were last written.
+func (fs FileStorage) ModTime(ctx context.Context) (time.Time, error) {
+	fi, err := os.Stat(filepath.Join(fs.Path, "users.pem"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// versionNumbers returns the numbers of the versions in the history,
+// newest first.
+func (fs FileStorage) versionNumbers() ([]int, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(fs.Path, "history"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	numbers := []int{}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), "users.pem.") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(fi.Name(), "users.pem."))
+		if err != nil || n <= 0 {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	return numbers, nil
+}
+
+// historySize returns how many versions are kept, or 0 if they all are.
+func (fs FileStorage) historySize() int {
+	switch {
+	case fs.HistorySize < 0:
+		return 0
+	case fs.HistorySize == 0:
+		return DefaultHistorySize
+	default:
+		return fs.HistorySize
+	}
+}
+
+func (fs FileStorage) versionPath(n int) string {
+	return filepath.Join(fs.Path, "history", fmt.Sprintf("users.pem.%d", n))
+}
+
+// addVersion adds data to the history and removes the versions beyond
+// HistorySize. Data stored before the history was kept become the first
+// version, so that they can still be restored. The caller must hold the
+// lock.
+func (fs FileStorage) addVersion(data []byte) error {
+	if err := os.MkdirAll(filepath.Join(fs.Path, "history"), 0755); err != nil {
+		return err
+	}
+	numbers, err := fs.versionNumbers()
+	if err != nil {
+		return err
+	}
+	if len(numbers) == 0 {
+		previousData, err := ioutil.ReadFile(filepath.Join(fs.Path, "users.pem"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := ioutil.WriteFile(fs.versionPath(1), previousData, 0644); err != nil {
+				return err
+			}
+			numbers = []int{1}
+		}
+	}
+
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[0] + 1
+	}
+	if err := ioutil.WriteFile(fs.versionPath(next), data, 0644); err != nil {
+		return err
+	}
+	numbers = append([]int{next}, numbers...)
+
+	if historySize := fs.historySize(); historySize > 0 && len(numbers) > historySize {
+		for _, n := range numbers[historySize:] {
+			if err := os.Remove(fs.versionPath(n)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions in the history, newest first.
+func (fs FileStorage) Versions(ctx context.Context) ([]StorageVersion, error) {
+	numbers, err := fs.versionNumbers()
+	if err != nil {
+		return nil, err
+	}
+	versions := []StorageVersion{}
+	for _, n := range numbers {
+		data, err := ioutil.ReadFile(fs.versionPath(n))
+		if os.IsNotExist(err) {
+			continue // removed by a concurrent Put
+		}
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(fs.versionPath(n))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, StorageVersion{
+			ID:   strconv.Itoa(n),
+			Etag: fileStorageETag(data),
+			Time: fi.ModTime(),
+		})
+	}
+	return versions, nil
+}
+
+// GetVersion returns the data stored as version id.
+func (fs FileStorage) GetVersion(ctx context.Context, id string) ([]byte, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil || n <= 0 {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(fs.versionPath(n))
 }
@@ -0,0 +1,181 @@
+//go:build !appengine
+// +build !appengine
+
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestWeb) TestFileStorage(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	fs := FileStorage{Path: tempDir}
+
+	_, _, err = fs.Get(context.TODO(), "")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	etag, err := fs.Put(context.TODO(), []byte("hello"), "")
+	c.Assert(err, IsNil)
+	c.Assert(etag, Equals, `"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"`)
+
+	// a write based on a stale etag is rejected
+	_, err = fs.Put(context.TODO(), []byte("goodbye"), `"stale"`)
+	c.Assert(err, Equals, ErrConflict)
+
+	data, newEtag, err := fs.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	c.Assert(newEtag, Equals, etag)
+
+	data, newEtag, err = fs.Get(context.TODO(), etag)
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+	c.Assert(newEtag, Equals, etag)
+
+	// a binary etag written by older versions is replaced
+	ioutil.WriteFile(filepath.Join(tempDir, "users.pem.etag"), []byte("\xaa\xf4\xc6"), 0644)
+	data, newEtag, err = fs.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	c.Assert(newEtag, Equals, etag)
+
+	// which does not prevent writes based on it
+	etag, err = fs.Put(context.TODO(), []byte("goodbye"), etag)
+	c.Assert(err, IsNil)
+	c.Assert(etag, Equals, `"3c8ec4874488f6090a157b014ce3397ca8e06d4f"`)
+
+	modTime, err := fs.ModTime(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(modTime) < time.Minute, Equals, true)
+}
+
+func (suite *TestWeb) TestFileStorageHistory(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	// data written before the history was kept become the first version
+	c.Assert(ioutil.WriteFile(filepath.Join(tempDir, "users.pem"), []byte("zero"), 0644), IsNil)
+
+	fs := FileStorage{Path: tempDir, HistorySize: 3}
+	for _, data := range []string{"one", "two", "three"} {
+		_, err := fs.Put(context.TODO(), []byte(data), "")
+		c.Assert(err, IsNil)
+	}
+
+	versions, err := fs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(len(versions), Equals, 3)
+	c.Assert(versions[0].ID, Equals, "4")
+	c.Assert(versions[0].Etag, Equals, fileStorageETag([]byte("three")))
+	c.Assert(versions[1].ID, Equals, "3")
+	c.Assert(versions[2].ID, Equals, "2")
+
+	data, err := fs.GetVersion(context.TODO(), "2")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one")
+
+	// the first version was removed to keep HistorySize versions
+	_, err = fs.GetVersion(context.TODO(), "1")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = fs.GetVersion(context.TODO(), "../users.pem")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// with a negative limit every version is kept
+	fs.HistorySize = -1
+	_, err = fs.Put(context.TODO(), []byte("four"), "")
+	c.Assert(err, IsNil)
+	versions, err = fs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(len(versions), Equals, 4)
+
+	// by default DefaultHistorySize versions are kept
+	fs.HistorySize = 0
+	for i := 0; i < DefaultHistorySize; i++ {
+		_, err = fs.Put(context.TODO(), []byte(strconv.Itoa(i)), "")
+		c.Assert(err, IsNil)
+	}
+	versions, err = fs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(len(versions), Equals, DefaultHistorySize)
+}
+
+func (suite *TestWeb) TestUpdateLocalCacheFromServer(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	storage := FileStorage{Path: tempDir}
+	_, err = storage.Put(context.TODO(), suite.FakeStorage.Data, "")
+	c.Assert(err, IsNil)
+
+	server := New(Config{Storage: storage, Auth: suite.FakeAuth, AdminKey: suite.AdminKey})
+	statuses := []int{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rec, r)
+		statuses = append(statuses, rec.Code)
+		for k, v := range rec.HeaderMap {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer testServer.Close()
+
+	cacheDir := filepath.Join(tempDir, "cache")
+	hostKey := suite.AdminKey.HostKey
+	userData, err := usermgr.UpdateLocalCache(cacheDir, testServer.URL+"/users.pem", hostKey)
+	c.Assert(err, IsNil)
+	serial := userData.Serial
+	etag, _ := ioutil.ReadFile(filepath.Join(cacheDir, "users.pem.etag"))
+	c.Assert(strings.HasPrefix(string(etag), "\""), Equals, true)
+
+	_, err = usermgr.UpdateLocalCache(cacheDir, testServer.URL+"/users.pem", hostKey)
+	c.Assert(err, IsNil)
+	c.Assert(statuses, DeepEquals, []int{http.StatusOK, http.StatusNotModified})
+
+	resp, err := http.Head(testServer.URL + "/users.pem")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	lastModified := resp.Header.Get("Last-Modified")
+	c.Assert(lastModified, Not(Equals), "")
+	req, _ := http.NewRequest("GET", testServer.URL+"/users.pem", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotModified)
+	statuses = statuses[:2]
+
+	// a change made through the server is fetched
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/", strings.NewReader("yubikey_client_id=one"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	userData, err = usermgr.UpdateLocalCache(cacheDir, testServer.URL+"/users.pem", hostKey)
+	c.Assert(err, IsNil)
+	c.Assert(userData.Serial, Equals, serial+1)
+	c.Assert(statuses, DeepEquals, []int{http.StatusOK, http.StatusNotModified, http.StatusOK})
+}
+
+func (suite *TestWeb) TestFileStoragePendingHosts(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	checkPendingHostStorage(c, FileStorage{Path: tempDir})
+}
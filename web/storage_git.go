@@ -0,0 +1,340 @@
+//go:build !appengine
+// +build !appengine
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// GitStorage stores the data in a git repository in the directory Path,
+// which is created if needed. Every change is a commit of users.pem and of
+// users.json, a rendering of the data without secrets, so that changes can
+// be reviewed with the usual git tools. The author of each commit is the
+// remote user who made the change (see RemoteUserName).
+//
+// Entity tags are the quoted object IDs of users.pem and version IDs are
+// commit IDs. The enrollment requests waiting for approval are not
+// committed, but kept in .git/usermgr-pending-hosts.json.
+type GitStorage struct {
+	Path string
+
+	// Remote, if specified, is the name or URL of a remote repository to
+	// which each commit is pushed in the background. A failed push is
+	// logged, and the commit is pushed again with the next one.
+	Remote string
+
+	// PushTimeout is how long a push may take before it is abandoned. By
+	// default it is DefaultGitPushTimeout.
+	PushTimeout time.Duration
+
+	// HistorySize, if specified, is how many versions Versions lists; the
+	// repository keeps them all. By default DefaultHistorySize are listed,
+	// and if it is negative they all are.
+	HistorySize int
+
+	// Render returns the content of users.json for the signed data. If it
+	// is nil, users.json is removed rather than left describing older data.
+	// The web server fills it in if it is nil.
+	Render func(data []byte) ([]byte, error)
+
+	// pushing is true while a push is running, and pushAgain is true if
+	// there have been commits since it started.
+	mu        sync.Mutex
+	pushing   bool
+	pushAgain bool
+}
+
+// setDefaultRender sets Render to render if it is nil.
+func (gs *GitStorage) setDefaultRender(render func(data []byte) ([]byte, error)) {
+	if gs.Render == nil {
+		gs.Render = render
+	}
+}
+
+// historySize returns how many versions are listed, or 0 if they all are.
+func (gs *GitStorage) historySize() int {
+	switch {
+	case gs.HistorySize < 0:
+		return 0
+	case gs.HistorySize == 0:
+		return DefaultHistorySize
+	default:
+		return gs.HistorySize
+	}
+}
+
+// git runs git in the repository and returns its output.
+func (gs *GitStorage) git(env []string, args ...string) ([]byte, error) {
+	return gs.gitContext(context.Background(), env, args...)
+}
+
+// gitContext runs git in the repository, killing it if ctx is done, and
+// returns its output.
+func (gs *GitStorage) gitContext(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = gs.Path
+	cmd.Env = append(os.Environ(), env...)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], err)
+	}
+	return output, nil
+}
+
+// objectID returns the ID of users.pem in the commit rev. If the repository,
+// the commit or the file does not exist the error satisfies os.IsNotExist.
+func (gs *GitStorage) objectID(rev string) (string, error) {
+	if _, err := os.Stat(filepath.Join(gs.Path, ".git")); err != nil {
+		return "", err
+	}
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+":users.pem")
+	cmd.Dir = gs.Path
+	output, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		return "", os.ErrNotExist
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Get returns the data in the newest commit, or nil if they match etag.
+func (gs *GitStorage) Get(ctx context.Context, etag string) ([]byte, string, error) {
+	objectID, err := gs.objectID("HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	currentEtag := quoteETag(objectID)
+	if etag != "" && etag == currentEtag {
+		return nil, etag, nil
+	}
+	data, err := gs.git(nil, "cat-file", "blob", objectID)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, currentEtag, nil
+}
+
+// Put commits the data, and starts pushing the commit if Remote is
+// specified.
+func (gs *GitStorage) Put(ctx context.Context, data []byte, expectedEtag string) (string, error) {
+	etag, err := gs.commit(ctx, data, expectedEtag)
+	if err != nil {
+		return "", err
+	}
+	if gs.Remote != "" {
+		gs.push()
+	}
+	return etag, nil
+}
+
+// commit commits the data while holding the lock on the repository.
+func (gs *GitStorage) commit(ctx context.Context, data []byte, expectedEtag string) (string, error) {
+	if err := os.MkdirAll(gs.Path, 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(gs.Path, ".git")); os.IsNotExist(err) {
+		if _, err := gs.git(nil, "init", "--quiet"); err != nil {
+			return "", err
+		}
+	}
+
+	unlock, err := lockFile(filepath.Join(gs.Path, ".git", "usermgr.lock"))
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if expectedEtag != "" {
+		objectID, err := gs.objectID("HEAD")
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if quoteETag(objectID) != expectedEtag {
+			return "", ErrConflict
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(gs.Path, "users.pem"), data, 0644); err != nil {
+		return "", err
+	}
+	paths := []string{"users.pem"}
+	if gs.Render != nil {
+		rendered, err := gs.Render(data)
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(gs.Path, "users.json"), rendered, 0644); err != nil {
+			return "", err
+		}
+		paths = append(paths, "users.json")
+	} else {
+		if _, err := gs.git(nil, "rm", "--quiet", "--cached", "--ignore-unmatch", "users.json"); err != nil {
+			return "", err
+		}
+		if err := os.Remove(filepath.Join(gs.Path, "users.json")); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	if _, err := gs.git(nil, append([]string{"add", "--"}, paths...)...); err != nil {
+		return "", err
+	}
+
+	author := RemoteUserName(ctx)
+	if author == "" {
+		author = "usermgr"
+	}
+	env := []string{
+		"GIT_AUTHOR_NAME=" + author,
+		"GIT_AUTHOR_EMAIL=",
+		"GIT_COMMITTER_NAME=usermgr",
+		"GIT_COMMITTER_EMAIL=",
+	}
+	message := fmt.Sprintf("Update users.pem\n\nChanged by %s.\n", author)
+	if _, err := gs.git(env, "commit", "--quiet", "--allow-empty", "-m", message); err != nil {
+		return "", err
+	}
+
+	objectID, err := gs.objectID("HEAD")
+	if err != nil {
+		return "", err
+	}
+	return quoteETag(objectID), nil
+}
+
+// DefaultGitPushTimeout is how long GitStorage waits for a push by default.
+const DefaultGitPushTimeout = time.Minute
+
+// push pushes HEAD to Remote in the background, so that changes are not
+// held up by the remote. If a push is already running, another is made
+// when it finishes, which pushes the new commits as well, so that a remote
+// that is slow to respond does not pile up a push for every change.
+func (gs *GitStorage) push() {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.pushing {
+		gs.pushAgain = true
+		return
+	}
+	gs.pushing = true
+	go func() {
+		for {
+			gs.pushOnce()
+			gs.mu.Lock()
+			if !gs.pushAgain {
+				gs.pushing = false
+				gs.mu.Unlock()
+				return
+			}
+			gs.pushAgain = false
+			gs.mu.Unlock()
+		}
+	}()
+}
+
+// pushOnce pushes HEAD to Remote and logs any error.
+func (gs *GitStorage) pushOnce() {
+	timeout := gs.PushTimeout
+	if timeout == 0 {
+		timeout = DefaultGitPushTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := gs.gitContext(ctx, nil, "push", "--quiet", gs.Remote, "HEAD"); err != nil {
+		log.Printf("ERROR: %s", err)
+	}
+}
+
+// GetPendingHosts returns the enrollment requests waiting for approval.
+func (gs *GitStorage) GetPendingHosts(ctx context.Context) ([]byte, string, error) {
+	return readFileWithETag(filepath.Join(gs.Path, ".git", "usermgr-pending-hosts.json"))
+}
+
+// PutPendingHosts replaces the enrollment requests waiting for approval.
+func (gs *GitStorage) PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error {
+	return writeFileIfMatch(filepath.Join(gs.Path, ".git", "usermgr-pending-hosts.json"), data, expectedEtag)
+}
+
+// Versions returns the newest HistorySize commits that changed users.pem,
+// newest first. They are read with a single git log, in which each commit
+// is followed by the raw diff line that gives the new object ID of
+// users.pem.
+func (gs *GitStorage) Versions(ctx context.Context) ([]StorageVersion, error) {
+	versions := []StorageVersion{}
+	if _, err := gs.objectID("HEAD"); os.IsNotExist(err) {
+		return versions, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	args := []string{"log", "--format=%H %ct", "--raw", "--no-abbrev"}
+	if historySize := gs.historySize(); historySize > 0 {
+		args = append(args, "-n", strconv.Itoa(historySize))
+	}
+	output, err := gs.git(nil, append(args, "--", "users.pem")...)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 6 && strings.HasPrefix(line, ":") && len(versions) > 0:
+			// :oldmode newmode oldid newid status path
+			versions[len(versions)-1].Etag = quoteETag(fields[3])
+		case len(fields) == 2:
+			commitTime, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			versions = append(versions, StorageVersion{
+				ID:   fields[0],
+				Time: time.Unix(commitTime, 0),
+			})
+		}
+	}
+	return versions, nil
+}
+
+// GetVersion returns the data in the commit id.
+func (gs *GitStorage) GetVersion(ctx context.Context, id string) ([]byte, error) {
+	if len(id) < 4 || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, os.ErrNotExist
+	}
+	objectID, err := gs.objectID(id)
+	if err != nil {
+		return nil, err
+	}
+	return gs.git(nil, "cat-file", "blob", objectID)
+}
+
+// ModTime returns the time of the newest commit.
+func (gs *GitStorage) ModTime(ctx context.Context) (time.Time, error) {
+	output, err := gs.git(nil, "log", "-1", "--format=%ct")
+	if err != nil {
+		return time.Time{}, err
+	}
+	commitTime, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(commitTime, 0), nil
+}
@@ -0,0 +1,188 @@
+//go:build !appengine
+// +build !appengine
+
+package web
+
+import (
+	"encoding"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/crewjam/usermgr"
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+func gitOutput(c *C, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	c.Assert(err, IsNil)
+	return strings.TrimSpace(string(output))
+}
+
+func (suite *TestWeb) TestGitStorage(c *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git is not installed")
+	}
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	gs := &GitStorage{
+		Path:   filepath.Join(tempDir, "repo"),
+		Render: func(data []byte) ([]byte, error) { return []byte("rendered " + string(data)), nil },
+	}
+
+	_, _, err = gs.Get(context.TODO(), "")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	versions, err := gs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 0)
+
+	etag, err := gs.Put(WithRemoteUserName(context.TODO(), "alice"), []byte("one"), "")
+	c.Assert(err, IsNil)
+	c.Assert(etag, Equals, "\""+gitOutput(c, gs.Path, "rev-parse", "HEAD:users.pem")+"\"")
+	c.Assert(gitOutput(c, gs.Path, "log", "-1", "--format=%an"), Equals, "alice")
+	c.Assert(gitOutput(c, gs.Path, "show", "HEAD:users.json"), Equals, "rendered one")
+
+	data, newEtag, err := gs.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one")
+	c.Assert(newEtag, Equals, etag)
+
+	data, newEtag, err = gs.Get(context.TODO(), etag)
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+	c.Assert(newEtag, Equals, etag)
+
+	// a write based on a stale etag is rejected
+	_, err = gs.Put(context.TODO(), []byte("two"), "\"stale\"")
+	c.Assert(err, Equals, ErrConflict)
+
+	// without Render, users.json is removed
+	gs.Render = nil
+	_, err = gs.Put(context.TODO(), []byte("two"), etag)
+	c.Assert(err, IsNil)
+	c.Assert(gitOutput(c, gs.Path, "log", "-1", "--format=%an"), Equals, "usermgr")
+	c.Assert(gitOutput(c, gs.Path, "ls-files"), Equals, "users.pem")
+
+	versions, err = gs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 2)
+	c.Assert(versions[1].Etag, Equals, etag)
+	data, err = gs.GetVersion(context.TODO(), versions[1].ID)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "one")
+	_, err = gs.GetVersion(context.TODO(), "--all")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = gs.GetVersion(context.TODO(), "0123456789")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (suite *TestWeb) TestGitStoragePushAndHistorySize(c *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git is not installed")
+	}
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	remote := filepath.Join(tempDir, "remote.git")
+	gitOutput(c, tempDir, "init", "--quiet", "--bare", remote)
+	gs := &GitStorage{Path: filepath.Join(tempDir, "repo"), Remote: remote, HistorySize: 2}
+
+	etag := ""
+	for _, data := range []string{"one", "two", "three"} {
+		etag, err = gs.Put(context.TODO(), []byte(data), etag)
+		c.Assert(err, IsNil)
+	}
+
+	// the commits reach the remote in the background
+	head := gitOutput(c, gs.Path, "rev-parse", "HEAD")
+	for i := 0; ; i++ {
+		cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", head+"^{commit}")
+		cmd.Dir = remote
+		if cmd.Run() == nil {
+			break
+		}
+		c.Assert(i < 100, Equals, true, Commentf("the commit was not pushed"))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// only the newest HistorySize versions are listed
+	versions, err := gs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 2)
+	c.Assert(versions[0].ID, Equals, head)
+	c.Assert(versions[0].Etag, Equals, etag)
+	c.Assert(versions[1].Etag, Equals, "\""+gitOutput(c, gs.Path, "rev-parse", "HEAD~1:users.pem")+"\"")
+	gs.HistorySize = -1
+	versions, err = gs.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 3)
+}
+
+func (suite *TestWeb) TestGitStorageServer(c *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git is not installed")
+	}
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	gs := &GitStorage{Path: tempDir}
+	_, err = gs.Put(context.TODO(), suite.FakeStorage.Data, "")
+	c.Assert(err, IsNil)
+
+	nextAdminKey := usermgr.GenerateKeyPair()
+	server := New(Config{Storage: gs, Auth: suite.FakeAuth, AdminKey: suite.AdminKey,
+		NextAdminKey: &nextAdminKey})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"real_name\": \"Bob Smith\", \"groups\":[\"wheel\"]}"))
+	server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 204)
+
+	// the change is a commit by the remote user, and the rendering shows it
+	// without revealing secrets
+	c.Assert(gitOutput(c, tempDir, "log", "-1", "--format=%an"), Equals, "alice")
+	rendered := gitOutput(c, tempDir, "show", "HEAD:users.json")
+	c.Assert(strings.Contains(rendered, "\"real_name\": \"Bob Smith\""), Equals, true)
+	c.Assert(strings.Contains(rendered, "\"backup_codes\""), Equals, true)
+	c.Assert(strings.Contains(rendered, "\"hash\""), Equals, false)
+	c.Assert(strings.Index(rendered, "\"alice\"") < strings.Index(rendered, "\"bob\""), Equals, true)
+
+	// in particular no key that would decrypt later versions
+	c.Assert(strings.Contains(rendered, "\"next_key\": true"), Equals, true)
+	for _, key := range []interface{}{suite.AdminKey, suite.AdminKey.HostKey, nextAdminKey, nextAdminKey.HostKey} {
+		text, err := key.(encoding.TextMarshaler).MarshalText()
+		c.Assert(err, IsNil)
+		c.Assert(strings.Contains(rendered, string(text)), Equals, false)
+	}
+	for _, privateKey := range [][32]byte{suite.AdminKey.HostPrivateKey, nextAdminKey.HostPrivateKey} {
+		c.Assert(strings.Contains(rendered, base64.StdEncoding.EncodeToString(privateKey[:])), Equals, false)
+		c.Assert(strings.Contains(rendered, base64.RawURLEncoding.EncodeToString(privateKey[:])), Equals, false)
+	}
+}
+
+func (suite *TestWeb) TestGitStoragePendingHosts(c *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git is not installed")
+	}
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	gs := &GitStorage{Path: tempDir}
+	_, err = gs.Put(context.TODO(), []byte("one"), "")
+	c.Assert(err, IsNil)
+	checkPendingHostStorage(c, gs)
+
+	// the requests are not committed
+	c.Assert(gitOutput(c, tempDir, "status", "--porcelain"), Equals, "")
+}
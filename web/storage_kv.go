@@ -0,0 +1,267 @@
+package web
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// KV is a key-value store with compare-and-swap and watches, such as etcd
+// or Consul, which lets several web servers share the data.
+type KV interface {
+	// Get returns the value of key and its revision, which changes whenever
+	// the value does. If the key does not exist the error satisfies
+	// os.IsNotExist.
+	Get(key string) (value []byte, revision uint64, err error)
+
+	// CompareAndSwap sets key to value if its revision is still revision,
+	// or if revision is zero and the key does not exist, and returns the
+	// new revision. Otherwise it returns ErrConflict.
+	CompareAndSwap(key string, value []byte, revision uint64) (uint64, error)
+
+	// Delete removes key. It is not an error if key does not exist.
+	Delete(key string) error
+
+	// Keys returns the keys that start with prefix, in lexical order.
+	Keys(prefix string) ([]string, error)
+
+	// Watch returns a channel that receives a value after each change to
+	// key, until stop is closed.
+	Watch(key string, stop <-chan struct{}) <-chan struct{}
+}
+
+// KVStorage stores the data in KV under Prefix+"users.pem", and each version
+// under Prefix+"versions/" followed by the revision of users.pem that it
+// became, padded with zeros. The etag and time of each version are kept
+// under Prefix+"version-index/" and the same revision, so that the versions
+// can be listed without reading their data. The enrollment requests waiting
+// for approval are kept under Prefix+"pending-hosts".
+type KVStorage struct {
+	KV     KV
+	Prefix string
+
+	// HistorySize, if specified, is how many versions are kept. By default
+	// DefaultHistorySize are kept, and if it is negative they are all kept.
+	HistorySize int
+}
+
+// kvRecord is the value of the data and version keys in KVStorage.
+type kvRecord struct {
+	Data []byte    `json:"data"`
+	Time time.Time `json:"time"`
+}
+
+// kvVersion is the value of the version index keys in KVStorage.
+type kvVersion struct {
+	Etag string    `json:"etag"`
+	Time time.Time `json:"time"`
+}
+
+func kvStorageETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", sha1.Sum(data))
+}
+
+func (ks *KVStorage) dataKey() string {
+	return ks.Prefix + "users.pem"
+}
+
+func (ks *KVStorage) versionKey(revision uint64) string {
+	return fmt.Sprintf("%sversions/%020d", ks.Prefix, revision)
+}
+
+func (ks *KVStorage) versionIndexPrefix() string {
+	return ks.Prefix + "version-index/"
+}
+
+func (ks *KVStorage) versionIndexKey(revision uint64) string {
+	return fmt.Sprintf("%s%020d", ks.versionIndexPrefix(), revision)
+}
+
+// historySize returns how many versions are kept, or 0 if they all are.
+func (ks *KVStorage) historySize() int {
+	switch {
+	case ks.HistorySize < 0:
+		return 0
+	case ks.HistorySize == 0:
+		return DefaultHistorySize
+	default:
+		return ks.HistorySize
+	}
+}
+
+func (ks *KVStorage) get(key string) (*kvRecord, uint64, error) {
+	value, revision, err := ks.KV.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	record := kvRecord{}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", key, err)
+	}
+	return &record, revision, nil
+}
+
+// Get returns the data, or nil if they match etag.
+func (ks *KVStorage) Get(ctx context.Context, etag string) ([]byte, string, error) {
+	record, _, err := ks.get(ks.dataKey())
+	if err != nil {
+		return nil, "", err
+	}
+	currentEtag := kvStorageETag(record.Data)
+	if etag != "" && etag == currentEtag {
+		return nil, etag, nil
+	}
+	return record.Data, currentEtag, nil
+}
+
+// Put replaces the data with a compare-and-swap of the revision that was
+// checked against expectedEtag, and then adds them to the versions and
+// removes the versions beyond HistorySize.
+func (ks *KVStorage) Put(ctx context.Context, data []byte, expectedEtag string) (string, error) {
+	record, revision, err := ks.get(ks.dataKey())
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if expectedEtag != "" && (record == nil || kvStorageETag(record.Data) != expectedEtag) {
+		return "", ErrConflict
+	}
+
+	now := TimeNow().UTC()
+	etag := kvStorageETag(data)
+	value, err := json.Marshal(kvRecord{Data: data, Time: now})
+	if err != nil {
+		return "", err
+	}
+	indexValue, err := json.Marshal(kvVersion{Etag: etag, Time: now})
+	if err != nil {
+		return "", err
+	}
+	newRevision, err := ks.KV.CompareAndSwap(ks.dataKey(), value, revision)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ks.KV.CompareAndSwap(ks.versionKey(newRevision), value, 0); err != nil {
+		return "", err
+	}
+	if _, err := ks.KV.CompareAndSwap(ks.versionIndexKey(newRevision), indexValue, 0); err != nil {
+		return "", err
+	}
+	if err := ks.removeOldVersions(); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// removeOldVersions removes the versions beyond HistorySize.
+func (ks *KVStorage) removeOldVersions() error {
+	historySize := ks.historySize()
+	if historySize == 0 {
+		return nil
+	}
+	keys, err := ks.KV.Keys(ks.versionIndexPrefix())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(keys)-historySize; i++ {
+		revision, err := strconv.ParseUint(strings.TrimPrefix(keys[i], ks.versionIndexPrefix()), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %s", keys[i], err)
+		}
+		if err := ks.KV.Delete(ks.versionKey(revision)); err != nil {
+			return err
+		}
+		if err := ks.KV.Delete(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions of the data, newest first, from the
+// version index.
+func (ks *KVStorage) Versions(ctx context.Context) ([]StorageVersion, error) {
+	keys, err := ks.KV.Keys(ks.versionIndexPrefix())
+	if err != nil {
+		return nil, err
+	}
+	versions := []StorageVersion{}
+	for i := len(keys) - 1; i >= 0; i-- {
+		value, _, err := ks.KV.Get(keys[i])
+		if os.IsNotExist(err) {
+			continue // removed by a concurrent Put
+		}
+		if err != nil {
+			return nil, err
+		}
+		version := kvVersion{}
+		if err := json.Unmarshal(value, &version); err != nil {
+			return nil, fmt.Errorf("%s: %s", keys[i], err)
+		}
+		versions = append(versions, StorageVersion{
+			ID:   strings.TrimLeft(strings.TrimPrefix(keys[i], ks.versionIndexPrefix()), "0"),
+			Etag: version.Etag,
+			Time: version.Time,
+		})
+	}
+	return versions, nil
+}
+
+// GetVersion returns the data stored as version id.
+func (ks *KVStorage) GetVersion(ctx context.Context, id string) ([]byte, error) {
+	revision, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	record, _, err := ks.get(ks.versionKey(revision))
+	if err != nil {
+		return nil, err
+	}
+	return record.Data, nil
+}
+
+// ModTime returns the time the data were stored.
+func (ks *KVStorage) ModTime(ctx context.Context) (time.Time, error) {
+	record, _, err := ks.get(ks.dataKey())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return record.Time, nil
+}
+
+// GetPendingHosts returns the enrollment requests waiting for approval. Their
+// entity tag is the revision of their key.
+func (ks *KVStorage) GetPendingHosts(ctx context.Context) ([]byte, string, error) {
+	value, revision, err := ks.KV.Get(ks.Prefix + "pending-hosts")
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return value, strconv.FormatUint(revision, 10), nil
+}
+
+// PutPendingHosts replaces the enrollment requests waiting for approval with
+// a compare-and-swap of the revision in expectedEtag.
+func (ks *KVStorage) PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error {
+	var revision uint64
+	if expectedEtag != "" {
+		var err error
+		if revision, err = strconv.ParseUint(expectedEtag, 10, 64); err != nil {
+			return ErrConflict
+		}
+	}
+	_, err := ks.KV.CompareAndSwap(ks.Prefix+"pending-hosts", data, revision)
+	return err
+}
+
+// Watch returns a channel that receives a value whenever the data change.
+func (ks *KVStorage) Watch(stop <-chan struct{}) <-chan struct{} {
+	return ks.KV.Watch(ks.dataKey(), stop)
+}
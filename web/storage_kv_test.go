@@ -0,0 +1,160 @@
+//go:build !appengine
+// +build !appengine
+
+package web
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestWeb) TestKVStorage(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	kv, err := OpenBoltKV(filepath.Join(tempDir, "users.db"))
+	c.Assert(err, IsNil)
+	defer kv.DB.Close()
+	ks := &KVStorage{KV: kv, Prefix: "usermgr/"}
+
+	_, _, err = ks.Get(context.TODO(), "")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	etag, err := ks.Put(context.TODO(), []byte("hello"), "")
+	c.Assert(err, IsNil)
+	c.Assert(etag, Equals, `"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"`)
+
+	data, newEtag, err := ks.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	c.Assert(newEtag, Equals, etag)
+
+	data, newEtag, err = ks.Get(context.TODO(), etag)
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+	c.Assert(newEtag, Equals, etag)
+
+	// a write based on a stale etag is rejected
+	_, err = ks.Put(context.TODO(), []byte("goodbye"), `"stale"`)
+	c.Assert(err, Equals, ErrConflict)
+	_, err = ks.Put(context.TODO(), []byte("goodbye"), etag)
+	c.Assert(err, IsNil)
+
+	versions, err := ks.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 2)
+	c.Assert(versions[1].Etag, Equals, etag)
+	data, err = ks.GetVersion(context.TODO(), versions[1].ID)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	_, err = ks.GetVersion(context.TODO(), "99")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	modTime, err := ks.ModTime(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(modTime) < time.Minute, Equals, true)
+
+	keys, err := kv.Keys("")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 5)
+	for _, key := range keys {
+		c.Assert(strings.HasPrefix(key, "usermgr/"), Equals, true)
+	}
+}
+
+func (suite *TestWeb) TestKVStorageHistorySize(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	kv, err := OpenBoltKV(filepath.Join(tempDir, "users.db"))
+	c.Assert(err, IsNil)
+	defer kv.DB.Close()
+	ks := &KVStorage{KV: kv, HistorySize: 3}
+
+	etag := ""
+	for _, data := range []string{"one", "two", "three", "four", "five"} {
+		etag, err = ks.Put(context.TODO(), []byte(data), etag)
+		c.Assert(err, IsNil)
+	}
+
+	// only the newest versions are kept, along with their index entries
+	versions, err := ks.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 3)
+	c.Assert(versions[0].Etag, Equals, etag)
+	data, err := ks.GetVersion(context.TODO(), versions[2].ID)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "three")
+	keys, err := kv.Keys("versions/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 3)
+	keys, err = kv.Keys("version-index/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 3)
+
+	// they are all kept if HistorySize is negative
+	ks.HistorySize = -1
+	_, err = ks.Put(context.TODO(), []byte("six"), etag)
+	c.Assert(err, IsNil)
+	versions, err = ks.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 4)
+}
+
+func (suite *TestWeb) TestKVStorageEvents(c *C) {
+	defer func(pollInterval, keepAlive time.Duration) {
+		EventPollInterval, EventKeepAlive = pollInterval, keepAlive
+	}(EventPollInterval, EventKeepAlive)
+	EventPollInterval = time.Hour
+	EventKeepAlive = time.Hour
+
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	kv, err := OpenBoltKV(filepath.Join(tempDir, "users.db"))
+	c.Assert(err, IsNil)
+	defer kv.DB.Close()
+	_, err = (&KVStorage{KV: kv}).Put(context.TODO(), suite.FakeStorage.Data, "")
+	c.Assert(err, IsNil)
+
+	server := httptest.NewServer(New(Config{Storage: &KVStorage{KV: kv}, Auth: suite.FakeAuth, AdminKey: suite.AdminKey}).Mux)
+	defer server.Close()
+	otherServer := New(Config{Storage: &KVStorage{KV: kv}, Auth: suite.FakeAuth, AdminKey: suite.AdminKey})
+
+	resp, err := http.Get(server.URL + "/users.pem/events")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	c.Assert(readEvent(c, r), DeepEquals, []string{"retry: 3600000"})
+	c.Assert(readEvent(c, r), HasLen, 3)
+
+	// a change made by another server is announced without waiting to poll
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/users/bob",
+		strings.NewReader("{\"name\":\"bob\",\"real_name\": \"Bob Smith\", \"groups\":[\"wheel\"]}"))
+	otherServer.Mux.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, 204)
+	_, etag, err := otherServer.Storage.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(readEvent(c, r), DeepEquals, []string{"event: etag", "id: " + etag, "data: " + etag})
+}
+
+func (suite *TestWeb) TestKVStoragePendingHosts(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	kv, err := OpenBoltKV(filepath.Join(tempDir, "users.db"))
+	c.Assert(err, IsNil)
+	defer kv.DB.Close()
+	checkPendingHostStorage(c, &KVStorage{KV: kv, Prefix: "usermgr/"})
+}
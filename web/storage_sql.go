@@ -0,0 +1,332 @@
+package web
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// sqlDialect describes how the SQL understood by a database differs from
+// that of the others.
+type sqlDialect struct {
+	serialType string
+	blobType   string
+	timeType   string
+
+	// numberedPlaceholders is true if query parameters are written $1, $2
+	// and so on rather than ?.
+	numberedPlaceholders bool
+}
+
+// sqlDialects are the supported databases by the name of their
+// database/sql driver.
+var sqlDialects = map[string]sqlDialect{
+	"sqlite3": {
+		serialType: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		blobType:   "BLOB",
+		timeType:   "DATETIME",
+	},
+	"postgres": {
+		serialType:           "BIGSERIAL PRIMARY KEY",
+		blobType:             "BYTEA",
+		timeType:             "TIMESTAMP WITH TIME ZONE",
+		numberedPlaceholders: true,
+	},
+}
+
+// schema returns the statements that create the tables if they do not
+// exist. usermgr_data has a single row holding the current data,
+// usermgr_versions holds the recent versions, usermgr_audit records who
+// stored each of them, and usermgr_pending_hosts has a single row holding
+// the enrollment requests waiting for approval.
+func (d sqlDialect) schema() []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS usermgr_data (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			data %s NOT NULL,
+			etag TEXT NOT NULL,
+			version_id BIGINT NOT NULL,
+			mod_time %s NOT NULL
+		)`, d.blobType, d.timeType),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS usermgr_versions (
+			id %s,
+			data %s NOT NULL,
+			etag TEXT NOT NULL,
+			create_time %s NOT NULL
+		)`, d.serialType, d.blobType, d.timeType),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS usermgr_audit (
+			id %s,
+			time %s NOT NULL,
+			remote_user TEXT NOT NULL,
+			version_id BIGINT NOT NULL,
+			previous_etag TEXT NOT NULL,
+			etag TEXT NOT NULL
+		)`, d.serialType, d.timeType),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS usermgr_pending_hosts (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			data %s NOT NULL,
+			etag TEXT NOT NULL
+		)`, d.blobType),
+	}
+}
+
+// rebind rewrites the ? placeholders in query for the database.
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	rv := parts[0]
+	for i, part := range parts[1:] {
+		rv += "$" + strconv.Itoa(i+1) + part
+	}
+	return rv
+}
+
+// SQLStorage stores the data in a SQL database, which lets several web
+// servers share them. Each version is kept, and the remote user who stored
+// it is recorded in an audit table (see RemoteUserName), until there are
+// more than HistorySize newer versions.
+type SQLStorage struct {
+	DB *sql.DB
+
+	// HistorySize, if specified, is how many versions and audit records are
+	// kept. By default DefaultHistorySize are kept, and if it is negative
+	// they are all kept.
+	HistorySize int
+
+	dialect sqlDialect
+}
+
+// NewSQLStorage returns storage in db, which was opened with the
+// database/sql driver driverName, either "sqlite3" or "postgres". The tables
+// are created if they do not exist.
+//
+// SQLite databases should be opened with _txlock=immediate, so that
+// concurrent writers wait for each other rather than fail.
+func NewSQLStorage(db *sql.DB, driverName string) (*SQLStorage, error) {
+	dialect, ok := sqlDialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SQL driver: %s", driverName)
+	}
+	for _, statement := range dialect.schema() {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLStorage{DB: db, dialect: dialect}, nil
+}
+
+// historySize returns how many versions are kept, or 0 if they all are.
+func (ss *SQLStorage) historySize() int {
+	switch {
+	case ss.HistorySize < 0:
+		return 0
+	case ss.HistorySize == 0:
+		return DefaultHistorySize
+	default:
+		return ss.HistorySize
+	}
+}
+
+func sqlStorageETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", sha1.Sum(data))
+}
+
+// Get returns the current data, or nil if they match etag.
+func (ss *SQLStorage) Get(ctx context.Context, etag string) ([]byte, string, error) {
+	var data []byte
+	var currentEtag string
+	err := ss.DB.QueryRow("SELECT data, etag FROM usermgr_data WHERE id = 1").Scan(&data, &currentEtag)
+	if err == sql.ErrNoRows {
+		return nil, "", os.ErrNotExist
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" && etag == currentEtag {
+		return nil, etag, nil
+	}
+	return data, currentEtag, nil
+}
+
+// Put stores the data as a new version in a transaction which only
+// replaces the current data if they have not changed since they were
+// checked against expectedEtag. Versions beyond HistorySize, and their
+// audit records, are removed in the same transaction.
+func (ss *SQLStorage) Put(ctx context.Context, data []byte, expectedEtag string) (string, error) {
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previousEtag string
+	err = tx.QueryRow("SELECT etag FROM usermgr_data WHERE id = 1").Scan(&previousEtag)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if expectedEtag != "" && expectedEtag != previousEtag {
+		return "", ErrConflict
+	}
+
+	etag := sqlStorageETag(data)
+	now := TimeNow().UTC()
+	var versionID int64
+	err = tx.QueryRow(ss.dialect.rebind(
+		"INSERT INTO usermgr_versions (data, etag, create_time) VALUES (?, ?, ?) RETURNING id"),
+		data, etag, now).Scan(&versionID)
+	if err != nil {
+		return "", err
+	}
+
+	if previousEtag == "" {
+		// Another server may be storing the first data at the same time,
+		// in which case the row exists by the time this one is inserted.
+		result, err := tx.Exec(ss.dialect.rebind(
+			"INSERT INTO usermgr_data (id, data, etag, version_id, mod_time) VALUES (1, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING"),
+			data, etag, versionID, now)
+		if err != nil {
+			return "", err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if rows != 1 {
+			return "", ErrConflict
+		}
+	} else {
+		// The data cannot have changed since they were read in databases
+		// that lock them, but in those that don't this detects the race.
+		result, err := tx.Exec(ss.dialect.rebind(
+			"UPDATE usermgr_data SET data = ?, etag = ?, version_id = ?, mod_time = ? WHERE id = 1 AND etag = ?"),
+			data, etag, versionID, now, previousEtag)
+		if err != nil {
+			return "", err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if rows != 1 {
+			return "", ErrConflict
+		}
+	}
+
+	_, err = tx.Exec(ss.dialect.rebind(
+		"INSERT INTO usermgr_audit (time, remote_user, version_id, previous_etag, etag) VALUES (?, ?, ?, ?, ?)"),
+		now, RemoteUserName(ctx), versionID, previousEtag, etag)
+	if err != nil {
+		return "", err
+	}
+
+	if historySize := ss.historySize(); historySize > 0 {
+		_, err = tx.Exec(ss.dialect.rebind(
+			"DELETE FROM usermgr_versions WHERE id NOT IN (SELECT id FROM usermgr_versions ORDER BY id DESC LIMIT ?)"),
+			historySize)
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.Exec("DELETE FROM usermgr_audit WHERE version_id NOT IN (SELECT id FROM usermgr_versions)")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// Versions returns the versions of the data, newest first.
+func (ss *SQLStorage) Versions(ctx context.Context) ([]StorageVersion, error) {
+	rows, err := ss.DB.Query("SELECT id, etag, create_time FROM usermgr_versions ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []StorageVersion{}
+	for rows.Next() {
+		var id int64
+		version := StorageVersion{}
+		if err := rows.Scan(&id, &version.Etag, &version.Time); err != nil {
+			return nil, err
+		}
+		version.ID = strconv.FormatInt(id, 10)
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetVersion returns the data stored as version id.
+func (ss *SQLStorage) GetVersion(ctx context.Context, id string) ([]byte, error) {
+	intID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	var data []byte
+	err = ss.DB.QueryRow(ss.dialect.rebind("SELECT data FROM usermgr_versions WHERE id = ?"), intID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ModTime returns the time the current data were stored.
+func (ss *SQLStorage) ModTime(ctx context.Context) (time.Time, error) {
+	var modTime time.Time
+	if err := ss.DB.QueryRow("SELECT mod_time FROM usermgr_data WHERE id = 1").Scan(&modTime); err != nil {
+		return time.Time{}, err
+	}
+	return modTime, nil
+}
+
+// GetPendingHosts returns the enrollment requests waiting for approval.
+func (ss *SQLStorage) GetPendingHosts(ctx context.Context) ([]byte, string, error) {
+	var data []byte
+	var etag string
+	err := ss.DB.QueryRow("SELECT data, etag FROM usermgr_pending_hosts WHERE id = 1").Scan(&data, &etag)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, etag, nil
+}
+
+// PutPendingHosts replaces the enrollment requests waiting for approval if
+// they still have the entity tag expectedEtag.
+func (ss *SQLStorage) PutPendingHosts(ctx context.Context, data []byte, expectedEtag string) error {
+	var result sql.Result
+	var err error
+	if expectedEtag == "" {
+		result, err = ss.DB.Exec(ss.dialect.rebind(
+			"INSERT INTO usermgr_pending_hosts (id, data, etag) VALUES (1, ?, ?) ON CONFLICT (id) DO NOTHING"),
+			data, sqlStorageETag(data))
+	} else {
+		result, err = ss.DB.Exec(ss.dialect.rebind(
+			"UPDATE usermgr_pending_hosts SET data = ?, etag = ? WHERE id = 1 AND etag = ?"),
+			data, sqlStorageETag(data), expectedEtag)
+	}
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows != 1 {
+		return ErrConflict
+	}
+	return nil
+}
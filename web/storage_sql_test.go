@@ -0,0 +1,181 @@
+package web
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/context"
+
+	. "gopkg.in/check.v1"
+)
+
+func openSQLStorage(c *C, dir string) *SQLStorage {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "users.db")+"?_txlock=immediate&_busy_timeout=10000")
+	c.Assert(err, IsNil)
+	storage, err := NewSQLStorage(db, "sqlite3")
+	c.Assert(err, IsNil)
+	return storage
+}
+
+func (suite *TestWeb) TestSQLStorage(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	ss := openSQLStorage(c, tempDir)
+	defer ss.DB.Close()
+
+	_, _, err = ss.Get(context.TODO(), "")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	etag, err := ss.Put(WithRemoteUserName(context.TODO(), "alice"), []byte("hello"), "")
+	c.Assert(err, IsNil)
+	c.Assert(etag, Equals, `"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"`)
+
+	data, newEtag, err := ss.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	c.Assert(newEtag, Equals, etag)
+
+	data, newEtag, err = ss.Get(context.TODO(), etag)
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+	c.Assert(newEtag, Equals, etag)
+
+	// a write based on a stale etag is rejected
+	_, err = ss.Put(context.TODO(), []byte("goodbye"), `"stale"`)
+	c.Assert(err, Equals, ErrConflict)
+
+	_, err = ss.Put(WithRemoteUserName(context.TODO(), "bob"), []byte("goodbye"), etag)
+	c.Assert(err, IsNil)
+
+	versions, err := ss.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 2)
+	c.Assert(versions[1].Etag, Equals, etag)
+	data, err = ss.GetVersion(context.TODO(), versions[1].ID)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	_, err = ss.GetVersion(context.TODO(), "99")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the audit table records who stored each version
+	rows, err := ss.DB.Query("SELECT remote_user, previous_etag FROM usermgr_audit ORDER BY id")
+	c.Assert(err, IsNil)
+	audit := []string{}
+	for rows.Next() {
+		var remoteUser, previousEtag string
+		c.Assert(rows.Scan(&remoteUser, &previousEtag), IsNil)
+		audit = append(audit, remoteUser+" "+previousEtag)
+	}
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(audit, DeepEquals, []string{"alice ", "bob " + etag})
+
+	_, err = ss.ModTime(context.TODO())
+	c.Assert(err, IsNil)
+
+	// the tables are reused
+	ss2 := openSQLStorage(c, tempDir)
+	defer ss2.DB.Close()
+	data, _, err = ss2.Get(context.TODO(), "")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "goodbye")
+}
+
+func (suite *TestWeb) TestSQLStorageHistorySize(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	ss := openSQLStorage(c, tempDir)
+	defer ss.DB.Close()
+	ss.HistorySize = 3
+
+	etag := ""
+	for _, data := range []string{"one", "two", "three", "four", "five"} {
+		etag, err = ss.Put(context.TODO(), []byte(data), etag)
+		c.Assert(err, IsNil)
+	}
+
+	// only the newest versions and their audit records are kept
+	versions, err := ss.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 3)
+	c.Assert(versions[0].Etag, Equals, etag)
+	data, err := ss.GetVersion(context.TODO(), versions[2].ID)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "three")
+	_, err = ss.GetVersion(context.TODO(), "1")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	var auditRows int
+	c.Assert(ss.DB.QueryRow("SELECT COUNT(*) FROM usermgr_audit").Scan(&auditRows), IsNil)
+	c.Assert(auditRows, Equals, 3)
+
+	// they are all kept if HistorySize is negative
+	ss.HistorySize = -1
+	_, err = ss.Put(context.TODO(), []byte("six"), etag)
+	c.Assert(err, IsNil)
+	versions, err = ss.Versions(context.TODO())
+	c.Assert(err, IsNil)
+	c.Assert(versions, HasLen, 4)
+}
+
+func (suite *TestWeb) TestSQLStorageReplicas(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	ss := openSQLStorage(c, tempDir)
+	defer ss.DB.Close()
+	_, err = ss.Put(context.TODO(), suite.FakeStorage.Data, "")
+	c.Assert(err, IsNil)
+
+	// two web servers change different users at the same time
+	servers := []*Server{}
+	for i := 0; i < 2; i++ {
+		replica := openSQLStorage(c, tempDir)
+		defer replica.DB.Close()
+		servers = append(servers, New(Config{Storage: replica, Auth: suite.FakeAuth, AdminKey: suite.AdminKey}))
+	}
+	wg := sync.WaitGroup{}
+	for i, name := range []string{"charlie", "dave", "erin", "frank"} {
+		wg.Add(1)
+		go func(server *Server, name string) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("PUT", "/users/"+name,
+				strings.NewReader("{\"groups\":[\"wheel\"]}"))
+			server.Mux.ServeHTTP(w, r)
+			c.Check(w.Code, Equals, 204)
+		}(servers[i%2], name)
+	}
+	wg.Wait()
+
+	usersData, _, err := servers[0].loadData(context.TODO())
+	c.Assert(err, IsNil)
+	for _, name := range []string{"alice", "bob", "charlie", "dave", "erin", "frank"} {
+		c.Assert(usersData.GetUserByName(name), NotNil, Commentf("%s", name))
+	}
+}
+
+func (suite *TestWeb) TestSQLRebind(c *C) {
+	query := "UPDATE t SET a = ?, b = ? WHERE c = ?"
+	c.Assert(sqlDialects["sqlite3"].rebind(query), Equals, query)
+	c.Assert(sqlDialects["postgres"].rebind(query), Equals, "UPDATE t SET a = $1, b = $2 WHERE c = $3")
+
+	_, err := NewSQLStorage(nil, "mysql")
+	c.Assert(err, ErrorMatches, "unsupported SQL driver: mysql")
+}
+
+func (suite *TestWeb) TestSQLStoragePendingHosts(c *C) {
+	tempDir, err := ioutil.TempDir("", "unittest")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tempDir)
+	ss := openSQLStorage(c, tempDir)
+	defer ss.DB.Close()
+	checkPendingHostStorage(c, ss)
+}
@@ -2,10 +2,14 @@
 package web
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/crewjam/httperr"
@@ -21,6 +25,26 @@ type Config struct {
 	Auth        Auth
 	AdminKey    usermgr.AdminKey
 	DownloadURL string
+
+	// NextAdminKey, if specified, is announced to hosts in every version of
+	// the data so that they will trust it once it replaces AdminKey.
+	NextAdminKey *usermgr.AdminKey
+
+	// PreviousAdminKeys are keys that were replaced by AdminKey. They are
+	// accepted when reading stored data, but never used for signing.
+	PreviousAdminKeys []usermgr.AdminKey
+
+	// DataLifetime, if specified, is how long hosts trust each version of
+	// the data. The data must be signed again before then, which happens
+	// whenever they are modified, including by the hourly cron job.
+	DataLifetime time.Duration
+
+	// SignaturePolicy is the policy hosts use to check the approvals of
+	// the data. If it requires approvals the server cannot publish changes,
+	// since they are not approved, so it refuses them instead of replacing
+	// an approved version. Changes must then be made with
+	// "usermgr admin propose".
+	SignaturePolicy usermgr.SignaturePolicy
 }
 
 type RemoteUser struct {
@@ -29,47 +53,121 @@ type RemoteUser struct {
 }
 
 type Server struct {
-	Mux         *web.Mux
-	Storage     Storage
-	Auth        Auth
-	ContextFunc func() context.Context
-	AdminKey    usermgr.AdminKey
-	DownloadURL string
+	Mux               *web.Mux
+	Storage           Storage
+	Auth              Auth
+	ContextFunc       func() context.Context
+	AdminKey          usermgr.AdminKey
+	NextAdminKey      *usermgr.AdminKey
+	PreviousAdminKeys []usermgr.AdminKey
+	DataLifetime      time.Duration
+	SignaturePolicy   usermgr.SignaturePolicy
+	DownloadURL       string
+	changes           changeNotifier
+	watchOnce         sync.Once
+	pendingHosts      memoryPendingHosts
 }
 
+// getSignedData serves the signed data to hosts, answering GET and HEAD
+// requests that are conditional on If-None-Match or If-Modified-Since.
 func (s *Server) getSignedData(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	etag := r.Header.Get("If-None-Match")
-	data, newEtag, err := s.Storage.Get(ctx, etag)
+	data, etag, err := s.Storage.Get(ctx, "")
+	if os.IsNotExist(err) {
+		return httperr.NotFound
+	}
 	if err != nil {
 		return err
 	}
-	if data == nil {
+	etag = quoteETag(etag)
+
+	var modTime time.Time
+	if storage, ok := s.Storage.(modTimer); ok {
+		if t, err := storage.ModTime(ctx); err == nil {
+			modTime = t
+		}
+	}
+
+	// caches must check with us before serving a stored copy
+	w.Header().Set("Cache-Control", "no-cache")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modTime) {
 		w.WriteHeader(http.StatusNotModified)
 		return nil
 	}
-	w.Header().Set("ETag", newEtag)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 	w.Write(data)
 	return nil
 }
 
+// maxMutateAttempts is how many times mutateUsersData applies a change
+// before giving up when the data keep being changed concurrently.
+const maxMutateAttempts = 5
+
+// mutateUsersData loads the data, applies f and stores the result. If the
+// data were changed by another request in the meantime, the change is
+// applied again to the new data.
 func (s *Server) mutateUsersData(ctx context.Context, f func(usersData *usermgr.UsersData) error) error {
-	usersData, _, err := s.loadData(ctx)
+	var err error
+	for attempt := 0; attempt < maxMutateAttempts; attempt++ {
+		err = s.mutateUsersDataIfMatch(ctx, "", f)
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return httperr.Error{StatusCode: http.StatusConflict, PrivateError: err}
+}
+
+// mutateUsersDataIfMatch applies f to the data once. If ifMatch, the value
+// of an If-Match header, is not empty and does not match the entity tag of
+// the data, or if the data are changed before the result is stored, it
+// returns httperr.PreconditionFailed. Otherwise a concurrent change is
+// reported as ErrConflict.
+func (s *Server) mutateUsersDataIfMatch(ctx context.Context, ifMatch string, f func(usersData *usermgr.UsersData) error) error {
+	usersData, etag, err := s.loadData(ctx)
 	if err != nil {
 		return err
 	}
+	if ifMatch != "" && !etagMatches(ifMatch, quoteETag(etag)) {
+		return httperr.PreconditionFailed
+	}
+
+	// when changes cannot be published, a function that changes nothing
+	// must not replace the approved version with an unapproved copy
+	var unchanged []byte
+	if s.requiresApproval() {
+		if unchanged, err = json.Marshal(usersData); err != nil {
+			return err
+		}
+	}
 
 	if err := f(usersData); err != nil {
 		return err
 	}
 
-	if err := s.storeData(ctx, usersData); err != nil {
-		return err
+	if unchanged != nil {
+		if buf, err := json.Marshal(usersData); err == nil && bytes.Equal(buf, unchanged) {
+			return nil
+		}
 	}
 
-	return nil
+	err = s.storeData(ctx, usersData, etag)
+	if err == ErrConflict && ifMatch != "" {
+		return httperr.PreconditionFailed
+	}
+	return err
 }
 
 func (s *Server) cronHourly(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if s.requiresApproval() {
+		log.Printf("not refreshing TOTP codes: changes must be approved by administrators")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
 	if err := s.mutateUsersData(ctx, func(usersData *usermgr.UsersData) error {
 		startTime := TimeNow().Add(-10 * time.Minute)
 		endTime := TimeNow().Add(2 * time.Hour)
@@ -106,6 +204,9 @@ func (s *Server) postGlobal(ctx context.Context, w http.ResponseWriter, r *http.
 		if k := r.FormValue("yubikey_client_secret"); k != "" {
 			usersData.YubikeyClientSecret = k
 		}
+		if k := r.FormValue("exclude_shared_host_key"); k != "" {
+			usersData.ExcludeSharedHostKey = k == "true"
+		}
 		return nil
 	}); err != nil {
 		return err
@@ -137,22 +238,85 @@ func (s *Server) loadData(ctx context.Context) (*usermgr.UsersData, string, erro
 		return nil, "", err
 	}
 
-	usersData, err := usermgr.LoadUsersData(usersDataBuf, s.AdminKey.HostKey)
+	usersData, err := s.parseData(usersDataBuf)
 	if err != nil {
 		return nil, "", err
 	}
 	return usersData, etag, nil
 }
 
-func (s *Server) storeData(ctx context.Context, usersData *usermgr.UsersData) error {
+// parseData verifies and decrypts stored data, which may have been signed
+// with one of the previous admin keys.
+func (s *Server) parseData(usersDataBuf []byte) (*usermgr.UsersData, error) {
+	usersData, err := usermgr.LoadUsersDataAsAdmin(usersDataBuf, s.AdminKey)
+	if err != nil {
+		// the data may have been signed before the admin key was rotated
+		for _, previousAdminKey := range s.PreviousAdminKeys {
+			if ud, previousErr := usermgr.LoadUsersDataAsAdmin(usersDataBuf, previousAdminKey); previousErr == nil {
+				usersData, err = ud, nil
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return usersData, nil
+}
+
+// renderData returns stored data as RedactedJSON.
+func (s *Server) renderData(usersDataBuf []byte) ([]byte, error) {
+	usersData, err := s.parseData(usersDataBuf)
+	if err != nil {
+		return nil, err
+	}
+	return RedactedJSON(usersData)
+}
+
+// errApprovalRequired is returned for changes that hosts would not accept
+// because they have not been approved by enough administrators.
+var errApprovalRequired = httperr.Error{
+	StatusCode:   http.StatusForbidden,
+	PrivateError: fmt.Errorf("changes must be approved by administrators (see: usermgr admin propose)"),
+}
+
+// requiresApproval returns true if hosts only accept data approved by
+// several administrators, which the server cannot provide.
+func (s *Server) requiresApproval() bool {
+	return len(s.SignaturePolicy.Keys) != 0
+}
+
+// storeData signs and stores usersData. If etag is not empty and the stored
+// data have changed since they were loaded with that entity tag, it returns
+// ErrConflict. If hosts require approvals it returns errApprovalRequired.
+func (s *Server) storeData(ctx context.Context, usersData *usermgr.UsersData, etag string) error {
+	if s.requiresApproval() {
+		return errApprovalRequired
+	}
+
+	usersData.NextKey = nil
+	if s.NextAdminKey != nil {
+		usersData.NextKey = &s.NextAdminKey.HostKey
+	}
+
+	now := TimeNow()
+	usersData.Serial++
+	usersData.IssueTime = &now
+	usersData.ExpireTime = nil
+	if s.DataLifetime != 0 {
+		expireTime := now.Add(s.DataLifetime)
+		usersData.ExpireTime = &expireTime
+	}
+
 	signedUserData, err := usersData.SignedString(s.AdminKey)
 	if err != nil {
 		return err
 	}
 
-	if _, err := s.Storage.Put(ctx, signedUserData); err != nil {
+	if _, err := s.Storage.Put(ctx, signedUserData, etag); err != nil {
 		return err
 	}
+	s.changes.notify()
 	return nil
 }
 
@@ -160,6 +324,7 @@ type contextKeyType int
 
 const (
 	urlParamsKey contextKeyType = iota
+	remoteUserKey
 )
 
 // Param returns the named URL parameter or an empty string if it is not present
@@ -168,6 +333,22 @@ func Param(ctx context.Context, name string) string {
 	return rv
 }
 
+// WithRemoteUserName returns a context in which RemoteUserName returns
+// name until RequireUser authenticates someone else.
+func WithRemoteUserName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, remoteUserKey, &name)
+}
+
+// RemoteUserName returns the name of the user making the request, once
+// RequireUser has authenticated them, or an empty string. Storage uses it to
+// record who made each change.
+func RemoteUserName(ctx context.Context) string {
+	if name, ok := ctx.Value(remoteUserKey).(*string); ok {
+		return *name
+	}
+	return ""
+}
+
 // NewContextFunc is invoked to renerate the new context for
 // a request. The default implementation uses context.Background,
 // but when running in appengine this must be replaced with
@@ -181,6 +362,7 @@ type wrapRequest func(ctx context.Context, w http.ResponseWriter, r *http.Reques
 func (f wrapRequest) ServeHTTPC(c web.C, w http.ResponseWriter, r *http.Request) {
 	ctx := NewContextFunc(r)
 	ctx = context.WithValue(ctx, urlParamsKey, c.URLParams)
+	ctx = WithRemoteUserName(ctx, "")
 	err := f(ctx, w, r)
 	if err != nil {
 		log.Printf("ERROR: %s", err)
@@ -190,12 +372,16 @@ func (f wrapRequest) ServeHTTPC(c web.C, w http.ResponseWriter, r *http.Request)
 
 func New(config Config) *Server {
 	s := Server{
-		Mux:         web.New(),
-		Storage:     config.Storage,
-		Auth:        config.Auth,
-		ContextFunc: func() context.Context { return context.Background() },
-		AdminKey:    config.AdminKey,
-		DownloadURL: config.DownloadURL,
+		Mux:               web.New(),
+		Storage:           config.Storage,
+		Auth:              config.Auth,
+		ContextFunc:       func() context.Context { return context.Background() },
+		AdminKey:          config.AdminKey,
+		NextAdminKey:      config.NextAdminKey,
+		PreviousAdminKeys: config.PreviousAdminKeys,
+		DataLifetime:      config.DataLifetime,
+		SignaturePolicy:   config.SignaturePolicy,
+		DownloadURL:       config.DownloadURL,
 	}
 	if s.DownloadURL == "" {
 		s.DownloadURL = "https://github.com/crewjam/usermgr/releases/download/XXX/usermgr"
@@ -204,6 +390,7 @@ func New(config Config) *Server {
 	s.Mux.Get("/setup", wrapRequest(s.getSetup))
 	s.Mux.Get("/setup/:key", wrapRequest(s.getSetup))
 	s.Mux.Get("/users.pem", wrapRequest(s.getSignedData))
+	s.Mux.Get("/users.pem/events", wrapRequest(s.getEvents))
 	s.Mux.Post("/_totp", wrapRequest(s.totpSecret))
 	s.Mux.Post("/_backup_code", wrapRequest(s.makeBackupCode))
 	s.Mux.Post("/_cron/hourly", wrapRequest(s.cronHourly))
@@ -214,9 +401,22 @@ func New(config Config) *Server {
 	s.Mux.Get("/users/:user", wrapRequest(s.getUser))
 	s.Mux.Put("/users/:user", wrapRequest(s.putUser))
 	s.Mux.Delete("/users/:user", wrapRequest(s.deleteUser))
+	s.Mux.Post("/hosts/", wrapRequest(s.postHost))
+	s.Mux.Get("/hosts/", wrapRequest(s.getHostsList))
+	s.Mux.Put("/hosts/:host", wrapRequest(s.putHost))
+	s.Mux.Delete("/hosts/:host", wrapRequest(s.deleteHost))
+	s.Mux.Get("/history/", wrapRequest(s.getHistory))
+	s.Mux.Get("/history/:version", wrapRequest(s.getHistoryVersion))
+	s.Mux.Post("/history/:version/restore", wrapRequest(s.restoreHistoryVersion))
+	if storage, ok := s.Storage.(renderingStorage); ok {
+		storage.setDefaultRender(s.renderData)
+	}
 	if oauth, ok := s.Auth.(OauthAuth); ok {
 		s.Mux.Get("/oauth2callback", wrapRequest(oauth.HandleCallback))
 	}
+	if oidc, ok := s.Auth.(*OIDCAuth); ok {
+		s.Mux.Get("/oauth2callback", wrapRequest(oidc.HandleCallback))
+	}
 
 	return &s
 }
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -28,6 +31,13 @@ type FakeStorage struct {
 	Data []byte
 	Etag string
 	Err  error
+
+	// BeforePut, if set, is called at the start of each Put, which lets
+	// tests change the data concurrently with a request.
+	BeforePut func()
+
+	// History holds every version that was Put, oldest first.
+	History [][]byte
 }
 
 func (fs *FakeStorage) Get(ctx context.Context, etag string) ([]byte, string, error) {
@@ -37,12 +47,39 @@ func (fs *FakeStorage) Get(ctx context.Context, etag string) ([]byte, string, er
 	return fs.Data, fs.Etag, fs.Err
 }
 
-func (fs *FakeStorage) Put(ctx context.Context, data []byte) (string, error) {
+func (fs *FakeStorage) Put(ctx context.Context, data []byte, expectedEtag string) (string, error) {
+	if fs.BeforePut != nil {
+		fs.BeforePut()
+	}
+	if expectedEtag != "" && expectedEtag != fs.Etag {
+		return "", ErrConflict
+	}
 	fs.Data = data
-	fs.Etag = fmt.Sprintf("%x", sha1.Sum(data))
+	fs.Etag = fmt.Sprintf("\"%x\"", sha1.Sum(data))
+	fs.History = append(fs.History, data)
 	return fs.Etag, fs.Err
 }
 
+func (fs *FakeStorage) Versions(ctx context.Context) ([]StorageVersion, error) {
+	versions := []StorageVersion{}
+	for i := len(fs.History) - 1; i >= 0; i-- {
+		versions = append(versions, StorageVersion{
+			ID:   strconv.Itoa(i + 1),
+			Etag: fmt.Sprintf("\"%x\"", sha1.Sum(fs.History[i])),
+			Time: time.Date(2015, 1, 1, 0, i, 0, 0, time.UTC),
+		})
+	}
+	return versions, fs.Err
+}
+
+func (fs *FakeStorage) GetVersion(ctx context.Context, id string) ([]byte, error) {
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 1 || i > len(fs.History) {
+		return nil, os.ErrNotExist
+	}
+	return fs.History[i-1], fs.Err
+}
+
 type FakeAuth struct {
 	User string
 	Err  error
@@ -73,7 +110,7 @@ func (suite *TestWeb) SetUpTest(c *C) {
 		"s3CTLY+rLTOaVvfaE/frs7p6gK5NWsdXaIvFhQS5TZh7ElgyYIu07zMeXen3C/pG\n"+
 		"gZwoGXcArFSHyGHWYtD3+B1no+2+oPIj/P5MOp8Nk26yi/8WtTU+J2bYEloNMSPa\n"+
 		"rV6hfH0P\n"+
-		"-----END USERMGR DATA-----\n"))
+		"-----END USERMGR DATA-----\n"), "")
 	suite.AdminKey.UnmarshalText([]byte("m_NiqMyWkkgOi1sT4uMCnp5kYuNanescRkRr3DP29FUAAgQGCAoMDhASFBYYGhweICIkJigqLC4wMjQ2ODo8PkBCREZISkxOUFJUVlhaXF5gYmRmaGpsbnBydHZ4enx-ommQj5KJoeHRLhbHyA2RzNXBeJ_Xz4p1vJUsozZzhXw"))
 
 	suite.FakeAuth = &FakeAuth{
@@ -117,11 +154,11 @@ func (suite *TestWeb) TestCanGetSignedData(c *C) {
 		"gZwoGXcArFSHyGHWYtD3+B1no+2+oPIj/P5MOp8Nk26yi/8WtTU+J2bYEloNMSPa\n"+
 		"rV6hfH0P\n"+
 		"-----END USERMGR DATA-----\n")
-	c.Assert(w.Header().Get("Etag"), DeepEquals, "34cfb4411e1ed35d1183e544202c0608e3c91c0c")
+	c.Assert(w.Header().Get("Etag"), DeepEquals, "\"34cfb4411e1ed35d1183e544202c0608e3c91c0c\"")
 
 	w = httptest.NewRecorder()
 	r, _ = http.NewRequest("GET", "/users.pem", nil)
-	r.Header.Add("If-None-Match", "34cfb4411e1ed35d1183e544202c0608e3c91c0c")
+	r.Header.Add("If-None-Match", "\"34cfb4411e1ed35d1183e544202c0608e3c91c0c\"")
 	suite.Server.Mux.ServeHTTP(w, r)
 	c.Assert(w.Code, Equals, http.StatusNotModified)
 	c.Assert(string(w.Body.Bytes()), Equals, "")
@@ -132,7 +169,7 @@ func (suite *TestWeb) TestCanGetSignedData(c *C) {
 	suite.FakeStorage.Err = fmt.Errorf("cannot frob the grob")
 	w = httptest.NewRecorder()
 	r, _ = http.NewRequest("GET", "/users.pem", nil)
-	r.Header.Add("If-None-Match", "34cfb4411e1ed35d1183e544202c0608e3c91c0c")
+	r.Header.Add("If-None-Match", "\"34cfb4411e1ed35d1183e544202c0608e3c91c0c\"")
 	suite.Server.Mux.ServeHTTP(w, r)
 	c.Assert(w.Code, Equals, http.StatusInternalServerError)
 	c.Assert(string(w.Body.Bytes()), Equals, "Internal Server Error\n")
@@ -167,6 +204,34 @@ func (suite *TestWeb) TestCron(c *C) {
 	c.Assert(len(ud.Users[0].TOTPDevices[0].Codes), Equals, 261)
 }
 
+func (suite *TestWeb) TestSignaturePolicy(c *C) {
+	signingKey := usermgr.GenerateSigningKey()
+	approvedData, err := usermgr.Approve(suite.FakeStorage.Data, signingKey)
+	c.Assert(err, IsNil)
+	suite.FakeStorage.Data = approvedData
+	suite.Server.SignaturePolicy = usermgr.SignaturePolicy{Keys: []usermgr.SigningPublicKey{signingKey.PublicKey}}
+
+	// changes are refused rather than replacing the approved version
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/users/bob", strings.NewReader(`{"name":"bob","groups":["wheel","ops"]}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/_cron/hourly", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	// a change that changes nothing keeps the approvals
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/users/bob", strings.NewReader(`{"name":"bob","groups":["wheel"]}`))
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	c.Assert(string(suite.FakeStorage.Data), Equals, string(approvedData))
+	c.Assert(suite.Server.SignaturePolicy.Verify(suite.FakeStorage.Data), IsNil)
+}
+
 func (suite *TestWeb) TestGlobal(c *C) {
 	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("POST", "/", strings.NewReader("yubikey_client_id=one&yubikey_client_secret=password"))
@@ -192,3 +257,61 @@ func (suite *TestWeb) TestGlobal(c *C) {
 	suite.Server.Mux.ServeHTTP(w, r)
 	c.Assert(w.Code, Equals, http.StatusUnauthorized)
 }
+
+func (suite *TestWeb) TestKeyRotation(c *C) {
+	nextAdminKey := usermgr.GenerateKeyPair()
+
+	// while rotating, the data announces the next key
+	suite.Server.NextAdminKey = &nextAdminKey
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", "/users/bob", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	ud, err := usermgr.LoadUsersData(suite.FakeStorage.Data, suite.AdminKey.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(*ud.NextKey, Equals, nextAdminKey.HostKey)
+
+	// after rotating, data signed with the previous key can be read and is
+	// re-signed with the new key.
+	suite.Server.PreviousAdminKeys = []usermgr.AdminKey{suite.AdminKey}
+	suite.Server.AdminKey = nextAdminKey
+	suite.Server.NextAdminKey = nil
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "/users/charlie", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	ud, err = usermgr.LoadUsersData(suite.FakeStorage.Data, nextAdminKey.HostKey)
+	c.Assert(err, IsNil)
+	c.Assert(ud.NextKey, IsNil)
+	c.Assert(len(ud.Users), Equals, 1)
+}
+
+func (suite *TestWeb) TestSerialAndLifetime(c *C) {
+	TimeNow = func() time.Time {
+		rv, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
+		return rv
+	}
+	defer func() { TimeNow = time.Now }()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", "/users/charlie", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	ud, _ := usermgr.LoadUsersData(suite.FakeStorage.Data, suite.AdminKey.HostKey)
+	c.Assert(ud.Serial, Equals, uint64(1))
+	c.Assert(ud.IssueTime.Format(time.RFC3339), Equals, "2006-01-02T15:04:05Z")
+	c.Assert(ud.ExpireTime, IsNil)
+
+	suite.Server.DataLifetime = 24 * time.Hour
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "/users/charlie", nil)
+	suite.Server.Mux.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	ud, _ = usermgr.LoadUsersData(suite.FakeStorage.Data, suite.AdminKey.HostKey)
+	c.Assert(ud.Serial, Equals, uint64(2))
+	c.Assert(ud.ExpireTime.Format(time.RFC3339), Equals, "2006-01-03T15:04:05Z")
+}